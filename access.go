@@ -0,0 +1,140 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "fmt"
+import "io/fs"
+import "strings"
+import "unsafe"
+
+const ERROR_HINT_ACCESS = "Run the runner from an elevated prompt or as SYSTEM, or give the account it runs as access to %s."
+
+// Names GetNamedSecurityInfo knows the registry roots by.
+var securityRootNames = map[registry.Key]string{
+	registry.LOCAL_MACHINE: "MACHINE",
+	registry.USERS:         "USERS",
+	registry.CLASSES_ROOT:  "CLASSES_ROOT",
+	registry.CURRENT_USER:  "CURRENT_USER",
+}
+
+// An accessError is an access denied error with what we found out about why.
+type accessError struct {
+	err    error
+	detail string
+}
+
+func (e *accessError) Error() string { return e.err.Error() + " (" + e.detail + ")" }
+func (e *accessError) Cause() error  { return e.err }
+func (e *accessError) Unwrap() error { return e.err }
+
+// FileAccessError explains err if it's access to path being denied. Other errors come
+// back as they are.
+func FileAccessError(err error, path string) error {
+	return explainAccess(err, path, path, windows.SE_FILE_OBJECT)
+}
+
+// KeyAccessError is FileAccessError for the registry key root\path.
+func KeyAccessError(err error, root registry.Key, path string) error {
+	name, ok := securityRootNames[root]
+	if !ok {
+		return err
+	}
+	return explainAccess(err, name+`\`+path, path, windows.SE_REGISTRY_KEY)
+}
+
+// explainAccess adds who the runner is running as, whether it's elevated, and who owns
+// and has access to object, or the nearest thing above it that exists, since creating
+// something new is up to its parent.
+func explainAccess(err error, object, display string, t windows.SE_OBJECT_TYPE) error {
+	if err == nil || !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	detail := []string{runningAs()}
+
+	var sd *windows.SECURITY_DESCRIPTOR
+	for {
+		var serr error
+		sd, serr = windows.GetNamedSecurityInfo(object, t, windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION)
+		if serr == nil {
+			break
+		}
+		i := strings.LastIndex(object, `\`)
+		if (serr != windows.ERROR_FILE_NOT_FOUND && serr != windows.ERROR_PATH_NOT_FOUND) || i < 0 {
+			detail = append(detail, fmt.Sprintf("permissions on %s unreadable: %v", object, serr))
+			sd = nil
+			break
+		}
+		object = object[:i]
+	}
+	if sd != nil {
+		detail = append(detail, describeSecurity(object, sd))
+	}
+
+	return &RunnerError{
+		Category: ERROR_ACCESS_DENIED,
+		Hint:     fmt.Sprintf(ERROR_HINT_ACCESS, display),
+		Err:      &accessError{err, strings.Join(detail, "; ")},
+	}
+}
+
+// runningAs describes the account the runner is running as, e.g.
+// "running as CORP\jdoe, not elevated".
+func runningAs() string {
+	token := windows.GetCurrentProcessToken()
+	elevated := "not elevated"
+	if token.IsElevated() {
+		elevated = "elevated"
+	}
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return "running as an unknown account, " + elevated
+	}
+	return fmt.Sprintf("running as %s, %s", accountName(user.User.Sid), elevated)
+}
+
+func accountName(sid *windows.SID) string {
+	account, domain, _, err := sid.LookupAccount("")
+	if err != nil {
+		return sid.String()
+	}
+	if domain == "" {
+		return account
+	}
+	return domain + `\` + account
+}
+
+// describeSecurity lists the owner of object and what each entry of its DACL allows
+// or denies, e.g. "C:\ProgramData\2020runner is owned by BUILTIN\Administrators,
+// allows NT AUTHORITY\SYSTEM 0x1f01ff, allows BUILTIN\Users 0x1200a9".
+func describeSecurity(object string, sd *windows.SECURITY_DESCRIPTOR) string {
+	s := object
+	if owner, _, err := sd.Owner(); err == nil && owner != nil {
+		s += " is owned by " + accountName(owner)
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil || dacl == nil {
+		return s + ", with no DACL"
+	}
+	for i := uint32(0); i < uint32(dacl.AceCount); i++ {
+		var ace *windows.ACCESS_ALLOWED_ACE
+		if windows.GetAce(dacl, i, &ace) != nil {
+			continue
+		}
+		var verb string
+		switch ace.Header.AceType {
+		case windows.ACCESS_ALLOWED_ACE_TYPE:
+			verb = "allows"
+		case windows.ACCESS_DENIED_ACE_TYPE:
+			verb = "denies"
+		default:
+			continue
+		}
+		// Both ACE types end in the SID, starting at SidStart.
+		sid := (*windows.SID)(unsafe.Pointer(&ace.SidStart))
+		s += fmt.Sprintf(", %s %s %#x", verb, accountName(sid), uint32(ace.Mask))
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os/exec"
+import "strings"
+
+// DirectoryInfo is where the computer account sits in Active Directory.
+type DirectoryInfo struct {
+	DN     string
+	Groups []string
+}
+
+// GetDirectoryInfo looks up the computer's DN and the groups its account is directly a
+// member of. Group membership comes from ADSI via PowerShell, which is there on every
+// machine we manage and saves us an LDAP client.
+func GetDirectoryInfo(ctx context.Context) (DirectoryInfo, error) {
+	var info DirectoryInfo
+	dn, err := GetComputerDN()
+	if err != nil {
+		return info, err
+	}
+	info.DN = dn
+
+	script := "([adsi]'LDAP://" + strings.Replace(dn, "'", "''", -1) + "').memberOf"
+	out, err := RunCommand(ctx, exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script))
+	if err != nil {
+		return info, errors.Wrapf(err, "Cannot look up computer groups, output: %s", out)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			info.Groups = append(info.Groups, line)
+		}
+	}
+	return info, nil
+}
+
+// GroupCN returns the common name from a group DN, e.g. 2020-Pilot from
+// CN=2020-Pilot,OU=Groups,DC=example,DC=local.
+func GroupCN(dn string) string {
+	first := strings.SplitN(dn, ",", 2)[0]
+	if len(first) > 3 && strings.EqualFold(first[:3], "CN=") {
+		return first[3:]
+	}
+	return dn
+}
+
+func (d DirectoryInfo) InGroup(pattern string) bool {
+	for _, g := range d.Groups {
+		if matchPattern(pattern, g) || matchPattern(pattern, GroupCN(g)) {
+			return true
+		}
+	}
+	return false
+}
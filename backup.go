@@ -0,0 +1,254 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+// BackupConfig lists what user content to save before the software is uninstalled.
+// Profile entries are relative to each user profile, Shared entries to ProgramData.
+type BackupConfig struct {
+	Path    string   `xml:"Path,attr"`
+	Profile []string `xml:"Profile"`
+	Shared  []string `xml:"Shared"`
+}
+
+// Each computer keeps this many of its backups, the newest ones, so that a folder of
+// backups doesn't grow by one on every upgrade. A backup that's been restored is
+// removed straight away.
+const BACKUP_KEEP = 3
+
+var DEFAULT_BACKUP_PROFILE = []string{`AppData\Roaming\2020`, `AppData\Local\2020`}
+var DEFAULT_BACKUP_SHARED = []string{`2020`}
+
+func (b BackupConfig) profileItems() []string {
+	if len(b.Profile) == 0 {
+		return DEFAULT_BACKUP_PROFILE
+	}
+	return b.Profile
+}
+
+func (b BackupConfig) sharedItems() []string {
+	if len(b.Shared) == 0 {
+		return DEFAULT_BACKUP_SHARED
+	}
+	return b.Shared
+}
+
+func (b BackupConfig) root() (string, error) {
+	if b.Path != "" {
+		return b.Path, nil
+	}
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "backup"), nil
+}
+
+// BackupUserData copies the configured user content into a new timestamped folder
+// and returns its path. The layout is profiles\<SID>\<item>, hives\<SID>.xml for
+// HKCU settings and shared\<item>. Older backups beyond BACKUP_KEEP go once it's made.
+func BackupUserData(ctx context.Context) (string, error) {
+	root, err := config.Backup.root()
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot get hostname")
+	}
+	dir := filepath.Join(root, host, time.Now().Format("20060102-150405"))
+
+	profiles, err := ListUserProfiles()
+	if err != nil {
+		return "", err
+	}
+	for _, p := range profiles {
+		for _, item := range config.Backup.profileItems() {
+			err = backupItem(ctx, filepath.Join(p.Path, item), filepath.Join(dir, "profiles", p.SID, item), nil)
+			if err != nil {
+				return "", err
+			}
+		}
+		// A profile whose hive can't be loaded (corrupt, or in use by a stuck
+		// session) shouldn't hold up the upgrade for everyone else.
+		err = CaptureUserSettings(ctx, p, filepath.Join(dir, "hives", p.SID+".xml"))
+		if err != nil {
+			Warn("Unable to save settings for %s: %v", p.Name(), err)
+		}
+	}
+
+	pd, err := ProgramData()
+	if err != nil {
+		return "", err
+	}
+	dsa, err := DSARoot()
+	if err != nil {
+		return "", err
+	}
+	// The catalog content itself comes back from the network, and is far too big
+	// to copy around anyway.
+	skipDSA := func(path string) bool {
+		return strings.EqualFold(path, dsa)
+	}
+	for _, item := range config.Backup.sharedItems() {
+		err = backupItem(ctx, filepath.Join(pd, item), filepath.Join(dir, "shared", item), skipDSA)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	PruneBackups(filepath.Dir(dir), dir)
+	return dir, nil
+}
+
+// PruneBackups removes all but the newest BACKUP_KEEP backups in hostDir, never the
+// one at keep. The folder names sort by when they were made. Failures are only
+// warned about; they'll be tried again next time.
+func PruneBackups(hostDir, keep string) {
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		return
+	}
+	var backups []string
+	for _, e := range entries {
+		if _, err := time.Parse("20060102-150405", e.Name()); e.IsDir() && err == nil {
+			backups = append(backups, e.Name())
+		}
+	}
+	sort.Strings(backups)
+	for len(backups) > BACKUP_KEEP {
+		old := filepath.Join(hostDir, backups[0])
+		backups = backups[1:]
+		if strings.EqualFold(old, keep) {
+			continue
+		}
+		Verbose("Removing the old backup %s", old)
+		err = os.RemoveAll(old)
+		if err != nil {
+			Warn("Unable to remove the old backup %s: %v", old, FileAccessError(err, old))
+		}
+	}
+}
+
+func backupItem(ctx context.Context, src, dst string, skip func(string) bool) error {
+	_, err := os.Stat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	Say("Backing up %s", src)
+	err = CopyTree(ctx, src, dst, skip)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot back up %s", src)
+	}
+	return nil
+}
+
+// RestoreUserData copies a backup made by BackupUserData back into place. Profiles
+// that no longer exist on the machine are skipped.
+func RestoreUserData(ctx context.Context, dir string) error {
+	profiles, err := ListUserProfiles()
+	if err != nil {
+		return err
+	}
+
+	sids, err := os.ReadDir(filepath.Join(dir, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Cannot read profile backups")
+	}
+	for _, sid := range sids {
+		p, ok := FindUserProfile(profiles, sid.Name())
+		if !ok {
+			Say("Profile %s no longer exists, not restoring it", sid.Name())
+			continue
+		}
+		Say("Restoring user data for %s", p.Name())
+		err = CopyTree(ctx, filepath.Join(dir, "profiles", sid.Name()), p.Path, nil)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot restore user data for %s", p.Name())
+		}
+	}
+
+	hives, err := os.ReadDir(filepath.Join(dir, "hives"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Cannot read settings backups")
+	}
+	for _, h := range hives {
+		sid := strings.TrimSuffix(h.Name(), ".xml")
+		p, ok := FindUserProfile(profiles, sid)
+		if !ok {
+			continue
+		}
+		err = ApplyUserSettings(ctx, p, filepath.Join(dir, "hives", h.Name()))
+		if err != nil {
+			Warn("Unable to restore settings for %s: %v", p.Name(), err)
+		}
+	}
+
+	shared := filepath.Join(dir, "shared")
+	_, err = os.Stat(shared)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	pd, err := ProgramData()
+	if err != nil {
+		return err
+	}
+	Say("Restoring shared 2020 data")
+	err = CopyTree(ctx, shared, pd, nil)
+	if err != nil {
+		return errors.Wrap(err, "Cannot restore shared data")
+	}
+	return nil
+}
+
+// BackupAndUninstallSoftware saves user data and only then removes the software. The
+// backup is remembered in the runner state so a later run can restore it.
+func BackupAndUninstallSoftware(ctx context.Context) error {
+	state, err := LoadState()
+	if err != nil {
+		return err
+	}
+
+	Say("Backing up user data first...")
+	state.PendingRestore, err = BackupUserData(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to back up user data, not uninstalling the 2020 software")
+	}
+	state.UpgradeInProgress = true
+	err = SaveState(state)
+	if err != nil {
+		return err
+	}
+	return UninstallSoftware(ctx)
+}
+
+func RestorePendingBackup(ctx context.Context) error {
+	state, err := LoadState()
+	if err != nil {
+		return err
+	}
+	if state.PendingRestore == "" {
+		return nil
+	}
+
+	err = RestoreUserData(ctx, state.PendingRestore)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to restore user data from %s", state.PendingRestore)
+	}
+	// Forget the backup before removing it, so that a run that stops in between
+	// doesn't go looking for it again.
+	err = UpdateState(func(s *RunnerState) { s.PendingRestore = "" })
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(state.PendingRestore)
+	if err != nil {
+		Warn("Unable to remove the restored backup %s: %v", state.PendingRestore, FileAccessError(err, state.PendingRestore))
+	}
+	return nil
+}
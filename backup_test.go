@@ -0,0 +1,29 @@
+package main
+
+import "os"
+import "path/filepath"
+import "reflect"
+import "testing"
+
+func TestPruneBackups(t *testing.T) {
+	host := t.TempDir()
+	for _, name := range []string{"20260101-020000", "20260301-020000", "20260201-020000", "20260401-020000", "20260501-020000", "notes"} {
+		if err := os.Mkdir(filepath.Join(host, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	PruneBackups(host, filepath.Join(host, "20260501-020000"))
+	entries, err := os.ReadDir(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	for _, e := range entries {
+		left = append(left, e.Name())
+	}
+	want := []string{"20260301-020000", "20260401-020000", "20260501-020000", "notes"}
+	if !reflect.DeepEqual(left, want) {
+		t.Errorf("PruneBackups left %q, want %q", left, want)
+	}
+}
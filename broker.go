@@ -0,0 +1,277 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/svc"
+import "golang.org/x/sys/windows/svc/mgr"
+import "github.com/Microsoft/go-winio"
+import "github.com/pkg/errors"
+import "bufio"
+import "context"
+import "encoding/json"
+import "net"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "sync"
+import "time"
+
+// The broker is the elevated half of the runner for standard users: it runs as the
+// 2020runner service, and starts a run when 2020runner-gui asks for one on
+// BROKER_PIPE_NAME. The service itself is only ever this program with -broker.
+const (
+	BROKER_SERVICE      = "2020runner"
+	BROKER_DISPLAY_NAME = "2020 Software Update"
+	BROKER_PIPE_NAME    = `\\.\pipe\2020runner-broker`
+)
+
+// Interactive users can ask for a run; what they can ask for is brokerRequests.
+const BROKER_SDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;IU)"
+
+// A request has to come in this soon after connecting.
+const BROKER_READ_TIMEOUT = 10 * time.Second
+
+// What can be asked for, and the flags the run is started with for it. The requests
+// are names rather than command lines, so that asking doesn't give a user any more
+// than a compliance run.
+var brokerRequests = map[string][]string{
+	"check": {"-report-only"},
+	"run":   {},
+}
+
+// A BrokerRequest is the line of JSON a client sends after connecting. The broker
+// answers with the run's events, as a line of JSON each, ending with EVENT_DONE.
+type BrokerRequest struct {
+	Command string `json:"command"`
+}
+
+// Only one run asked for through the broker goes at a time.
+var brokerMu sync.Mutex
+
+// RunBroker implements -broker: it answers requests until ctx is done, or until the
+// service manager stops it when started as the service.
+func RunBroker(ctx context.Context) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return errors.Wrap(err, "Cannot tell whether this is running as a service")
+	}
+	if !isService {
+		Say("Waiting for requests on %s.", BROKER_PIPE_NAME)
+		return ServeBroker(ctx)
+	}
+	return svc.Run(BROKER_SERVICE, &brokerService{ctx: ctx})
+}
+
+type brokerService struct {
+	ctx context.Context
+}
+
+func (b *brokerService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	s <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(b.ctx)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() { errc <- ServeBroker(ctx) }()
+	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-errc:
+			if err != nil {
+				Warn("The broker stopped: %v", err)
+				return true, 1
+			}
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-errc
+				return false, 0
+			}
+		}
+	}
+}
+
+// ServeBroker listens on BROKER_PIPE_NAME until ctx is done.
+func ServeBroker(ctx context.Context) error {
+	l, err := winio.ListenPipe(BROKER_PIPE_NAME, &winio.PipeConfig{SecurityDescriptor: BROKER_SDDL})
+	if err != nil {
+		return errors.Wrapf(err, "Cannot listen on %s", BROKER_PIPE_NAME)
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrapf(err, "Cannot take requests on %s", BROKER_PIPE_NAME)
+		}
+		go handleBrokerRequest(ctx, c)
+	}
+}
+
+func handleBrokerRequest(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(BROKER_READ_TIMEOUT))
+	var req BrokerRequest
+	line, err := bufio.NewReader(c).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &req)
+	}
+	flags, ok := brokerRequests[req.Command]
+	if err != nil || !ok {
+		brokerReply(c, Failed("The 2020runner service doesn't know that request.", errors.Errorf("Unknown request %q", line)))
+		return
+	}
+	if !brokerMu.TryLock() {
+		brokerReply(c, Busy("A run asked for from this computer is already going."))
+		return
+	}
+	defer brokerMu.Unlock()
+
+	Say("Starting a %s run someone on this computer asked for.", req.Command)
+	if r, ok := brokerRun(ctx, flags, c); !ok {
+		Warn("%s: %v", r.Message, r.Err)
+		brokerReply(c, r)
+	}
+}
+
+// brokerRun runs this program with flags and passes the events of the run on to c. A
+// client that goes away doesn't stop the run. It returns the outcome if the run ended
+// without saying how it went.
+func brokerRun(ctx context.Context, flags []string, c net.Conn) (Result, bool) {
+	exe, err := os.Executable()
+	if err != nil {
+		return Failed("Unable to find the runner to start it.", err), false
+	}
+	args := append(forwardedFlags("broker", "nopause", "output", "pipe"), "-nopause", "-pipe", "-output", OUTPUT_NDJSON)
+	cmd := exec.CommandContext(ctx, exe, append(args, flags...)...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return Failed("Unable to start the run.", errors.Wrap(err, "Cannot follow the run")), false
+	}
+	err = cmd.Start()
+	if err != nil {
+		return Failed("Unable to start the run.", errors.Wrapf(err, "Cannot start %s", exe)), false
+	}
+
+	done := false
+	sc := bufio.NewScanner(out)
+	for sc.Scan() {
+		var e Event
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.Type == EVENT_DONE {
+			done = true
+		}
+		writeLine(c, append(append([]byte{}, sc.Bytes()...), '\n'))
+	}
+	err = cmd.Wait()
+	if !done {
+		return Failed("The run stopped without finishing.", errors.Wrap(err, "The runner exited early")), false
+	}
+	return Result{}, true
+}
+
+func brokerReply(c net.Conn, r Result) {
+	e := Event{Time: time.Now(), Type: EVENT_DONE, Message: r.Message, Outcome: r.Outcome}
+	if r.Err != nil {
+		e.Error = r.Err.Error()
+	}
+	b, err := json.Marshal(e)
+	if err == nil {
+		writeLine(c, append(b, '\n'))
+	}
+}
+
+// ServiceCommand implements `2020runner service install | remove`. install copies this
+// program to Program Files and sets it up as the broker service, run as LocalSystem
+// and started with Windows, with the flags service install was given, -config
+// included. remove stops and removes it again.
+func ServiceCommand(ctx context.Context, args []string) Result {
+	if len(args) != 1 || (args[0] != "install" && args[0] != "remove") {
+		return Failed("Usage: 2020runner service install | remove", errors.New("Missing or unknown service command"))
+	}
+	pf, err := windows.KnownFolderPath(windows.FOLDERID_ProgramFiles, 0)
+	if err != nil {
+		return Failed("Unable to find Program Files.", errors.Wrap(err, "Cannot resolve the Program Files folder"))
+	}
+	exe := filepath.Join(pf, "2020runner", "2020runner.exe")
+	m, err := mgr.Connect()
+	if err != nil {
+		return Failed("Unable to reach the service manager.", errors.Wrap(err, "Cannot connect to the service manager"))
+	}
+	defer m.Disconnect()
+
+	if args[0] == "remove" {
+		err = removeBrokerService(m)
+		if err != nil {
+			return Failed("Unable to remove the 2020runner service.", err)
+		}
+		os.RemoveAll(filepath.Dir(exe))
+		return Succeeded("The 2020runner service is removed.")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return Failed("Unable to find this program to install it.", err)
+	}
+	if !sameFile(self, exe) {
+		err = os.MkdirAll(filepath.Dir(exe), 0755)
+		if err == nil {
+			err = copyExecutable(self, exe)
+		}
+		if err != nil {
+			return Failed("Unable to copy the runner to "+exe+".", err)
+		}
+	}
+	flags := append(forwardedFlags("broker", "nopause", "watch", "gui", "report-only", "pipe", "output"), "-broker", "-nopause")
+	s, err := m.CreateService(BROKER_SERVICE, exe, mgr.Config{
+		DisplayName: BROKER_DISPLAY_NAME,
+		Description: "Runs 2020 software and catalog updates when a user without admin rights asks for one.",
+		StartType:   mgr.StartAutomatic,
+	}, flags...)
+	if err != nil {
+		return Failed("Unable to install the 2020runner service.", errors.Wrap(err, "Cannot create the service"))
+	}
+	defer s.Close()
+	err = s.Start()
+	if err != nil {
+		return Failed("The 2020runner service is installed, but didn't start.", errors.Wrap(err, "Cannot start the service"))
+	}
+	return Succeeded("The 2020runner service is installed and running. Users can run checks from the 2020 tray icon.")
+}
+
+func sameFile(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	return err == nil && os.SameFile(fa, fb)
+}
+
+func removeBrokerService(m *mgr.Mgr) error {
+	s, err := m.OpenService(BROKER_SERVICE)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open the service")
+	}
+	defer s.Close()
+	if status, err := s.Control(svc.Stop); err == nil {
+		for i := 0; status.State != svc.Stopped && i < 30; i++ {
+			time.Sleep(time.Second)
+			status, err = s.Query()
+			if err != nil {
+				break
+			}
+		}
+	}
+	return errors.Wrap(s.Delete(), "Cannot delete the service")
+}
@@ -0,0 +1,177 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+import "unsafe"
+
+// Another installer that is already running is waited for this long, checking every
+// INSTALLER_POLL, before the run gives up with exit code 3.
+const (
+	INSTALLER_WAIT = 10 * time.Minute
+	INSTALLER_POLL = 15 * time.Second
+)
+
+// Windows Installer holds this mutex while it runs an install, and writes this key.
+const (
+	MSI_EXECUTE_MUTEX = `Global\_MSIExecute`
+	MSI_IN_PROGRESS   = `SOFTWARE\Microsoft\Windows\CurrentVersion\Installer\InProgress`
+)
+
+func processPath(pid uint32) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n := uint32(len(buf))
+	if windows.QueryFullProcessImageName(h, 0, &buf[0], &n) != nil {
+		return ""
+	}
+	return windows.UTF16ToString(buf[:n])
+}
+
+// Installer file names too common to tell a 2020 setup from any other vendor's, which
+// only count when they run from one of the 2020 folders.
+var GENERIC_SETUP_NAMES = []string{"setup.exe", "install.exe", "installer.exe", "autorun.exe"}
+
+// runningInstallers lists processes that look like a 2020 setup or catalog wizard
+// someone started by hand: anything running from the folder of a configured installer,
+// its cached copy or the installed dsa.exe, anything with the file name of a
+// configured installer wherever it runs from, such as a setup that extracted itself to
+// %TEMP%, unless the name is one of GENERIC_SETUP_NAMES, and anything those started.
+// The runner itself doesn't count, nor what it started, nor the process that started
+// it, which RelaunchLocally leaves waiting on the deployment share.
+func runningInstallers() []string {
+	self, _ := os.Executable()
+	pid := uint32(os.Getpid())
+	var dirs, names []string
+	for _, i := range []string{policy.SoftwareInstaller, policy.CatalogSetup, policy.FallbackSoftwareInstaller} {
+		if i == "" {
+			continue
+		}
+		dirs = append(dirs, filepath.Dir(i))
+		if c, err := cacheDir(filepath.Dir(i)); err == nil {
+			dirs = append(dirs, c)
+		}
+		if !nameIn(filepath.Base(i), GENERIC_SETUP_NAMES) {
+			names = append(names, filepath.Base(i))
+		}
+	}
+	if dsa, err := DSAExecutable(policy.Catalog()); err == nil {
+		dirs = append(dirs, filepath.Dir(dsa))
+	}
+
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil
+	}
+	defer windows.CloseHandle(snap)
+	parents := map[uint32]uint32{}
+	images := map[uint32]string{}
+	installers := map[uint32]bool{}
+	e := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snap, &e); err == nil; err = windows.Process32Next(snap, &e) {
+		if e.ProcessID == pid || e.ProcessID == uint32(os.Getppid()) || e.ParentProcessID == pid {
+			continue
+		}
+		path := processPath(e.ProcessID)
+		if path == "" {
+			path = windows.UTF16ToString(e.ExeFile[:])
+		}
+		if strings.EqualFold(path, self) {
+			continue
+		}
+		parents[e.ProcessID] = e.ParentProcessID
+		images[e.ProcessID] = path
+		installers[e.ProcessID] = under(path, dirs) || nameIn(filepath.Base(path), names)
+	}
+	// What an installer started is part of the install, whatever it's called.
+	for child, parent := range parents {
+		for seen := 0; parent != 0 && seen < len(parents); seen++ {
+			if installers[parent] {
+				installers[child] = true
+				break
+			}
+			parent = parents[parent]
+		}
+	}
+
+	var found []string
+	for p, installer := range installers {
+		if installer {
+			found = append(found, fmt.Sprintf("%s (process %d)", images[p], p))
+		}
+	}
+	sort.Strings(found)
+	return found
+}
+
+func nameIn(name string, names []string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// msiBusy reports whether Windows Installer is in the middle of an install.
+func msiBusy() bool {
+	m, err := windows.OpenMutex(windows.SYNCHRONIZE, false, windows.StringToUTF16Ptr(MSI_EXECUTE_MUTEX))
+	if err == nil {
+		windows.CloseHandle(m)
+		return true
+	}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, MSI_IN_PROGRESS, registry.QUERY_VALUE)
+	if err == nil {
+		k.Close()
+		return true
+	}
+	return false
+}
+
+// InstallersBusy describes any install already going on, or returns "".
+func InstallersBusy() string {
+	busy := runningInstallers()
+	if msiBusy() {
+		busy = append(busy, "Windows Installer")
+	}
+	return strings.Join(busy, ", ")
+}
+
+// WaitForInstallers waits for other installs to finish before we start one of our
+// own, so that two installers don't end up fighting over the same files. If they're
+// still going after INSTALLER_WAIT, or the wait is cut short, it returns the Result to
+// end the run with and false.
+func WaitForInstallers(ctx context.Context) (Result, bool) {
+	busy := InstallersBusy()
+	if busy == "" {
+		return Result{}, true
+	}
+	Say("Waiting for an install that's already running to finish: %s", busy)
+	deadline := time.Now().Add(INSTALLER_WAIT)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return Failed("Stopped waiting for the other install.", ctx.Err()), false
+		case <-time.After(INSTALLER_POLL):
+		}
+		busy = InstallersBusy()
+		if busy == "" {
+			Say("The other install has finished.")
+			return Result{}, true
+		}
+	}
+	NoteRemaining("Wait for the other install to finish", RerunCommand())
+	return Busy(fmt.Sprintf("Another install is still running (%s). Run this again once it's done.", busy)), false
+}
@@ -0,0 +1,171 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "crypto/sha256"
+import "fmt"
+import "hash/fnv"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+// A dropped connection is retried this many times before the copy is given up on.
+// Whatever made it across is kept for the next run to carry on from.
+const CACHE_RETRIES = 3
+
+// LocalInstaller returns the path to run installer from. With CacheInstallers set,
+// the installer's folder is copied from the share to the local cache first, and the
+// copy is what runs, so a blip on the network can't take the installer down mid-way.
+func LocalInstaller(ctx context.Context, installer string) (string, error) {
+	if !policy.CachesInstallers() || !strings.HasPrefix(installer, `\\`) {
+		return installer, nil
+	}
+	src := filepath.Dir(installer)
+	dst, err := cacheDir(src)
+	if err != nil {
+		return "", err
+	}
+
+	Say("Copying %s to the local cache...", src)
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		for try := 1; ; try++ {
+			err = cacheFile(ctx, path, filepath.Join(dst, rel), info)
+			if err == nil || ctx.Err() != nil || try == CACHE_RETRIES {
+				return err
+			}
+			Warn("Copying %s failed, trying again: %v", rel, err)
+			time.Sleep(POLL_INTERVAL)
+		}
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot copy %s to the local cache", src)
+	}
+	return filepath.Join(dst, filepath.Base(installer)), nil
+}
+
+// cacheDir returns the cache folder for the installer folder src. Each source folder
+// gets one of its own, so versions don't mix.
+func cacheDir(src string) (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToUpper(src)))
+	return filepath.Join(dir, "cache", fmt.Sprintf("%s-%08x", filepath.Base(src), h.Sum32())), nil
+}
+
+// cacheUpToDate reports whether the cached copy at dst matches src as described by info.
+func cacheUpToDate(dst string, info os.FileInfo) bool {
+	fi, err := os.Stat(dst)
+	return err == nil && fi.Size() == info.Size() && fi.ModTime().Equal(info.ModTime())
+}
+
+// cacheFile brings dst up to date with src. A copy that was cut short is picked up
+// where it left off, and the finished copy is checked against the original before it's
+// used.
+func cacheFile(ctx context.Context, src, dst string, info os.FileInfo) error {
+	if cacheUpToDate(dst, info) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open %s", src)
+	}
+	defer in.Close()
+
+	partial := dst + ".partial"
+	out, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create %s", partial)
+	}
+	off, err := out.Seek(0, io.SeekEnd)
+	if err == nil && off > info.Size() {
+		err = out.Truncate(0)
+		off = 0
+		if err == nil {
+			_, err = out.Seek(0, io.SeekStart)
+		}
+	}
+	if err == nil && off > 0 {
+		Say("Resuming the copy of %s at %d MB", filepath.Base(src), off/1024/1024)
+		_, err = in.Seek(off, io.SeekStart)
+	}
+	var r io.Reader
+	if err == nil {
+		r, err = NewTransferReader(ctx, in)
+	}
+	if err == nil {
+		_, err = io.Copy(out, r)
+	}
+	cerr := out.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot copy %s", src)
+	}
+	if cerr != nil {
+		return errors.Wrapf(cerr, "Cannot write %s", partial)
+	}
+
+	err = verifyCopy(ctx, src, partial)
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	os.Remove(dst)
+	err = os.Rename(partial, dst)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot rename %s", partial)
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func verifyCopy(ctx context.Context, src, dst string) error {
+	a, err := hashFile(ctx, src, true)
+	if err != nil {
+		return err
+	}
+	b, err := hashFile(ctx, dst, false)
+	if err != nil {
+		return err
+	}
+	if a != b {
+		return errors.Errorf("Copy of %s doesn't match the original", src)
+	}
+	return nil
+}
+
+// hashFile returns the SHA-256 of the file at path. Reading a remote file counts as a
+// transfer.
+func hashFile(ctx context.Context, path string, remote bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot open %s", path)
+	}
+	defer f.Close()
+	var r io.Reader = ctxReader{ctx, f}
+	if remote {
+		r, err = NewTransferReader(ctx, f)
+		if err != nil {
+			return "", err
+		}
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot read %s", path)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
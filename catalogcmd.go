@@ -0,0 +1,157 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os/exec"
+import "regexp"
+import "sort"
+import "strings"
+
+var mfgCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A catalogOperation is one of the dsa.exe content operations `catalog` runs. Args
+// come before DSA_SILENT_SWITCHES, with {rootpath} and {mfg} filled in, and can be
+// replaced for the phase in the config's Commands if a DSA version wants others.
+type catalogOperation struct {
+	Phase string
+	Title string
+	Args  []string
+	// Takes a manufacturer code, and should leave its granule selected or not.
+	Mfg      bool
+	Selected bool
+}
+
+var catalogOperations = map[string]catalogOperation{
+	"update": {Phase: PHASE_CATALOG_UPDATE, Title: "Updating the catalog content",
+		Args: []string{"/update", "/rootpath", "{rootpath}"}},
+	"verify": {Phase: PHASE_CATALOG_VERIFY, Title: "Verifying the catalog content",
+		Args: []string{"/verify", "/rootpath", "{rootpath}"}},
+	"add": {Phase: PHASE_CATALOG_ADD, Title: "Adding the %s catalog",
+		Args: []string{"/add", "{mfg}", "/rootpath", "{rootpath}"}, Mfg: true, Selected: true},
+	"remove": {Phase: PHASE_CATALOG_REMOVE, Title: "Removing the %s catalog",
+		Args: []string{"/remove", "{mfg}", "/rootpath", "{rootpath}"}, Mfg: true},
+}
+
+// CatalogCommand implements `2020runner catalog list | check [-update] | update |
+// verify | add <MfgCode> | remove <MfgCode>`, which look after the catalog content of
+// the deployed line through dsa.exe rather than by reinstalling it.
+func CatalogCommand(ctx context.Context, args []string) Result {
+	if len(args) == 0 {
+		return Failed("Usage: 2020runner catalog list | check [-update] | update | verify | add <MfgCode> | remove <MfgCode>", errors.New("Missing catalog command"))
+	}
+	switch args[0] {
+	case "list":
+		return listCatalogs()
+	case "check":
+		return CatalogCheckCommand(ctx, args[1:])
+	}
+	op, ok := catalogOperations[args[0]]
+	if !ok {
+		return Failed("Unknown catalog command.", errors.Errorf("Unknown catalog command %s", args[0]))
+	}
+	mfg := ""
+	if op.Mfg {
+		if len(args) != 2 || !mfgCodePattern.MatchString(args[1]) {
+			return Failed(fmt.Sprintf("Usage: 2020runner catalog %s <MfgCode>", args[0]), errors.New("Missing or odd manufacturer code"))
+		}
+		mfg = strings.ToUpper(args[1])
+		op.Title = fmt.Sprintf(op.Title, mfg)
+	}
+	return runCatalog(ctx, op, mfg)
+}
+
+// runCatalog carries out op, on the manufacturer mfg if it takes one.
+func runCatalog(ctx context.Context, op catalogOperation, mfg string) Result {
+	if r, ok := AcquireRunLock(); !ok {
+		return r
+	}
+	before := stampDSAState()
+	Say("%s.", op.Title)
+	done := TimePhase(op.Phase)
+	err := RunPhase(ctx, op.Phase, func(ctx context.Context) error {
+		return runCatalogOperation(ctx, op, mfg)
+	})
+	done()
+	if err != nil {
+		return Failed(op.Title+" didn't work.", err)
+	}
+	if !op.Mfg {
+		return Succeeded(op.finished())
+	}
+
+	// DSA writes the selection out after dsa.exe is done, like after an uninstall.
+	WaitForDSAStateChange(ctx, before)
+	s, err := LoadDSAState()
+	if err != nil {
+		return Failed("Unable to read the catalog selection back.", err)
+	}
+	if s == nil || granuleSelected(s, mfg, policy.Catalog().PlatformType) != op.Selected {
+		return Unsuccessful(fmt.Sprintf("dsa.exe finished, but the %s catalog's selection is unchanged.", mfg))
+	}
+	return Succeeded(op.finished())
+}
+
+func (op catalogOperation) finished() string {
+	return "dsa.exe finished " + strings.ToLower(op.Title[:1]) + op.Title[1:] + "."
+}
+
+func runCatalogOperation(ctx context.Context, op catalogOperation, mfg string) error {
+	exe, err := DSAExecutable(policy.Catalog())
+	if err != nil {
+		return err
+	}
+	root, err := DSARoot()
+	if err != nil {
+		return err
+	}
+	vars := map[string]string{"dsa": exe, "rootpath": root, "mfg": mfg}
+	args := append([]string{}, op.Args...)
+	for i := range args {
+		for k, v := range vars {
+			args[i] = strings.ReplaceAll(args[i], "{"+k+"}", v)
+		}
+	}
+	cmd, err := PhaseCommand(op.Phase, vars, exec.Command(exe, append(args, DSA_SILENT_SWITCHES...)...))
+	if err != nil {
+		return err
+	}
+	dsaLog := TailDSALogs(ctx)
+	out, err := RunPromptedCommand(ctx, cmd, DSA_PROMPT_ANSWERS)
+	if err != nil {
+		err = errors.Wrapf(err, "dsa.exe output: %s", out)
+	}
+	return dsaLog.Finish(err)
+}
+
+// granuleSelected reports whether s has the granule mfg/platform selected.
+func granuleSelected(s *DSACatalogState, mfg, platform string) bool {
+	for _, g := range s.GranulePicks {
+		if strings.EqualFold(g.MfgCode, mfg) && strings.EqualFold(g.PlatformType, platform) {
+			return g.SelectionState == `Selected`
+		}
+	}
+	return false
+}
+
+// listCatalogs prints the manufacturers DSA has selected, by platform.
+func listCatalogs() Result {
+	s, err := LoadDSAState()
+	if err != nil {
+		return Failed("Unable to read the catalog selection.", err)
+	}
+	if s == nil {
+		return Unsuccessful("DSA has no catalogs on this computer.")
+	}
+	var picks []string
+	for _, g := range s.GranulePicks {
+		if g.SelectionState == `Selected` {
+			picks = append(picks, g.MfgCode+"/"+g.PlatformType)
+		}
+	}
+	sort.Strings(picks)
+	for _, p := range picks {
+		fmt.Println(p)
+	}
+	return Succeeded(fmt.Sprintf("%d catalogs are selected.", len(picks)))
+}
@@ -0,0 +1,112 @@
+package main
+
+import "strings"
+
+// The catalog product lines. A machine's role picks one with CatalogLine in its policy;
+// DSA keeps a single state cookie and network location per machine, so there's only
+// ever one line deployed at a time.
+const (
+	CATALOG_COMMERCIAL  = "Commercial"
+	CATALOG_RESIDENTIAL = "Residential"
+)
+
+const (
+	RESIDENTIAL_CATALOG      = `SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall\20-20 RESIDENTIAL CATALOGS`
+	PATH_CATALOG_RESIDENTIAL = `\\10.0.9.29\2020catalogresidential\ClientSetup\setup.exe`
+)
+
+// A CatalogLine is where a catalog product line registers itself and how its granules
+// are recognized in the DSA state cookie.
+type CatalogLine struct {
+	Name         string
+	UninstallKey string
+	PlatformType string
+	Setup        string
+}
+
+var CATALOG_LINES = map[string]CatalogLine{
+	CATALOG_COMMERCIAL: {
+		Name:         "commercial catalog",
+		UninstallKey: CAP2020_CATALOG,
+		PlatformType: "CAP",
+		Setup:        PATH_CATALOG,
+	},
+	CATALOG_RESIDENTIAL: {
+		Name:         "residential catalog",
+		UninstallKey: RESIDENTIAL_CATALOG,
+		PlatformType: "DES",
+		Setup:        PATH_CATALOG_RESIDENTIAL,
+	},
+}
+
+// Sentinels returns the granules, as MfgCode/PlatformType, that CatalogInstalledLocally
+// looks for.
+func (p Policy) Sentinels() []string {
+	var granules []string
+	for _, g := range strings.Split(p.SentinelGranules, ",") {
+		g = strings.ToUpper(strings.TrimSpace(g))
+		if g == "" {
+			continue
+		}
+		if !strings.Contains(g, "/") {
+			g += "/" + p.Catalog().PlatformType
+		}
+		granules = append(granules, g)
+	}
+	return granules
+}
+
+// CatalogInstalledLocally reports whether at least SentinelMatches of the sentinel
+// granules are selected in s.
+func CatalogInstalledLocally(s *DSACatalogState) bool {
+	selected := map[string]bool{}
+	for _, g := range s.GranulePicks {
+		if g.SelectionState == `Selected` {
+			selected[strings.ToUpper(g.MfgCode+"/"+g.PlatformType)] = true
+		}
+	}
+	matches := uint32(0)
+	for _, g := range policy.Sentinels() {
+		if selected[g] {
+			matches++
+		}
+	}
+	return matches > 0 && matches >= policy.SentinelsNeeded()
+}
+
+func catalogLine(name string) (CatalogLine, bool) {
+	for n, l := range CATALOG_LINES {
+		if strings.EqualFold(n, name) {
+			return l, true
+		}
+	}
+	return CATALOG_LINES[CATALOG_COMMERCIAL], false
+}
+
+// Catalog returns the catalog line p deploys. ResolvePolicy has warned about unknown
+// lines, which are taken to be the commercial one.
+func (p Policy) Catalog() CatalogLine {
+	l, _ := catalogLine(p.CatalogLine)
+	return l
+}
+
+// CatalogContentVersions returns the content version of each granule selected in s, by
+// MfgCode/PlatformType, with "" for those DSA doesn't record one for.
+func CatalogContentVersions(s *DSACatalogState) map[string]string {
+	versions := map[string]string{}
+	for _, g := range s.GranulePicks {
+		if g.SelectionState == `Selected` {
+			versions[strings.ToUpper(g.MfgCode+"/"+g.PlatformType)] = g.ContentVersion()
+		}
+	}
+	return versions
+}
+
+// NoteCatalogVersions puts the content version of each selected granule in the report.
+func NoteCatalogVersions() {
+	s, err := LoadDSAState()
+	if err != nil || s == nil {
+		return
+	}
+	report.CatalogVersions = CatalogContentVersions(s)
+}
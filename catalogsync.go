@@ -0,0 +1,99 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "flag"
+import "fmt"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// ShareCatalogState reads the state cookie the network deployment keeps on the
+// catalog share, which has the manufacturers the catalog admin has picked for everyone.
+func ShareCatalogState() (*DSACatalogState, error) {
+	err := ConnectShare(policy.CatalogSetup)
+	if err != nil {
+		return nil, err
+	}
+	name := config.CatalogShareState
+	if name == "" {
+		name = DSA_STATE_COOKIE
+	}
+	path := filepath.Join(filepath.Dir(filepath.Dir(policy.CatalogSetup)), name)
+	s, err := loadDSAStateFile(path)
+	if err == nil && s == nil {
+		err = errors.Errorf("Cannot find the network deployment's state at %s", path)
+	}
+	return s, err
+}
+
+// catalogBehind lists the granules of the deployed line, as MfgCode/PlatformType, that
+// share has selected and s doesn't, or has at another content version.
+func catalogBehind(s, share *DSACatalogState) []string {
+	platform := policy.Catalog().PlatformType
+	have := CatalogContentVersions(s)
+	var missing []string
+	for _, g := range share.GranulePicks {
+		if g.SelectionState != `Selected` || !strings.EqualFold(g.PlatformType, platform) {
+			continue
+		}
+		name := strings.ToUpper(g.MfgCode + "/" + g.PlatformType)
+		v, ok := have[name]
+		if !ok {
+			missing = append(missing, name)
+		} else if want := g.ContentVersion(); want != "" && v != want {
+			missing = append(missing, fmt.Sprintf("%s %s (here %s)", name, want, v))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// CatalogCheckCommand implements `2020runner catalog check [-update]`, for machines on
+// the network deployment: it compares the manufacturers selected here, and their
+// content versions, with the ones on the share, so that a client that hasn't picked
+// up new content shows up in its report before a designer finds the products missing.
+// -update has dsa.exe update the content if so, and checks again.
+func CatalogCheckCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("catalog check", flag.ExitOnError)
+	update := fs.Bool("update", false, "Update the catalog content if it's behind the share, and check again")
+	fs.Parse(args)
+
+	s, err := LoadDSAState()
+	if err != nil {
+		return Failed("Unable to read the catalog selection.", err)
+	}
+	if s == nil || !s.UsingNetwork {
+		return Unsuccessful("This computer isn't on the network catalog deployment.")
+	}
+	report.CatalogVersions = CatalogContentVersions(s)
+	share, err := ShareCatalogState()
+	if err != nil {
+		return Failed("Unable to read the catalog selection on the share.", err)
+	}
+
+	missing := catalogBehind(s, share)
+	if len(missing) > 0 && *update {
+		Warn("Not picked up from the share yet: %s", strings.Join(missing, ", "))
+		before := stampDSAState()
+		r := runCatalog(ctx, catalogOperations["update"], "")
+		if r.Outcome != OUTCOME_SUCCESS {
+			report.CatalogBehind = missing
+			return r
+		}
+		WaitForDSAStateChange(ctx, before)
+		s, err = LoadDSAState()
+		if err != nil {
+			return Failed("Unable to read the catalog selection back.", err)
+		}
+		if s == nil {
+			return Failed("The update left this computer without catalogs.", errors.New("No DSA state after the update"))
+		}
+		missing = catalogBehind(s, share)
+	}
+	report.CatalogBehind = missing
+	if len(missing) > 0 {
+		return Unsuccessful(fmt.Sprintf("This computer hasn't picked up %s from the catalog share. Run 2020runner catalog check -update.", strings.Join(missing, ", ")))
+	}
+	return Succeeded("This computer has every manufacturer the catalog share has.")
+}
@@ -0,0 +1,128 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+
+// The most of each index file ConfirmNetworkCatalog reads, which is enough to know the
+// share serves its content and not just its folder listing.
+const CATALOG_INDEX_READ = 64 * 1024
+
+// ConfirmNetworkCatalog checks that the network catalog DSA now says is installed
+// works: that DSA has a network deployment from the configured share, that the
+// catalog's index files can be read off the share, by the logged-on user as well as
+// the runner, and that the site's CatalogLookup command, if there is one, finds what it
+// looks for. dsa.exe is only asked to verify the deployment if the config has a
+// CatalogVerify command, since its switches for that differ between DSA versions and a
+// wrong guess would fail every install.
+func ConfirmNetworkCatalog(ctx context.Context) error {
+	if !networkDeploymentStaged() {
+		return errors.Errorf("DSA doesn't show a network deployment from %s", filepath.Dir(policy.CatalogSetup))
+	}
+	if phaseOverride(PHASE_CATALOG_VERIFY) != "" {
+		err := RunPhase(ctx, PHASE_CATALOG_VERIFY, func(ctx context.Context) error {
+			return runCatalogOperation(ctx, catalogOperations["verify"], "")
+		})
+		if err != nil {
+			return errors.Wrap(err, "dsa.exe doesn't find the network deployment healthy")
+		}
+		NoteChecked("dsa.exe verification of the network deployment")
+	}
+
+	err := ReadCatalogIndexFiles(ctx)
+	if err != nil {
+		return err
+	}
+	NoteChecked("Catalog index files on %s", catalogShareRoot())
+	user, err := CheckUserCatalogAccess()
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		NoteChecked("%s can read the catalog index files", user)
+	}
+
+	return lookupSampleItem(ctx)
+}
+
+// catalogShareRoot is the folder above ClientSetup that the catalog's content is in.
+func catalogShareRoot() string {
+	return filepath.Dir(filepath.Dir(policy.CatalogSetup))
+}
+
+// catalogIndexFiles returns the full paths of the config's CatalogIndexFiles, or of the
+// network deployment's state cookie if there are none.
+func catalogIndexFiles() []string {
+	names := config.CatalogIndexFiles
+	if len(names) == 0 {
+		name := config.CatalogShareState
+		if name == "" {
+			name = DSA_STATE_COOKIE
+		}
+		names = []string{name}
+	}
+	var paths []string
+	for _, n := range names {
+		paths = append(paths, filepath.Join(catalogShareRoot(), strings.TrimSpace(n)))
+	}
+	return paths
+}
+
+// ReadCatalogIndexFiles reads the start of every file from catalogIndexFiles, and lists
+// the ones that can't be read.
+func ReadCatalogIndexFiles(ctx context.Context) error {
+	err := ConnectShare(policy.CatalogSetup)
+	if err != nil {
+		return ShareError(ctx, policy.CatalogSetup, err)
+	}
+	var problems []string
+	for _, path := range catalogIndexFiles() {
+		if err := readIndexFile(path); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("Cannot read the catalog index files: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func readIndexFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return FileAccessError(err, path)
+	}
+	defer f.Close()
+	n, err := io.CopyN(io.Discard, f, CATALOG_INDEX_READ)
+	if err != nil && err != io.EOF {
+		return errors.Wrapf(FileAccessError(err, path), "Cannot read %s", path)
+	}
+	if n == 0 {
+		return errors.Errorf("%s is empty", path)
+	}
+	return nil
+}
+
+// lookupSampleItem runs the config's CatalogLookup command, which has nothing to run
+// by default, since only the site knows an item every machine should find. It gets
+// {share}, {rootpath} and {dsa} filled in, and has to exit with 0.
+func lookupSampleItem(ctx context.Context) error {
+	root, _ := DSARoot()
+	exe, _ := DSAExecutable(policy.Catalog())
+	cmd, err := PhaseCommand(PHASE_CATALOG_LOOKUP, map[string]string{"share": catalogShareRoot(), "rootpath": root, "dsa": exe}, nil)
+	if err != nil || cmd == nil {
+		return err
+	}
+	err = RunPhase(ctx, PHASE_CATALOG_LOOKUP, func(ctx context.Context) error {
+		out, err := RunPromptedCommand(ctx, cmd, DSA_PROMPT_ANSWERS)
+		return errors.Wrapf(err, "Lookup command output: %s", out)
+	})
+	if err != nil {
+		return errors.Wrap(err, "The sample catalog lookup failed")
+	}
+	NoteChecked("Sample catalog lookup")
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os/exec"
+import "strings"
+
+// A CommandOverride replaces the command line a phase runs, for when the vendor
+// changes an installer's switches:
+//
+//	<Commands>
+//	  <Command Phase="SoftwareInstall">"{installer}" /S /v"/qn REBOOT=ReallySuppress"</Command>
+//	  <Command Phase="SoftwareUninstall">msiexec /x {product} /qn /norestart</Command>
+//	  <Command Phase="CatalogVerify">"{dsa}" /verify /rootpath "{rootpath}" /silent</Command>
+//	</Commands>
+//
+// A CatalogVerify command also has each network catalog install checked with it, see
+// ConfirmNetworkCatalog.
+//
+// {installer} is the setup program, as it's about to be run, for the install phases,
+// {product} the software's product code, and {uninstall} the catalog's registered
+// uninstall command. The catalog operations have {dsa} for dsa.exe, {rootpath} for
+// the DSA folder and, adding or removing, {mfg} for the manufacturer code. Quote
+// them where they could have spaces in.
+type CommandOverride struct {
+	Phase   string `xml:"Phase,attr"`
+	Command string `xml:",chardata"`
+}
+
+// phaseOverride returns the config's command line for phase, or "" if it has none.
+func phaseOverride(phase string) string {
+	var line string
+	for _, c := range config.Commands {
+		if strings.EqualFold(c.Phase, phase) {
+			line = strings.TrimSpace(c.Command)
+		}
+	}
+	return line
+}
+
+// PhaseCommand returns the command for phase: the override from the config with vars
+// filled in, or def if there isn't one.
+func PhaseCommand(phase string, vars map[string]string, def *exec.Cmd) (*exec.Cmd, error) {
+	line := phaseOverride(phase)
+	if line == "" {
+		return def, nil
+	}
+	for k, v := range vars {
+		line = strings.ReplaceAll(line, "{"+k+"}", v)
+	}
+	argv, err := splitCommandLine(line)
+	if err != nil || len(argv) == 0 {
+		return nil, errors.Errorf("Cannot parse the %s command %s", phase, line)
+	}
+	// The command line goes to the program exactly as written, since installers tend
+	// to parse their own, msiexec's /v"..." being the usual example.
+	return commandLine(argv, line), nil
+}
+
+// psQuote quotes s as a PowerShell string literal.
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func runPowerShell(ctx context.Context, script string) (string, error) {
+	out, err := RunCommand(ctx, exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script))
+	if err != nil {
+		return "", errors.Wrapf(err, "PowerShell output: %s", out)
+	}
+	return string(out), nil
+}
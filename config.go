@@ -0,0 +1,242 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "os"
+import "path/filepath"
+
+// The runner reads an optional XML config, by default from
+// %ProgramData%\2020runner\config.xml. The same file is usually pushed to every
+// machine, or -config points at a copy on the deployment share. Any Policy setting
+// can go at the top level. Installer paths can use a host name or a DFS namespace as
+// well as the server's address:
+//
+//	<RunnerConfig>
+//	  <LogLevel>verbose</LogLevel>
+//	  <SoftwareVersion>13.00.13037</SoftwareVersion>
+//	  <SoftwareVersions>only</SoftwareVersions>
+//	  <MigrationStrategy>network-first</MigrationStrategy>
+//	  <CatalogSetup>\\10.0.9.29\2020catalog\ClientSetup\setup.exe</CatalogSetup>
+//	  <SoftwareInstaller>\\corp.example\apps\2020software\Setup.exe</SoftwareInstaller>
+//	  <Rules>
+//	    <Rule Hostname="KIOSK-*"><Skip>true</Skip></Rule>
+//	    <Rule Hostname="DEMO-*"><Exempt>Trade show demo machines</Exempt></Rule>
+//	    <Rule Hostname="LAB-*"><SentinelGranules>KFI,HAF/CAP,STC</SentinelGranules><SentinelMatches>2</SentinelMatches></Rule>
+//	  </Rules>
+//	  <Hooks>
+//	    <Hook Phase="SoftwareUninstall" When="pre">C:\Scripts\BackupTemplates.ps1</Hook>
+//	    <Hook Phase="SoftwareInstall" When="post">C:\Scripts\RegisterLicense.cmd /quiet</Hook>
+//	  </Hooks>
+//	  <Backup Path="\\fileserver\2020backup">
+//	    <Profile>AppData\Roaming\2020</Profile>
+//	    <Shared>2020</Shared>
+//	  </Backup>
+//	  <UserSettings>
+//	    <Key>Software\20-20 Technologies</Key>
+//	  </UserSettings>
+//	  <RegistryDiff>
+//	    <Key>SOFTWARE\Classes\2020Design.kit</Key>
+//	  </RegistryDiff>
+//	  <License Server="lic01.example.local" Port="5093" />
+//	  <Shares User="CORP\svc-2020" Password="dpapi:AQAAANCMnd8BFdERjHoAwE/Cl+s..." />
+//	  <ReportURL>https://inventory.example.local/2020runner/reports</ReportURL>
+//	  <FleetCSV>\\fileserver\2020deploy\runs.csv</FleetCSV>
+//	  <ReportPin>sha256/7HIpactkIAq2Y49orFOOQKurWxmmSFZhBCoQYcRhJ3Y=</ReportPin>
+//	  <ReportToken>dpapi:AQAAANCMnd8BFdERjHoAwE/Cl+s...</ReportToken>
+//	  <Proxy URL="http://proxy.example.local:8080" />
+//	  <Timeouts>
+//	    <Timeout Phase="SoftwareInstall" Minutes="180" />
+//	  </Timeouts>
+//	  <CatalogIndexFiles>
+//	    <File>Catalogs\DMO\DMO.cix</File>
+//	  </CatalogIndexFiles>
+//	  <Commands>
+//	    <Command Phase="CatalogLookup">C:\Scripts\FindSampleItem.cmd {share}</Command>
+//	  </Commands>
+//	  <Retries>
+//	    <Retry Action="InstallNetworkCatalog" Checks="3" DelaySeconds="10" />
+//	  </Retries>
+//	</RunnerConfig>
+type Config struct {
+	XMLName         xml.Name          `xml:"RunnerConfig"`
+	Hooks           []Hook            `xml:"Hooks>Hook"`
+	Backup          BackupConfig      `xml:"Backup"`
+	UserSettings    []string          `xml:"UserSettings>Key"`
+	License         LicenseConfig     `xml:"License"`
+	Rules           []Rule            `xml:"Rules>Rule"`
+	Rollout         Rollout           `xml:"Rollout"`
+	Timeouts        []PhaseTimeout    `xml:"Timeouts>Timeout"`
+	Retries         []StepRetry       `xml:"Retries>Retry"`
+	Integration     IntegrationConfig `xml:"Integration"`
+	Shares          ShareConfig       `xml:"Shares"`
+	Commands        []CommandOverride `xml:"Commands>Command"`
+	CatalogManifest CatalogManifest   `xml:"CatalogManifest"`
+	// The network deployment's own state cookie, relative to the catalog share root,
+	// for catalog check. DSA_STATE_COOKIE if not given.
+	CatalogShareState string `xml:"CatalogShareState"`
+	// Files relative to the catalog share root that a designer's catalog reads, checked
+	// once the network catalog is installed. CatalogShareState if not given.
+	CatalogIndexFiles []string `xml:"CatalogIndexFiles>File"`
+	// More subtrees of HKLM for -registry-diff to compare.
+	RegistryDiff []string `xml:"RegistryDiff>Key"`
+	// Pattern for DSA's log files, absolute or relative to the DSA folder.
+	DSALogs string `xml:"DSALogs"`
+	// Every run's report is posted here as JSON, through Proxy if need be. ReportCA is
+	// a PEM bundle of extra CAs to trust for it, and ReportPin the key it must have.
+	// ReportToken is sent as the bearer token `2020runner serve` checks, and can be
+	// protected with protect-secret.
+	ReportURL   string      `xml:"ReportURL"`
+	ReportCA    string      `xml:"ReportCA"`
+	ReportPin   string      `xml:"ReportPin"`
+	ReportToken string      `xml:"ReportToken"`
+	Proxy       ProxyConfig `xml:"Proxy"`
+	// A CSV file, usually on the deployment share, that every run adds a row to.
+	FleetCSV string `xml:"FleetCSV"`
+	// Answers with the fleet's typical phase durations, as JSON seconds by phase name,
+	// for estimates on machines without history of their own.
+	DurationsURL string `xml:"DurationsURL"`
+	// normal, verbose or debug, for when -v and -vv aren't given.
+	LogLevel string `xml:"LogLevel"`
+	Policy
+}
+
+var config Config
+
+// ShareConfig gives the credentials to connect to the 2020 shares with, when the
+// account the runner runs as can't get in by itself. Password can be protected with
+// protect-secret. MapDrive runs the software installers from a drive letter, for
+// setups that won't run from a UNC path; the catalog setup always runs from its UNC
+// path, since DSA records where it was run from.
+//
+//	<Shares User="CORP\svc-2020" Password="dpapi:..." MapDrive="false" />
+type ShareConfig struct {
+	User     string `xml:"User,attr"`
+	Password string `xml:"Password,attr"`
+	MapDrive bool   `xml:"MapDrive,attr"`
+}
+
+// IntegrationConfig lists the shortcuts and file associations the software should
+// have. Without it, whatever shortcuts are there are checked to point somewhere, and
+// the default associations to open with a program that exists. Repair puts back the
+// configured ones that are missing or broken:
+//
+//	<Integration Repair="true">
+//	  <Shortcut Name="2020 Design" Target="C:\Program Files (x86)\2020\Design\2020Design.exe" Desktop="true" />
+//	  <Association Extension=".kit" ProgID="2020Design.kit" Command="&quot;C:\Program Files (x86)\2020\Design\2020Design.exe&quot; &quot;%1&quot;" />
+//	  <LaunchPoint>D:\Citrix\Published\2020</LaunchPoint>
+//	</Integration>
+//
+// Shortcuts anywhere on the desktops and Start Menus, or in a LaunchPoint folder, that
+// start a 2020 program from somewhere other than the installed software are stale, and
+// are pointed at it with Repair.
+type IntegrationConfig struct {
+	Repair       bool          `xml:"Repair,attr"`
+	Shortcuts    []Shortcut    `xml:"Shortcut"`
+	Associations []Association `xml:"Association"`
+	LaunchPoints []string      `xml:"LaunchPoint"`
+}
+
+// A Shortcut goes in the Start Menu under PURGE_PROGRAM_FOLDERS[0], and on the public
+// desktop as well if Desktop is set.
+type Shortcut struct {
+	Name    string `xml:"Name,attr"`
+	Target  string `xml:"Target,attr"`
+	Desktop bool   `xml:"Desktop,attr"`
+}
+
+type Association struct {
+	Extension string `xml:"Extension,attr"`
+	ProgID    string `xml:"ProgID,attr"`
+	Command   string `xml:"Command,attr"`
+}
+
+// LicenseConfig is either a network license server or an activation key. RegistryKey
+// overrides where under HKLM the values are written. Key can be protected with
+// 2020runner protect-secret.
+type LicenseConfig struct {
+	Server      string `xml:"Server,attr"`
+	Port        uint32 `xml:"Port,attr"`
+	Key         string `xml:"Key,attr"`
+	RegistryKey string `xml:"RegistryKey,attr"`
+}
+
+func (l LicenseConfig) Configured() bool {
+	return l.Server != "" || l.Key != ""
+}
+
+const (
+	LICENSE_KEY          = `SOFTWARE\WOW6432Node\20-20 Technologies\License`
+	LICENSE_PORT_DEFAULT = 5093
+)
+
+// CatalogManifest describes what the catalog share holds once it's fully synced, so
+// that a share still halfway through replicating isn't installed from. Paths are
+// relative to the share root, the folder above ClientSetup:
+//
+//	<CatalogManifest VersionFile="version.txt" Version="2024.3" SetupVersion="13.0.24.3">
+//	  <Folder>Catalogs</Folder>
+//	  <File SHA256="9f86d081884c7d65...">ClientSetup\setup.exe</File>
+//	</CatalogManifest>
+type CatalogManifest struct {
+	VersionFile  string         `xml:"VersionFile,attr"`
+	Version      string         `xml:"Version,attr"`
+	SetupVersion string         `xml:"SetupVersion,attr"`
+	Folders      []string       `xml:"Folder"`
+	Files        []ManifestFile `xml:"File"`
+}
+
+type ManifestFile struct {
+	SHA256 string `xml:"SHA256,attr"`
+	Path   string `xml:",chardata"`
+}
+
+func (m CatalogManifest) Configured() bool {
+	return m.VersionFile != "" || m.SetupVersion != "" || len(m.Folders) > 0 || len(m.Files) > 0
+}
+
+// RunnerDataDir returns the folder the runner keeps its own files in.
+func RunnerDataDir() (string, error) {
+	pd, err := ProgramData()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(pd, "2020runner"), nil
+}
+
+// LoadConfig reads the config at path. An empty path means the default location,
+// which is allowed not to exist.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+
+	explicit := path != ""
+	if !explicit {
+		dir, err := RunnerDataDir()
+		if err != nil {
+			return c, err
+		}
+		path = filepath.Join(dir, "config.xml")
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && !explicit {
+		return c, nil
+	} else if err != nil {
+		return c, errors.Wrap(err, "Cannot open config file")
+	}
+	defer f.Close()
+
+	err = xml.NewDecoder(f).Decode(&c)
+	if err != nil {
+		return c, errors.Wrapf(err, "Cannot decode config file %s", path)
+	}
+	if logLevel >= LOG_DEBUG {
+		shown := c
+		for _, secret := range []*string{&shown.Shares.Password, &shown.Proxy.Password, &shown.License.Key, &shown.ReportToken} {
+			if *secret != "" {
+				*secret = "(hidden)"
+			}
+		}
+		DebugXML("Config from "+path, shown)
+	}
+	return c, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "encoding/base64"
+import "encoding/hex"
+import "encoding/xml"
+import "flag"
+import "fmt"
+import "io"
+import "net/url"
+import "os"
+import "path/filepath"
+import "reflect"
+import "regexp"
+import "sort"
+import "strings"
+import "time"
+
+// How long -reach waits for each installer on a share.
+const CONFIG_REACH_TIMEOUT = 15 * time.Second
+
+var versionPattern = regexp.MustCompile(`^\d+(\.\d+){1,3}$`)
+
+// Phases hooks, timeouts and command overrides can name.
+var CONFIG_PHASES = []string{PHASE_SOFTWARE_INSTALL, PHASE_SOFTWARE_UNINSTALL, PHASE_CATALOG_UNINSTALL, PHASE_CATALOG_INSTALL, PHASE_LICENSE,
+	PHASE_CATALOG_UPDATE, PHASE_CATALOG_VERIFY, PHASE_CATALOG_ADD, PHASE_CATALOG_REMOVE, PHASE_CATALOG_LOOKUP}
+
+// ConfigCommand implements `2020runner config validate` and `config init`. It runs
+// before the config is loaded, so that it can say what's wrong with one that doesn't
+// load. path is the -config given, if any.
+func ConfigCommand(ctx context.Context, path string, args []string) Result {
+	if len(args) == 0 {
+		flag.Usage()
+		return Failed("Missing config command.", errors.New("Use config validate or config init"))
+	}
+	switch args[0] {
+	case "validate":
+		return ValidateConfigCommand(ctx, path, args[1:])
+	case "init":
+		return InitConfigCommand(ctx, path, args[1:])
+	default:
+		flag.Usage()
+		return Failed("Unknown config command.", errors.Errorf("Unknown config command %s", args[0]))
+	}
+}
+
+// configCheck collects what's wrong with a config.
+type configCheck struct {
+	problems []string
+	warnings []string
+}
+
+func (c *configCheck) problem(where, format string, a ...interface{}) {
+	c.problems = append(c.problems, where+": "+fmt.Sprintf(format, a...))
+}
+
+func (c *configCheck) warning(where, format string, a ...interface{}) {
+	c.warnings = append(c.warnings, where+": "+fmt.Sprintf(format, a...))
+}
+
+// ValidateConfigCommand implements `2020runner config validate [-reach]`: it loads the
+// config, then checks for elements and attributes the runner doesn't know, which it
+// would otherwise ignore without a word, and for values that won't work. -reach also
+// opens every installer the config names.
+func ValidateConfigCommand(ctx context.Context, path string, args []string) Result {
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	reach := fs.Bool("reach", false, "Also check that this computer can open every installer the config names")
+	fs.Parse(args)
+
+	if path == "" {
+		dir, err := RunnerDataDir()
+		if err != nil {
+			return Failed("Unable to find the config.", err)
+		}
+		path = filepath.Join(dir, "config.xml")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Failed("Unable to read the config.", errors.Wrap(err, "Cannot open config file"))
+	}
+	var c configCheck
+	checkXMLKeys(&c, path, b, reflect.TypeOf(Config{}))
+	if len(c.problems) > 0 {
+		return c.finish(path)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return Failed("The config can't be loaded.", err)
+	}
+
+	c.checkConfig(cfg)
+	if *reach {
+		c.checkReach(ctx, cfg)
+	}
+	return c.finish(path)
+}
+
+func (c *configCheck) finish(path string) Result {
+	for _, w := range c.warnings {
+		fmt.Println("warning: " + w)
+	}
+	for _, p := range c.problems {
+		fmt.Println(p)
+	}
+	if len(c.problems) > 0 {
+		fmt.Println()
+		return Failed(fmt.Sprintf("%s has %d problem(s).", path, len(c.problems)), errors.New(c.problems[0]))
+	}
+	return Succeeded(path + " is valid.")
+}
+
+// An xmlFrame is what may appear inside an element: child elements by path from the
+// xml tags, and attributes.
+type xmlFrame struct {
+	children []xmlChild
+	attrs    map[string]bool
+}
+
+type xmlChild struct {
+	path []string
+	typ  reflect.Type
+}
+
+func frameFor(t reflect.Type) xmlFrame {
+	f := xmlFrame{attrs: map[string]bool{}}
+	addFields(&f, t)
+	return f
+}
+
+func addFields(f *xmlFrame, t reflect.Type) {
+	for t.Kind() == reflect.Ptr || (t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8) {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || t == reflect.TypeOf(time.Time{}) {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("xml")
+		if sf.Name == "XMLName" || tag == "-" || !sf.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			addFields(f, sf.Type)
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		switch {
+		case strings.Contains(opts, "attr"):
+			f.attrs[name] = true
+		case opts == "" || opts == "omitempty":
+			f.children = append(f.children, xmlChild{strings.Split(name, ">"), sf.Type})
+		}
+	}
+}
+
+// checkXMLKeys walks the config's XML against the Config type, since decoding it
+// drops anything unknown, like a misspelt element.
+func checkXMLKeys(c *configCheck, file string, b []byte, t reflect.Type) {
+	d := xml.NewDecoder(strings.NewReader(string(b)))
+	type level struct {
+		name  string
+		frame *xmlFrame
+	}
+	var stack []level
+	where := func(name string) string {
+		line, _ := d.InputPos()
+		var names []string
+		for _, l := range stack {
+			names = append(names, l.name)
+		}
+		return fmt.Sprintf("%s:%d: <%s> in <%s>", file, line, name, strings.Join(names, ">"))
+	}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			c.problem(file, "%v", err)
+			return
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := tok.Name.Local
+			var next *xmlFrame
+			if len(stack) == 0 {
+				if name != "RunnerConfig" {
+					c.problem(file, "The root element is <%s>, not <RunnerConfig>", name)
+					return
+				}
+				f := frameFor(t)
+				next = &f
+			} else {
+				for _, ch := range stack[len(stack)-1].frame.children {
+					if ch.path[0] != name {
+						continue
+					}
+					if len(ch.path) > 1 {
+						next = &xmlFrame{children: []xmlChild{{ch.path[1:], ch.typ}}, attrs: map[string]bool{}}
+					} else {
+						f := frameFor(ch.typ)
+						next = &f
+					}
+					break
+				}
+			}
+			if next == nil {
+				c.problem(where(name), "unknown element")
+				d.Skip()
+				continue
+			}
+			for _, a := range tok.Attr {
+				if !next.attrs[a.Name.Local] && a.Name.Space == "" {
+					c.problem(where(name), "unknown attribute %s", a.Name.Local)
+				}
+			}
+			stack = append(stack, level{name, next})
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		}
+	}
+}
+
+func (c *configCheck) checkConfig(cfg Config) {
+	c.checkPolicy("RunnerConfig", cfg.Policy)
+	for i, r := range cfg.Rules {
+		where := fmt.Sprintf("Rules>Rule %d", i+1)
+		if r.Hostname == "" && !r.needsDirectory() {
+			c.problem(where, "has none of Hostname, OU or Group, so it never applies")
+		}
+		c.checkPolicy(where, r.Policy)
+	}
+	if cfg.Rollout.Name != "" || cfg.Rollout.Percent != 0 {
+		if cfg.Rollout.Name == "" {
+			c.problem("Rollout", "has no Name, so it never applies")
+		}
+		if cfg.Rollout.Percent > 100 {
+			c.problem("Rollout", "Percent is %d, more than 100", cfg.Rollout.Percent)
+		}
+		c.checkPolicy("Rollout", cfg.Rollout.Policy)
+	}
+
+	for i, h := range cfg.Hooks {
+		where := fmt.Sprintf("Hooks>Hook %d", i+1)
+		c.checkPhase(where, h.Phase)
+		if h.When != HOOK_PRE && h.When != HOOK_POST {
+			c.problem(where, "When is %q, not %s or %s", h.When, HOOK_PRE, HOOK_POST)
+		}
+		if strings.TrimSpace(h.Command) == "" {
+			c.problem(where, "has no command")
+		}
+	}
+	for i, t := range cfg.Timeouts {
+		where := fmt.Sprintf("Timeouts>Timeout %d", i+1)
+		c.checkPhase(where, t.Phase)
+		if t.Minutes == 0 {
+			c.problem(where, "Minutes is missing or 0")
+		}
+	}
+	for i, r := range cfg.Retries {
+		where := fmt.Sprintf("Retries>Retry %d", i+1)
+		if _, ok := planActions[r.Action]; !ok {
+			c.problem(where, "Action %q isn't one of %s", r.Action, strings.Join(actionNames(), ", "))
+		}
+		if r.Attempts == 0 && r.Checks == 0 {
+			c.warning(where, "sets neither Attempts nor Checks, so it changes nothing")
+		}
+	}
+	for i, o := range cfg.Commands {
+		where := fmt.Sprintf("Commands>Command %d", i+1)
+		c.checkPhase(where, o.Phase)
+		if strings.TrimSpace(o.Command) == "" {
+			c.problem(where, "has no command")
+		}
+	}
+
+	if cfg.LogLevel != "" {
+		if _, err := ParseLogLevel(cfg.LogLevel); err != nil {
+			c.problem("LogLevel", "%v", err)
+		}
+	}
+	for name, u := range map[string]string{"ReportURL": cfg.ReportURL, "DurationsURL": cfg.DurationsURL, "Proxy URL": cfg.Proxy.URL} {
+		if u == "" {
+			continue
+		}
+		if err := checkURL(u); err != nil {
+			c.problem(name, "%v", err)
+		}
+	}
+	if _, err := TrustConfig(cfg.ReportCA, cfg.ReportPin); err != nil {
+		c.problem("ReportCA/ReportPin", "%v", err)
+	}
+	c.checkSecret("Shares Password", cfg.Shares.Password)
+	c.checkSecret("Proxy Password", cfg.Proxy.Password)
+	c.checkSecret("License Key", cfg.License.Key)
+	if cfg.Shares.Password != "" && cfg.Shares.User == "" {
+		c.problem("Shares", "has a Password but no User")
+	}
+
+	for i, f := range cfg.CatalogManifest.Files {
+		where := fmt.Sprintf("CatalogManifest>File %d", i+1)
+		if sum, err := hex.DecodeString(f.SHA256); err != nil || len(sum) != 32 {
+			c.problem(where, "SHA256 %q isn't 64 hex digits", f.SHA256)
+		}
+		if f.Path == "" || filepath.IsAbs(f.Path) || strings.HasPrefix(f.Path, `\`) {
+			c.problem(where, "path %q isn't relative to the catalog share", f.Path)
+		}
+	}
+	m := cfg.CatalogManifest
+	for name, v := range map[string]string{"Version": m.Version, "SetupVersion": m.SetupVersion} {
+		if v != "" && !versionPattern.MatchString(v) {
+			c.problem("CatalogManifest "+name, "%s isn't a version like 13.00.13037", v)
+		}
+	}
+	if m.Version != "" && m.VersionFile == "" {
+		c.problem("CatalogManifest", "has a Version but no VersionFile to read it from")
+	}
+	if p := cfg.CatalogShareState; filepath.IsAbs(p) || strings.HasPrefix(p, `\`) {
+		c.problem("CatalogShareState", "path %q isn't relative to the catalog share", p)
+	}
+	for i, p := range cfg.CatalogIndexFiles {
+		if p = strings.TrimSpace(p); p == "" || filepath.IsAbs(p) || strings.HasPrefix(p, `\`) {
+			c.problem(fmt.Sprintf("CatalogIndexFiles>File %d", i+1), "path %q isn't relative to the catalog share", p)
+		}
+	}
+}
+
+func (c *configCheck) checkPolicy(where string, p Policy) {
+	if p.SoftwareVersion != "" && !versionPattern.MatchString(p.SoftwareVersion) {
+		c.problem(where, "SoftwareVersion %s isn't a version like 13.00.13037", p.SoftwareVersion)
+	}
+	for name, v := range map[string]string{
+		"SoftwareInstaller":         p.SoftwareInstaller,
+		"CatalogSetup":              p.CatalogSetup,
+		"FallbackSoftwareInstaller": p.FallbackSoftwareInstaller,
+	} {
+		if v == "" {
+			continue
+		}
+		if err := checkInstallerPath(v); err != nil {
+			c.problem(where, "%s %v", name, err)
+		}
+	}
+	if p.CatalogLine != "" {
+		if _, ok := catalogLine(p.CatalogLine); !ok {
+			c.problem(where, "CatalogLine %s isn't %s or %s", p.CatalogLine, CATALOG_COMMERCIAL, CATALOG_RESIDENTIAL)
+		}
+	}
+	if p.SoftwareVersions != "" && p.SoftwareVersions != VERSIONS_PRESENT && p.SoftwareVersions != VERSIONS_ONLY {
+		c.problem(where, "SoftwareVersions %s isn't %s or %s", p.SoftwareVersions, VERSIONS_PRESENT, VERSIONS_ONLY)
+	}
+	if p.MigrationStrategy != "" && p.MigrationStrategy != MIGRATION_REPLACE && p.MigrationStrategy != MIGRATION_NETWORK_FIRST {
+		c.problem(where, "MigrationStrategy %s isn't %s or %s", p.MigrationStrategy, MIGRATION_REPLACE, MIGRATION_NETWORK_FIRST)
+	}
+	if p.TransferHours != "" {
+		if _, err := ParseTransferWindow(p.TransferHours); err != nil {
+			c.problem(where, "TransferHours: %v", err)
+		}
+	}
+	if p.RebootHours != "" {
+		if _, err := ParseTransferWindow(p.RebootHours); err != nil {
+			c.problem(where, "RebootHours: %v", err)
+		}
+	}
+	if p.RebootCancel != "" && !rebootCancels[p.RebootCancel] {
+		c.problem(where, "RebootCancel %s isn't %s, %s or %s", p.RebootCancel, REBOOT_CANCEL_ALLOW, REBOOT_CANCEL_POSTPONE, REBOOT_CANCEL_DENY)
+	}
+	for _, g := range strings.Split(p.SentinelGranules, ",") {
+		if p.SentinelGranules != "" && strings.TrimSpace(g) == "" {
+			c.problem(where, "SentinelGranules %s has an empty entry", p.SentinelGranules)
+			break
+		}
+	}
+}
+
+// checkInstallerPath checks that p is a full path to a program, on a share or a drive.
+func checkInstallerPath(p string) error {
+	if strings.Contains(p, "/") {
+		return errors.Errorf("%s uses / instead of \\", p)
+	}
+	if strings.HasPrefix(p, `\\`) {
+		parts := strings.Split(p[2:], `\`)
+		if len(parts) < 3 || parts[0] == "" || parts[1] == "" {
+			return errors.Errorf(`%s isn't a path like \\server\share\Setup.exe`, p)
+		}
+	} else if !filepath.IsAbs(p) {
+		return errors.Errorf("%s isn't a full path", p)
+	}
+	if !strings.EqualFold(filepath.Ext(p), ".exe") {
+		return errors.Errorf("%s isn't a program", p)
+	}
+	return nil
+}
+
+func checkURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return errors.Errorf("%s isn't an http or https URL", u)
+	}
+	return nil
+}
+
+func (c *configCheck) checkPhase(where, phase string) {
+	for _, p := range CONFIG_PHASES {
+		if p == phase {
+			return
+		}
+	}
+	c.problem(where, "Phase %q isn't one of %s", phase, strings.Join(CONFIG_PHASES, ", "))
+}
+
+func actionNames() []string {
+	var names []string
+	for name := range planActions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// checkSecret checks that a protected value at least decodes; it can only be decrypted
+// on the machine that protected it, which usually isn't this one.
+func (c *configCheck) checkSecret(where, v string) {
+	if v == "" {
+		return
+	}
+	if !strings.HasPrefix(v, SECRET_PREFIX) {
+		c.warning(where, "is in plain text; protect it with 2020runner protect-secret")
+		return
+	}
+	if _, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v[len(SECRET_PREFIX):])); err != nil {
+		c.problem(where, "isn't a valid protected value: %v", err)
+	}
+}
+
+// checkReach opens every distinct installer the config names, each with a time limit
+// since a share that isn't there can take a long time to say so.
+func (c *configCheck) checkReach(ctx context.Context, cfg Config) {
+	var paths []string
+	seen := map[string]bool{}
+	add := func(p Policy) {
+		for _, v := range []string{p.SoftwareInstaller, p.CatalogSetup, p.FallbackSoftwareInstaller} {
+			if v != "" && !seen[strings.ToLower(v)] {
+				seen[strings.ToLower(v)] = true
+				paths = append(paths, NormalizeUNC(v))
+			}
+		}
+	}
+	def := DEFAULT_POLICY
+	def.Merge(cfg.Policy)
+	if def.CatalogSetup == "" {
+		if l, ok := catalogLine(def.CatalogLine); ok {
+			def.CatalogSetup = l.Setup
+		}
+	}
+	add(def)
+	for _, r := range cfg.Rules {
+		add(r.Policy)
+	}
+	add(cfg.Rollout.Policy)
+
+	for _, p := range paths {
+		Say("Checking %s...", p)
+		done := make(chan error, 1)
+		go func() {
+			_, err := os.Stat(p)
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				c.problem(p, "can't be opened: %v", ShareError(ctx, p, err))
+			}
+		case <-time.After(CONFIG_REACH_TIMEOUT):
+			c.problem(p, "didn't answer within %v", CONFIG_REACH_TIMEOUT)
+		case <-ctx.Done():
+			c.problem(p, "%v", ctx.Err())
+			return
+		}
+	}
+}
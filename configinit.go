@@ -0,0 +1,218 @@
+package main
+
+import "github.com/pkg/errors"
+import "bufio"
+import "bytes"
+import "context"
+import "encoding/xml"
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "text/template"
+
+// The config written by config init. Everything optional is left in as a comment, so
+// the file doubles as a reference for what else can go in it.
+var configTemplate = template.Must(template.New("config").Funcs(template.FuncMap{"x": xmlText}).Parse(`<?xml version="1.0" encoding="utf-8"?>
+<!-- 2020runner config, written by 2020runner config init. Check it with
+     2020runner config validate -reach after changing it. -->
+<RunnerConfig>
+  <!-- The version every machine should have, and where its installer is. -->
+  <SoftwareVersion>{{x .SoftwareVersion}}</SoftwareVersion>
+  <SoftwareInstaller>{{x .SoftwareInstaller}}</SoftwareInstaller>
+  <!-- present: the target version has to be installed; only: nothing else either. -->
+  <SoftwareVersions>present</SoftwareVersions>
+
+  <!-- The catalog product line, Commercial or Residential, and its ClientSetup. -->
+  <CatalogLine>{{x .CatalogLine}}</CatalogLine>
+  <CatalogSetup>{{x .CatalogSetup}}</CatalogSetup>
+{{if .Rollout}}
+  <!-- The next version goes to this share of the machines first. Raise Percent to
+       widen it; at 100, fold the version into the settings above. -->
+  <Rollout Name="{{x .RolloutVersion}}" Percent="{{.RolloutPercent}}">
+    <SoftwareVersion>{{x .RolloutVersion}}</SoftwareVersion>
+    <SoftwareInstaller>{{x .RolloutInstaller}}</SoftwareInstaller>
+  </Rollout>
+{{else}}
+  <!-- To stage the next version to some of the machines first:
+  <Rollout Name="13.00.14000" Percent="10">
+    <SoftwareVersion>13.00.14000</SoftwareVersion>
+    <SoftwareInstaller>\\server\2020software-next\Setup.exe</SoftwareInstaller>
+  </Rollout>
+  -->
+{{end}}
+{{- if .ReportURL}}
+  <!-- Every run's report is posted here as JSON. With 2020runner serve, set the
+       server's token too, protected with 2020runner protect-secret:
+  <ReportToken>dpapi:...</ReportToken>
+  -->
+  <ReportURL>{{x .ReportURL}}</ReportURL>
+{{else}}
+  <!-- To collect every run's report as JSON:
+  <ReportURL>https://inventory.example.local/2020runner/reports</ReportURL>
+  <ReportToken>dpapi:...</ReportToken>
+  -->
+{{end}}
+  <!-- Exceptions for some machines, by hostname, OU or group:
+  <Rules>
+    <Rule Hostname="KIOSK-*"><Skip>true</Skip></Rule>
+    <Rule OU="*OU=Design Lab,*"><KeepLocalCatalog>true</KeepLocalCatalog></Rule>
+    <Rule Hostname="DEMO-*"><Exempt>Demo machines, left as they are</Exempt></Rule>
+  </Rules>
+  -->
+
+  <!-- Credentials for the shares, if the computer account can't read them. Make the
+       password with 2020runner protect-secret on each machine:
+  <Shares User="CORP\svc-2020" Password="dpapi:..." />
+  -->
+</RunnerConfig>
+`))
+
+type configAnswers struct {
+	SoftwareVersion   string
+	SoftwareInstaller string
+	CatalogLine       string
+	CatalogSetup      string
+	Rollout           bool
+	RolloutVersion    string
+	RolloutInstaller  string
+	RolloutPercent    uint32
+	ReportURL         string
+}
+
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// asker asks questions on the console, offering a default and asking again until
+// check accepts the answer.
+type asker struct {
+	in *bufio.Reader
+}
+
+func (a asker) ask(question, def string, check func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Printf("%s [%s]: ", question, def)
+		} else {
+			fmt.Printf("%s: ", question)
+		}
+		line, err := a.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.Wrap(err, "Cannot read the answer")
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		if check == nil {
+			return answer, nil
+		}
+		if err := check(answer); err != nil {
+			fmt.Printf("  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+func checkVersion(v string) error {
+	if !versionPattern.MatchString(v) {
+		return errors.Errorf("%s isn't a version like 13.00.13037", v)
+	}
+	return nil
+}
+
+func checkOptionalURL(u string) error {
+	if u == "" {
+		return nil
+	}
+	return checkURL(u)
+}
+
+// InitConfigCommand implements `2020runner config init [-out file] [-force]`, which
+// asks for the settings every shop has to make and writes them to a commented config.
+func InitConfigCommand(ctx context.Context, path string, args []string) Result {
+	fs := flag.NewFlagSet("config init", flag.ExitOnError)
+	out := fs.String("out", path, "Write the config here instead of the default location")
+	force := fs.Bool("force", false, "Replace the file if there's one already")
+	fs.Parse(args)
+
+	if *out == "" {
+		dir, err := RunnerDataDir()
+		if err != nil {
+			return Failed("Unable to find the config folder.", err)
+		}
+		*out = filepath.Join(dir, "config.xml")
+	}
+	if _, err := os.Stat(*out); err == nil && !*force {
+		return Failed("There's a config already.", errors.Errorf("%s exists; use -force to replace it", *out))
+	}
+
+	a := asker{bufio.NewReader(os.Stdin)}
+	var ans configAnswers
+	var err error
+	ask := func(dst *string, question, def string, check func(string) error) {
+		if err == nil {
+			*dst, err = a.ask(question, def, check)
+		}
+	}
+	ask(&ans.SoftwareVersion, "2020 software version every machine should have", CAP2020_SOFTWARE_CURRENT, checkVersion)
+	ask(&ans.SoftwareInstaller, "Its installer", PATH_SOFTWARE, checkInstallerPath)
+	ask(&ans.CatalogLine, "Catalog line (Commercial or Residential)", CATALOG_COMMERCIAL, func(s string) error {
+		if _, ok := catalogLine(s); !ok {
+			return errors.Errorf("%s isn't %s or %s", s, CATALOG_COMMERCIAL, CATALOG_RESIDENTIAL)
+		}
+		return nil
+	})
+	if l, ok := catalogLine(ans.CatalogLine); ok {
+		ans.CatalogLine = l.Name
+		ask(&ans.CatalogSetup, "The catalog's ClientSetup", l.Setup, checkInstallerPath)
+	}
+	ask(&ans.RolloutVersion, "Next version to try on some machines first (Enter for none)", "", func(s string) error {
+		if s == "" {
+			return nil
+		}
+		return checkVersion(s)
+	})
+	if ans.RolloutVersion != "" {
+		ans.Rollout = true
+		ask(&ans.RolloutInstaller, "Its installer", "", checkInstallerPath)
+		var percent string
+		ask(&percent, "Percent of machines to start with", "10", func(s string) error {
+			n, perr := strconv.ParseUint(s, 10, 32)
+			if perr != nil || n == 0 || n > 100 {
+				return errors.Errorf("%s isn't a percentage from 1 to 100", s)
+			}
+			return nil
+		})
+		n, _ := strconv.ParseUint(percent, 10, 32)
+		ans.RolloutPercent = uint32(n)
+	}
+	ask(&ans.ReportURL, "URL to post each run's report to (Enter for none)", "", checkOptionalURL)
+	if err != nil {
+		return Failed("Unable to ask for the settings.", err)
+	}
+
+	var b bytes.Buffer
+	err = configTemplate.Execute(&b, ans)
+	if err != nil {
+		return Failed("Unable to write the config.", errors.Wrap(err, "Cannot fill in the config"))
+	}
+	err = os.MkdirAll(filepath.Dir(*out), 0755)
+	if err == nil {
+		err = os.WriteFile(*out, b.Bytes(), 0644)
+	}
+	if err != nil {
+		return Failed("Unable to write the config.", errors.Wrap(FileAccessError(err, *out), "Cannot write config file"))
+	}
+	fmt.Println()
+	if r := ValidateConfigCommand(ctx, *out, nil); r.Outcome != OUTCOME_SUCCESS {
+		return r
+	}
+	return Succeeded(fmt.Sprintf("Wrote %s. Push it to the machines, or point -config at it.", *out))
+}
@@ -0,0 +1,260 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "context"
+import "strings"
+import "sync"
+import "syscall"
+import "unsafe"
+
+var (
+	modmpr                    = windows.NewLazySystemDLL("mpr.dll")
+	procWNetAddConnection2W   = modmpr.NewProc("WNetAddConnection2W")
+	procWNetCancelConnection2 = modmpr.NewProc("WNetCancelConnection2W")
+	procWNetGetConnectionW    = modmpr.NewProc("WNetGetConnectionW")
+	procWNetOpenEnumW         = modmpr.NewProc("WNetOpenEnumW")
+	procWNetEnumResourceW     = modmpr.NewProc("WNetEnumResourceW")
+	procWNetCloseEnum         = modmpr.NewProc("WNetCloseEnum")
+)
+
+const (
+	RESOURCE_CONNECTED = 1
+	RESOURCETYPE_DISK  = 1
+	CONNECT_TEMPORARY  = 4
+)
+
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+// A connection the runner made itself, and so can take down again.
+type shareConnection struct {
+	remote string
+	local  string
+}
+
+var connectionsMu sync.Mutex
+var connections = map[string]shareConnection{}
+
+// shareRoot returns the \\server\share part of a UNC path.
+func shareRoot(path string) string {
+	server := shareServer(path)
+	if server == "" {
+		return ""
+	}
+	rest := path[2+len(server):]
+	parts := strings.SplitN(strings.TrimPrefix(rest, `\`), `\`, 2)
+	return `\\` + server + `\` + parts[0]
+}
+
+func addConnection(local, remote string) error {
+	var user, password *uint16
+	if config.Shares.User != "" {
+		p, err := Secret(config.Shares.Password)
+		if err != nil {
+			return errors.Wrap(err, "Cannot read the share password")
+		}
+		user, password = windows.StringToUTF16Ptr(config.Shares.User), windows.StringToUTF16Ptr(p)
+	}
+	nr := netResource{Type: RESOURCETYPE_DISK, RemoteName: windows.StringToUTF16Ptr(remote)}
+	if local != "" {
+		nr.LocalName = windows.StringToUTF16Ptr(local)
+	}
+	connect := func() uintptr {
+		r, _, _ := procWNetAddConnection2W.Call(uintptr(unsafe.Pointer(&nr)), uintptr(unsafe.Pointer(password)),
+			uintptr(unsafe.Pointer(user)), CONNECT_TEMPORARY)
+		return r
+	}
+	r := connect()
+	// Windows only allows one user name per server and logon session, so a connection
+	// left by something else, typically under the account the runner runs as, is in
+	// the way. It's by far the most common reason the network catalog install fails.
+	if syscall.Errno(r) == windows.ERROR_SESSION_CREDENTIAL_CONFLICT && clearConflictingConnections(remote) {
+		r = connect()
+	}
+	if r != 0 {
+		return shareFailureError(errors.Wrapf(syscall.Errno(r), "Cannot connect to %s", remote))
+	}
+	return nil
+}
+
+// serverConnections lists this logon session's connections to the server of remote,
+// by the drive letter or the share they're known by.
+func serverConnections(remote string) ([]string, error) {
+	var h windows.Handle
+	r, _, _ := procWNetOpenEnumW.Call(RESOURCE_CONNECTED, RESOURCETYPE_DISK, 0, 0, uintptr(unsafe.Pointer(&h)))
+	if r != 0 {
+		return nil, errors.Wrap(syscall.Errno(r), "Cannot list the network connections")
+	}
+	defer procWNetCloseEnum.Call(uintptr(h))
+
+	server := shareServer(remote)
+	var names []string
+	buf := make([]byte, 16*1024)
+	for {
+		count, size := uint32(0xFFFFFFFF), uint32(len(buf))
+		r, _, _ := procWNetEnumResourceW.Call(uintptr(h), uintptr(unsafe.Pointer(&count)),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+		switch syscall.Errno(r) {
+		case windows.ERROR_NO_MORE_ITEMS:
+			return names, nil
+		case windows.ERROR_MORE_DATA:
+			buf = make([]byte, size)
+			continue
+		case 0:
+		default:
+			return nil, errors.Wrap(syscall.Errno(r), "Cannot list the network connections")
+		}
+		for _, nr := range unsafe.Slice((*netResource)(unsafe.Pointer(&buf[0])), count) {
+			if nr.RemoteName == nil {
+				continue
+			}
+			name := windows.UTF16PtrToString(nr.RemoteName)
+			if !sameServer(shareServer(name), server) {
+				continue
+			}
+			if nr.LocalName != nil && *nr.LocalName != 0 {
+				name = windows.UTF16PtrToString(nr.LocalName)
+			}
+			names = append(names, name)
+		}
+	}
+}
+
+// clearConflictingConnections disconnects the connections to the server of remote
+// that ConnectShare and MapDrive didn't make, saying which, and reports whether there
+// were any. Open files on them are closed.
+func clearConflictingConnections(remote string) bool {
+	names, err := serverConnections(remote)
+	if err != nil {
+		Warn("Unable to look for the connection in the way of %s: %v", remote, err)
+		return false
+	}
+	cleared := false
+	for _, name := range names {
+		if _, ok := connections[strings.ToUpper(name)]; ok {
+			continue
+		}
+		Say("Disconnecting %s, which is connected to the same server as %s under another user name.", name, remote)
+		r, _, _ := procWNetCancelConnection2.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(name))), 0, 1)
+		if r != 0 {
+			Warn("Unable to disconnect %s: %v", name, syscall.Errno(r))
+			continue
+		}
+		cleared = true
+	}
+	return cleared
+}
+
+// ConnectShare connects to the share path is on with the configured credentials,
+// without a drive letter, and keeps the connection until DisconnectShares. Without
+// credentials configured there's nothing to do, since Windows connects as the runner's
+// account by itself.
+func ConnectShare(path string) error {
+	root := shareRoot(path)
+	if root == "" || config.Shares.User == "" {
+		return nil
+	}
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	if _, ok := connections[strings.ToUpper(root)]; ok {
+		return nil
+	}
+	err := addConnection("", root)
+	if err != nil {
+		return err
+	}
+	connections[strings.ToUpper(root)] = shareConnection{remote: root}
+	return nil
+}
+
+// freeDrive picks a drive letter that isn't in use, from the end of the alphabet.
+// Mappings belong to the logon session that made them, so one of ours doesn't take a
+// letter away from a signed-in user, and no existing mapping is ever replaced.
+func freeDrive() (string, error) {
+	used, err := windows.GetLogicalDrives()
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot list drives")
+	}
+	for l := 'Z'; l >= 'D'; l-- {
+		if used&(1<<uint(l-'A')) == 0 {
+			return string(l) + ":", nil
+		}
+	}
+	return "", errors.New("No drive letter is free")
+}
+
+// MapDrive maps a free drive letter to the share path is on and returns path on that
+// drive. The mapping goes with DisconnectShares.
+func MapDrive(path string) (string, error) {
+	root := shareRoot(path)
+	if root == "" {
+		return path, nil
+	}
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	drive, err := freeDrive()
+	if err != nil {
+		return "", err
+	}
+	err = addConnection(drive, root)
+	if err != nil {
+		return "", err
+	}
+	connections[drive] = shareConnection{remote: root, local: drive}
+	Say("Mapped %s to %s", drive, root)
+	rememberDrive(drive, root, true)
+	return drive + path[len(root):], nil
+}
+
+// mappedRemote returns the share drive is connected to, if it is.
+func mappedRemote(drive string) (string, bool) {
+	buf := make([]uint16, windows.MAX_PATH)
+	n := uint32(len(buf))
+	r, _, _ := procWNetGetConnectionW.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(drive))),
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)))
+	if r != 0 {
+		return "", false
+	}
+	return windows.UTF16ToString(buf), true
+}
+
+// DisconnectShares takes down the connections and drive mappings made by ConnectShare
+// and MapDrive, and nothing else.
+func DisconnectShares() {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+	for key, c := range connections {
+		name := c.remote
+		if c.local != "" {
+			name = c.local
+		}
+		r, _, _ := procWNetCancelConnection2.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(name))), 0, 1)
+		if r != 0 {
+			Warn("Unable to disconnect %s: %v", name, syscall.Errno(r))
+		} else if c.local != "" {
+			rememberDrive(c.local, c.remote, false)
+		}
+		delete(connections, key)
+	}
+}
+
+// SoftwareInstallerPath returns the path to run a software installer from: the local
+// cache if it's used, otherwise the share, by drive letter if MapDrive is set.
+func SoftwareInstallerPath(ctx context.Context, installer string) (string, error) {
+	path, err := LocalInstaller(ctx, installer)
+	if err != nil || !config.Shares.MapDrive {
+		return path, err
+	}
+	return MapDrive(path)
+}
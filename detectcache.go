@@ -0,0 +1,105 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "encoding/xml"
+import "fmt"
+import "os"
+import "path/filepath"
+import "time"
+
+// status keeps the last detection here, in the runner data folder, so that monitoring
+// tools calling it every minute don't have the DSA state cookie parsed and the shares
+// probed every time. It's used for as long as what detection reads locally hasn't
+// changed, and no longer than DETECTION_CACHE_MAX_AGE, which is what keeps the share
+// and license server results fresh enough.
+const DETECTION_CACHE_FILE = "detection.json"
+
+const DETECTION_CACHE_MAX_AGE = 15 * time.Minute
+
+type detectionCache struct {
+	Saved     time.Time `json:"saved"`
+	Inputs    string    `json:"inputs"`
+	Preflight Preflight `json:"preflight"`
+}
+
+func detectionCachePath() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, DETECTION_CACHE_FILE), nil
+}
+
+// detectionInputs hashes what detection depends on that can be checked without
+// detecting: the policy, the registry values it reads and the state cookie's size and
+// time. Anything that changes one of them changes the hash.
+func detectionInputs() string {
+	h := sha256.New()
+	b, _ := xml.Marshal(policy)
+	h.Write(b)
+	s := stampDSAState()
+	fmt.Fprintf(h, "\n%v %d %s\n", s.exists, s.size, s.modTime.UTC().Format(time.RFC3339Nano))
+	h.Write([]byte(registryInputs()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// CachedPreflight returns the last detection if it still holds, or runs the probes and
+// keeps their results for next time. Detection that failed or timed out isn't kept.
+func CachedPreflight(ctx context.Context) Preflight {
+	inputs := detectionInputs()
+	path, err := detectionCachePath()
+	if err != nil {
+		return RunPreflight(ctx)
+	}
+	var c detectionCache
+	if b, err := os.ReadFile(path); err == nil && json.Unmarshal(b, &c) == nil &&
+		c.Inputs == inputs && time.Since(c.Saved) >= 0 && time.Since(c.Saved) < DETECTION_CACHE_MAX_AGE {
+		Say("Detected at %s; nothing it depends on has changed since. Use status -fresh to detect again.", c.Saved.Format(time.Kitchen))
+		return c.Preflight
+	}
+
+	pf := RunPreflight(ctx)
+	if pf.SoftwareErr != nil || pf.CatalogErr != nil {
+		InvalidateDetectionCache()
+		return pf
+	}
+	for _, r := range pf.Results {
+		if r.Detail == "timed out" {
+			InvalidateDetectionCache()
+			return pf
+		}
+	}
+	err = saveDetection(path, detectionCache{Saved: time.Now(), Inputs: inputs, Preflight: pf})
+	if err != nil {
+		Warn("Unable to keep the detection for next time: %v", err)
+	}
+	return pf
+}
+
+func saveDetection(path string, c detectionCache) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, filepath.Dir(path)), "Cannot create runner data folder")
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode the detection")
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, path), "Cannot write the detection")
+	}
+	return nil
+}
+
+// InvalidateDetectionCache drops the kept detection, for runs that changed the machine
+// in ways the inputs might not show, like the shares they mapped.
+func InvalidateDetectionCache() {
+	if path, err := detectionCachePath(); err == nil {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "context"
+import "net"
+import "os"
+import "path/filepath"
+import "strings"
+import "unsafe"
+
+var (
+	modnetapi32             = windows.NewLazySystemDLL("netapi32.dll")
+	procNetDfsGetClientInfo = modnetapi32.NewProc("NetDfsGetClientInfo")
+)
+
+const DFS_STORAGE_STATE_ACTIVE = 4
+
+type dfsInfo3 struct {
+	EntryPath        *uint16
+	Comment          *uint16
+	State            uint32
+	NumberOfStorages uint32
+	Storage          *dfsStorageInfo
+}
+
+type dfsStorageInfo struct {
+	State      uint32
+	ServerName *uint16
+	ShareName  *uint16
+}
+
+// ResolveDFS returns the folder target that the DFS client is using for path, like
+// \\FS02\2020software\Setup.exe for \\corp.example\apps\2020software\Setup.exe. It
+// returns "" when path isn't in a DFS namespace, or hasn't been visited yet so there's
+// no active target.
+func ResolveDFS(path string) string {
+	if shareServer(path) == "" {
+		return ""
+	}
+	// The client only knows about roots and links, so try path's folders from the
+	// deepest up.
+	for entry := filepath.Dir(path); ; entry = filepath.Dir(entry) {
+		var buf *byte
+		r, _, _ := procNetDfsGetClientInfo.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(entry))),
+			0, 0, 3, uintptr(unsafe.Pointer(&buf)))
+		if r != 0 {
+			if filepath.Dir(entry) == entry {
+				return ""
+			}
+			continue
+		}
+		info := (*dfsInfo3)(unsafe.Pointer(buf))
+		storage := unsafe.Slice(info.Storage, info.NumberOfStorages)
+		target := ""
+		for _, s := range storage {
+			if s.State&DFS_STORAGE_STATE_ACTIVE != 0 {
+				target = `\\` + windows.UTF16PtrToString(s.ServerName) + `\` + windows.UTF16PtrToString(s.ShareName) +
+					path[len(entry):]
+				break
+			}
+		}
+		windows.NetApiBufferFree(buf)
+		return target
+	}
+}
+
+// ShareOrigin says which server is actually behind path: the DFS target if it's in a
+// namespace, and the addresses a host name resolves to.
+func ShareOrigin(ctx context.Context, path string) string {
+	var notes []string
+	server := shareServer(path)
+	if target := ResolveDFS(path); target != "" {
+		notes = append(notes, "DFS target "+target)
+		server = shareServer(target)
+	}
+	if host := shareHost(server); server != "" && !isAddress(host) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil {
+			notes = append(notes, host+" is "+strings.Join(addrs, ", "))
+		}
+	}
+	return strings.Join(notes, "; ")
+}
+
+// ValidateShareLayout checks that installer looks like what we expect to run before
+// anything is started: a non-empty program, and for the catalog, the setup in the
+// ClientSetup folder of a catalog share that matches CatalogManifest, if there is one.
+func ValidateShareLayout(installer string, catalog bool) error {
+	fi, err := os.Stat(installer)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot find %s", installer)
+	}
+	if fi.IsDir() || fi.Size() == 0 {
+		return errors.Errorf("%s is not a program", installer)
+	}
+	ext := strings.ToLower(filepath.Ext(installer))
+	if ext != ".exe" && ext != ".msi" {
+		return errors.Errorf("%s is not a setup program", installer)
+	}
+	if catalog && !strings.EqualFold(filepath.Base(filepath.Dir(installer)), "ClientSetup") {
+		return errors.Errorf("%s is not in the catalog share's ClientSetup folder", installer)
+	}
+	if catalog && config.CatalogManifest.Configured() {
+		return config.CatalogManifest.Check(installer)
+	}
+	return nil
+}
+
+// PrepareInstaller validates installer and logs where it's coming from, just before it
+// is copied or run.
+func PrepareInstaller(ctx context.Context, installer string, catalog bool) error {
+	err := ConnectShare(installer)
+	if err != nil {
+		return ShareError(ctx, installer, err)
+	}
+	err = ValidateShareLayout(installer, catalog)
+	var re *RunnerError
+	if errors.As(err, &re) {
+		// The share could be read fine; it's what's on it that's wrong.
+		return err
+	} else if err != nil {
+		return ShareError(ctx, installer, err)
+	}
+	if o := ShareOrigin(ctx, installer); o != "" {
+		Say("%s comes from %s", installer, o)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import "github.com/pkg/errors"
+import "bytes"
+import "context"
+import "io"
+import "os"
+import "path/filepath"
+import "regexp"
+import "strings"
+import "sync"
+import "time"
+
+// Where DSA writes its logs, relative to DSARoot, unless DSALogs in the config says
+// otherwise.
+var DEFAULT_DSA_LOGS = []string{`*.log`, `Logs\*.log`}
+
+const DSA_LOG_POLL = time.Second
+
+var (
+	dsaErrorLine    = regexp.MustCompile(`(?i)\b(error|failed|failure|exception)\b`)
+	dsaProgressLine = regexp.MustCompile(`\b(\d{1,3})\s?%`)
+	dsaDoneLine     = regexp.MustCompile(`(?i)\b(completed|finished|succeeded|successfully)\b`)
+)
+
+// A DSALog follows DSA's log files while a catalog install or removal runs, passing on
+// what DSA says about its progress and errors. Only lines written after it started
+// count.
+type DSALog struct {
+	mu        sync.Mutex
+	offsets   map[string]int64
+	errors    []string
+	completed bool
+	progress  string
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func dsaLogFiles() []string {
+	patterns := DEFAULT_DSA_LOGS
+	if config.DSALogs != "" {
+		patterns = []string{config.DSALogs}
+	}
+	root, err := DSARoot()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, p := range patterns {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		found, _ := filepath.Glob(p)
+		files = append(files, found...)
+	}
+	return files
+}
+
+// TailDSALogs starts following the DSA logs until Stop is called or ctx is done.
+func TailDSALogs(ctx context.Context) *DSALog {
+	l := &DSALog{offsets: map[string]int64{}, stop: make(chan struct{}), done: make(chan struct{})}
+	for _, f := range dsaLogFiles() {
+		if info, err := os.Stat(f); err == nil {
+			l.offsets[f] = info.Size()
+		}
+	}
+	go func() {
+		defer close(l.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.stop:
+				l.poll()
+				return
+			case <-time.After(DSA_LOG_POLL):
+				l.poll()
+			}
+		}
+	}()
+	return l
+}
+
+// poll reads whatever has been added to the logs since last time. Logs that appeared
+// since the start are read from the beginning.
+func (l *DSALog) poll() {
+	for _, name := range dsaLogFiles() {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		offset := l.offsets[name]
+		if err != nil || info.Size() <= offset {
+			// A log that shrank was started over.
+			if err == nil && info.Size() < offset {
+				l.offsets[name] = 0
+			}
+			f.Close()
+			continue
+		}
+		f.Seek(offset, io.SeekStart)
+		b, _ := io.ReadAll(f)
+		f.Close()
+		// Only whole lines; the rest is read next time.
+		n := bytes.LastIndexByte(b, '\n')
+		if n < 0 {
+			continue
+		}
+		l.offsets[name] = offset + int64(n) + 1
+		// Some DSA logs are UTF-16, which for what's in them means a NUL after each
+		// character.
+		text := strings.ReplaceAll(string(b[:n]), "\x00", "")
+		for _, line := range strings.Split(text, "\n") {
+			l.line(strings.TrimSpace(line))
+		}
+	}
+}
+
+func (l *DSALog) line(s string) {
+	if s == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case dsaErrorLine.MatchString(s):
+		l.errors = append(l.errors, s)
+		Warn("DSA: %s", s)
+	case dsaProgressLine.MatchString(s):
+		p := dsaProgressLine.FindStringSubmatch(s)[1] + "%"
+		if p != l.progress {
+			l.progress = p
+			Say("DSA: %s", s)
+		}
+	case dsaDoneLine.MatchString(s):
+		l.completed = true
+		Say("DSA: %s", s)
+	}
+}
+
+// Stop reads the logs one last time and stops following them. It returns the error
+// lines DSA wrote and whether it said it had finished.
+func (l *DSALog) Stop() ([]string, bool) {
+	select {
+	case <-l.done:
+	default:
+		close(l.stop)
+		<-l.done
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.errors, l.completed
+}
+
+// Finish stops following the logs and adds the last error DSA logged, if any, to err.
+func (l *DSALog) Finish(err error) error {
+	logged, _ := l.Stop()
+	if err == nil || len(logged) == 0 {
+		return err
+	}
+	return errors.Wrapf(err, "DSA logged: %s", logged[len(logged)-1])
+}
@@ -0,0 +1,157 @@
+package main
+
+import "github.com/pkg/errors"
+import "flag"
+import "os"
+import "reflect"
+import "strconv"
+import "strings"
+import "unicode"
+
+// Deployment tools can change a run without touching the config or the command line:
+// 2020RUNNER_<FLAG> sets a flag that wasn't given, e.g. 2020RUNNER_NOPAUSE=1 or
+// 2020RUNNER_REPORT_ONLY=1, and 2020RUNNER_<SETTING> overrides a config setting, e.g.
+// 2020RUNNER_SOFTWARE_VERSION=13.00.14000, 2020RUNNER_CATALOG_LINE=Residential or
+// 2020RUNNER_SHARES_USER=CORP\svc-2020. Settings are named after their element in
+// upper case with underscores between the words. Lists of keys take ; between
+// entries; lists of elements with attributes, like Rules and Hooks, can't be set.
+const ENV_PREFIX = "2020RUNNER_"
+
+// envName turns an XML name like MinFreeDiskMB or DSALogs into MIN_FREE_DISK_MB or
+// DSA_LOGS.
+func envName(name string) string {
+	r := []rune(name)
+	var b strings.Builder
+	caps := 0
+	for i, c := range r {
+		if unicode.IsUpper(c) {
+			// A word starts after a lower case letter, or with the last capital of an
+			// acronym of three or more, as in DSALogs but not TransferKBps.
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if i > 0 && (caps == 0 || (caps >= 3 && nextLower)) {
+				b.WriteByte('_')
+			}
+			caps++
+		} else {
+			caps = 0
+		}
+		b.WriteRune(unicode.ToUpper(c))
+	}
+	return b.String()
+}
+
+// ApplyEnvFlags sets each flag that wasn't given on the command line from its
+// 2020RUNNER_ variable, if there is one.
+func ApplyEnvFlags() error {
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		name := ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		v, ok := os.LookupEnv(name)
+		if given[f.Name] || !ok || err != nil {
+			return
+		}
+		if serr := flag.Set(f.Name, v); serr != nil {
+			err = errors.Wrapf(serr, "Cannot use %s", name)
+		}
+	})
+	return err
+}
+
+// ApplyEnvOverrides overrides the settings in c that have a 2020RUNNER_ variable.
+// Policy settings are left to ApplyEnvPolicy, since rules would override them here.
+func ApplyEnvOverrides(c *Config) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), ENV_PREFIX, false)
+}
+
+// ApplyEnvPolicy overrides the settings in p that have a 2020RUNNER_ variable.
+func ApplyEnvPolicy(p *Policy) error {
+	return applyEnv(reflect.ValueOf(p).Elem(), ENV_PREFIX, true)
+}
+
+// applyEnv sets the fields of v from the environment, including those of embedded
+// structs if embedded is set.
+func applyEnv(v reflect.Value, prefix string, embedded bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("xml")
+		if sf.Name == "XMLName" || tag == "-" || !sf.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" {
+			if embedded {
+				if err := applyEnv(v.Field(i), prefix, true); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		// For Hooks>Hook and the like, it's the outer element that names the setting.
+		name, _, _ = strings.Cut(name, ">")
+		key := prefix + envName(name)
+
+		f := v.Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := applyEnv(f, key+"_", true); err != nil {
+				return err
+			}
+			continue
+		}
+		s, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		err := setFromEnv(f, s)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot use %s", key)
+		}
+		Say("Using %s from the environment.", key)
+	}
+	return nil
+}
+
+func setFromEnv(f reflect.Value, s string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Ptr:
+		p := reflect.New(f.Type().Elem())
+		err := setFromEnv(p.Elem(), s)
+		if err != nil {
+			return err
+		}
+		f.Set(p)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return errors.New("This setting can't be set from the environment")
+		}
+		var list []string
+		for _, e := range strings.Split(s, ";") {
+			if e = strings.TrimSpace(e); e != "" {
+				list = append(list, e)
+			}
+		}
+		f.Set(reflect.ValueOf(list))
+	default:
+		return errors.New("This setting can't be set from the environment")
+	}
+	return nil
+}
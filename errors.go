@@ -0,0 +1,82 @@
+package main
+
+import "github.com/pkg/errors"
+import "net"
+import "os/exec"
+import "syscall"
+
+// Error categories, for the helpdesk to sort failures by without reading the details.
+const (
+	ERROR_NETWORK        = "NetworkError"
+	ERROR_ACCESS_DENIED  = "AccessDenied"
+	ERROR_INSTALLER      = "InstallerError"
+	ERROR_CORRUPT_STATE  = "CorruptState"
+	ERROR_POLICY_BLOCKED = "PolicyBlocked"
+	ERROR_OTHER          = "Other"
+)
+
+// What to try first for each category.
+var ERROR_HINTS = map[string]string{
+	ERROR_NETWORK:        "Check that the computer is on the office network or VPN and that the 2020 file server is up.",
+	ERROR_ACCESS_DENIED:  "Run the runner as an administrator, and check that the computer account can read the 2020 shares.",
+	ERROR_INSTALLER:      "The 2020 setup program failed. Look at its output above and in %TEMP%, then run the runner again.",
+	ERROR_CORRUPT_STATE:  "A file the runner or DSA keeps is damaged. Run 2020runner purge -yes and then the runner again.",
+	ERROR_POLICY_BLOCKED: "Software restriction or application control policy blocked a program. Ask for the 2020 shares to be allowed.",
+	ERROR_OTHER:          "Send the report or this output to the helpdesk.",
+}
+
+// A RunnerError puts err in a category. Hint overrides the category's usual hint.
+type RunnerError struct {
+	Category string
+	Hint     string
+	Err      error
+}
+
+func (e *RunnerError) Error() string { return e.Err.Error() }
+func (e *RunnerError) Cause() error  { return e.Err }
+func (e *RunnerError) Unwrap() error { return e.Err }
+
+// Categorize puts err in category, keeping any category it already has.
+func Categorize(category string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var re *RunnerError
+	if errors.As(err, &re) {
+		return err
+	}
+	return &RunnerError{Category: category, Err: err}
+}
+
+// Classify works out the category of err and the hint to go with it. An explicit
+// category wins; otherwise it's guessed from the Windows error underneath.
+func Classify(err error) (string, string) {
+	category := classify(err)
+	var re *RunnerError
+	if errors.As(err, &re) && re.Hint != "" {
+		return category, re.Hint
+	}
+	return category, ERROR_HINTS[category]
+}
+
+func classify(err error) string {
+	var re *RunnerError
+	if errors.As(err, &re) {
+		return re.Category
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return ERROR_INSTALLER
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if category := classifyErrno(errno); category != "" {
+			return category
+		}
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return ERROR_NETWORK
+	}
+	return ERROR_OTHER
+}
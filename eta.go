@@ -0,0 +1,82 @@
+package main
+
+import "context"
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+
+// Estimates come from the median of this many most recent runs of a phase on this
+// machine, and are only given for phases expected to take at least ETA_MIN.
+const (
+	ETA_SAMPLES = 5
+	ETA_MIN     = 2 * time.Minute
+)
+
+const FLEET_DURATIONS_TIMEOUT = 5 * time.Second
+
+var fleetOnce sync.Once
+var fleetDurations map[string]float64
+
+// fleetDuration returns the fleet's typical duration of phase from DurationsURL. It's
+// fetched once per run, and any trouble just means no estimate.
+func fleetDuration(phase string) (time.Duration, bool) {
+	if config.DurationsURL == "" {
+		return 0, false
+	}
+	fleetOnce.Do(func() {
+		tc, err := TrustConfig(config.ReportCA, config.ReportPin)
+		if err != nil {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), FLEET_DURATIONS_TIMEOUT)
+		defer cancel()
+		err = GetJSON(ctx, NewHTTPClient(tc), config.DurationsURL, &fleetDurations)
+		if err != nil {
+			Warn("Unable to get the fleet's phase durations: %v", err)
+		}
+	})
+	s, ok := fleetDurations[phase]
+	return time.Duration(s * float64(time.Second)), ok && s > 0
+}
+
+// EstimatePhase returns how long phase will probably take, from this machine's history
+// or else the fleet's, and which of the two it came from.
+func EstimatePhase(phase string) (time.Duration, string, bool) {
+	h, err := LoadHistory()
+	if err == nil {
+		var samples []float64
+		for i := len(h.Runs) - 1; i >= 0 && len(samples) < ETA_SAMPLES; i-- {
+			for _, p := range h.Runs[i].Phases {
+				if p.Name == phase {
+					samples = append(samples, p.Seconds)
+				}
+			}
+		}
+		if len(samples) > 0 {
+			sort.Float64s(samples)
+			return time.Duration(samples[len(samples)/2] * float64(time.Second)), "on this computer", true
+		}
+	}
+	if d, ok := fleetDuration(phase); ok {
+		return d, "on other computers", true
+	}
+	return 0, "", false
+}
+
+// SayETA tells the user how long phase is likely to take, if it's a long one.
+func SayETA(phase string) {
+	d, source, ok := EstimatePhase(phase)
+	if !ok || d < ETA_MIN {
+		return
+	}
+	Say("This usually takes about %s %s, so it should be done around %s.",
+		roundETA(d), source, time.Now().Add(d).Format(time.Kitchen))
+}
+
+func roundETA(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%d minutes", int(d.Round(time.Minute)/time.Minute))
+	}
+	return fmt.Sprintf("%.1f hours", d.Hours())
+}
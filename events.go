@@ -0,0 +1,141 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "fmt"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	EVENT_MESSAGE     = "message"
+	EVENT_WARNING     = "warning"
+	EVENT_PHASE_START = "phase-start"
+	EVENT_PHASE_END   = "phase-end"
+	EVENT_DONE        = "done"
+	// The run is waiting on the user, e.g. to finish an installer's wizard.
+	EVENT_PROMPT = "prompt"
+	// Detail for support cases, only there under -v or -vv.
+	EVENT_DEBUG = "debug"
+	// The countdown to a restart the run has scheduled, see AwaitReboot.
+	EVENT_REBOOT = "reboot"
+)
+
+// Where -pipe publishes the events, for 2020runner-gui.
+const PIPE_NAME = `\\.\pipe\2020runner`
+
+// How much detail a run shows, from -v, -vv or the config's LogLevel. Verbose adds the
+// registry values read and how each command ended, debug each command's output and the
+// XML files parsed.
+const (
+	LOG_NORMAL = iota
+	LOG_VERBOSE
+	LOG_DEBUG
+)
+
+var logLevelNames = []string{"normal", "verbose", "debug"}
+
+var logLevel = LOG_NORMAL
+
+// ParseLogLevel turns a LogLevel from the config into one of the LOG_ levels.
+func ParseLogLevel(s string) (int, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+	return LOG_NORMAL, errors.Errorf("Unknown log level %s, use one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+// An Event is one step of progress through the run, for anything following along
+// other than the console: the named pipe and the GUI front-end listening on it, the
+// log file and -output ndjson.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Phase   string    `json:"phase,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Step    int       `json:"step,omitempty"`
+	Steps   int       `json:"steps,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Hint    string    `json:"hint,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	// For EVENT_REBOOT, whether the user can call the restart off now.
+	Cancel bool `json:"cancel,omitempty"`
+}
+
+var eventsMu sync.Mutex
+var eventSinks []func(Event)
+
+// AddEventSink registers f to be called with every event from now on. Sinks are called
+// in order, one event at a time.
+func AddEventSink(f func(Event)) {
+	eventsMu.Lock()
+	eventSinks = append(eventSinks, f)
+	eventsMu.Unlock()
+}
+
+func Emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for _, f := range eventSinks {
+		f(e)
+	}
+}
+
+// Say prints a progress message to the console and passes it on as an event.
+func Say(format string, a ...interface{}) {
+	m := fmt.Sprintf(format, a...)
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_MESSAGE, Message: m})
+}
+
+// Warn is Say for things that went wrong but don't stop the run.
+func Warn(format string, a ...interface{}) {
+	m := fmt.Sprintf(format, a...)
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_WARNING, Message: m})
+}
+
+// Verbose is Say for detail that only shows under -v and up.
+func Verbose(format string, a ...interface{}) {
+	sayAt(LOG_VERBOSE, format, a...)
+}
+
+// Debug is Say for detail that only shows under -vv.
+func Debug(format string, a ...interface{}) {
+	sayAt(LOG_DEBUG, format, a...)
+}
+
+func sayAt(level int, format string, a ...interface{}) {
+	if logLevel < level {
+		return
+	}
+	m := fmt.Sprintf(format, a...)
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_DEBUG, Message: m})
+}
+
+// DebugXML shows v as XML under -vv, for the files the runner parses.
+func DebugXML(what string, v interface{}) {
+	if logLevel < LOG_DEBUG {
+		return
+	}
+	b, err := xml.MarshalIndent(v, "  ", "  ")
+	if err != nil {
+		Debug("%s: %v", what, err)
+		return
+	}
+	Debug("%s:\n  %s", what, b)
+}
+
+// SayStep is Say for the start of step n of steps, so a front-end can show how far
+// along the run is.
+func SayStep(step, steps int, format string, a ...interface{}) {
+	m := fmt.Sprintf(format, a...)
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_MESSAGE, Message: m, Step: step, Steps: steps})
+}
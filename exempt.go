@@ -0,0 +1,87 @@
+package main
+
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+// Some computers have to keep things as they are, like the lab and demo machines that
+// work off their own catalog, and runs on them only report that. An exemption can be
+// asked for in three places: the policy's Exempt, usually from a rule; the Exempt value
+// under HKLM\SOFTWARE\2020runner, for whoever looks after the machine; or this file in
+// the runner data folder, whose text says why.
+const EXEMPT_MARKER = "exempt.txt"
+
+// An Exemption is why a computer is exempt, and where that was said.
+type Exemption struct {
+	Reason string
+	Source string
+}
+
+func (e Exemption) String() string {
+	if e.Reason == "" {
+		return "set in the " + e.Source
+	}
+	return fmt.Sprintf("%s, set in the %s", e.Reason, e.Source)
+}
+
+// FindExemption returns the exemption for this computer, if it has one.
+func FindExemption() (Exemption, bool) {
+	if policy.Exempt != "" {
+		return Exemption{Reason: policy.Exempt, Source: "config"}, true
+	}
+	if reason, ok := exemptionFlag(); ok {
+		return Exemption{Reason: reason, Source: `registry (HKLM\` + HEALTH_KEY + `)`}, true
+	}
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return Exemption{}, false
+	}
+	path := filepath.Join(dir, EXEMPT_MARKER)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Exemption{}, false
+	}
+	return Exemption{Reason: firstLine(string(b)), Source: "marker file " + path}, true
+}
+
+// firstLine returns the first line of s with anything non-blank on it.
+func firstLine(s string) string {
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			return l
+		}
+	}
+	return ""
+}
+
+// ExemptRun ends a run on an exempt computer without doing anything. What a run would
+// have done still goes in the report, so that the machines left alone can be told
+// apart from the ones that are up to date.
+func ExemptRun(p Plan, e Exemption) Result {
+	Say("This computer is exempt: %s.", e)
+	report.Exempt = e.String()
+	report.Installed = p.State.SoftwareVersion
+	report.OtherVersions = p.State.OtherVersions
+	if p.State.SoftwareInstalled && (p.State.SoftwareCurrent || p.State.HoldingFallback()) {
+		report.Catalog = catalogStateNames[p.State.CatalogState]
+	}
+	report.Planned, report.Hold = p.Actions, p.Hold
+	if len(p.Actions) > 0 {
+		Say("Without the exemption, the run would:")
+		p.Print()
+	}
+	NoteChecked("Exempt, so nothing was changed")
+	return Succeeded("Exempt — no action. " + exemptionHelp(e))
+}
+
+// exemptionHelp says how to lift the exemption e.
+func exemptionHelp(e Exemption) string {
+	switch {
+	case e.Source == "config":
+		return "Take the computer out of the config's Exempt rule to manage it again."
+	case strings.HasPrefix(e.Source, "registry"):
+		return `Delete the Exempt value under HKLM\` + HEALTH_KEY + " to manage it again."
+	}
+	return "Delete the " + strings.TrimPrefix(e.Source, "marker file ") + " file to manage it again."
+}
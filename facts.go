@@ -0,0 +1,137 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "fmt"
+import "os"
+import "strings"
+import "time"
+import "unsafe"
+
+var (
+	procGlobalMemoryStatusEx = modkernel32.NewProc("GlobalMemoryStatusEx")
+	procGetTickCount64       = modkernel32.NewProc("GetTickCount64")
+)
+
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+const (
+	WINDOWS_VERSION_KEY  = `SOFTWARE\Microsoft\Windows NT\CurrentVersion`
+	DOTNET_FRAMEWORK_KEY = `SOFTWARE\Microsoft\NET Framework Setup\NDP`
+	// The .NET installers keep this in the 32-bit view of the registry on every platform.
+	DOTNET_RUNTIMES_KEY = `SOFTWARE\dotnet\Setup\InstalledVersions\%s\sharedfx\Microsoft.NETCore.App`
+)
+
+// CollectSystemFacts gathers what there is to know about the computer itself, so that
+// failures can be lined up against Windows builds and the like. Anything that can't
+// be read is left out.
+func CollectSystemFacts() *SystemFacts {
+	f := &SystemFacts{}
+	v := windows.RtlGetVersion()
+	f.Build = fmt.Sprintf("%d.%d.%d", v.MajorVersion, v.MinorVersion, v.BuildNumber)
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, WINDOWS_VERSION_KEY, registry.QUERY_VALUE)
+	if err == nil {
+		f.OS, _, _ = k.GetStringValue("ProductName")
+		// Windows 11 still calls itself Windows 10 here.
+		if v.BuildNumber >= 22000 {
+			f.OS = strings.Replace(f.OS, "Windows 10", "Windows 11", 1)
+		}
+		release, _, err := k.GetStringValue("DisplayVersion")
+		if err != nil {
+			release, _, _ = k.GetStringValue("ReleaseId")
+		}
+		if release != "" {
+			f.OS += " " + release
+		}
+		if ubr, _, err := k.GetIntegerValue("UBR"); err == nil {
+			f.Build += fmt.Sprintf(".%d", ubr)
+		}
+		k.Close()
+	}
+
+	k, err = registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Control\Session Manager\Environment`, registry.QUERY_VALUE)
+	if err == nil {
+		f.Arch, _, _ = k.GetStringValue("PROCESSOR_ARCHITECTURE")
+		k.Close()
+	}
+
+	drive := os.Getenv("SystemDrive") + `\`
+	if free, err := diskFree(drive); err == nil {
+		f.FreeDiskMB = free / (1024 * 1024)
+	}
+	m := memoryStatusEx{Length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&m))); r != 0 {
+		f.MemoryMB = m.TotalPhys / (1024 * 1024)
+	}
+
+	n := uint32(256)
+	buf := make([]uint16, n)
+	if windows.GetComputerNameEx(windows.ComputerNameDnsDomain, &buf[0], &n) == nil {
+		f.Domain = windows.UTF16ToString(buf[:n])
+	}
+
+	r1, r2, _ := procGetTickCount64.Call()
+	ms := uint64(r1)
+	if unsafe.Sizeof(r1) == 4 {
+		ms |= uint64(r2) << 32
+	}
+	f.LastBoot = time.Now().Add(-time.Duration(ms) * time.Millisecond).Round(time.Second)
+
+	f.DotNet = dotNetVersions()
+	return f
+}
+
+// dotNetVersions lists the .NET Framework versions installed, then the .NET (Core)
+// runtimes.
+func dotNetVersions() []string {
+	var versions []string
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, DOTNET_FRAMEWORK_KEY, registry.ENUMERATE_SUB_KEYS)
+	if err == nil {
+		names, _ := k.ReadSubKeyNames(-1)
+		k.Close()
+		for _, name := range names {
+			if !strings.HasPrefix(name, "v") {
+				continue
+			}
+			// 4.x keeps its version under Full, the older ones in their own key.
+			for _, sub := range []string{name + `\Full`, name} {
+				sk, err := registry.OpenKey(registry.LOCAL_MACHINE, DOTNET_FRAMEWORK_KEY+`\`+sub, registry.QUERY_VALUE)
+				if err != nil {
+					continue
+				}
+				v, _, err := sk.GetStringValue("Version")
+				sk.Close()
+				if err == nil {
+					versions = append(versions, "Framework "+v)
+					break
+				}
+			}
+		}
+	}
+
+	for _, arch := range []string{"x64", "arm64", "x86"} {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, fmt.Sprintf(DOTNET_RUNTIMES_KEY, arch),
+			registry.QUERY_VALUE|registry.WOW64_32KEY)
+		if err != nil {
+			continue
+		}
+		names, _ := k.ReadValueNames(-1)
+		k.Close()
+		for _, v := range names {
+			versions = append(versions, fmt.Sprintf("%s (%s)", v, arch))
+		}
+	}
+	return versions
+}
@@ -0,0 +1,81 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "io"
+import "os"
+import "path/filepath"
+
+// CopyTree copies the contents of src into dst, creating folders as needed. Paths for
+// which skip returns true are left out, along with everything below them.
+func CopyTree(ctx context.Context, src, dst string, skip func(path string) bool) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if skip != nil && skip(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return CopyFile(ctx, path, target)
+	})
+}
+
+// CopyFile copies src to dst, keeping the modification time. Cancelling ctx stops the
+// copy part way through a file.
+func CopyFile(ctx context.Context, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open %s", src)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot stat %s", src)
+	}
+
+	err = os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create folder for %s", dst)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(FileAccessError(err, dst), "Cannot create %s", dst)
+	}
+	_, err = io.Copy(out, ctxReader{ctx, in})
+	cerr := out.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot copy %s", src)
+	}
+	if cerr != nil {
+		return errors.Wrapf(cerr, "Cannot write %s", dst)
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,71 @@
+package main
+
+import "fmt"
+import "strings"
+import "time"
+
+// The fixes that undo something a user or another tool can do again, like
+// reinstalling the local catalog, and so can end up being made over and over. The
+// software steps are left out: an upgrade takes them over several runs anyway.
+var flapActions = map[string]bool{
+	ACTION_REMOVE_OTHER_VERSIONS: true,
+	ACTION_UNINSTALL_CATALOG:     true,
+	ACTION_REPAIR_CATALOG:        true,
+	ACTION_INSTALL_CATALOG:       true,
+	ACTION_SYNC_GRANULES:         true,
+}
+
+// Set by -ignore-flapping.
+var ignoreFlapping bool
+
+// flapping returns the actions of p that runs in h have already made policy.FlapLimit
+// times since since, with how many times.
+func flapping(h History, p Plan, since time.Time) map[string]int {
+	counts := map[string]int{}
+	for _, r := range h.Runs {
+		if r.Outcome != OUTCOME_SUCCESS || r.Time.Before(since) {
+			continue
+		}
+		for _, a := range strings.Split(r.Actions, ",") {
+			if flapActions[a] && p.has(a) {
+				counts[a]++
+			}
+		}
+	}
+	for a, n := range counts {
+		if n < int(policy.FlapThreshold()) {
+			delete(counts, a)
+		}
+	}
+	return counts
+}
+
+// CheckFlapping holds the run off if the plan would make a fix that keeps coming
+// undone, so that someone finds out what undoes it rather than the runner making it
+// again every run without anyone noticing.
+func CheckFlapping(p Plan) (Result, bool) {
+	if ignoreFlapping || policy.FlapThreshold() == 0 {
+		return Result{}, true
+	}
+	h, err := LoadHistory()
+	if err != nil {
+		Warn("Not checking for fixes that keep coming undone: %v", err)
+		return Result{}, true
+	}
+	counts := flapping(h, p, time.Now().AddDate(0, 0, -int(policy.FlapDays)))
+	if len(counts) == 0 {
+		return Result{}, true
+	}
+
+	var actions, flaps []string
+	for _, a := range p.Actions {
+		if n, ok := counts[a]; ok {
+			actions = append(actions, a)
+			flaps = append(flaps, fmt.Sprintf("%s %d times", a, n))
+		}
+	}
+	report.Flapping = flaps
+	NoteRemaining("Find out what keeps undoing "+strings.Join(actions, " and "), RerunCommand("-ignore-flapping"))
+	return Flapping(fmt.Sprintf("This computer keeps drifting back: in the last %d days the runner already did %s. It was left alone this time.",
+		policy.FlapDays, strings.Join(flaps, " and "))), false
+}
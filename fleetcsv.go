@@ -0,0 +1,66 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/csv"
+import "math/rand"
+import "strings"
+import "time"
+
+// How many times a run tries to get the FleetCSV to itself, and about how long it waits
+// in between. Machines started together all finish at much the same time.
+const (
+	FLEET_CSV_ATTEMPTS = 20
+	FLEET_CSV_RETRY    = time.Second
+)
+
+var errFileBusy = errors.New("The file is in use")
+
+var FLEET_CSV_HEADER = []string{"Hostname", "Time", "Installed", "Target", "Outcome", "Catalog", "Actions", "Message"}
+
+// AppendFleetCSV adds a row for this run to the FleetCSV, for shops without anything
+// to collect reports with: everyone's runs end up in one file they can open in Excel.
+// The file is held exclusively while the row is added, so that two machines can't
+// interleave theirs; whoever finds it in use, someone with it open in Excel included,
+// tries again a little later.
+func AppendFleetCSV() error {
+	path := config.FleetCSV
+	err := ConnectShare(path)
+	if err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		err = appendFleetRow(path)
+		if err != errFileBusy {
+			return err
+		}
+		if attempt >= FLEET_CSV_ATTEMPTS {
+			return errors.Wrapf(err, "Cannot add to %s, it's been in use for the last %d tries", path, attempt)
+		}
+		time.Sleep(FLEET_CSV_RETRY/2 + time.Duration(rand.Int63n(int64(FLEET_CSV_RETRY))))
+	}
+}
+
+func appendFleetRow(path string) error {
+	f, err := openExclusive(path)
+	if err != nil {
+		if err == errFileBusy {
+			return err
+		}
+		return errors.Wrapf(FileAccessError(err, path), "Cannot open %s", path)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot open %s", path)
+	}
+
+	w := csv.NewWriter(f)
+	w.UseCRLF = true
+	if fi.Size() == 0 {
+		w.Write(FLEET_CSV_HEADER)
+	}
+	w.Write([]string{report.Hostname, report.Finished.Format("2006-01-02 15:04:05"), report.Installed,
+		policy.SoftwareVersion, report.Outcome, report.Catalog, strings.Join(report.Actions, ", "), report.Message})
+	w.Flush()
+	return errors.Wrapf(w.Error(), "Cannot write to %s", path)
+}
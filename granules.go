@@ -0,0 +1,179 @@
+package main
+
+import "github.com/pkg/errors"
+import "bufio"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+
+// LoadMasterGranules reads the MasterGranules list: the manufacturer codes every
+// machine of the catalog line should have selected, one to a line, as MfgCode or
+// MfgCode/PlatformType, with # starting a comment. Codes for other platform types are
+// left out. A relative path is relative to the catalog share root.
+//
+//	# Commercial catalogs for the design team
+//	KFI
+//	HAF/CAP
+func LoadMasterGranules() ([]string, error) {
+	path := policy.MasterGranules
+	if !filepath.IsAbs(path) && !strings.HasPrefix(path, `\\`) {
+		path = filepath.Join(filepath.Dir(filepath.Dir(policy.CatalogSetup)), path)
+	}
+	err := ConnectShare(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read the master granule list")
+	}
+	defer f.Close()
+
+	platform := policy.Catalog().PlatformType
+	var codes []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ToUpper(strings.TrimSpace(line))
+		if line == "" {
+			continue
+		}
+		mfg, p, found := strings.Cut(line, "/")
+		if found && p != strings.ToUpper(platform) {
+			continue
+		}
+		if !mfgCodePattern.MatchString(mfg) {
+			return nil, errors.Errorf("%s has an odd manufacturer code %q", path, line)
+		}
+		codes = append(codes, mfg)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.Wrap(err, "Cannot read the master granule list")
+	}
+	return codes, nil
+}
+
+// granuleChanges works out which of master s is missing for the deployed line, and
+// which it has selected that master doesn't list, both as sorted, comma separated
+// MfgCodes. The sentinel granules are left out either way: selecting one would make
+// the catalog count as installed locally.
+func granuleChanges(s *DSACatalogState, master []string) (string, string) {
+	platform := policy.Catalog().PlatformType
+	sentinel := map[string]bool{}
+	for _, g := range policy.Sentinels() {
+		sentinel[g] = true
+	}
+	listed := map[string]bool{}
+	var add, remove []string
+	for _, mfg := range master {
+		listed[mfg] = true
+		if !sentinel[mfg+"/"+platform] && !granuleSelected(s, mfg, platform) && !contains(add, mfg) {
+			add = append(add, mfg)
+		}
+	}
+	for _, g := range s.GranulePicks {
+		mfg := strings.ToUpper(g.MfgCode)
+		if g.SelectionState == `Selected` && strings.EqualFold(g.PlatformType, platform) && !listed[mfg] && !sentinel[mfg+"/"+platform] {
+			remove = append(remove, mfg)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(remove)
+	return strings.Join(add, ","), strings.Join(remove, ",")
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// probeGranules compares the catalog selection with the master list, if there is one.
+func probeGranules(ctx context.Context) (CheckResult, func(*Preflight)) {
+	r := CheckResult{Name: "Granules", OK: true, Detail: "no master list"}
+	if policy.MasterGranules == "" {
+		return r, func(*Preflight) {}
+	}
+	master, err := LoadMasterGranules()
+	var s *DSACatalogState
+	if err == nil {
+		s, err = LoadDSAState()
+	}
+	if err != nil {
+		r.OK, r.Detail = false, err.Error()
+		return r, func(*Preflight) {}
+	}
+	if s == nil {
+		r.Detail = "no catalog"
+		return r, func(*Preflight) {}
+	}
+	add, remove := granuleChanges(s, master)
+	var differences []string
+	if add != "" {
+		differences = append(differences, "missing "+add)
+	}
+	if remove != "" {
+		differences = append(differences, "retired "+remove)
+	}
+	r.OK, r.Detail = len(differences) == 0, "same as the master list"
+	if !r.OK {
+		r.Detail = strings.Join(differences, "; ")
+	}
+	return r, func(pf *Preflight) { pf.GranulesToAdd, pf.GranulesToRemove = add, remove }
+}
+
+// SyncGranules brings the catalog selection in line with the master list through
+// dsa.exe, adding the missing manufacturers first and then removing the retired ones.
+func SyncGranules(ctx context.Context) error {
+	master, err := LoadMasterGranules()
+	if err != nil {
+		return err
+	}
+	s, err := LoadDSAState()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errors.New("DSA has no catalog to bring in line")
+	}
+	add, remove := granuleChanges(s, master)
+	for _, c := range []struct{ op, codes string }{{"add", add}, {"remove", remove}} {
+		if c.codes == "" {
+			continue
+		}
+		op := catalogOperations[c.op]
+		for _, mfg := range strings.Split(c.codes, ",") {
+			before := stampDSAState()
+			Say("%s...", fmt.Sprintf(op.Title, mfg))
+			err = RunPhase(ctx, op.Phase, func(ctx context.Context) error {
+				return runCatalogOperation(ctx, op, mfg)
+			})
+			if err != nil {
+				return err
+			}
+			WaitForDSAStateChange(ctx, before)
+		}
+	}
+
+	s, err = LoadDSAState()
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return errors.New("DSA has no catalog after bringing it in line")
+	}
+	add, remove = granuleChanges(s, master)
+	if add != "" || remove != "" {
+		return errors.Errorf("dsa.exe finished, but the selection still differs from the master list (missing %q, retired %q)", add, remove)
+	}
+	return nil
+}
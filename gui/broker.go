@@ -0,0 +1,32 @@
+//go:build windows
+
+package main
+
+import "encoding/json"
+import "os"
+
+// Where the 2020runner service takes requests for a run, for users who can't start
+// the runner elevated themselves.
+const BROKER_PIPE_NAME = `\\.\pipe\2020runner-broker`
+
+type brokerRequest struct {
+	Command string `json:"command"`
+}
+
+// askBroker asks the 2020runner service for a run, "check" or "run", and returns the
+// pipe the run's events come back on. It fails if the service isn't installed.
+func askBroker(command string) (*os.File, error) {
+	f, err := os.OpenFile(BROKER_PIPE_NAME, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(brokerRequest{Command: command})
+	if err == nil {
+		_, err = f.Write(append(b, '\n'))
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,197 @@
+//go:build windows
+
+// Command 2020runner-gui shows the progress of a 2020runner run in a window. Start the
+// runner with -pipe and it publishes its events on a named pipe; this just follows
+// along, so it can run as the logged-on user while the runner itself runs as SYSTEM
+// from a scheduled task or a deployment tool.
+//
+// With -tray it stays in the notification area instead, showing the result of the last
+// run on hover. From its menu the user can run a check straight away, or snooze a
+// pending remediation for a few hours.
+//
+// Where the runner is installed as the 2020runner service, users without admin rights
+// can have it run: the tray asks the service rather than starting the runner elevated,
+// and -request check or -request run does the same from a shortcut.
+//
+// When the runner has scheduled a restart, the window counts down to it, and while
+// Windows is warning about it, lets the user put it off if the runner's policy does.
+//
+// Build it with the manifest embedded, so it gets visual styles:
+//
+//	rsrc -manifest 2020runner-gui.manifest -o rsrc.syso
+//	go build -ldflags -H=windowsgui
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/ispaceenvironments/2020runner/winui"
+import "github.com/lxn/win"
+import "bufio"
+import "flag"
+import "encoding/json"
+import "io"
+import "os"
+import "time"
+
+const PIPE_NAME = `\\.\pipe\2020runner`
+
+var (
+	modadvapi32              = windows.NewLazySystemDLL("advapi32.dll")
+	procAbortSystemShutdownW = modadvapi32.NewProc("AbortSystemShutdownW")
+)
+
+// Event matches the runner's Event, as far as the window cares.
+type Event struct {
+	Type    string `json:"type"`
+	Phase   string `json:"phase"`
+	Message string `json:"message"`
+	Step    int    `json:"step"`
+	Steps   int    `json:"steps"`
+	Outcome string `json:"outcome"`
+	Hint    string `json:"hint"`
+	Cancel  bool   `json:"cancel"`
+}
+
+type progressWindow struct {
+	*winui.Window
+	status   *winui.Control
+	progress *winui.Control
+	log      *winui.Control
+	putOff   *winui.Control
+}
+
+func newProgressWindow() *progressWindow {
+	w := &progressWindow{Window: winui.NewWindow("2020 Software Update", 480, 300)}
+	w.status = w.AddLabel("Waiting for the 2020 update to start...", 12, 12, 456, 20)
+	w.progress = w.AddProgress(12, 38, 456, 18)
+	w.log = w.AddLog(12, 66, 456, 190)
+	w.putOff = w.AddButton("Put off the restart", 12, 266, 160, 24, w.abortRestart)
+	w.putOff.Show(false)
+	w.AddButton("Close", 388, 266, 80, 24, func() { w.Close() })
+	return w
+}
+
+// abortRestart calls off the restart the runner has scheduled, which it then puts
+// off or tries again as the admins have set it to.
+func (w *progressWindow) abortRestart() {
+	err := enableShutdownPrivilege()
+	if err == nil {
+		if r, _, e := procAbortSystemShutdownW.Call(0); r == 0 {
+			err = e
+		}
+	}
+	if err != nil {
+		winui.MessageBox(w.Window, "2020 Software Update", "The restart couldn't be called off: "+err.Error(), win.MB_OK|win.MB_ICONERROR)
+		return
+	}
+	w.putOff.Show(false)
+	w.status.SetText("The restart was called off.")
+}
+
+// enableShutdownPrivilege enables the privilege calling a restart off takes, which
+// users hold on workstations but don't have enabled.
+func enableShutdownPrivilege() error {
+	var t windows.Token
+	err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ADJUST_PRIVILEGES|windows.TOKEN_QUERY, &t)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	var luid windows.LUID
+	err = windows.LookupPrivilegeValue(nil, windows.StringToUTF16Ptr("SeShutdownPrivilege"), &luid)
+	if err != nil {
+		return err
+	}
+	tp := windows.Tokenprivileges{PrivilegeCount: 1}
+	tp.Privileges[0] = windows.LUIDAndAttributes{Luid: luid, Attributes: windows.SE_PRIVILEGE_ENABLED}
+	return windows.AdjustTokenPrivileges(t, false, &tp, 0, nil, nil)
+}
+
+// follow reads events from the runner until it finishes, waiting for the pipe to
+// show up if the runner hasn't started yet.
+func (w *progressWindow) follow() {
+	for {
+		f, err := os.Open(PIPE_NAME)
+		if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		w.read(f)
+		f.Close()
+		return
+	}
+}
+
+// read shows the events from r until the run is over.
+func (w *progressWindow) read(r io.Reader) {
+	done := false
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var e Event
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		done = done || e.Type == "done"
+		w.Invoke(func() { w.show(e) })
+	}
+	if !done {
+		w.Invoke(func() { w.status.SetText("The 2020 update stopped without finishing.") })
+	}
+}
+
+func (w *progressWindow) show(e Event) {
+	switch e.Type {
+	case "message", "warning", "prompt":
+		w.log.Append(e.Message)
+		if e.Steps > 0 {
+			w.status.SetText(e.Message)
+			w.progress.SetProgress(e.Step-1, e.Steps)
+		}
+	case "reboot":
+		w.status.SetText(e.Message)
+		w.log.Append(e.Message)
+		w.putOff.Show(e.Cancel)
+	case "phase-start":
+		if e.Phase == "Detection" {
+			w.status.SetText("Checking this computer...")
+		}
+	case "done":
+		w.progress.SetProgress(1, 1)
+		w.status.SetText(e.Message)
+		icon := uint32(win.MB_ICONINFORMATION)
+		if e.Outcome != "success" {
+			icon = win.MB_ICONWARNING
+		}
+		m := e.Message
+		if e.Hint != "" {
+			m += "\n\n" + e.Hint
+		}
+		winui.MessageBox(w.Window, "2020 Software Update", m, win.MB_OK|icon)
+	}
+}
+
+func main() {
+	tray := flag.Bool("tray", false, "Sit in the notification area")
+	request := flag.String("request", "", "Ask the 2020runner service for a run, check or run, and show how it goes")
+	flag.Parse()
+
+	if *tray {
+		newTrayAgent().Run()
+		return
+	}
+	w := newProgressWindow()
+	if *request != "" {
+		f, err := askBroker(*request)
+		if err != nil {
+			winui.MessageBox(nil, "2020 Software Update", "The 2020runner service isn't available: "+err.Error(), win.MB_OK|win.MB_ICONERROR)
+			return
+		}
+		defer f.Close()
+		w.Show()
+		go w.read(f)
+		w.Run()
+		return
+	}
+	w.Show()
+	go w.follow()
+	w.Run()
+}
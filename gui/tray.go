@@ -0,0 +1,186 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/ispaceenvironments/2020runner/winui"
+import "github.com/lxn/win"
+import "encoding/json"
+import "encoding/xml"
+import "fmt"
+import "os"
+import "path/filepath"
+import "syscall"
+import "time"
+
+const SNOOZE_FOR = 4 * time.Hour
+
+// How often the tooltip is brought up to date with the last run.
+const TRAY_REFRESH = time.Minute
+
+// LastRun is the part of the runner's last-run.json the tray shows.
+type LastRun struct {
+	Finished time.Time `json:"finished"`
+	Outcome  string    `json:"outcome"`
+	Hint     string    `json:"hint"`
+	Message  string    `json:"message"`
+}
+
+// Snooze matches the runner's snooze.xml.
+type Snooze struct {
+	XMLName xml.Name  `xml:"Snooze"`
+	Until   time.Time `xml:"Until,attr"`
+	User    string    `xml:"User,attr,omitempty"`
+}
+
+func runnerDataDir() (string, error) {
+	pd, err := windows.KnownFolderPath(windows.FOLDERID_ProgramData, 0)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(pd, "2020runner"), nil
+}
+
+func loadLastRun() (LastRun, bool) {
+	var r LastRun
+	dir, err := runnerDataDir()
+	if err != nil {
+		return r, false
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "last-run.json"))
+	if err != nil {
+		return r, false
+	}
+	return r, json.Unmarshal(b, &r) == nil
+}
+
+func loadSnooze() Snooze {
+	var s Snooze
+	dir, err := runnerDataDir()
+	if err == nil {
+		b, err := os.ReadFile(filepath.Join(dir, "snooze.xml"))
+		if err == nil {
+			xml.Unmarshal(b, &s)
+		}
+	}
+	return s
+}
+
+// saveSnooze puts off remediation until the given time. Users can create files in
+// the runner's folder under ProgramData, but not change the ones the runner wrote,
+// which is why this has a file of its own.
+func saveSnooze(until time.Time) error {
+	dir, err := runnerDataDir()
+	if err != nil {
+		return err
+	}
+	b, err := xml.MarshalIndent(Snooze{Until: until, User: os.Getenv("USERNAME")}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "snooze.xml"), b, 0644)
+}
+
+func clearSnooze() {
+	dir, err := runnerDataDir()
+	if err == nil {
+		os.Remove(filepath.Join(dir, "snooze.xml"))
+	}
+}
+
+type trayAgent struct {
+	*winui.Window
+	icon *winui.TrayIcon
+}
+
+func newTrayAgent() *trayAgent {
+	t := &trayAgent{Window: winui.NewWindow("2020 Software Update", 0, 0)}
+	t.icon = t.AddTrayIcon("2020 Software Update")
+	t.icon.Menu = t.menu
+	t.icon.OnDoubleClick = t.checkNow
+	t.refresh()
+	t.Every(TRAY_REFRESH, t.refresh)
+	return t
+}
+
+func (t *trayAgent) status() string {
+	r, ok := loadLastRun()
+	s := ""
+	switch {
+	case !ok:
+		s = "2020 updates haven't run on this computer yet."
+	case r.Outcome == "success":
+		s = "2020 software is up to date (checked " + r.Finished.Format("Jan 2 3:04 PM") + ")."
+	default:
+		s = "2020 software needs attention: " + r.Message
+		if r.Hint != "" {
+			s += " " + r.Hint
+		}
+	}
+	if sn := loadSnooze(); time.Now().Before(sn.Until) {
+		s = fmt.Sprintf("Snoozed until %s. %s", sn.Until.Format(time.Kitchen), s)
+	}
+	return s
+}
+
+func (t *trayAgent) refresh() {
+	t.icon.SetTip(t.status())
+}
+
+func (t *trayAgent) menu() []winui.MenuItem {
+	r, ok := loadLastRun()
+	pending := ok && r.Outcome != "success"
+	snoozed := time.Now().Before(loadSnooze().Until)
+	return []winui.MenuItem{
+		{Text: "Check for 2020 updates now", OnClick: t.checkNow},
+		{Text: fmt.Sprintf("Snooze for %d hours", int(SNOOZE_FOR.Hours())), Disabled: !pending || snoozed, OnClick: t.snooze},
+		{},
+		{Text: "Exit", OnClick: func() {
+			t.icon.Remove()
+			t.Destroy()
+		}},
+	}
+}
+
+// checkNow has the 2020runner service do a run, or without the service runs 2020runner
+// from next to this program, elevated, and follows it in a progress window. Checking
+// now is an explicit ask to go ahead, so it ends any snooze.
+func (t *trayAgent) checkNow() {
+	clearSnooze()
+	f, err := askBroker("run")
+	if err != nil {
+		exe, err := os.Executable()
+		if err != nil {
+			winui.MessageBox(nil, "2020 Software Update", err.Error(), win.MB_OK|win.MB_ICONERROR)
+			return
+		}
+		runner := filepath.Join(filepath.Dir(exe), "2020runner.exe")
+		ok := win.ShellExecute(t.HWND(), syscall.StringToUTF16Ptr("runas"), syscall.StringToUTF16Ptr(runner),
+			syscall.StringToUTF16Ptr("-pipe"), syscall.StringToUTF16Ptr(filepath.Dir(runner)), win.SW_SHOWMINNOACTIVE)
+		if !ok {
+			return
+		}
+	}
+	w := newProgressWindow()
+	w.OnClose = func() bool {
+		t.refresh()
+		return true
+	}
+	w.Show()
+	if f == nil {
+		go w.follow()
+		return
+	}
+	go func() {
+		w.read(f)
+		f.Close()
+	}()
+}
+
+func (t *trayAgent) snooze() {
+	err := saveSnooze(time.Now().Add(SNOOZE_FOR))
+	if err != nil {
+		winui.MessageBox(nil, "2020 Software Update", "Unable to snooze: "+err.Error(), win.MB_OK|win.MB_ICONERROR)
+	}
+	t.refresh()
+}
@@ -0,0 +1,101 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "encoding/json"
+import "net"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// While watching, the runner keeps these values under HKLM up to date for monitoring
+// to poll: Heartbeat every HEARTBEAT_INTERVAL, and LastEvaluated and LastOutcome after
+// each compliance check.
+const (
+	HEALTH_KEY         = `SOFTWARE\2020runner`
+	HEARTBEAT_INTERVAL = time.Minute
+)
+
+type Health struct {
+	PID           int       `json:"pid"`
+	Started       time.Time `json:"started"`
+	Heartbeat     time.Time `json:"heartbeat"`
+	LastEvaluated time.Time `json:"lastEvaluated,omitempty"`
+	LastOutcome   string    `json:"lastOutcome,omitempty"`
+}
+
+var healthMu sync.Mutex
+var health = Health{PID: os.Getpid(), Started: time.Now()}
+
+// Evaluated records the outcome of a compliance check from its exit code.
+func Evaluated(code int) {
+	healthMu.Lock()
+	health.LastEvaluated = time.Now()
+	health.LastOutcome = exitOutcomes[code]
+	if health.LastOutcome == "" {
+		health.LastOutcome = OUTCOME_ERROR
+	}
+	healthMu.Unlock()
+	writeHeartbeat()
+}
+
+func writeHeartbeat() {
+	healthMu.Lock()
+	health.Heartbeat = time.Now()
+	h := health
+	healthMu.Unlock()
+
+	err := saveHealth(h)
+	if err != nil {
+		Warn("Unable to write the heartbeat: %v", err)
+	}
+}
+
+// StartHealth keeps the heartbeat going until ctx is done. With addr set, it also
+// answers GET /health on addr with the same as JSON; addr has to be a loopback
+// address, since there's no authentication.
+func StartHealth(ctx context.Context, addr string) error {
+	if addr != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot parse health address %s", addr)
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return errors.Errorf("The health address %s isn't a loopback address", addr)
+		}
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot listen on %s", addr)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			healthMu.Lock()
+			h := health
+			healthMu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(h)
+		})
+		srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+		go srv.Serve(l)
+		go func() {
+			<-ctx.Done()
+			srv.Close()
+		}()
+	}
+
+	writeHeartbeat()
+	go func() {
+		t := time.NewTicker(HEARTBEAT_INTERVAL)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				writeHeartbeat()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import "context"
+import "encoding/xml"
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+import "text/tabwriter"
+import "time"
+
+// The run database keeps this many runs; older ones drop off the front.
+const HISTORY_MAX = 1000
+
+// A HistoryEntry is one run that could have changed the machine. Earlier versions kept
+// them in history.xml, which the run database takes over.
+type HistoryEntry struct {
+	Time      time.Time      `xml:"Time,attr"`
+	Outcome   string         `xml:"Outcome,attr"`
+	Installed string         `xml:"Installed,attr,omitempty"`
+	Target    string         `xml:"Target,attr,omitempty"`
+	Catalog   string         `xml:"Catalog,attr,omitempty"`
+	Actions   string         `xml:"Actions,attr,omitempty"`
+	Message   string         `xml:"Message"`
+	Error     string         `xml:"Error,omitempty"`
+	Phases    []HistoryPhase `xml:"Phase"`
+}
+
+// A HistoryPhase is how long one phase of a run took, for estimating the next one.
+type HistoryPhase struct {
+	Name    string  `xml:"Name,attr"`
+	Seconds float64 `xml:"Seconds,attr"`
+}
+
+type History struct {
+	XMLName xml.Name       `xml:"History"`
+	Runs    []HistoryEntry `xml:"Run"`
+}
+
+// LoadHistory reads the runs recorded in the run database, oldest first.
+func LoadHistory() (History, error) {
+	var h History
+	db, err := OpenRunDB()
+	if err != nil {
+		return h, err
+	}
+	defer db.Close()
+	h.Runs, err = loadRuns(db)
+	return h, err
+}
+
+// AppendHistory adds the run in the report to the run database.
+func AppendHistory() error {
+	entry := HistoryEntry{
+		Time:      report.Finished,
+		Outcome:   report.Outcome,
+		Installed: report.Installed,
+		Target:    policy.SoftwareVersion,
+		Catalog:   report.Catalog,
+		Actions:   strings.Join(report.Actions, ","),
+		Message:   report.Message,
+		Error:     report.Error,
+	}
+	for _, p := range report.Phases {
+		entry.Phases = append(entry.Phases, HistoryPhase{Name: p.Name, Seconds: p.Seconds})
+	}
+
+	db, err := OpenRunDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Tx(func() error {
+		err := insertRun(db, entry)
+		if err != nil {
+			return err
+		}
+		return pruneRuns(db)
+	})
+}
+
+// CatalogChanges counts the times the catalog state differed from the run before, of
+// the runs that found one.
+func (h History) CatalogChanges() int {
+	changes, last := 0, ""
+	for _, r := range h.Runs {
+		if r.Catalog == "" {
+			continue
+		}
+		if last != "" && r.Catalog != last {
+			changes++
+		}
+		last = r.Catalog
+	}
+	return changes
+}
+
+// HistoryCommand implements `2020runner history`, which lists the most recent runs,
+// newest first.
+func HistoryCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	n := fs.Int("n", 20, "How many runs to show")
+	fs.Parse(args)
+
+	h, err := LoadHistory()
+	if err != nil {
+		return Failed("Unable to read the run history.", err)
+	}
+	if len(h.Runs) == 0 {
+		return Succeeded("The runner hasn't changed anything on this computer yet.")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "When\tOutcome\tInstalled\tTarget\tCatalog\tActions\tMessage")
+	for i := len(h.Runs) - 1; i >= 0 && i >= len(h.Runs)-*n; i-- {
+		r := h.Runs[i]
+		installed := r.Installed
+		if installed == "" {
+			installed = "-"
+		}
+		catalog := r.Catalog
+		if catalog == "" {
+			catalog = "-"
+		}
+		actions := r.Actions
+		if actions == "" {
+			actions = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Time.Local().Format("2006-01-02 15:04"), r.Outcome,
+			installed, r.Target, catalog, actions, r.Message)
+	}
+	w.Flush()
+	fmt.Println()
+	msg := fmt.Sprintf("%d runs recorded since %s.", len(h.Runs), h.Runs[0].Time.Local().Format("2006-01-02"))
+	switch n := h.CatalogChanges(); {
+	case n == 1:
+		msg += " The catalog state changed once in between."
+	case n > 1:
+		msg += fmt.Sprintf(" The catalog state changed %d times in between.", n)
+	}
+	return Succeeded(msg)
+}
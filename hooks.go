@@ -0,0 +1,125 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "time"
+
+// Phases that sites can attach hooks to.
+const (
+	PHASE_SOFTWARE_INSTALL   = "SoftwareInstall"
+	PHASE_SOFTWARE_UNINSTALL = "SoftwareUninstall"
+	PHASE_CATALOG_UNINSTALL  = "CatalogUninstall"
+	PHASE_CATALOG_INSTALL    = "CatalogInstall"
+	PHASE_LICENSE            = "License"
+	// The 2020runner catalog operations.
+	PHASE_CATALOG_UPDATE = "CatalogUpdate"
+	PHASE_CATALOG_VERIFY = "CatalogVerify"
+	PHASE_CATALOG_ADD    = "CatalogAdd"
+	PHASE_CATALOG_REMOVE = "CatalogRemove"
+	// The site's own check that the network catalog finds an item, see lookupSampleItem.
+	PHASE_CATALOG_LOOKUP = "CatalogLookup"
+)
+
+var DEFAULT_PHASE_TIMEOUTS = map[string]time.Duration{
+	PHASE_SOFTWARE_INSTALL:   2 * time.Hour,
+	PHASE_SOFTWARE_UNINSTALL: time.Hour,
+	PHASE_CATALOG_UNINSTALL:  30 * time.Minute,
+	PHASE_CATALOG_INSTALL:    2 * time.Hour,
+}
+
+// Phases without a default, like the license or restoring user data.
+const PHASE_TIMEOUT_OTHER = 30 * time.Minute
+
+type PhaseTimeout struct {
+	Phase   string `xml:"Phase,attr"`
+	Minutes uint32 `xml:"Minutes,attr"`
+}
+
+// TimeoutFor returns how long phase, including its hooks, may take.
+func TimeoutFor(phase string) time.Duration {
+	for _, t := range config.Timeouts {
+		if strings.EqualFold(t.Phase, phase) && t.Minutes > 0 {
+			return time.Duration(t.Minutes) * time.Minute
+		}
+	}
+	if d, ok := DEFAULT_PHASE_TIMEOUTS[phase]; ok {
+		return d
+	}
+	return PHASE_TIMEOUT_OTHER
+}
+
+const (
+	HOOK_PRE  = "pre"
+	HOOK_POST = "post"
+)
+
+// A Hook is a PowerShell script (.ps1) or any other command line that runs before or
+// after a phase. The phase name is passed to it in RUNNER_PHASE.
+type Hook struct {
+	Phase   string `xml:"Phase,attr"`
+	When    string `xml:"When,attr"`
+	Command string `xml:",chardata"`
+}
+
+func (h Hook) command() (*exec.Cmd, error) {
+	argv, err := splitCommandLine(strings.TrimSpace(h.Command))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot parse hook command %s", h.Command)
+	}
+	if len(argv) == 0 {
+		return nil, errors.Errorf("Empty hook for phase %s", h.Phase)
+	}
+
+	var cmd *exec.Cmd
+	if strings.EqualFold(filepath.Ext(argv[0]), ".ps1") {
+		args := append([]string{"-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-File"}, argv...)
+		cmd = exec.Command("powershell.exe", args...)
+	} else {
+		cmd = exec.Command(argv[0], argv[1:]...)
+	}
+	cmd.Env = append(ChildEnvironment(), "RUNNER_PHASE="+h.Phase)
+	return cmd, nil
+}
+
+// RunHooks runs the configured hooks for phase at the given point, in config order,
+// and stops at the first one that fails.
+func RunHooks(ctx context.Context, phase, when string) error {
+	for _, h := range config.Hooks {
+		if !strings.EqualFold(h.Phase, phase) || !strings.EqualFold(h.When, when) {
+			continue
+		}
+
+		cmd, err := h.command()
+		if err != nil {
+			return err
+		}
+		Say("Running %s-%s hook: %s", when, phase, strings.TrimSpace(h.Command))
+		out, err := RunCommand(ctx, cmd)
+		if err != nil {
+			return errors.Wrapf(err, "%s-%s hook failed, output: %s", when, phase, out)
+		}
+	}
+	return nil
+}
+
+// RunPhase wraps fn in the pre and post hooks for phase, all bounded by the phase's
+// timeout. A failing pre hook means fn never runs. Under -registry-diff, whatever the
+// phase and its hooks changed in the registry is logged at the end.
+func RunPhase(ctx context.Context, phase string, fn func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, TimeoutFor(phase))
+	defer cancel()
+	defer TrackRegistry(phase)()
+
+	err := RunHooks(ctx, phase, HOOK_PRE)
+	if err != nil {
+		return err
+	}
+	err = fn(ctx)
+	if err != nil {
+		return err
+	}
+	return RunHooks(ctx, phase, HOOK_POST)
+}
@@ -0,0 +1,190 @@
+package main
+
+import "github.com/pkg/errors"
+import "bytes"
+import "context"
+import "crypto/sha256"
+import "crypto/subtle"
+import "crypto/tls"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/json"
+import "net/http"
+import "net/url"
+import "os"
+import "strings"
+import "time"
+
+const HTTP_TIMEOUT = 30 * time.Second
+
+// ProxyConfig sets the proxy for the runner's HTTP requests. Without it, the machine's
+// WinHTTP proxy (netsh winhttp set proxy) is used, then the Internet Options one of the
+// account we run as. Password can be protected with protect-secret; the credentials
+// are sent as basic authentication.
+//
+//	<Proxy URL="http://proxy.example.local:8080" User="svc-2020runner" Password="dpapi:..." Bypass="*.example.local" />
+type ProxyConfig struct {
+	URL      string `xml:"URL,attr"`
+	User     string `xml:"User,attr"`
+	Password string `xml:"Password,attr"`
+	Bypass   string `xml:"Bypass,attr"`
+}
+
+// pickProxy picks the entry for scheme out of a WinHTTP proxy list.
+func pickProxy(list, scheme string) string {
+	var plain string
+	for _, p := range strings.FieldsFunc(list, func(r rune) bool { return r == ';' || r == ' ' }) {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			if strings.EqualFold(k, scheme) {
+				return v
+			}
+			continue
+		}
+		if plain == "" {
+			plain = p
+		}
+	}
+	return plain
+}
+
+func bypassed(bypass, host string) bool {
+	for _, b := range strings.FieldsFunc(bypass, func(r rune) bool { return r == ';' || r == ' ' || r == ',' }) {
+		if b == "<local>" && !strings.Contains(host, ".") {
+			return true
+		}
+		if matchPattern(b, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyFor is the http.Transport Proxy function for the configured or system proxy.
+func proxyFor(req *http.Request) (*url.URL, error) {
+	p := config.Proxy
+	list, bypass := p.URL, p.Bypass
+	if list == "" {
+		list, bypass = systemProxy()
+	}
+	host := req.URL.Hostname()
+	if bypassed(bypass, host) {
+		return nil, nil
+	}
+	proxy := pickProxy(list, req.URL.Scheme)
+	if proxy == "" {
+		return nil, nil
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot parse proxy %s", proxy)
+	}
+	if p.User != "" {
+		password, err := Secret(p.Password)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot read the proxy password")
+		}
+		u.User = url.UserPassword(p.User, password)
+	}
+	return u, nil
+}
+
+// NewHTTPClient returns a client that goes through the proxy, and checks servers'
+// certificates with tc if it isn't nil.
+func NewHTTPClient(tc *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   HTTP_TIMEOUT,
+		Transport: &http.Transport{Proxy: proxyFor, TLSClientConfig: tc},
+	}
+}
+
+// TrustConfig returns the TLS settings for checking a server against the CA
+// certificates in the PEM file ca, on top of the Windows ones, and if pin is set,
+// requiring a certificate in its chain to have that public key: the base64 SHA-256 of
+// the SubjectPublicKeyInfo, as in HPKP. Either can be empty; with both empty it
+// returns nil, for the defaults.
+func TrustConfig(ca, pin string) (*tls.Config, error) {
+	if ca == "" && pin == "" {
+		return nil, nil
+	}
+	tc := &tls.Config{}
+	if ca != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "Cannot read the CA bundle")
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("No certificates in %s", ca)
+		}
+		tc.RootCAs = pool
+	}
+	if pin != "" {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(want) != sha256.Size {
+			return nil, errors.Errorf("%s is not a base64 SHA-256 public key pin", pin)
+		}
+		tc.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, chain := range cs.VerifiedChains {
+				for _, c := range chain {
+					sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+					if subtle.ConstantTimeCompare(sum[:], want) == 1 {
+						return nil
+					}
+				}
+			}
+			return errors.Errorf("The certificate of %s doesn't match the pinned key", cs.ServerName)
+		}
+	}
+	return tc, nil
+}
+
+// GetJSON fetches url with client and decodes the JSON it answers with into v.
+func GetJSON(ctx context.Context, client *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot make request to %s", url)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "2020runner")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Categorize(ERROR_NETWORK, errors.Wrapf(err, "Cannot fetch %s", url))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%s answered %s", url, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot decode the answer from %s", url)
+	}
+	return nil
+}
+
+// PostJSON sends b to url with client and fails unless the server accepts it.
+func PostJSON(ctx context.Context, client *http.Client, url, token string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "Cannot make request to %s", url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", "2020runner")
+	resp, err := client.Do(req)
+	if err != nil {
+		return Categorize(ERROR_NETWORK, errors.Wrapf(err, "Cannot send to %s", url))
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
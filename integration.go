@@ -0,0 +1,213 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+// File types the 2020 suite opens, checked even when nothing is configured.
+var DEFAULT_ASSOCIATIONS = []string{".kit", ".cat"}
+
+// shortcutTargets returns the target of every shortcut under dir, keyed by path.
+func shortcutTargets(ctx context.Context, dir, pattern string) (map[string]string, error) {
+	targets := map[string]string{}
+	if _, err := os.Stat(dir); err != nil {
+		return targets, nil
+	}
+	out, err := runPowerShell(ctx, fmt.Sprintf(
+		`$s = New-Object -ComObject WScript.Shell; Get-ChildItem -LiteralPath %s -Filter %s -Recurse | ForEach-Object { $_.FullName + '|' + $s.CreateShortcut($_.FullName).TargetPath }`,
+		psQuote(dir), psQuote(pattern)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read shortcuts")
+	}
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "|", 2)
+		if len(parts) == 2 {
+			targets[parts[0]] = parts[1]
+		}
+	}
+	return targets, nil
+}
+
+func createShortcut(ctx context.Context, path, target string) error {
+	_, err := runPowerShell(ctx, fmt.Sprintf(
+		`$l = (New-Object -ComObject WScript.Shell).CreateShortcut(%s); $l.TargetPath = %s; $l.WorkingDirectory = %s; $l.Save()`,
+		psQuote(path), psQuote(target), psQuote(filepath.Dir(target))))
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create shortcut %s", path)
+	}
+	return nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// openCommand returns the command registered to open files of type ext, and the
+// program it runs.
+func openCommand(ext string) (string, string, error) {
+	k, err := registry.OpenKey(registry.CLASSES_ROOT, ext, registry.QUERY_VALUE)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "No file association for %s", ext)
+	}
+	progID, _, err := k.GetStringValue("")
+	k.Close()
+	if err != nil || progID == "" {
+		return "", "", errors.Errorf("No program registered for %s", ext)
+	}
+
+	k, err = registry.OpenKey(registry.CLASSES_ROOT, progID+`\shell\open\command`, registry.QUERY_VALUE)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "No open command for %s (%s)", ext, progID)
+	}
+	defer k.Close()
+	cmd, _, err := k.GetStringValue("")
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Cannot read the open command for %s", ext)
+	}
+	cmd, err = registry.ExpandString(cmd)
+	if err != nil {
+		return "", "", err
+	}
+	argv, err := windows.DecomposeCommandLine(cmd)
+	if err != nil || len(argv) == 0 {
+		return cmd, "", errors.Errorf("Cannot parse the open command for %s: %s", ext, cmd)
+	}
+	return cmd, argv[0], nil
+}
+
+func setAssociation(a Association) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, `SOFTWARE\Classes\`+a.Extension, registry.SET_VALUE)
+	if err != nil {
+		return errors.Wrapf(KeyAccessError(err, registry.LOCAL_MACHINE, `SOFTWARE\Classes\`+a.Extension), "Cannot create file association for %s", a.Extension)
+	}
+	err = k.SetStringValue("", a.ProgID)
+	k.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot set file association for %s", a.Extension)
+	}
+
+	k, _, err = registry.CreateKey(registry.LOCAL_MACHINE, `SOFTWARE\Classes\`+a.ProgID+`\shell\open\command`, registry.SET_VALUE)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot create open command for %s", a.ProgID)
+	}
+	defer k.Close()
+	err = k.SetStringValue("", a.Command)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot set open command for %s", a.ProgID)
+	}
+	return nil
+}
+
+// VerifyIntegration checks the shortcuts and file associations once the software is in
+// place, along with the other shortcuts users start it from, and repairs what it can if
+// asked to. It fails if anything is still broken.
+func VerifyIntegration(ctx context.Context) error {
+	var broken []string
+
+	programs, err := windows.KnownFolderPath(windows.FOLDERID_CommonPrograms, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot resolve the Start Menu folder")
+	}
+	desktop, err := windows.KnownFolderPath(windows.FOLDERID_PublicDesktop, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot resolve the public desktop folder")
+	}
+	menu := filepath.Join(programs, PURGE_PROGRAM_FOLDERS[0])
+
+	targets, err := shortcutTargets(ctx, menu, "*.lnk")
+	if err != nil {
+		return err
+	}
+	onDesktop, err := shortcutTargets(ctx, desktop, "*2020*.lnk")
+	if err != nil {
+		return err
+	}
+	for path, target := range onDesktop {
+		targets[path] = target
+	}
+
+	expected := map[string]string{}
+	for _, s := range config.Integration.Shortcuts {
+		expected[filepath.Join(menu, s.Name+".lnk")] = s.Target
+		if s.Desktop {
+			expected[filepath.Join(desktop, s.Name+".lnk")] = s.Target
+		}
+	}
+	for path, target := range expected {
+		if t, ok := targets[path]; ok && strings.EqualFold(t, target) && exists(t) {
+			continue
+		}
+		if !config.Integration.Repair || !exists(target) {
+			broken = append(broken, "shortcut "+path)
+			continue
+		}
+		Say("Repairing shortcut %s", path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = createShortcut(ctx, path, target)
+		if err != nil {
+			return err
+		}
+		targets[path] = target
+	}
+	current := currentExecutables()
+	for path, target := range targets {
+		// Shortcuts to things other than files, like URLs, have no target path. The
+		// ones to an old copy of a 2020 program are verifyLaunchers'.
+		if _, ok := expected[path]; !ok && target != "" && !exists(target) && !isOurProgram(current, target) {
+			broken = append(broken, fmt.Sprintf("shortcut %s (points at %s)", path, target))
+		}
+	}
+	stale, err := verifyLaunchers(ctx, current, targets, expected)
+	if err != nil {
+		return err
+	}
+	broken = append(broken, stale...)
+
+	configured := map[string]Association{}
+	for _, a := range config.Integration.Associations {
+		configured[strings.ToLower(a.Extension)] = a
+	}
+	exts := append([]string{}, DEFAULT_ASSOCIATIONS...)
+	for ext := range configured {
+		found := false
+		for _, e := range exts {
+			found = found || e == ext
+		}
+		if !found {
+			exts = append(exts, ext)
+		}
+	}
+	for _, ext := range exts {
+		cmd, exe, err := openCommand(ext)
+		a, ok := configured[ext]
+		want, _ := registry.ExpandString(a.Command)
+		if err == nil && exists(exe) && (!ok || strings.EqualFold(cmd, want)) {
+			continue
+		}
+		if !ok || !config.Integration.Repair {
+			if err == nil {
+				err = errors.Errorf("%s opens with %s, which doesn't exist", ext, exe)
+			}
+			broken = append(broken, err.Error())
+			continue
+		}
+		Say("Repairing the file association for %s", ext)
+		err = setAssociation(a)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(broken) > 0 {
+		return errors.Errorf("Broken: %s", strings.Join(broken, "; "))
+	}
+	return nil
+}
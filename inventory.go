@@ -0,0 +1,316 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "encoding/csv"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+// Inventory is everything there is to know about the 2020 footprint of a machine,
+// for the asset database.
+type Inventory struct {
+	Hostname  string             `json:"hostname"`
+	Collected time.Time          `json:"collected"`
+	Products  []InventoryProduct `json:"products"`
+	Catalog   string             `json:"catalog"`
+	Line      string             `json:"catalogLine"`
+	Granules  []string           `json:"granules,omitempty"`
+	Folders   []InventoryFolder  `json:"folders"`
+	LastRun   *Report            `json:"lastRun,omitempty"`
+	// The content version of each granule in Granules, "" where DSA doesn't say.
+	GranuleVersions map[string]string `json:"granuleVersions,omitempty"`
+	// Every shortcut that starts one of the 2020 programs, and the version it starts.
+	Launchers []InventoryLauncher `json:"launchers,omitempty"`
+}
+
+type InventoryLauncher struct {
+	Path    string `json:"path"`
+	Target  string `json:"target"`
+	Version string `json:"version,omitempty"`
+	Stale   bool   `json:"stale,omitempty"`
+}
+
+type InventoryProduct struct {
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Code        string `json:"code"`
+	InstallDate string `json:"installDate,omitempty"`
+	Location    string `json:"location,omitempty"`
+}
+
+type InventoryFolder struct {
+	Path string `json:"path"`
+	MB   uint64 `json:"mb"`
+}
+
+// folderSize adds up the size of the files under dir.
+func folderSize(dir string) uint64 {
+	var total uint64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += uint64(info.Size())
+		}
+		return nil
+	})
+	return total
+}
+
+func loadLastRun() *Report {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return nil
+	}
+	b, err := os.ReadFile(filepath.Join(dir, LAST_RUN_FILE))
+	if err != nil {
+		return nil
+	}
+	var r Report
+	if json.Unmarshal(b, &r) != nil {
+		return nil
+	}
+	return &r
+}
+
+func CollectInventory() (Inventory, error) {
+	inv := Inventory{Collected: time.Now()}
+	inv.Hostname, _ = os.Hostname()
+
+	products, err := ListInstalledSoftware()
+	if err != nil {
+		return inv, err
+	}
+	for _, p := range products {
+		ip := InventoryProduct{Name: p.Name, Version: p.Version, Code: p.Code}
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, p.Key, registry.QUERY_VALUE)
+		if err == nil {
+			ip.InstallDate, _, _ = k.GetStringValue("InstallDate")
+			ip.Location, _, _ = k.GetStringValue("InstallLocation")
+			k.Close()
+		}
+		inv.Products = append(inv.Products, ip)
+	}
+
+	state, err := GetCatalogStatus()
+	if err != nil {
+		return inv, err
+	}
+	inv.Catalog = catalogStateNames[state]
+	inv.Line = policy.CatalogLine
+	dsa, err := LoadDSAState()
+	if err != nil {
+		return inv, err
+	}
+	if dsa != nil {
+		for _, g := range dsa.GranulePicks {
+			if g.SelectionState == "Selected" {
+				inv.Granules = append(inv.Granules, g.MfgCode+"/"+g.PlatformType)
+			}
+		}
+		inv.GranuleVersions = CatalogContentVersions(dsa)
+	}
+
+	pf, err := windows.KnownFolderPath(windows.FOLDERID_ProgramFilesX86, 0)
+	if err != nil {
+		return inv, errors.Wrap(err, "Cannot resolve the Program Files folder")
+	}
+	dirs := []string{}
+	for _, f := range PURGE_PROGRAM_FOLDERS {
+		dirs = append(dirs, filepath.Join(pf, f))
+	}
+	if root, err := DSARoot(); err == nil {
+		dirs = append(dirs, root)
+	}
+	if dir, err := RunnerDataDir(); err == nil {
+		dirs = append(dirs, dir)
+	}
+	for _, d := range dirs {
+		if exists(d) {
+			inv.Folders = append(inv.Folders, InventoryFolder{Path: d, MB: folderSize(d) / (1024 * 1024)})
+		}
+	}
+
+	current := currentExecutables()
+	launchers, err := findLaunchers(context.Background(), current, nil)
+	if err != nil {
+		return inv, err
+	}
+	for path, target := range launchers {
+		l := InventoryLauncher{Path: path, Target: target, Stale: launcherStale(current, target)}
+		l.Version, _ = FileVersion(target)
+		inv.Launchers = append(inv.Launchers, l)
+	}
+	sort.Slice(inv.Launchers, func(i, j int) bool { return inv.Launchers[i].Path < inv.Launchers[j].Path })
+
+	inv.LastRun = loadLastRun()
+	return inv, nil
+}
+
+// StoreInventory collects the inventory and keeps it in the run database, so that
+// `inventory -history` can show how the machine has changed.
+func StoreInventory() error {
+	inv, err := CollectInventory()
+	if err != nil {
+		return err
+	}
+	return storeInventory(inv)
+}
+
+func storeInventory(inv Inventory) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode the inventory")
+	}
+	return SaveInventorySnapshot(inv.Collected, b)
+}
+
+// WriteCSV writes the inventory one item to a row, every row starting with the
+// hostname, so that inventories from many machines can be concatenated.
+func (inv Inventory) WriteCSV(w io.Writer) error {
+	return writeInventoryCSV(w, []Inventory{inv})
+}
+
+// writeInventoryCSV writes inventories under the one header. With more than one, each
+// starts with a row for when it was collected.
+func writeInventoryCSV(w io.Writer, inventories []Inventory) error {
+	c := csv.NewWriter(w)
+	c.Write([]string{"Hostname", "Kind", "Name", "Version", "Detail"})
+	for _, inv := range inventories {
+		if len(inventories) > 1 {
+			c.Write([]string{inv.Hostname, "collected", inv.Collected.Format(time.RFC3339), "", ""})
+		}
+		inv.writeCSVRows(c)
+	}
+	c.Flush()
+	return c.Error()
+}
+
+func (inv Inventory) writeCSVRows(c *csv.Writer) {
+	row := func(kind, name, version, detail string) {
+		c.Write([]string{inv.Hostname, kind, name, version, detail})
+	}
+	for _, p := range inv.Products {
+		row("product", p.Name, p.Version, fmt.Sprintf("code=%s installed=%s location=%s", p.Code, p.InstallDate, p.Location))
+	}
+	row("catalog", inv.Catalog, "", "line="+inv.Line)
+	for _, g := range inv.Granules {
+		row("granule", g, inv.GranuleVersions[strings.ToUpper(g)], "selected")
+	}
+	for _, l := range inv.Launchers {
+		detail := "target=" + l.Target
+		if l.Stale {
+			detail += " stale"
+		}
+		row("launcher", l.Path, l.Version, detail)
+	}
+	for _, f := range inv.Folders {
+		row("folder", f.Path, "", fmt.Sprintf("%d MB", f.MB))
+	}
+	if inv.LastRun != nil {
+		row("lastrun", inv.LastRun.Outcome, inv.LastRun.Installed,
+			inv.LastRun.Finished.Format(time.RFC3339)+" "+inv.LastRun.Message)
+	}
+}
+
+// storedInventories reads the inventories in the run database collected since since.
+func storedInventories(since time.Time) ([]Inventory, error) {
+	snapshots, err := LoadInventorySnapshots(since)
+	if err != nil {
+		return nil, err
+	}
+	var inventories []Inventory
+	for _, b := range snapshots {
+		var inv Inventory
+		err = json.Unmarshal(b, &inv)
+		if err != nil {
+			return nil, Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot decode a stored inventory"))
+		}
+		inventories = append(inventories, inv)
+	}
+	return inventories, nil
+}
+
+// InventoryCommand implements `2020runner inventory [-format csv|json] [-out file]
+// [-history [-since date]]`. The inventory collected is stored in the run database as
+// well; -history writes out the stored ones instead, oldest first.
+func InventoryCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("inventory", flag.ExitOnError)
+	format := fs.String("format", "json", "csv or json")
+	out := fs.String("out", "", "Write the inventory to this file instead of the console")
+	history := fs.Bool("history", false, "Write the inventories stored by earlier runs instead of collecting one")
+	since := fs.String("since", "", "With -history, only the inventories collected since this date, as 2006-01-02")
+	fs.Parse(args)
+	if *format != "csv" && *format != "json" {
+		return Failed("Unknown inventory format.", errors.Errorf("Unknown format %s", *format))
+	}
+
+	var inventories []Inventory
+	var err error
+	if *history {
+		var from time.Time
+		if *since != "" {
+			from, err = time.ParseInLocation("2006-01-02", *since, time.Local)
+			if err != nil {
+				return Failed("Usage: 2020runner inventory -history -since 2006-01-02", errors.Wrap(err, "Cannot parse -since"))
+			}
+		}
+		inventories, err = storedInventories(from)
+		if err != nil {
+			return Failed("Unable to read the stored inventories.", err)
+		}
+		if len(inventories) == 0 {
+			return Unsuccessful("No inventories are stored for that time.")
+		}
+	} else {
+		inv, err := CollectInventory()
+		if err != nil {
+			return Failed("Unable to collect the inventory.", err)
+		}
+		err = storeInventory(inv)
+		if err != nil {
+			Warn("Unable to store the inventory: %v", err)
+		}
+		inventories = []Inventory{inv}
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return Failed("Unable to write the inventory.", errors.Wrap(err, "Cannot create inventory file"))
+		}
+		defer f.Close()
+		w = f
+	}
+	if *format == "csv" {
+		err = writeInventoryCSV(w, inventories)
+	} else {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if *history {
+			err = enc.Encode(inventories)
+		} else {
+			err = enc.Encode(inventories[0])
+		}
+	}
+	if err != nil {
+		return Failed("Unable to write the inventory.", err)
+	}
+	if *out == "" {
+		// Nothing else goes to the console, so the output can be piped as it is.
+		r := Succeeded("Inventory written.")
+		r.Quiet = true
+		return r
+	}
+	return Succeeded("Inventory written to " + *out + ".")
+}
@@ -0,0 +1,135 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "path/filepath"
+import "strings"
+
+// currentExecutables returns the programs of the 2020 software that's installed, keyed
+// by their file name in lower case: the configured shortcut targets, and the programs
+// in the install folder of its uninstall entry.
+func currentExecutables() map[string]string {
+	current := map[string]string{}
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, CAP2020_SOFTWARE, registry.QUERY_VALUE)
+	if err == nil {
+		loc, _, _ := k.GetStringValue("InstallLocation")
+		k.Close()
+		if loc != "" {
+			exes, _ := filepath.Glob(filepath.Join(loc, "*.exe"))
+			for _, exe := range exes {
+				current[strings.ToLower(filepath.Base(exe))] = exe
+			}
+		}
+	}
+	for _, s := range config.Integration.Shortcuts {
+		if exists(s.Target) {
+			current[strings.ToLower(filepath.Base(s.Target))] = s.Target
+		}
+	}
+	return current
+}
+
+// launchPointDirs returns the other places users start the 2020 software from: every
+// profile's desktop and Start Menu, and the configured LaunchPoints, like the folder
+// of the shortcuts Citrix publishes.
+func launchPointDirs() []string {
+	dirs := append([]string{}, config.Integration.LaunchPoints...)
+	profiles, _ := ListUserProfiles()
+	for _, p := range profiles {
+		dirs = append(dirs, filepath.Join(p.Path, "Desktop"),
+			filepath.Join(p.Path, `AppData\Roaming\Microsoft\Windows\Start Menu\Programs`))
+	}
+	if desktop, err := windows.KnownFolderPath(windows.FOLDERID_PublicDesktop, 0); err == nil {
+		dirs = append(dirs, desktop)
+	}
+	if programs, err := windows.KnownFolderPath(windows.FOLDERID_CommonPrograms, 0); err == nil {
+		dirs = append(dirs, programs)
+	}
+	return dirs
+}
+
+func retargetShortcut(ctx context.Context, path, target string) error {
+	_, err := runPowerShell(ctx, fmt.Sprintf(
+		`$l = (New-Object -ComObject WScript.Shell).CreateShortcut(%s); $l.TargetPath = %s; $l.WorkingDirectory = %s; $l.Save()`,
+		psQuote(path), psQuote(target), psQuote(filepath.Dir(target))))
+	if err != nil {
+		return errors.Wrapf(err, "Cannot point shortcut %s at %s", path, target)
+	}
+	return nil
+}
+
+// findLaunchers returns the shortcuts in launchPointDirs, and in targets, that start
+// one of the programs in current by name, wherever from.
+func findLaunchers(ctx context.Context, current, targets map[string]string) (map[string]string, error) {
+	found := map[string]string{}
+	all := map[string]string{}
+	for _, dir := range launchPointDirs() {
+		t, err := shortcutTargets(ctx, dir, "*.lnk")
+		if err != nil {
+			return nil, err
+		}
+		for path, target := range t {
+			all[path] = target
+		}
+	}
+	for path, target := range targets {
+		all[path] = target
+	}
+	for path, target := range all {
+		if isOurProgram(current, target) {
+			found[path] = target
+		}
+	}
+	return found, nil
+}
+
+// verifyLaunchers finds the shortcuts that start one of the 2020 programs but from
+// somewhere other than the installed software, usually a version that was upgraded
+// away from. With Repair they're pointed at the installed one, keeping their arguments
+// and icon. It returns the ones left stale. current is from currentExecutables, and
+// shortcuts in skip are looked after elsewhere.
+func verifyLaunchers(ctx context.Context, current, targets, skip map[string]string) ([]string, error) {
+	if len(current) == 0 {
+		return nil, nil
+	}
+	all, err := findLaunchers(ctx, current, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []string
+	for path, target := range all {
+		want := current[strings.ToLower(filepath.Base(target))]
+		if _, ok := skip[path]; ok || !launcherStale(current, target) {
+			continue
+		}
+		if !config.Integration.Repair {
+			stale = append(stale, fmt.Sprintf("shortcut %s (starts %s, not %s)", path, target, want))
+			continue
+		}
+		Say("Pointing shortcut %s at %s", path, want)
+		// Other people's shortcuts, and read-only ones on a share, may not be ours to change.
+		if err := retargetShortcut(ctx, path, want); err != nil {
+			stale = append(stale, err.Error())
+		}
+	}
+	return stale, nil
+}
+
+// launcherStale reports whether target is one of the current programs by name, but
+// not the installed copy of it.
+func launcherStale(current map[string]string, target string) bool {
+	want, ok := current[strings.ToLower(filepath.Base(target))]
+	return ok && !strings.EqualFold(filepath.Clean(target), filepath.Clean(want))
+}
+
+// isOurProgram reports whether target is one of the current programs by name.
+func isOurProgram(current map[string]string, target string) bool {
+	_, ok := current[strings.ToLower(filepath.Base(target))]
+	return ok
+}
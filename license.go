@@ -0,0 +1,69 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+
+// ConfigureLicense points the installed software at the configured license so it
+// doesn't prompt each designer for activation. Values already set correctly are left
+// untouched, so this is safe to run on every pass.
+func ConfigureLicense(ctx context.Context) error {
+	l := config.License
+	if !l.Configured() {
+		return nil
+	}
+	path := l.RegistryKey
+	if path == "" {
+		path = LICENSE_KEY
+	}
+
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, path, registry.READ|registry.WRITE)
+	if err != nil {
+		return errors.Wrap(KeyAccessError(err, registry.LOCAL_MACHINE, path), "Cannot open license registry key")
+	}
+	defer k.Close()
+
+	if l.Server != "" {
+		port := l.Port
+		if port == 0 {
+			port = LICENSE_PORT_DEFAULT
+		}
+		err = setStringIfChanged(k, "Server", l.Server)
+		if err != nil {
+			return err
+		}
+		cur, _, err := k.GetIntegerValue("Port")
+		if err != nil || cur != uint64(port) {
+			err = k.SetDWordValue("Port", port)
+			if err != nil {
+				return errors.Wrap(err, "Cannot write license port")
+			}
+		}
+	}
+	if l.Key != "" {
+		key, err := Secret(l.Key)
+		if err != nil {
+			return errors.Wrap(err, "Cannot read the license key")
+		}
+		err = setStringIfChanged(k, "ActivationKey", key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setStringIfChanged(k registry.Key, name, value string) error {
+	cur, _, err := k.GetStringValue(name)
+	if err == nil && cur == value {
+		return nil
+	}
+	Say("Setting license %s", name)
+	err = k.SetStringValue(name, value)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot write license %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import "github.com/pkg/errors"
+import "bytes"
+import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+// Each run logs to a file of its own in the logs folder. A file that grows past
+// LOG_FILE_MAX_BYTES, which only a long -watch is likely to do, is continued in a new
+// one. Logs older than LOG_RETENTION are removed, and then the oldest ones until the
+// folder is under LOG_FOLDER_MAX_BYTES.
+const (
+	LOG_FILE_MAX_BYTES   = 10 << 20
+	LOG_FOLDER_MAX_BYTES = 100 << 20
+	LOG_RETENTION        = 90 * 24 * time.Hour
+)
+
+// The most of the end of the log that goes with the report sent to ReportURL.
+const LOG_REPORT_MAX_BYTES = 256 << 10
+
+type logFile struct {
+	mu   sync.Mutex
+	dir  string
+	path string
+	f    *os.File
+	size int64
+}
+
+var runLog *logFile
+
+func logsDir() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "logs"), nil
+}
+
+// StartLog opens a new log file and has every event written to it from now on.
+func StartLog() error {
+	dir, err := logsDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create the logs folder")
+	}
+	PruneLogs(dir)
+
+	l := &logFile{dir: dir}
+	err = l.open()
+	if err != nil {
+		return err
+	}
+	runLog = l
+	AddEventSink(l.write)
+	return nil
+}
+
+func (l *logFile) open() error {
+	name := fmt.Sprintf("2020runner-%s-%d.log", time.Now().Format("20060102-150405"), os.Getpid())
+	path := filepath.Join(l.dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create log file")
+	}
+	l.f, l.path, l.size = f, path, 0
+	fmt.Fprintf(f, "2020runner %s\r\n", strings.Join(os.Args[1:], " "))
+	return nil
+}
+
+func (l *logFile) write(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return
+	}
+	line := e.Message
+	switch e.Type {
+	case EVENT_WARNING:
+		line = "WARNING: " + line
+	case EVENT_DEBUG:
+		line = "DEBUG: " + line
+	case EVENT_PHASE_START:
+		line = "--- " + e.Phase
+	case EVENT_PHASE_END:
+		return
+	case EVENT_DONE:
+		line = strings.ToUpper(e.Outcome) + ": " + line
+		if report.Error != "" {
+			line += " (" + report.Error + ")"
+		}
+	}
+	n, _ := fmt.Fprintf(l.f, "%s %s\r\n", e.Time.Format("2006-01-02 15:04:05"), line)
+	l.size += int64(n)
+	if l.size > LOG_FILE_MAX_BYTES {
+		l.f.Close()
+		l.f = nil
+		PruneLogs(l.dir)
+		l.open()
+	}
+}
+
+// RunLogTail returns up to LOG_REPORT_MAX_BYTES of the end of the log file, from the
+// start of a line, or "" if there's no log.
+func RunLogTail() string {
+	if runLog == nil {
+		return ""
+	}
+	runLog.mu.Lock()
+	path := runLog.path
+	runLog.mu.Unlock()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	if len(b) > LOG_REPORT_MAX_BYTES {
+		b = b[len(b)-LOG_REPORT_MAX_BYTES:]
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+	return string(b)
+}
+
+// CloseLog stops logging to the file, e.g. so that the logs folder can be removed.
+func CloseLog() {
+	if runLog == nil {
+		return
+	}
+	runLog.mu.Lock()
+	defer runLog.mu.Unlock()
+	if runLog.f != nil {
+		runLog.f.Close()
+		runLog.f = nil
+	}
+}
+
+// PruneLogs applies the retention limits to the log files in dir. Failures are
+// ignored; they'll be tried again next time.
+func PruneLogs(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, "2020runner-*.log"))
+	if err != nil {
+		return
+	}
+	type logInfo struct {
+		path string
+		fi   os.FileInfo
+	}
+	var logs []logInfo
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil {
+			logs = append(logs, logInfo{f, fi})
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].fi.ModTime().Before(logs[j].fi.ModTime()) })
+
+	var total int64
+	for _, l := range logs {
+		total += l.fi.Size()
+	}
+	for _, l := range logs {
+		if time.Since(l.fi.ModTime()) < LOG_RETENTION && total <= LOG_FOLDER_MAX_BYTES {
+			break
+		}
+		if os.Remove(l.path) == nil {
+			total -= l.fi.Size()
+		}
+	}
+}
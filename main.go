@@ -1,10 +1,13 @@
 package main
 
-import "golang.org/x/sys/windows/registry"
 import "github.com/pkg/errors"
+import "context"
+import "flag"
 import "fmt"
-import "os/exec"
+import "io"
+import "os/signal"
 import "os"
+import "path/filepath"
 import "encoding/xml"
 import "time"
 import "strings"
@@ -14,6 +17,19 @@ type DSACatalogGranulePick struct {
 	PlatformType   string   `xml:"PlatformType,attr"`
 	MfgCode        string   `xml:"MfgCode,attr"`
 	SelectionState string   `xml:"SelectionState,attr"`
+	// Whatever else DSA records about the granule, which varies between versions.
+	Other []xml.Attr `xml:",any,attr"`
+}
+
+// ContentVersion returns the version of the manufacturer's content DSA has recorded
+// for g, from the first attribute with Version in its name, or "" if there's none.
+func (g DSACatalogGranulePick) ContentVersion() string {
+	for _, a := range g.Other {
+		if strings.Contains(strings.ToLower(a.Name.Local), "version") {
+			return a.Value
+		}
+	}
+	return ""
 }
 
 type DSACatalogState struct {
@@ -31,194 +47,385 @@ const (
 	PATH_SOFTWARE            = `\\10.0.9.29\2020software\Setup.exe`
 )
 
+// Switches that stop dsa.exe from asking for confirmation, which would otherwise
+// stall forever when nobody is around to click (e.g. running as SYSTEM).
+var DSA_SILENT_SWITCHES = []string{"/silent"}
+
+// The answers to give dsa.exe if it asks for confirmation despite DSA_SILENT_SWITCHES,
+// as running /removeall already means yes. Only a question is answered: a message
+// with nothing but OK to click is dsa.exe reporting a problem, see answerPrompt.
+var DSA_PROMPT_ANSWERS = []string{"Yes"}
+
 const (
 	CATALOG_STATE_MISSNG = iota
 	CATALOG_STATE_LOCAL
 	CATALOG_STATE_NETWORK
 	CATALOG_STATE_INVALID
+	// The state cookie and the uninstall entry disagree, typically because an
+	// uninstall crashed halfway.
+	CATALOG_STATE_INCONSISTENT
 )
 
-func GetCatalogStatus() (int, error) {
-	f, err := os.Open(`C:\ProgramData\2020\DSA\2020Catalogs-StateCookie.xml`)
+// The file in the DSA folder where DSA keeps which granules are selected and where
+// the catalog was installed from.
+const DSA_STATE_COOKIE = "2020Catalogs-StateCookie.xml"
+
+// DSARoot returns the DSA data folder, i.e. %ProgramData%\2020\DSA.
+func DSARoot() (string, error) {
+	pd, err := ProgramData()
 	if err != nil {
-		// This is fine, it likely just means the software isn't installed
-		return CATALOG_STATE_MISSNG, nil
+		return "", err
 	}
-	defer f.Close()
+	return filepath.Join(pd, "2020", "DSA"), nil
+}
 
-	var catalogstate DSACatalogState
-	dec := xml.NewDecoder(f)
-	err = dec.Decode(&catalogstate)
+// LoadDSAState reads the DSA state cookie. It returns nil if there isn't one.
+func LoadDSAState() (*DSACatalogState, error) {
+	root, err := DSARoot()
 	if err != nil {
-		return CATALOG_STATE_INVALID, errors.Wrap(err, "Cannot decode DSA state XML file")
+		return nil, err
 	}
+	return loadDSAStateFile(filepath.Join(root, DSA_STATE_COOKIE))
+}
 
-	// The Demo package is mandatory for all installs, so we can check if it's selected
-	// in order to determine whether anything is locally installed.
-	for j := range catalogstate.GranulePicks {
-		if catalogstate.GranulePicks[j].MfgCode == `DMO` &&
-			catalogstate.GranulePicks[j].PlatformType == `CAP` &&
-			catalogstate.GranulePicks[j].SelectionState == `Selected` {
-			return CATALOG_STATE_LOCAL, nil
-		}
+func loadDSAStateFile(path string) (*DSACatalogState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		// This is fine, it likely just means the software isn't installed
+		return nil, nil
 	}
+	defer f.Close()
 
-	if !strings.EqualFold(catalogstate.LastDiscLocation, `\\10.0.9.29\2020catalogbeta\ClientSetup\`) {
-		fmt.Printf("Catalog Last Disc Location is incorrectly %s\n", catalogstate.LastDiscLocation)
-		return CATALOG_STATE_INVALID, nil
+	catalogstate, err := decodeDSAState(f)
+	if err != nil {
+		return nil, err
 	}
-
-	return CATALOG_STATE_NETWORK, nil
+	DebugXML("DSA state from "+path, catalogstate)
+	return catalogstate, nil
 }
 
-func CleanCatalog() error {
-	return os.RemoveAll(`C:\ProgramData\2020\DSA`)
-}
-
-func UninstallCatalog() error {
-	k, err := registry.OpenKey(registry.LOCAL_MACHINE, CAP2020_CATALOG, registry.READ)
+// decodeDSAState reads a DSA state cookie from r.
+func decodeDSAState(r io.Reader) (*DSACatalogState, error) {
+	var catalogstate DSACatalogState
+	dec := xml.NewDecoder(r)
+	err := dec.Decode(&catalogstate)
 	if err != nil {
-		return errors.Wrap(err, "Cannot open registry key for uninstall")
+		return nil, Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot decode DSA state XML file"))
 	}
-	defer k.Close()
+	return &catalogstate, nil
+}
 
-	v, _, err := k.GetStringValue("UninstallString")
-	if err != nil {
-		return errors.Wrap(err, "Cannot read value UninstallString")
-	}
+// How long DSA gets to rewrite its state cookie once the catalog uninstaller is done.
+const DSA_STATE_WAIT = 2 * time.Minute
 
-	// Verify that the uninstall command looks like one we recognize.
-	if !strings.EqualFold(v, `C:\Program Files (x86)\2020\DSA\dsa.exe /removeall /rootpath "C:\ProgramData\2020\DSA"`) {
-		return errors.Errorf("UninstallString had an unexpected value of %s", v)
-	}
+// A dsaStateStamp tells whether the state cookie has changed since, without reading it.
+type dsaStateStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
 
-	out, err := exec.Command(`C:\Program Files (x86)\2020\DSA\dsa.exe`, "/removeall", "/rootpath", `"C:\ProgramData\2020\DSA"`).CombinedOutput()
+func stampDSAState() dsaStateStamp {
+	root, err := DSARoot()
 	if err != nil {
-		return errors.Wrapf(err, "Uninstall command output: %s", out)
+		return dsaStateStamp{}
 	}
-	return nil
+	fi, err := os.Stat(filepath.Join(root, DSA_STATE_COOKIE))
+	if err != nil {
+		return dsaStateStamp{}
+	}
+	return dsaStateStamp{true, fi.Size(), fi.ModTime()}
 }
 
-// "Is Installed", "Is Current", error
-func GetSoftwareStatus() (bool, bool, error) {
-	k, err := registry.OpenKey(registry.LOCAL_MACHINE, CAP2020_SOFTWARE, registry.READ)
-	if err == registry.ErrNotExist {
-		return false, false, nil
-	} else if err != nil {
-		return false, false, errors.Wrap(err, "Cannot open registry key for software version")
+// WaitForDSAStateChange polls until the state cookie is no longer what it was at
+// before: rewritten or removed. DSA updates it in the background after dsa.exe has
+// exited, so reading it straight away can still find the catalog installed. It gives
+// up after DSA_STATE_WAIT and reports whether the cookie changed.
+func WaitForDSAStateChange(ctx context.Context, before dsaStateStamp) bool {
+	if !before.exists {
+		return true
 	}
-	defer k.Close()
-
-	v, _, err := k.GetStringValue("DisplayVersion")
-	if err != nil {
-		return false, false, errors.Wrap(err, "Cannot read value DisplayVersion")
+	deadline := time.Now().Add(DSA_STATE_WAIT)
+	for {
+		if stampDSAState() != before {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(POLL_INTERVAL):
+		}
 	}
-
-	return true, (v == CAP2020_SOFTWARE_CURRENT), nil
 }
 
-func InstallNetworkCatalog() error {
-	out, err := exec.Command(PATH_CATALOG).CombinedOutput()
+func GetCatalogStatus() (int, error) {
+	catalogstate, err := LoadDSAState()
 	if err != nil {
-		return errors.Wrapf(err, "Setup command output: %s", out)
+		return CATALOG_STATE_INVALID, err
 	}
-
-	return nil
+	return catalogStateOf(catalogstate, catalogRegistered()), nil
 }
 
-func InstallSoftware() error {
-	out, err := exec.Command(PATH_SOFTWARE).CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "Install command output: %s", out)
+// catalogStateOf works out the catalog state from a DSA state cookie, nil if there's
+// none, and whether the catalog line has an uninstall entry.
+func catalogStateOf(catalogstate *DSACatalogState, registered bool) int {
+	if catalogstate == nil {
+		if registered {
+			Warn("The %s is registered as installed, but DSA has no state for it.", policy.Catalog().Name)
+			return CATALOG_STATE_INCONSISTENT
+		}
+		return CATALOG_STATE_MISSNG
 	}
 
-	return nil
-}
-
-func UninstallSoftware() error {
-	out, err := exec.Command("msiexec", "/x", `{5D4D912A-D5EE-4748-84B8-7C2C75EC4408}`, "/passive", "/forcerestart").CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "Uninstall command output: %s", out)
+	// The Demo package is part of every standard install, so by default its selection
+	// means something is installed locally. Images without it name other sentinels.
+	if CatalogInstalledLocally(catalogstate) {
+		if !registered {
+			Warn("DSA has the %s installed locally, but it isn't registered as installed.", policy.Catalog().Name)
+			return CATALOG_STATE_INCONSISTENT
+		}
+		return CATALOG_STATE_LOCAL
 	}
 
-	return nil
-}
+	if !strings.EqualFold(catalogstate.LastDiscLocation, filepath.Dir(policy.CatalogSetup)+`\`) {
+		Warn("Catalog Last Disc Location is incorrectly %s", catalogstate.LastDiscLocation)
+		return CATALOG_STATE_INVALID
+	}
 
-func ExitWithSuccess(m string) {
-	fmt.Printf("SUCCESS: %s\n\n", m)
-	time.Sleep(10 * time.Second)
-	os.Exit(0)
+	return CATALOG_STATE_NETWORK
 }
 
-func ExitWithError(m string, e error) {
-	fmt.Printf("ERROR: %s (%+v)\n\n", m, e)
-	time.Sleep(5 * time.Minute)
-	os.Exit(1)
+// exit ends the run. The pause leaves the console window up long enough to read the
+// outcome; the wizard swaps this out to wait on its own window instead.
+var exit = func(code int, pause time.Duration) {
+	time.Sleep(pause)
+	os.Exit(code)
 }
 
-func ExitWithoutSuccess(m string) {
-	fmt.Printf("UNSUCCESSFUL: %s\n\n", m)
-	time.Sleep(5 * time.Minute)
-	os.Exit(2)
+// Exit records r and ends the process with its exit code. Only the top-level caller,
+// main or the wizard, calls it; everything below returns a Result.
+func Exit(r Result) {
+	if r.Outcome == OUTCOME_ERROR {
+		report.Category, report.Hint = Classify(r.Err)
+	}
+	FinishReport(r.Outcome, r.Message, r.Err)
+	ReleaseRunLock()
+	if r.Quiet {
+		exit(r.Code(), 0)
+	}
+	switch r.Outcome {
+	case OUTCOME_SUCCESS:
+		PrintSummary("SUCCESS", r.Message)
+		exit(0, 10*time.Second)
+	case OUTCOME_REBOOT:
+		PrintSummary("RESTART NEEDED", r.Message)
+		AwaitReboot(r.Message)
+	case OUTCOME_ERROR:
+		PrintSummary("ERROR", fmt.Sprintf("%s (%+v)", r.Message, r.Err), fmt.Sprintf("%s: %s", report.Category, report.Hint))
+	default:
+		PrintSummary(strings.ToUpper(r.Outcome), r.Message)
+	}
+	exit(r.Code(), 5*time.Minute)
 }
 
 func main() {
 	var err error
 
-	softInstalled, softCurrent, err := GetSoftwareStatus()
+	configPath := flag.String("config", "", "Path to the runner config file")
+	flag.StringVar(&reportPath, "report", "", "Write a JSON report of the run to this file")
+	flag.StringVar(&reportHTMLPath, "report-html", "", "Write an HTML report of the run to this file, to attach to a ticket or mail")
+	gui := flag.Bool("gui", false, "Show detection and progress in a window, with a choice of actions")
+	watch := flag.Bool("watch", false, "Keep running and check again whenever the 2020 software or catalog changes")
+	broker := flag.Bool("broker", false, "Keep running and start a run whenever 2020runner-gui asks for one, as the 2020runner service does")
+	nopause := flag.Bool("nopause", false, "Exit as soon as the run is over instead of leaving the outcome on screen")
+	flag.BoolVar(&allowDowngrade, "allow-downgrade", false, "Replace 2020 software newer than the target version")
+	flag.BoolVar(&ignoreFlapping, "ignore-flapping", false, "Make fixes even if they keep coming undone")
+	flag.BoolVar(&rebootNow, "reboot-now", false, "If the computer has to restart to carry on, restart it after a minute's countdown")
+	flag.StringVar(&rebootAt, "reboot-at", "", "If the computer has to restart to carry on, restart it at this time of day, like 22:00")
+	pipe := flag.Bool("pipe", false, "Publish progress events on "+PIPE_NAME+" for 2020runner-gui")
+	flag.BoolVar(&auditUI, "audit-ui", false, "Note every window the commands run show, to find the steps that aren't silent")
+	reportOnly := flag.Bool("report-only", false, "Only check the computer and publish the report, without changing anything")
+	output := flag.String("output", OUTPUT_TEXT, "text, or ndjson for every event as a line of JSON on standard output")
+	flag.BoolVar(&registryDiff, "registry-diff", false, "Log the registry changes each phase makes to the 2020 keys")
+	verbose := flag.Bool("v", false, "Show more detail: registry values read and how each command ended")
+	debug := flag.Bool("vv", false, "Show everything -v does, plus command output and the XML files read")
+	healthAddr := flag.String("health-addr", "", "With -watch, answer GET /health on this loopback address, like 127.0.0.1:8020")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: 2020runner [flags] [status [-all-users] [-fresh] | plan [-out file] | apply file | prestage | history [-n count] | inventory [-format csv|json] [-history] | simulate [-host name] file | catalog list|check [-update]|update|verify|add code|remove code | config validate [-reach] | config init [-out file] | protect-secret | service install|remove | purge -yes | serve [-addr host:port] [-db file] [-token-file file] [-read-token-file file] [-cert file -key file]]\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	err = ApplyEnvFlags()
 	if err != nil {
-		ExitWithError("Unable to check software status.", err)
+		Exit(Failed("Unable to use the flags from the environment.", err))
 	}
 
-	if !softInstalled {
-		fmt.Println("2020 software is not installed.")
-		err = InstallSoftware()
+	if _, _, err := rebootTime(time.Now()); err != nil {
+		Exit(Failed("Unable to use the restart flags.", err))
+	}
+	if *nopause {
+		exit = func(code int, pause time.Duration) { os.Exit(code) }
+	}
+	switch {
+	case *debug:
+		logLevel = LOG_DEBUG
+	case *verbose:
+		logLevel = LOG_VERBOSE
+	}
+	err = RelaunchLocally()
+	if err != nil {
+		Exit(Failed("Unable to run from a local copy.", err))
+	}
+	err = SetOutput(*output)
+	if err != nil {
+		Exit(Failed("Unknown -output.", err))
+	}
+	err = StartLog()
+	if err != nil {
+		Warn("Unable to log to a file: %v", err)
+	}
+	// When watching, each check is a run of its own that serves the pipe itself.
+	if *pipe && !*watch {
+		err = ServePipe()
 		if err != nil {
-			ExitWithError("Unable to install the 2020 software. Restart your computer and try again manually.", err)
+			Warn("Unable to publish progress events: %v", err)
 		}
-		ExitWithoutSuccess("Complete the install process manually and run this again afterward.")
 	}
 
-	if !softCurrent {
-		fmt.Println("2020 software is out of date. Uninstalling current software...")
-		err = UninstallSoftware()
+	// Ctrl+C stops whatever is in flight, rather than leaving an installer orphaned.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if flag.Arg(0) == "config" {
+		Exit(ConfigCommand(ctx, *configPath, flag.Args()[1:]))
+	}
+	// The report server runs until it's stopped, with none of a run's policy or budget.
+	if flag.Arg(0) == "serve" {
+		Exit(ServeCommand(ctx, flag.Args()[1:]))
+	}
+	config, err = LoadConfig(*configPath)
+	if err != nil {
+		Exit(Failed("Unable to load the runner config.", err))
+	}
+	err = ApplyEnvOverrides(&config)
+	if err != nil {
+		Exit(Failed("Unable to use the settings from the environment.", err))
+	}
+	if config.LogLevel != "" && !*verbose && !*debug {
+		logLevel, err = ParseLogLevel(config.LogLevel)
 		if err != nil {
-			ExitWithError("Unable to uninstall the 2020 software. Restart your computer and try again manually.", err)
+			Warn("%v", err)
 		}
-		ExitWithoutSuccess("Software uninstall will require a reboot. After reboot, run again to update software.")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		Exit(Failed("Unable to get the computer name.", err))
+	}
+	policy = ResolvePolicy(ctx, config, host)
+	if policy.ShouldSkip() {
+		Exit(Succeeded("This computer is excluded from 2020 management. Nothing to do."))
 	}
 
-	fmt.Println("Looks like the 2020 software is up to date. Let's check your catalog...")
+	if *healthAddr != "" && !*watch {
+		Exit(Failed("-health-addr only works with -watch.", errors.New("Unsupported combination")))
+	}
+	if *watch {
+		if flag.NArg() > 0 || *gui {
+			Exit(Failed("-watch can't be combined with a command or -gui.", errors.New("Unsupported combination")))
+		}
+		err = Watch(ctx, *healthAddr)
+		Exit(Failed("Stopped watching.", err))
+	}
 
-	catState, err := GetCatalogStatus()
-	if err != nil {
-		ExitWithError("Unable to check for Network Deployment.", err)
+	if *broker {
+		if flag.NArg() > 0 || *gui || *watch {
+			Exit(Failed("-broker can't be combined with a command, -gui or -watch.", errors.New("Unsupported combination")))
+		}
+		err = RunBroker(ctx)
+		if err != nil {
+			Exit(Failed("Stopped taking requests.", err))
+		}
+		Exit(Succeeded("Stopped taking requests."))
 	}
 
-	if catState == CATALOG_STATE_NETWORK {
-		ExitWithSuccess("You are using the 2020 Network Deployment. Nice.")
+	// The whole run has a wall-clock budget on top of the per-phase timeouts.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(policy.RunTimeoutMinutes)*time.Minute)
+	defer cancel()
+
+	if *reportOnly {
+		if flag.NArg() > 0 || *gui {
+			Exit(Failed("-report-only can't be combined with a command or -gui.", errors.New("Unsupported combination")))
+		}
+		Exit(ReportOnly(ctx))
 	}
 
-	if catState == CATALOG_STATE_LOCAL {
-		fmt.Println("Looks like you have the catalog installed locally, not on the network.")
-		fmt.Println("Uninstalling local catalog.")
-		err = UninstallCatalog()
+	// Runs that change the machine take turns, and so does installing or removing the
+	// broker service, which runs them; the rest only look.
+	switch flag.Arg(0) {
+	case "", "apply", "purge", "prestage", "service":
+		if r, ok := AcquireRunLock(); !ok {
+			Exit(r)
+		}
+	}
+
+	// Let whoever is using the computer see why 2020 is about to go away, unless it
+	// isn't, on an exempt computer.
+	_, exempt := FindExemption()
+	if !*gui && !exempt && (flag.Arg(0) == "" || flag.Arg(0) == "apply") {
+		err = ShowProgressWindow(!*pipe)
 		if err != nil {
-			ExitWithError("Can't run the uninstaller for the catalog. Try running it yourself.", err)
+			Warn("Unable to show the progress to the logged-on user: %v", err)
 		}
-		fmt.Println("Clearing out remaining files after uninstall.")
-		CleanCatalog()
 	}
+	if *gui && flag.NArg() == 0 {
+		recordLastRun = true
+		RunWizard(ctx)
+	}
+	Exit(Run(ctx, flag.Arg(0), flag.Args()))
+}
 
-	fmt.Println("Installing the network catalog...")
-	err = InstallNetworkCatalog()
-	if err != nil {
-		ExitWithError("Failed to install the network catalog.", err)
+// Run carries out command, or a compliance run if it's empty, and returns how it went.
+func Run(ctx context.Context, command string, args []string) Result {
+	if len(args) > 0 {
+		args = args[1:]
+	}
+	switch command {
+	case "":
+		recordLastRun = true
+	case "status":
+		return StatusCommand(ctx, args)
+	case "plan":
+		return PlanCommand(ctx, args)
+	case "apply":
+		recordLastRun = true
+		return ApplyCommand(ctx, args)
+	case "purge":
+		return PurgeCommand(ctx, args)
+	case "prestage":
+		return PrestageCommand(ctx, args)
+	case "history":
+		return HistoryCommand(ctx, args)
+	case "inventory":
+		return InventoryCommand(ctx, args)
+	case "simulate":
+		return SimulateCommand(ctx, args)
+	case "catalog":
+		return CatalogCommand(ctx, args)
+	case "protect-secret":
+		return ProtectSecretCommand(ctx, args)
+	case "service":
+		return ServiceCommand(ctx, args)
+	default:
+		flag.Usage()
+		return Failed("Unknown command.", errors.Errorf("Unknown command %s", command))
 	}
-	fmt.Println("Checking the catalog status again...")
-	catState, err = GetCatalogStatus()
-	if err == nil && catState == CATALOG_STATE_NETWORK {
-		ExitWithSuccess("Looks good. Network catalog is now installed.")
+
+	s, err := GetMachineState(ctx)
+	if err != nil {
+		return Failed("Unable to check the machine state.", err)
 	}
-	ExitWithoutSuccess("Finish installing the catalog by using the wizard. You can close this window.")
+	return ApplyPlan(ctx, BuildPlan(s))
 }
@@ -0,0 +1,166 @@
+package main
+
+import "bytes"
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "runtime"
+import "sort"
+import "strings"
+import "testing"
+
+var update = flag.Bool("update", false, "Rewrite the .golden files of the state cookie tests")
+
+const STATE_COOKIES = "testdata/statecookie"
+
+// describeDSAState is what the golden files hold for a decoded state cookie: every
+// field the detection reads, in a stable order.
+func describeDSAState(s *DSACatalogState, err error) string {
+	if err != nil {
+		return "error: " + err.Error() + "\n"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "network: %v\n", s.UsingNetwork)
+	fmt.Fprintf(&b, "location: %s\n", s.LastDiscLocation)
+	fmt.Fprintf(&b, "picks:\n")
+	for _, g := range s.GranulePicks {
+		fmt.Fprintf(&b, "  %s/%s %s", g.MfgCode, g.PlatformType, g.SelectionState)
+		if v := g.ContentVersion(); v != "" {
+			fmt.Fprintf(&b, " version %s", v)
+		}
+		b.WriteString("\n")
+	}
+	versions := CatalogContentVersions(s)
+	var selected []string
+	for g, v := range versions {
+		selected = append(selected, g+"="+v)
+	}
+	sort.Strings(selected)
+	fmt.Fprintf(&b, "selected:%s\n", strings.Join(append([]string{""}, selected...), " "))
+	return b.String()
+}
+
+func TestStateCookieGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(STATE_COOKIES, "*.xml"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("No state cookies in %s: %v", STATE_COOKIES, err)
+	}
+	for _, f := range files {
+		t.Run(filepath.Base(f), func(t *testing.T) {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := describeDSAState(decodeDSAState(bytes.NewReader(b)))
+			golden := strings.TrimSuffix(f, ".xml") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v; run go test -run StateCookieGolden -update to create it", err)
+			}
+			if got != string(want) {
+				t.Errorf("%s decodes to\n%s\nwant\n%s", f, got, want)
+			}
+		})
+	}
+}
+
+func loadStateCookie(t *testing.T, name string) *DSACatalogState {
+	t.Helper()
+	if name == "" {
+		return nil
+	}
+	s, err := loadDSAStateFile(filepath.Join(STATE_COOKIES, name))
+	if err != nil || s == nil {
+		t.Fatalf("Cannot load %s: %v", name, err)
+	}
+	return s
+}
+
+func TestCatalogStateOf(t *testing.T) {
+	tests := []struct {
+		name       string
+		cookie     string
+		registered bool
+		policy     Policy
+		want       int
+		// The share is compared as a Windows path, which filepath only splits on Windows.
+		share bool
+	}{
+		{name: "no cookie", want: CATALOG_STATE_MISSNG},
+		{name: "registered without a cookie", registered: true, want: CATALOG_STATE_INCONSISTENT},
+		{name: "network deployment", cookie: "network-deployment.xml", registered: true, want: CATALOG_STATE_NETWORK, share: true},
+		{name: "network deployment, not registered", cookie: "network-deployment.xml", want: CATALOG_STATE_NETWORK, share: true},
+		{name: "network deployment without picks", cookie: "no-picks.xml", registered: true, want: CATALOG_STATE_NETWORK, share: true},
+		{name: "older DSA, share in upper case", cookie: "older-dsa.xml", registered: true, want: CATALOG_STATE_NETWORK, share: true},
+		{name: "network deployment from another share", cookie: "wrong-share.xml", registered: true, want: CATALOG_STATE_INVALID},
+		{name: "local install", cookie: "local-install.xml", registered: true, want: CATALOG_STATE_LOCAL},
+		{name: "local install, not registered", cookie: "local-install.xml", want: CATALOG_STATE_INCONSISTENT},
+		{name: "partial install", cookie: "partial-install.xml", registered: true, want: CATALOG_STATE_INVALID},
+		{
+			name: "other sentinels", cookie: "local-install.xml", registered: true,
+			policy: Policy{SentinelGranules: "KFI"}, want: CATALOG_STATE_INVALID,
+		},
+		{
+			name: "enough sentinels", cookie: "local-install.xml", registered: true,
+			policy: Policy{SentinelGranules: "DMO,STC,KFI", SentinelMatches: uint32Ptr(2)}, want: CATALOG_STATE_LOCAL,
+		},
+		{
+			name: "too few sentinels", cookie: "local-install.xml", registered: true,
+			policy: Policy{SentinelGranules: "DMO,KFI", SentinelMatches: uint32Ptr(2)}, want: CATALOG_STATE_INVALID,
+		},
+		{
+			name: "sentinel with its platform type", cookie: "local-install.xml", registered: true,
+			policy: Policy{SentinelGranules: "stc/cap"}, want: CATALOG_STATE_LOCAL,
+		},
+		{name: "residential cookie, commercial line", cookie: "residential.xml", registered: true, want: CATALOG_STATE_INVALID},
+		{
+			name: "residential cookie, residential line", cookie: "residential.xml", registered: true,
+			policy: Policy{CatalogLine: CATALOG_RESIDENTIAL}, want: CATALOG_STATE_LOCAL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.share && runtime.GOOS != "windows" {
+				t.Skip("Needs Windows paths")
+			}
+			useConfig(t, Config{Policy: tt.policy}, "TEST-PC")
+			got := catalogStateOf(loadStateCookie(t, tt.cookie), tt.registered)
+			if got != tt.want {
+				t.Errorf("catalogStateOf = %s, want %s", catalogStateNames[got], catalogStateNames[tt.want])
+			}
+		})
+	}
+}
+
+func FuzzDecodeDSAState(f *testing.F) {
+	files, _ := filepath.Glob(filepath.Join(STATE_COOKIES, "*.xml"))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err == nil {
+			f.Add(b)
+		}
+	}
+	useConfig(f, Config{}, "TEST-PC")
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := decodeDSAState(bytes.NewReader(b))
+		if err != nil {
+			if s != nil {
+				t.Fatalf("decodeDSAState returned a state with %v", err)
+			}
+			return
+		}
+		for _, registered := range []bool{false, true} {
+			if state := catalogStateOf(s, registered); catalogStateNames[state] == "" {
+				t.Fatalf("catalogStateOf = %d, which isn't a catalog state", state)
+			}
+		}
+		describeDSAState(s, nil)
+	})
+}
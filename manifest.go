@@ -0,0 +1,71 @@
+package main
+
+import "github.com/pkg/errors"
+import "crypto/sha256"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+
+const ERROR_HINT_HALF_SYNCED = "The catalog share doesn't match its manifest, so it's probably still being copied. Wait for it to finish, then run again."
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Check compares the share that setup, the catalog's ClientSetup program, comes from
+// against the manifest. It lists everything that doesn't match, not just the first.
+func (m CatalogManifest) Check(setup string) error {
+	root := filepath.Dir(filepath.Dir(setup))
+	var problems []string
+
+	for _, f := range m.Folders {
+		fi, err := os.Stat(filepath.Join(root, f))
+		if err != nil || !fi.IsDir() {
+			problems = append(problems, "folder "+f+" is missing")
+		}
+	}
+	if m.VersionFile != "" {
+		b, err := os.ReadFile(filepath.Join(root, m.VersionFile))
+		if err != nil {
+			problems = append(problems, m.VersionFile+" is missing")
+		} else if v := strings.TrimSpace(string(b)); m.Version != "" && v != m.Version {
+			problems = append(problems, fmt.Sprintf("%s says %s, not %s", m.VersionFile, v, m.Version))
+		}
+	}
+	if m.SetupVersion != "" {
+		v, err := FileVersion(setup)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if v != m.SetupVersion {
+			problems = append(problems, fmt.Sprintf("%s is version %s, not %s", filepath.Base(setup), v, m.SetupVersion))
+		}
+	}
+	for _, f := range m.Files {
+		p := strings.TrimSpace(f.Path)
+		sum, err := fileSHA256(filepath.Join(root, p))
+		if err != nil {
+			problems = append(problems, p+" is missing")
+		} else if f.SHA256 != "" && !strings.EqualFold(sum, f.SHA256) {
+			problems = append(problems, p+" has the wrong checksum")
+		}
+	}
+
+	if len(problems) > 0 {
+		return &RunnerError{Category: ERROR_INSTALLER, Hint: ERROR_HINT_HALF_SYNCED,
+			Err: errors.Errorf("The catalog share at %s doesn't match its manifest: %s", root, strings.Join(problems, "; "))}
+	}
+	return nil
+}
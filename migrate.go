@@ -0,0 +1,118 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+
+// Moving a computer off its local catalog is done in two steps, so that a designer
+// isn't left with no catalog at all: VerifyCatalogMigration makes sure the network
+// catalog can take over, and only then is the local one uninstalled. The plan already
+// holds off when the detection says it can't, but detection can be hours old by the
+// time a deferred run gets there, so everything is checked again just before.
+
+// Values for Policy.MigrationStrategy. With MIGRATION_REPLACE the local catalog is
+// uninstalled once the checks pass, and the network one installed after. With
+// MIGRATION_NETWORK_FIRST the network deployment is set up alongside the local catalog
+// first, see StageNetworkCatalog, and the local catalog is only uninstalled once DSA
+// has taken it up. Since DSA's /removeall takes the network deployment's registration
+// with it, it's installed again afterwards, from a share that has just worked.
+const (
+	MIGRATION_REPLACE       = "replace"
+	MIGRATION_NETWORK_FIRST = "network-first"
+)
+
+// migratingLocalCatalog reports whether the plan for s moves it off a local catalog.
+func migratingLocalCatalog(s MachineState) bool {
+	return s.CatalogState == CATALOG_STATE_LOCAL && !policy.KeepsLocalCatalog()
+}
+
+// migrationBlocked puts the move off the local catalog on hold if the detection
+// already says the network catalog couldn't replace it.
+func migrationBlocked(s MachineState) (string, string) {
+	if hold, share := catalogShareBlocked(s); hold != "" {
+		return hold, share
+	}
+	switch {
+	case s.LowDisk:
+		return fmt.Sprintf("There is not enough free disk space to move to the network catalog (%d MB needed), so the local catalog was kept.", policy.MinFreeDiskMB), ""
+	case s.LicenseDown:
+		return "The license server " + config.License.Server + " isn't answering, so the local catalog was kept until it is.", ""
+	}
+	return "", ""
+}
+
+// VerifyCatalogMigration checks, just before the local catalog is uninstalled, that the
+// network catalog can replace it: that the share can be opened and its ClientSetup
+// matches CatalogManifest, that there's MinFreeDiskMB free, and that the license server
+// answers if there is one. It lists every check that failed, and keeps the error of
+// the only one if just one did, for Classify.
+func VerifyCatalogMigration(ctx context.Context) error {
+	var problems []error
+	err := PrepareInstaller(ctx, policy.CatalogSetup, true)
+	if err != nil {
+		problems = append(problems, err)
+	} else {
+		NoteChecked("Network catalog setup at %s", policy.CatalogSetup)
+	}
+
+	drive := os.Getenv("SystemDrive") + `\`
+	free, err := diskFree(drive)
+	switch {
+	case err != nil:
+		problems = append(problems, errors.Wrapf(err, "Cannot check the free space on %s", drive))
+	case free/(1024*1024) < policy.MinFreeDiskMB:
+		problems = append(problems, errors.Errorf("%d MB free on %s, %d MB needed", free/(1024*1024), drive, policy.MinFreeDiskMB))
+	}
+
+	if config.License.Server != "" {
+		d, err := CheckLicenseServer(ctx)
+		if err != nil {
+			problems = append(problems, err)
+		} else {
+			NoteChecked("License server: %s", d)
+		}
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.Wrap(problems[0], "The network catalog can't replace the local one yet")
+	}
+	var all []string
+	for _, p := range problems {
+		all = append(all, p.Error())
+	}
+	return errors.Errorf("The network catalog can't replace the local one yet: %s", strings.Join(all, "; "))
+}
+
+// StageNetworkCatalog runs the network catalog's setup while the local catalog is still
+// in place, and waits for DSA to show the network deployment, which may take someone
+// finishing the setup's wizard, and for ConfirmNetworkCatalog to find it working. The
+// local catalog isn't touched if it doesn't.
+func StageNetworkCatalog(ctx context.Context) error {
+	err := InstallNetworkCatalog(ctx)
+	if err != nil {
+		return err
+	}
+	if !waitForWizard(ctx, "the catalog wizard to be finished", networkDeploymentStaged) {
+		return errors.Errorf("DSA doesn't show a network deployment from %s after its setup ran", filepath.Dir(policy.CatalogSetup))
+	}
+	err = ConfirmNetworkCatalog(ctx)
+	if err != nil {
+		return err
+	}
+	NoteDone("Set up the network catalog alongside the local one")
+	return nil
+}
+
+// networkDeploymentStaged reports whether DSA has a network deployment from the
+// configured share, whatever is installed locally besides.
+func networkDeploymentStaged() bool {
+	state, err := LoadDSAState()
+	return err == nil && state != nil && state.UsingNetwork &&
+		strings.EqualFold(state.LastDiscLocation, filepath.Dir(policy.CatalogSetup)+`\`)
+}
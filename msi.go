@@ -0,0 +1,45 @@
+package main
+
+import "strings"
+
+// An MSIProduct is a product as Windows Installer knows it, which is what actually
+// gets removed by msiexec /x, whatever the uninstall entries say.
+type MSIProduct struct {
+	Code    string
+	Name    string
+	Version string
+}
+
+// CrossCheckProducts compares the uninstall entries with what Windows Installer has.
+// It returns the entries to ignore because Windows Installer doesn't have their
+// product, which uninstalling would fail on, and a description of every difference.
+func CrossCheckProducts(products []InstalledProduct, msi []MSIProduct) (map[string]bool, []string) {
+	orphaned := map[string]bool{}
+	var problems []string
+	known := map[string]MSIProduct{}
+	for _, m := range msi {
+		known[strings.ToUpper(m.Code)] = m
+	}
+	listed := map[string]bool{}
+	for _, p := range products {
+		if !productCodePattern.MatchString(p.Code) {
+			continue
+		}
+		code := strings.ToUpper(p.Code)
+		listed[code] = true
+		m, ok := known[code]
+		switch {
+		case !ok:
+			orphaned[code] = true
+			problems = append(problems, "uninstall entry "+p.Code+" ("+p.Name+" "+p.Version+") has no Windows Installer product")
+		case m.Version != "" && CompareVersions(m.Version, p.Version) != 0:
+			problems = append(problems, p.Code+" is "+p.Version+" by its uninstall entry but "+m.Version+" to Windows Installer")
+		}
+	}
+	for _, m := range msi {
+		if !listed[strings.ToUpper(m.Code)] {
+			problems = append(problems, m.Name+" "+m.Version+" ("+m.Code+") is installed but has no uninstall entry")
+		}
+	}
+	return orphaned, problems
+}
@@ -0,0 +1,35 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/json"
+import "os"
+
+const (
+	OUTPUT_TEXT   = "text"
+	OUTPUT_NDJSON = "ndjson"
+)
+
+// Under -output ndjson, the standard output the events go to. Everything else that
+// would have been printed goes to standard error instead.
+var ndjsonOut *os.File
+
+// StartNDJSON implements -output ndjson: each event is written to standard output as
+// a line of JSON, for tools that wrap the runner, and the text output is moved to
+// standard error so the two don't mix.
+func StartNDJSON() {
+	ndjsonOut = os.Stdout
+	os.Stdout = os.Stderr
+	enc := json.NewEncoder(ndjsonOut)
+	AddEventSink(func(e Event) { enc.Encode(e) })
+}
+
+func SetOutput(format string) error {
+	switch format {
+	case OUTPUT_TEXT:
+	case OUTPUT_NDJSON:
+		StartNDJSON()
+	default:
+		return errors.Errorf("Unknown output format %s", format)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import "github.com/pkg/errors"
+import "fmt"
+import "os"
+import "path/filepath"
+import "text/tabwriter"
+
+// Where some DSA versions keep a state cookie of their own for each user, relative to
+// the profile folder. The first one found wins.
+var USER_DSA_FOLDERS = []string{`AppData\Local\2020\DSA`, `AppData\Roaming\2020\DSA`}
+
+// UserCatalog is the catalog state DSA has for one user.
+type UserCatalog struct {
+	User   string `json:"user"`
+	SID    string `json:"sid"`
+	State  string `json:"state"`
+	Cookie string `json:"cookie,omitempty"`
+}
+
+// userDSAState reads the profile's own state cookie, if it has one, and returns it
+// along with where it was.
+func userDSAState(p UserProfile) (*DSACatalogState, string, error) {
+	for _, dir := range USER_DSA_FOLDERS {
+		path := filepath.Join(p.Path, dir, DSA_STATE_COOKIE)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		state, err := loadDSAStateFile(path)
+		return state, path, err
+	}
+	return nil, "", nil
+}
+
+// GetUserCatalogs evaluates the catalog state for every user profile on the machine.
+// Users without a cookie of their own get whatever the machine has. Reading other
+// users' profiles takes an elevated process.
+func GetUserCatalogs() ([]UserCatalog, error) {
+	if !isElevated() {
+		return nil, Categorize(ERROR_ACCESS_DENIED, errors.New("Checking every user's catalog state needs an elevated prompt"))
+	}
+	profiles, err := ListUserProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	machine, err := GetCatalogStatus()
+	if err != nil {
+		return nil, err
+	}
+	registered := catalogRegistered()
+
+	var users []UserCatalog
+	for _, p := range profiles {
+		u := UserCatalog{User: p.Name(), SID: p.SID}
+		state, path, err := userDSAState(p)
+		switch {
+		case err != nil:
+			u.State = err.Error()
+		case state == nil:
+			u.State = catalogStateNames[machine] + " (machine-wide)"
+		default:
+			u.State = catalogStateNames[catalogStateOf(state, registered)]
+		}
+		u.Cookie = path
+		users = append(users, u)
+	}
+	return users, nil
+}
+
+func PrintUserCatalogs(users []UserCatalog) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "User\tCatalog\tState cookie\n")
+	for _, u := range users {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", u.User, u.State, u.Cookie)
+	}
+	w.Flush()
+	fmt.Println()
+}
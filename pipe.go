@@ -0,0 +1,87 @@
+//go:build windows
+
+package main
+
+import "github.com/Microsoft/go-winio"
+import "github.com/pkg/errors"
+import "encoding/json"
+import "net"
+import "sync"
+import "time"
+
+// SYSTEM and administrators get full control. Interactive users can only read, which
+// is all the GUI needs, so the runner can be running as SYSTEM while the logged-on user
+// watches.
+const PIPE_SDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GR;;;IU)"
+
+// A client that can't keep up is dropped rather than holding up the run.
+const PIPE_WRITE_TIMEOUT = time.Second
+
+type pipeServer struct {
+	mu      sync.Mutex
+	history [][]byte
+	clients []net.Conn
+}
+
+// ServePipe publishes every event on PIPE_NAME as a line of JSON. Clients that connect
+// late get everything so far first, so the GUI can be started at any point in the run.
+func ServePipe() error {
+	l, err := winio.ListenPipe(PIPE_NAME, &winio.PipeConfig{SecurityDescriptor: PIPE_SDDL})
+	if err != nil {
+		return errors.Wrapf(err, "Cannot listen on %s", PIPE_NAME)
+	}
+	s := &pipeServer{}
+	go s.accept(l)
+	AddEventSink(s.send)
+	return nil
+}
+
+func (s *pipeServer) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		ok := true
+		for _, b := range s.history {
+			if writeLine(c, b) != nil {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			s.clients = append(s.clients, c)
+		} else {
+			c.Close()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *pipeServer) send(e Event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, b)
+	live := s.clients[:0]
+	for _, c := range s.clients {
+		if writeLine(c, b) == nil {
+			live = append(live, c)
+		} else {
+			c.Close()
+		}
+	}
+	s.clients = live
+}
+
+func writeLine(c net.Conn, b []byte) error {
+	c.SetWriteDeadline(time.Now().Add(PIPE_WRITE_TIMEOUT))
+	_, err := c.Write(b)
+	return err
+}
@@ -0,0 +1,653 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "encoding/xml"
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+import "time"
+
+const (
+	ACTION_INSTALL_SOFTWARE      = "InstallSoftware"
+	ACTION_UNINSTALL_SOFTWARE    = "UninstallSoftware"
+	ACTION_RESTORE_USER_DATA     = "RestoreUserData"
+	ACTION_CONFIGURE_LICENSE     = "ConfigureLicense"
+	ACTION_VERIFY_MIGRATION      = "VerifyCatalogMigration"
+	ACTION_STAGE_NETWORK_CATALOG = "StageNetworkCatalog"
+	ACTION_UNINSTALL_CATALOG     = "UninstallCatalog"
+	ACTION_INSTALL_CATALOG       = "InstallNetworkCatalog"
+	ACTION_REPAIR_CATALOG        = "RepairCatalog"
+	ACTION_REMOVE_OTHER_VERSIONS = "RemoveOtherVersions"
+	ACTION_SYNC_GRANULES         = "SyncGranules"
+)
+
+// How often a run checks on what it's waiting for, like the processes an installer
+// spawned or another run's download.
+const POLL_INTERVAL = 2 * time.Second
+
+// How often, and for how long, a run checks whether someone has finished an
+// installer's wizard before it gives up and leaves the rest for the next run.
+const (
+	WIZARD_POLL = 30 * time.Second
+	WIZARD_WAIT = time.Hour
+)
+
+// MachineState is everything the plan is decided from. The catalog is only looked at
+// once the software is current, same as the workflow itself.
+type MachineState struct {
+	SoftwareInstalled bool   `xml:"SoftwareInstalled"`
+	SoftwareCurrent   bool   `xml:"SoftwareCurrent"`
+	SoftwareVersion   string `xml:"SoftwareVersion,omitempty"`
+	OtherVersions     string `xml:"OtherVersions,omitempty"`
+	PendingRestore    string `xml:"PendingRestore,omitempty"`
+	UpgradeInProgress bool   `xml:"UpgradeInProgress,omitempty"`
+	FallbackFor       string `xml:"FallbackFor,omitempty"`
+	CatalogState      int    `xml:"CatalogState"`
+	GranulesToAdd     string `xml:"GranulesToAdd,omitempty"`
+	GranulesToRemove  string `xml:"GranulesToRemove,omitempty"`
+	RebootPending     bool   `xml:"RebootPending"`
+	LowDisk           bool   `xml:"LowDisk"`
+	LicenseDown       bool   `xml:"LicenseDown,omitempty"`
+	SoftwareShare     bool   `xml:"SoftwareShare"`
+	CatalogShare      bool   `xml:"CatalogShare"`
+}
+
+// A Plan is the list of actions to bring the machine into line, along with the state
+// it was made from so that a saved plan can't be applied once the machine has moved on.
+// Hold is set when something has to be fixed first; it's reported once the actions
+// that could go ahead have run. HoldShare is the path behind the hold when it's a share
+// that couldn't be reached.
+type Plan struct {
+	XMLName   xml.Name     `xml:"Plan"`
+	Hostname  string       `xml:"Hostname,attr"`
+	Created   time.Time    `xml:"Created,attr"`
+	State     MachineState `xml:"State"`
+	Actions   []string     `xml:"Actions>Action"`
+	Hold      string       `xml:"Hold,omitempty"`
+	HoldShare string       `xml:"HoldShare,omitempty"`
+}
+
+type planAction struct {
+	Title   string
+	Message string
+	Phase   string
+	Run     func(context.Context) error
+	Failure string
+	// Whether it would get in the way of someone using the software, see DeferIfInUse.
+	Disruptive bool
+
+	// Actions with an Incomplete message decide how the run ends. Once everything has
+	// run, Verify checks that the action worked, after saying Checking, and waits for
+	// Waiting to be done if it hasn't yet, since installers finish in a wizard of their
+	// own. Verified is the outcome if it did, or with Continue, what's said before the
+	// run carries on with a new plan. Otherwise, and always without a Verify, the run
+	// ends Incomplete, with Remaining left to do.
+	Checking string
+	Verify   func() bool
+	Waiting  string
+	Verified string
+	Continue bool
+	// Once Verify passes, Confirm checks that what the action set up works, and the run
+	// fails with Unconfirmed if it doesn't.
+	Confirm     func(context.Context) error
+	Unconfirmed string
+	Remaining   string
+	Incomplete  string
+	// The run can't go on until the computer restarts, see WaitingForReboot.
+	Reboot bool
+}
+
+var planActions = map[string]planAction{
+	ACTION_INSTALL_SOFTWARE: {
+		Title:      "Install the 2020 software",
+		Message:    "2020 software is not installed. Installing it...",
+		Phase:      PHASE_SOFTWARE_INSTALL,
+		Run:        InstallSoftwareWithRollback,
+		Failure:    "Unable to install the 2020 software. Restart your computer and try again manually.",
+		Disruptive: true,
+		Verify:     softwareCurrent,
+		Waiting:    "the 2020 software install to be completed",
+		Verified:   "The 2020 software is installed.",
+		Continue:   true,
+		Remaining:  "Finish the 2020 software install in its own window",
+		Incomplete: "Complete the install process manually and run this again afterward.",
+	},
+	ACTION_UNINSTALL_SOFTWARE: {
+		Title:      "Uninstall the out of date 2020 software",
+		Message:    "2020 software is out of date. Uninstalling current software...",
+		Phase:      PHASE_SOFTWARE_UNINSTALL,
+		Run:        BackupAndUninstallSoftware,
+		Failure:    "Unable to uninstall the 2020 software. Restart your computer and try again manually.",
+		Disruptive: true,
+		Incomplete: "Software uninstall will require a reboot. After reboot, run again to update software.",
+		Reboot:     true,
+	},
+	ACTION_REMOVE_OTHER_VERSIONS: {
+		Title:      "Remove other versions of the 2020 software",
+		Message:    "Other versions of the 2020 software are installed alongside. Removing them...",
+		Phase:      PHASE_SOFTWARE_UNINSTALL,
+		Run:        RemoveOtherVersions,
+		Failure:    "Unable to remove the other versions of the 2020 software. Remove them yourself from Apps & features.",
+		Disruptive: true,
+	},
+	ACTION_RESTORE_USER_DATA: {
+		Title:   "Restore user data saved before the upgrade",
+		Message: "Restoring user data saved before the last upgrade...",
+		Run:     RestorePendingBackup,
+		Failure: "Unable to restore user data saved before the last upgrade.",
+	},
+	ACTION_CONFIGURE_LICENSE: {
+		Title:   "Configure the license server",
+		Message: "Checking the 2020 license configuration...",
+		Phase:   PHASE_LICENSE,
+		Run:     ConfigureLicense,
+		Failure: "Unable to configure the 2020 license.",
+	},
+	ACTION_VERIFY_MIGRATION: {
+		Title:   "Check that the network catalog can replace the local one",
+		Message: "Checking that the network catalog can take over before the local one is removed...",
+		Run:     VerifyCatalogMigration,
+		Failure: "The local catalog was kept, since the network catalog can't replace it yet. Fix the problem below and run again.",
+	},
+	ACTION_STAGE_NETWORK_CATALOG: {
+		Title:      "Set up the network catalog before removing the local one",
+		Message:    "Setting up the network catalog alongside the local one first...",
+		Phase:      PHASE_CATALOG_INSTALL,
+		Run:        StageNetworkCatalog,
+		Failure:    "The network catalog couldn't be set up, so the local catalog was kept.",
+		Disruptive: true,
+	},
+	ACTION_UNINSTALL_CATALOG: {
+		Title:      "Uninstall the local catalog",
+		Message:    "Looks like you have the catalog installed locally, not on the network. Uninstalling local catalog.",
+		Phase:      PHASE_CATALOG_UNINSTALL,
+		Run:        UninstallAndCleanCatalog,
+		Failure:    "Can't run the uninstaller for the catalog. Try running it yourself.",
+		Disruptive: true,
+	},
+	ACTION_REPAIR_CATALOG: {
+		Title:      "Clear out the half-removed catalog",
+		Message:    "The catalog is half installed, probably after an uninstall that didn't finish. Clearing it out...",
+		Phase:      PHASE_CATALOG_UNINSTALL,
+		Run:        RepairCatalog,
+		Failure:    "Unable to clear out the half-removed catalog. Remove the DSA folder and the catalog's entry in Apps & features yourself.",
+		Disruptive: true,
+	},
+	ACTION_INSTALL_CATALOG: {
+		Title:       "Install the network catalog",
+		Message:     "Installing the network catalog...",
+		Phase:       PHASE_CATALOG_INSTALL,
+		Run:         InstallNetworkCatalog,
+		Failure:     "Failed to install the network catalog.",
+		Disruptive:  true,
+		Checking:    "Checking the catalog status again...",
+		Verify:      catalogNetworked,
+		Waiting:     "the catalog wizard to be finished",
+		Confirm:     ConfirmNetworkCatalog,
+		Unconfirmed: "The network catalog is installed, but doesn't work yet.",
+		Verified:    "Looks good. Network catalog is now installed and works.",
+		Remaining:   "Finish installing the catalog in the wizard",
+		Incomplete:  "Finish installing the catalog by using the wizard. You can close this window.",
+	},
+	ACTION_SYNC_GRANULES: {
+		Title:      "Bring the catalog selection in line with the master list",
+		Message:    "The catalog selection differs from the master list. Adding and removing manufacturers...",
+		Run:        SyncGranules,
+		Failure:    "Unable to bring the catalog selection in line with the master list.",
+		Disruptive: true,
+	},
+}
+
+func softwareCurrent() bool {
+	_, current, err := GetSoftwareStatus()
+	return err == nil && current
+}
+
+func catalogNetworked() bool {
+	state, err := GetCatalogStatus()
+	return err == nil && state == CATALOG_STATE_NETWORK
+}
+
+func GetMachineState(ctx context.Context) (MachineState, error) {
+	defer TimePhase("Detection")()
+	return RunPreflight(ctx).MachineState()
+}
+
+// MachineState turns the probe results into the state a plan is made from. A failed
+// catalog check only matters once the catalog is being looked at.
+func (pf Preflight) MachineState() (MachineState, error) {
+	var s MachineState
+	if pf.SoftwareErr != nil {
+		return s, errors.Wrap(pf.SoftwareErr, "Unable to check software status")
+	}
+	s.SoftwareInstalled, s.SoftwareCurrent = pf.SoftwareInstalled, pf.SoftwareCurrent
+	s.SoftwareVersion, s.OtherVersions = pf.SoftwareVersion, pf.OtherVersions
+	s.RebootPending = pf.RebootPending
+	s.LowDisk = pf.FreeDiskMB < policy.MinFreeDiskMB
+	s.LicenseDown = pf.LicenseDown
+	s.SoftwareShare, s.CatalogShare = pf.SoftwareShare, pf.CatalogShare
+
+	state, err := LoadState()
+	if err != nil {
+		return s, err
+	}
+	s.PendingRestore = state.PendingRestore
+	s.UpgradeInProgress = state.UpgradeInProgress
+	s.FallbackFor = state.FallbackFor
+
+	if s.SoftwareInstalled && (s.SoftwareCurrent || s.HoldingFallback()) {
+		if pf.CatalogErr != nil {
+			return s, errors.Wrap(pf.CatalogErr, "Unable to check for Network Deployment")
+		}
+		s.CatalogState = pf.CatalogState
+		s.GranulesToAdd, s.GranulesToRemove = pf.GranulesToAdd, pf.GranulesToRemove
+	}
+	return s, nil
+}
+
+// A planStep is one thing BuildPlan looks at, in order. A step that's Needed either
+// adds its Action, or if Blocked says why not, puts the plan on hold and ends it there.
+// A step with no Action is only a check. Nothing after a Last step that was Needed is
+// planned in the same run.
+type planStep struct {
+	Action string
+	Needed func(MachineState) bool
+	// The reason the step can't go ahead, and the share behind it if that's the reason,
+	// or "" to go ahead.
+	Blocked func(MachineState) (string, string)
+	Last    bool
+}
+
+func catalogShareBlocked(s MachineState) (string, string) {
+	if !s.CatalogShare {
+		return "Cannot reach the network catalog at " + policy.CatalogSetup + ".", policy.CatalogSetup
+	}
+	return "", ""
+}
+
+// The software is handled first and on its own, since both installing and
+// uninstalling end the run; the catalog is only looked at once the software is current.
+var planSteps = []planStep{
+	{
+		Action: ACTION_INSTALL_SOFTWARE,
+		Needed: func(s MachineState) bool { return !s.SoftwareInstalled },
+		Blocked: func(s MachineState) (string, string) {
+			switch {
+			case s.RebootPending && s.UpgradeInProgress:
+				return "The old 2020 software was removed, but the computer hasn't been restarted since. Restart it and run this again to install the new version.", ""
+			case s.RebootPending:
+				return "A restart is pending. Restart the computer and run this again to install the 2020 software.", ""
+			case s.LowDisk:
+				return fmt.Sprintf("There is not enough free disk space to install the 2020 software (%d MB needed).", policy.MinFreeDiskMB), ""
+			case !s.SoftwareShare:
+				return "Cannot reach the 2020 software installer at " + policy.SoftwareInstaller + ".", policy.SoftwareInstaller
+			}
+			return "", ""
+		},
+		Last: true,
+	},
+	{
+		Needed: func(s MachineState) bool { return s.IsDowngrade() && !allowDowngrade },
+		Blocked: func(s MachineState) (string, string) {
+			return fmt.Sprintf("2020 software %s is newer than %s, so it was left alone. Run with -allow-downgrade to replace it.",
+				s.SoftwareVersion, policy.SoftwareVersion), ""
+		},
+	},
+	{
+		Action: ACTION_UNINSTALL_SOFTWARE,
+		Needed: func(s MachineState) bool { return !s.SoftwareCurrent && !s.HoldingFallback() },
+		Last:   true,
+	},
+	{
+		Action: ACTION_REMOVE_OTHER_VERSIONS,
+		Needed: func(s MachineState) bool { return s.OtherVersions != "" && policy.SoftwareVersions == VERSIONS_ONLY },
+	},
+	{
+		Action: ACTION_RESTORE_USER_DATA,
+		Needed: func(s MachineState) bool { return s.PendingRestore != "" },
+	},
+	{
+		Action: ACTION_CONFIGURE_LICENSE,
+		Needed: func(MachineState) bool { return config.License.Configured() },
+	},
+	{
+		// Don't take the local catalog away if the network one can't replace it.
+		Action:  ACTION_VERIFY_MIGRATION,
+		Needed:  migratingLocalCatalog,
+		Blocked: migrationBlocked,
+	},
+	{
+		Action: ACTION_STAGE_NETWORK_CATALOG,
+		Needed: func(s MachineState) bool {
+			return migratingLocalCatalog(s) && policy.MigrationStrategy == MIGRATION_NETWORK_FIRST
+		},
+		Blocked: catalogShareBlocked,
+	},
+	{
+		Action:  ACTION_UNINSTALL_CATALOG,
+		Needed:  migratingLocalCatalog,
+		Blocked: catalogShareBlocked,
+	},
+	{
+		Action: ACTION_REPAIR_CATALOG,
+		Needed: func(s MachineState) bool { return s.CatalogState == CATALOG_STATE_INCONSISTENT },
+		Blocked: func(s MachineState) (string, string) {
+			if policy.KeepsLocalCatalog() {
+				return "The local catalog is half installed. Reinstall it, since this computer keeps its own.", ""
+			}
+			return catalogShareBlocked(s)
+		},
+	},
+	{
+		Action: ACTION_INSTALL_CATALOG,
+		Needed: func(s MachineState) bool {
+			return s.CatalogState != CATALOG_STATE_NETWORK && !(s.CatalogState == CATALOG_STATE_LOCAL && policy.KeepsLocalCatalog())
+		},
+		Blocked: catalogShareBlocked,
+	},
+	{
+		Action: ACTION_SYNC_GRANULES,
+		Needed: func(s MachineState) bool {
+			return s.CatalogState == CATALOG_STATE_NETWORK && (s.GranulesToAdd != "" || s.GranulesToRemove != "")
+		},
+		Blocked: catalogShareBlocked,
+	},
+}
+
+// BuildPlan decides what to do about s, going through planSteps.
+func BuildPlan(s MachineState) Plan {
+	host, _ := os.Hostname()
+	p := Plan{Hostname: host, Created: time.Now(), State: s}
+
+	for _, step := range planSteps {
+		if !step.Needed(s) {
+			continue
+		}
+		if step.Blocked != nil {
+			if hold, share := step.Blocked(s); hold != "" {
+				p.Hold, p.HoldShare = hold, share
+				return p
+			}
+		}
+		if step.Action != "" {
+			p.Actions = append(p.Actions, step.Action)
+		}
+		if step.Last {
+			return p
+		}
+	}
+	return p
+}
+
+func (p Plan) has(action string) bool {
+	for _, a := range p.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Plan) Print() {
+	fmt.Printf("Plan for %s, made %s:\n", p.Hostname, p.Created.Format(time.RFC1123))
+	if len(p.Actions) == 0 && p.Hold == "" {
+		fmt.Println("  Nothing to do.")
+	}
+	for i, a := range p.Actions {
+		fmt.Printf("  %d. %s\n", i+1, a)
+	}
+	if p.Hold != "" {
+		fmt.Printf("  On hold: %s\n", p.Hold)
+	}
+	fmt.Println()
+}
+
+// waitForWizard checks finished every WIZARD_POLL until it returns true, and reports
+// whether it did before WIZARD_WAIT was up or ctx was done.
+func waitForWizard(ctx context.Context, what string, finished func() bool) bool {
+	if finished() {
+		return true
+	}
+	m := fmt.Sprintf("Waiting for %s. The run will carry on by itself once that's done.", what)
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_PROMPT, Message: m})
+	defer TimePhase("Wizard")()
+	deadline := time.Now().Add(WIZARD_WAIT)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(WIZARD_POLL):
+		}
+		if finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyPlan runs the plan's actions in order and returns the outcome. The checks that
+// decide whether the run goes ahead at all are made once, before the first pass; an
+// action that Continues has the plan made again and applied in another pass, whose
+// actions are added to the report's.
+func ApplyPlan(ctx context.Context, p Plan) Result {
+	NoteState(p.State)
+	// An exempt computer is left as it is, down to a restart it's waiting for.
+	if e, ok := FindExemption(); ok {
+		return ExemptRun(p, e)
+	}
+	RecoverInterruptedRun()
+	ClearReboot(ctx)
+	if p.State.HoldingFallback() {
+		Say("Keeping the last known good 2020 software, since installing %s failed.", p.State.FallbackFor)
+	}
+	if len(p.Actions) > 0 {
+		snooze, err := LoadSnooze()
+		if err != nil {
+			Warn("Ignoring the snooze: %v", err)
+		} else if snooze.Active() {
+			NoteRemaining("Wait for the snooze to run out at "+snooze.Until.Format(time.Kitchen), RerunCommand())
+			return Unsuccessful(fmt.Sprintf("Updates were snoozed by %s until %s. Run again after that, or use Check now from the tray.",
+				snooze.User, snooze.Until.Format(time.Kitchen)))
+		}
+	}
+	if len(p.Actions) > 0 {
+		if r, ok := CheckFlapping(p); !ok {
+			return r
+		}
+	}
+	if r, ok := DeferIfInUse(p); !ok {
+		return r
+	}
+	if len(p.Actions) > 0 {
+		if r, ok := WaitForInstallers(ctx); !ok {
+			return r
+		}
+	}
+	for {
+		r, next := applyPass(ctx, p)
+		if next == nil {
+			return r
+		}
+		p = *next
+	}
+}
+
+// applyPass applies p, and returns the outcome, or the plan to apply next if one of
+// its actions Continues.
+func applyPass(ctx context.Context, p Plan) (Result, *Plan) {
+	report.Installed = p.State.SoftwareVersion
+	report.OtherVersions = p.State.OtherVersions
+	if p.State.SoftwareInstalled && (p.State.SoftwareCurrent || p.State.HoldingFallback()) {
+		report.Catalog = catalogStateNames[p.State.CatalogState]
+	}
+	NoteCatalogVersions()
+	if p.State.IsDowngrade() {
+		report.Downgrade = DOWNGRADE_DECLINED
+		if p.has(ACTION_UNINSTALL_SOFTWARE) {
+			report.Downgrade = DOWNGRADE_ALLOWED
+			Warn("Downgrading the 2020 software from %s to %s, since -allow-downgrade was given.", p.State.SoftwareVersion, policy.SoftwareVersion)
+		}
+	}
+	report.Actions = append(report.Actions, p.Actions...)
+	for i, name := range p.Actions {
+		a, ok := planActions[name]
+		if !ok {
+			return Failed("The plan contains an unknown action.", errors.Errorf("Unknown action %s", name)), nil
+		}
+		SayStep(i+1, len(p.Actions), "%s", a.Message)
+		SayETA(name)
+		done := TimePhase(name)
+		err := runAction(ctx, name, a)
+		done()
+		if err != nil {
+			return Failed(a.Failure, err), nil
+		}
+		NoteDone("%s", a.Title)
+	}
+
+	// Shortcuts and file associations are checked on every run once the software is
+	// in place, since upgrades are what tend to break them.
+	if p.State.SoftwareInstalled && (p.State.SoftwareCurrent || p.State.HoldingFallback()) {
+		done := TimePhase("Integration")
+		err := VerifyIntegration(ctx)
+		done()
+		if err != nil {
+			return Failed("Some 2020 shortcuts or file associations are broken.", err), nil
+		}
+		NoteChecked("Shortcuts and file associations")
+	}
+
+	if p.Hold != "" {
+		// The software install is the only step a pending restart holds up.
+		if p.State.RebootPending && !p.State.SoftwareInstalled {
+			return WaitingForReboot(ctx, p.Hold), nil
+		}
+		if p.HoldShare != "" {
+			_, err := os.Stat(p.HoldShare)
+			if d := DiagnoseShare(ctx, p.HoldShare, err); d != "" {
+				Say("Share diagnostics: %s", d)
+			}
+		}
+		switch {
+		case p.HoldShare != "":
+			NoteRemaining("Make sure this computer can open "+p.HoldShare, RerunCommand())
+		case p.State.RebootPending:
+			NoteRemaining("Restart the computer", RerunCommand())
+		case p.State.IsDowngrade():
+			NoteRemaining("Decide whether the newer software should be replaced", RerunCommand("-allow-downgrade"))
+		default:
+			NoteRemaining("Fix the problem above", RerunCommand())
+		}
+		return Unsuccessful(p.Hold), nil
+	}
+	for _, name := range p.Actions {
+		if a := planActions[name]; a.Incomplete != "" {
+			return finishAction(ctx, name, a)
+		}
+	}
+	if p.State.CatalogState == CATALOG_STATE_LOCAL {
+		return Succeeded("This computer keeps its local catalog. Nothing else to do."), nil
+	}
+	return Succeeded("You are using the 2020 Network Deployment. Nice."), nil
+}
+
+// finishAction ends a run with the outcome of a, the action called name, which has an
+// Incomplete message, or returns the plan to carry on with if a Continues.
+func finishAction(ctx context.Context, name string, a planAction) (Result, *Plan) {
+	if a.Verify != nil {
+		if a.Checking != "" {
+			Say("%s", a.Checking)
+		}
+		done := TimePhase("Verification")
+		ok := verifyAction(ctx, name, a)
+		done()
+		if ok || waitForWizard(ctx, a.Waiting, a.Verify) {
+			if a.Confirm != nil {
+				done := TimePhase("Confirmation")
+				err := a.Confirm(ctx)
+				done()
+				if err != nil {
+					return Failed(a.Unconfirmed, err), nil
+				}
+			}
+			if !a.Continue {
+				return Succeeded(a.Verified), nil
+			}
+			// Plan again, now that there's more that can be looked at.
+			Say("%s Carrying on...", a.Verified)
+			s, err := GetMachineState(ctx)
+			if err != nil {
+				return Failed("Unable to check the machine state.", err), nil
+			}
+			next := BuildPlan(s)
+			return Result{}, &next
+		}
+	}
+	if a.Reboot {
+		return WaitingForReboot(ctx, a.Incomplete), nil
+	}
+	NoteRemaining(a.Remaining, RerunCommand())
+	return Unsuccessful(a.Incomplete), nil
+}
+
+// PlanCommand implements `2020runner plan [-out plan.xml]`.
+func PlanCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	out := fs.String("out", "", "Write the plan to this file for a later apply")
+	fs.Parse(args)
+
+	s, err := GetMachineState(ctx)
+	if err != nil {
+		return Failed("Unable to check the machine state.", err)
+	}
+	p := BuildPlan(s)
+	p.Print()
+
+	if *out == "" {
+		return Succeeded("Plan not saved. Use -out to save it for apply.")
+	}
+	b, err := xml.MarshalIndent(p, "", "  ")
+	if err == nil {
+		err = os.WriteFile(*out, b, 0644)
+	}
+	if err != nil {
+		return Failed("Unable to save the plan.", err)
+	}
+	return Succeeded("Plan written to " + *out + ".")
+}
+
+// ApplyCommand implements `2020runner apply plan.xml`.
+func ApplyCommand(ctx context.Context, args []string) Result {
+	if len(args) != 1 {
+		return Failed("Usage: 2020runner apply <plan file>", errors.New("No plan file given"))
+	}
+
+	b, err := os.ReadFile(args[0])
+	if err != nil {
+		return Failed("Unable to read the plan.", err)
+	}
+	var p Plan
+	err = xml.Unmarshal(b, &p)
+	if err != nil {
+		return Failed("Unable to decode the plan.", err)
+	}
+
+	host, _ := os.Hostname()
+	if !strings.EqualFold(p.Hostname, host) {
+		return Unsuccessful("This plan was made for " + p.Hostname + ", not this machine.")
+	}
+	s, err := GetMachineState(ctx)
+	if err != nil {
+		return Failed("Unable to check the machine state.", err)
+	}
+	if s != p.State {
+		NoteRemaining("Make a new plan", "2020runner plan -out "+args[0])
+		return Unsuccessful("The machine has changed since the plan was made. Make a new plan.")
+	}
+
+	p.Print()
+	return ApplyPlan(ctx, p)
+}
@@ -0,0 +1,278 @@
+package main
+
+import "context"
+import "reflect"
+import "strings"
+
+// Values for Policy.SoftwareVersions: whether the target version only has to be there,
+// or has to be the only one.
+const (
+	VERSIONS_PRESENT = "present"
+	VERSIONS_ONLY    = "only"
+)
+
+// Policy holds the settings that can differ between machines. The top level of the
+// config sets them for everyone and rules override them for matching machines. Unset
+// fields (empty strings, nil pointers) fall through to the next level down.
+type Policy struct {
+	SoftwareVersion   string `xml:"SoftwareVersion,omitempty"`
+	SoftwareInstaller string `xml:"SoftwareInstaller,omitempty"`
+	CatalogSetup      string `xml:"CatalogSetup,omitempty"`
+	// Which catalog product line the machine gets, CATALOG_COMMERCIAL or
+	// CATALOG_RESIDENTIAL. CatalogSetup defaults to the line's own share.
+	CatalogLine string `xml:"CatalogLine,omitempty"`
+	// Granules whose selection means the catalog is installed locally, as comma
+	// separated MfgCode or MfgCode/PlatformType (the line's platform type if left out),
+	// and how many of them have to be selected, of which 0 means any one, as does 1.
+	SentinelGranules string  `xml:"SentinelGranules,omitempty"`
+	SentinelMatches  *uint32 `xml:"SentinelMatches,omitempty"`
+	// A list of the manufacturer codes the machine should have selected, see
+	// LoadMasterGranules. Others are removed, except for the sentinels.
+	MasterGranules string `xml:"MasterGranules,omitempty"`
+	// Display name pattern for finding versions installed side by side, and whether
+	// SoftwareVersion is to be present (VERSIONS_PRESENT) or the only one (VERSIONS_ONLY).
+	SoftwareName     string `xml:"SoftwareName,omitempty"`
+	SoftwareVersions string `xml:"SoftwareVersions,omitempty"`
+	// Installer for the last known good version, used if the upgrade fails.
+	FallbackSoftwareInstaller string `xml:"FallbackSoftwareInstaller,omitempty"`
+	MinFreeDiskMB             uint64 `xml:"MinFreeDiskMB,omitempty"`
+	// The disruptive steps wait while the 2020 applications are running or have been
+	// started in the last InUseMinutes. 0 turns the check off.
+	InUseMinutes      *uint32 `xml:"InUseMinutes,omitempty"`
+	RunTimeoutMinutes uint32  `xml:"RunTimeoutMinutes,omitempty"`
+	KeepLocalCatalog  *bool   `xml:"KeepLocalCatalog,omitempty"`
+	// How a local catalog is replaced by the network one, one of the MIGRATION_ values.
+	MigrationStrategy string `xml:"MigrationStrategy,omitempty"`
+	// Run the software installers from a local copy rather than straight off the share.
+	CacheInstallers *bool `xml:"CacheInstallers,omitempty"`
+	// Limits on copying content over the network: a rate cap and the hours of the day
+	// it's allowed in, like 18:00-07:00.
+	TransferKBps  uint32 `xml:"TransferKBps,omitempty"`
+	TransferHours string `xml:"TransferHours,omitempty"`
+	Skip          *bool  `xml:"Skip,omitempty"`
+	// Why the computer is to be left as it is; runs only report on it, see FindExemption.
+	Exempt string `xml:"Exempt,omitempty"`
+	// A catalog fix that runs have already made FlapLimit times in the last FlapDays
+	// keeps coming undone, and is reported rather than made again. 0 turns the check off.
+	FlapLimit *uint32 `xml:"FlapLimit,omitempty"`
+	FlapDays  uint32  `xml:"FlapDays,omitempty"`
+	// When a run can't go on until the computer restarts, have the next boot start the
+	// run again rather than waiting for the next deployment.
+	ContinueAfterReboot *bool `xml:"ContinueAfterReboot,omitempty"`
+	// The hours of the day the runner may restart the computer in by itself, like
+	// 22:00-06:00, when a run needs it; without them it only does under -reboot-now or
+	// -reboot-at. Windows warns whoever is logged on at least RebootWarningMinutes ahead,
+	// from when the run ends, and RebootCancel says what happens if they call it off, one
+	// of the REBOOT_CANCEL_ values. Only -reboot-now waits to see that through; otherwise
+	// the next run schedules a restart that was called off again.
+	RebootHours          string `xml:"RebootHours,omitempty"`
+	RebootWarningMinutes uint32 `xml:"RebootWarningMinutes,omitempty"`
+	RebootCancel         string `xml:"RebootCancel,omitempty"`
+}
+
+// A Rule applies its policy to machines matching all of its patterns, e.g.
+//
+//	<Rule Hostname="KIOSK-*"><Skip>true</Skip></Rule>
+//	<Rule Hostname="DESIGN-LAB-*"><KeepLocalCatalog>true</KeepLocalCatalog></Rule>
+//	<Rule Hostname="DEMO-*"><Exempt>Trade show demo machines, kept offline</Exempt></Rule>
+//	<Rule OU="*OU=Pilot,*"><CatalogSetup>\\10.0.9.29\2020catalogbeta\ClientSetup\setup.exe</CatalogSetup></Rule>
+//	<Rule Group="2020-Pilot">...</Rule>
+//	<Rule OU="*OU=Residential,*"><CatalogLine>Residential</CatalogLine></Rule>
+//
+// OU is matched against the computer's distinguished name and Group against the name
+// or DN of each group the computer account is in. Later rules win over earlier ones.
+// Patterns ignore case, and * stands for any run of characters, / and \ included, as
+// DNs have them both; ? stands for any one. Everything else is taken as it is.
+type Rule struct {
+	Hostname string `xml:"Hostname,attr"`
+	OU       string `xml:"OU,attr"`
+	Group    string `xml:"Group,attr"`
+	Policy
+}
+
+var DEFAULT_POLICY = Policy{
+	SoftwareVersion:      CAP2020_SOFTWARE_CURRENT,
+	SoftwareInstaller:    PATH_SOFTWARE,
+	CatalogLine:          CATALOG_COMMERCIAL,
+	SentinelGranules:     "DMO",
+	SentinelMatches:      uint32Ptr(1),
+	SoftwareName:         "2020 Design*",
+	SoftwareVersions:     VERSIONS_PRESENT,
+	MigrationStrategy:    MIGRATION_REPLACE,
+	MinFreeDiskMB:        2048,
+	InUseMinutes:         uint32Ptr(30),
+	RunTimeoutMinutes:    6 * 60,
+	FlapLimit:            uint32Ptr(3),
+	FlapDays:             14,
+	RebootWarningMinutes: 10,
+	RebootCancel:         REBOOT_CANCEL_POSTPONE,
+}
+
+// The effective policy for this machine, set up by ResolvePolicy.
+var policy Policy
+
+// Merge overrides p with every field that is set in o.
+func (p *Policy) Merge(o Policy) {
+	dst := reflect.ValueOf(p).Elem()
+	src := reflect.ValueOf(o)
+	for i := 0; i < src.NumField(); i++ {
+		if !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// matchPattern reports whether s matches pattern, as Rule describes.
+func matchPattern(pattern, s string) bool {
+	p, r := []rune(strings.ToUpper(pattern)), []rune(strings.ToUpper(s))
+	// Where the last * was in p, and how far into r it had got.
+	star, from := -1, 0
+	i, j := 0, 0
+	for j < len(r) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			star, from = i, j
+			i++
+		case i < len(p) && (p[i] == '?' || p[i] == r[j]):
+			i++
+			j++
+		case star >= 0:
+			from++
+			i, j = star+1, from
+		default:
+			return false
+		}
+	}
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+	return i == len(p)
+}
+
+func (r Rule) needsDirectory() bool {
+	return r.OU != "" || r.Group != ""
+}
+
+// Matches reports whether the rule applies. dir is nil when the directory couldn't be
+// queried, in which case rules that depend on it never match.
+func (r Rule) Matches(host string, dir *DirectoryInfo) bool {
+	if r.Hostname == "" && !r.needsDirectory() {
+		return false
+	}
+	if r.Hostname != "" && !matchPattern(r.Hostname, host) {
+		return false
+	}
+	if r.needsDirectory() && dir == nil {
+		return false
+	}
+	if r.OU != "" && !matchPattern(r.OU, dir.DN) {
+		return false
+	}
+	if r.Group != "" && !dir.InGroup(r.Group) {
+		return false
+	}
+	return true
+}
+
+func (r Rule) String() string {
+	var parts []string
+	if r.Hostname != "" {
+		parts = append(parts, "hostname "+r.Hostname)
+	}
+	if r.OU != "" {
+		parts = append(parts, "OU "+r.OU)
+	}
+	if r.Group != "" {
+		parts = append(parts, "group "+r.Group)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ResolvePolicy works out the policy for host from the built-in defaults, the config,
+// the rollout if host is in its ring, the rules that match host and, last of all, the
+// environment. Active Directory is only queried when some rule needs it.
+func ResolvePolicy(ctx context.Context, c Config, host string) Policy {
+	var dir *DirectoryInfo
+	for _, r := range c.Rules {
+		if r.needsDirectory() {
+			info, err := GetDirectoryInfo(ctx)
+			if err != nil {
+				Warn("Unable to query Active Directory, ignoring OU and group rules: %v", err)
+			} else {
+				dir = &info
+			}
+			break
+		}
+	}
+
+	p := DEFAULT_POLICY
+	p.Merge(c.Policy)
+	c.Rollout.apply(&p, host)
+	for _, r := range c.Rules {
+		if r.Matches(host, dir) {
+			Say("Applying rule for %s", r)
+			p.Merge(r.Policy)
+		}
+	}
+	err := ApplyEnvPolicy(&p)
+	if err != nil {
+		Warn("Unable to use all the settings from the environment: %v", err)
+	}
+	if _, ok := catalogLine(p.CatalogLine); !ok {
+		Warn("Unknown catalog line %s, using %s.", p.CatalogLine, CATALOG_COMMERCIAL)
+		p.CatalogLine = CATALOG_COMMERCIAL
+	}
+	if p.MigrationStrategy != MIGRATION_REPLACE && p.MigrationStrategy != MIGRATION_NETWORK_FIRST {
+		Warn("Unknown migration strategy %s, using %s.", p.MigrationStrategy, MIGRATION_REPLACE)
+		p.MigrationStrategy = MIGRATION_REPLACE
+	}
+	if p.CatalogSetup == "" {
+		p.CatalogSetup = p.Catalog().Setup
+	}
+	p.SoftwareInstaller = NormalizeUNC(p.SoftwareInstaller)
+	p.CatalogSetup = NormalizeUNC(p.CatalogSetup)
+	p.FallbackSoftwareInstaller = NormalizeUNC(p.FallbackSoftwareInstaller)
+	return p
+}
+
+func (p Policy) ShouldSkip() bool {
+	return p.Skip != nil && *p.Skip
+}
+
+func (p Policy) KeepsLocalCatalog() bool {
+	return p.KeepLocalCatalog != nil && *p.KeepLocalCatalog
+}
+
+func (p Policy) ContinuesAfterReboot() bool {
+	return p.ContinueAfterReboot != nil && *p.ContinueAfterReboot
+}
+
+func (p Policy) CachesInstallers() bool {
+	return p.CacheInstallers != nil && *p.CacheInstallers
+}
+
+// The settings that can be turned off with 0 are pointers, so that 0 isn't taken for
+// unset by Merge.
+
+func (p Policy) SentinelsNeeded() uint32 {
+	return uint32Value(p.SentinelMatches)
+}
+
+func (p Policy) InUseWindowMinutes() uint32 {
+	return uint32Value(p.InUseMinutes)
+}
+
+func (p Policy) FlapThreshold() uint32 {
+	return uint32Value(p.FlapLimit)
+}
+
+func uint32Ptr(n uint32) *uint32 {
+	return &n
+}
+
+func uint32Value(n *uint32) uint32 {
+	if n == nil {
+		return 0
+	}
+	return *n
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"KIOSK-*", "kiosk-07", true},
+		{"KIOSK-*", "LAB-07", false},
+		{"LAB-PC0?", "LAB-PC01", true},
+		{"LAB-PC0?", "LAB-PC010", false},
+		{"*OU=Pilot,*", "CN=LAB-PC01,OU=Pilot,DC=corp,DC=local", true},
+		{"*OU=Design*", `CN=LAB-PC01,OU=Design\/Build,DC=corp,DC=local`, true},
+		{"*OU=Design*,DC=corp*", `CN=LAB-PC01,OU=Design/Build,OU=Labs,DC=corp,DC=local`, true},
+		{`CN=Smith\, J*`, `CN=Smith\, Jo,OU=Staff`, true},
+		{"*OU=[AB]*", "CN=X,OU=[AB],DC=corp", true},
+		{"*OU=[AB]*", "CN=X,OU=A,DC=corp", false},
+		{"2020 Design*", "2020 Design v14.0", true},
+		{"*", "", true},
+		{"", "", true},
+		{"", "X", false},
+		{"A*B*C", "AXXBXXC", true},
+		{"A*B*C", "AXXCXXB", false},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
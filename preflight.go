@@ -0,0 +1,373 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "flag"
+import "fmt"
+import "net"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "text/tabwriter"
+import "time"
+
+const PREFLIGHT_TIMEOUT = 10 * time.Second
+
+var errTimedOut = errors.New("Timed out")
+
+type CheckResult struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// Preflight is the result of the independent probes run before anything is decided.
+type Preflight struct {
+	SoftwareInstalled bool
+	SoftwareCurrent   bool
+	SoftwareVersion   string
+	OtherVersions     string
+	SoftwareErr       error `json:"-"`
+	CatalogState      int
+	CatalogErr        error `json:"-"`
+	GranulesToAdd     string
+	GranulesToRemove  string
+	SoftwareShare     bool
+	CatalogShare      bool
+	FreeDiskMB        uint64
+	RebootPending     bool
+	LicenseDown       bool
+	Results           []CheckResult
+}
+
+// A probe returns its result for display, and a function that records what it found.
+// The latter is only called if the probe finished in time. The context a probe gets is
+// done once its time is up, or the run is stopped.
+type probe struct {
+	Name string
+	Run  func(context.Context) (CheckResult, func(*Preflight))
+}
+
+var preflightProbes = []probe{
+	{"Software", probeSoftware},
+	{"Catalog", probeCatalog},
+	{"Granules", probeGranules},
+	{"Software share", func(ctx context.Context) (CheckResult, func(*Preflight)) {
+		ok, r := probeShare(ctx, "Software share", policy.SoftwareInstaller, false)
+		return r, func(pf *Preflight) { pf.SoftwareShare = ok }
+	}},
+	{"Catalog share", func(ctx context.Context) (CheckResult, func(*Preflight)) {
+		ok, r := probeShare(ctx, "Catalog share", policy.CatalogSetup, true)
+		return r, func(pf *Preflight) { pf.CatalogShare = ok }
+	}},
+	{"License server", probeLicenseServer},
+	{"Free disk", probeDisk},
+	{"Pending reboot", probeReboot},
+}
+
+// RunPreflight runs all probes at once and waits at most PREFLIGHT_TIMEOUT for them.
+// A probe that doesn't finish in time is reported as timed out and counts as failed.
+// Probes are passed the deadline, so the ones that go over the network give up with
+// it, but a blocked SMB or registry call can't be interrupted, so its goroutine is
+// abandoned.
+func RunPreflight(ctx context.Context) Preflight {
+	ctx, cancel := context.WithTimeout(ctx, PREFLIGHT_TIMEOUT)
+	defer cancel()
+
+	pf := Preflight{SoftwareErr: errTimedOut, CatalogErr: errTimedOut}
+	pf.Results = make([]CheckResult, len(preflightProbes))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, p := range preflightProbes {
+		wg.Add(1)
+		go func(i int, p probe) {
+			defer wg.Done()
+			type result struct {
+				r     CheckResult
+				apply func(*Preflight)
+			}
+			done := make(chan result, 1)
+			go func() {
+				r, apply := p.Run(ctx)
+				done <- result{r, apply}
+			}()
+
+			select {
+			case res := <-done:
+				mu.Lock()
+				pf.Results[i] = res.r
+				res.apply(&pf)
+				mu.Unlock()
+			case <-ctx.Done():
+				mu.Lock()
+				pf.Results[i] = CheckResult{Name: p.Name, Detail: "timed out"}
+				mu.Unlock()
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	return pf
+}
+
+func probeSoftware(ctx context.Context) (CheckResult, func(*Preflight)) {
+	version, err := GetSoftwareVersion()
+	var products []InstalledProduct
+	if err == nil {
+		products, err = ListInstalledSoftware()
+	}
+	// An uninstall entry Windows Installer knows nothing about is left over from a
+	// botched removal, and uninstalling it again can only fail, so it doesn't count.
+	var problems []string
+	if err == nil {
+		msi, merr := ListMSIProducts()
+		if merr != nil {
+			problems = append(problems, merr.Error())
+		} else {
+			var orphaned map[string]bool
+			orphaned, problems = CrossCheckProducts(products, msi)
+			if orphaned[strings.ToUpper(filepath.Base(CAP2020_SOFTWARE))] {
+				version = ""
+			}
+			var kept []InstalledProduct
+			for _, p := range products {
+				if !orphaned[strings.ToUpper(p.Code)] {
+					kept = append(kept, p)
+				}
+			}
+			products = kept
+		}
+	}
+	side := false
+	for _, p := range products {
+		side = side || p.Version == policy.SoftwareVersion
+	}
+	others := OtherVersions(products)
+
+	installed, current := version != "" || side, version == policy.SoftwareVersion || side
+	r := CheckResult{Name: "Software", OK: err == nil && installed && current}
+	switch {
+	case err != nil:
+		r.Detail = err.Error()
+	case !installed:
+		r.Detail = "not installed"
+	case !current && CompareVersions(version, policy.SoftwareVersion) > 0:
+		r.Detail = "version " + version + ", newer than " + policy.SoftwareVersion
+	case !current:
+		r.Detail = "version " + version + ", out of date"
+	default:
+		r.Detail = "version " + policy.SoftwareVersion
+	}
+	if err == nil && others != "" {
+		r.Detail += "; also installed: " + others
+		r.OK = r.OK && policy.SoftwareVersions != VERSIONS_ONLY
+	}
+	if len(problems) > 0 {
+		r.Detail += "; " + strings.Join(problems, "; ")
+		r.OK = false
+	}
+	return r, func(pf *Preflight) {
+		pf.SoftwareInstalled, pf.SoftwareCurrent, pf.SoftwareErr = installed, current, err
+		pf.SoftwareVersion, pf.OtherVersions = version, others
+	}
+}
+
+var catalogStateNames = map[int]string{
+	CATALOG_STATE_MISSNG:       "not installed",
+	CATALOG_STATE_LOCAL:        "installed locally",
+	CATALOG_STATE_NETWORK:      "network deployment",
+	CATALOG_STATE_INVALID:      "invalid",
+	CATALOG_STATE_INCONSISTENT: "inconsistent (DSA state and uninstall entry disagree)",
+}
+
+func probeCatalog(ctx context.Context) (CheckResult, func(*Preflight)) {
+	state, err := GetCatalogStatus()
+	r := CheckResult{Name: "Catalog", OK: err == nil && state == CATALOG_STATE_NETWORK, Detail: catalogStateNames[state]}
+	if err != nil {
+		r.Detail = err.Error()
+	}
+	return r, func(pf *Preflight) {
+		pf.CatalogState, pf.CatalogErr = state, err
+	}
+}
+
+func probeShare(ctx context.Context, name, path string, catalog bool) (bool, CheckResult) {
+	err := ConnectShare(path)
+	if err == nil {
+		_, err = os.Stat(path)
+	}
+	if err == nil {
+		err = ValidateShareLayout(path, catalog)
+	}
+	if err != nil {
+		detail := err.Error()
+		if d := DiagnoseShare(ctx, path, err); d != "" {
+			detail += " (" + d + ")"
+		}
+		var re *RunnerError
+		if errors.As(shareFailureError(err), &re) && re.Hint != "" {
+			detail += ". " + re.Hint
+		}
+		return false, CheckResult{Name: name, Detail: detail}
+	}
+	detail := path
+	if o := ShareOrigin(ctx, path); o != "" {
+		detail += " (" + o + ")"
+	}
+	return true, CheckResult{Name: name, OK: true, Detail: detail}
+}
+
+// probeLicenseServer reports on the license server. It only counts against moving off
+// a local catalog, see migrationBlocked: a designer can't get a license without it,
+// but it's nothing installing fixes.
+func probeLicenseServer(ctx context.Context) (CheckResult, func(*Preflight)) {
+	r := CheckResult{Name: "License server", OK: true, Detail: "not configured"}
+	if config.License.Server != "" {
+		d, err := CheckLicenseServer(ctx)
+		if err != nil {
+			d, r.OK = err.Error(), false
+		}
+		r.Detail = d
+	}
+	return r, func(pf *Preflight) { pf.LicenseDown = !r.OK }
+}
+
+func probeDisk(ctx context.Context) (CheckResult, func(*Preflight)) {
+	drive := os.Getenv("SystemDrive") + `\`
+	free, err := diskFree(drive)
+	if err != nil {
+		return CheckResult{Name: "Free disk", Detail: err.Error()}, func(*Preflight) {}
+	}
+	mb := free / (1024 * 1024)
+	r := CheckResult{Name: "Free disk", OK: mb >= policy.MinFreeDiskMB, Detail: fmt.Sprintf("%d MB on %s", mb, drive)}
+	return r, func(pf *Preflight) { pf.FreeDiskMB = mb }
+}
+
+func probeReboot(ctx context.Context) (CheckResult, func(*Preflight)) {
+	pending, why := IsRebootPending()
+	r := CheckResult{Name: "Pending reboot", OK: !pending, Detail: "none"}
+	if pending {
+		r.Detail = why
+	}
+	return r, func(pf *Preflight) { pf.RebootPending = pending }
+}
+
+func (pf Preflight) Print() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, r := range pf.Results {
+		mark := "OK"
+		if !r.OK {
+			mark = "--"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", mark, r.Name, r.Detail)
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// ReportOnly implements -report-only, for scheduled runs that keep track of drift: it
+// works out what a run would do and publishes that through the report, without doing
+// any of it. The outcome is successful only if there's nothing to do.
+func ReportOnly(ctx context.Context) Result {
+	report.ReportOnly = true
+	sendReport = true
+	s, err := GetMachineState(ctx)
+	if err != nil {
+		return Failed("Unable to check the machine state.", err)
+	}
+	NoteState(s)
+	p := BuildPlan(s)
+	if e, ok := FindExemption(); ok {
+		return ExemptRun(p, e)
+	}
+	report.Installed = s.SoftwareVersion
+	report.OtherVersions = s.OtherVersions
+	NoteCatalogVersions()
+	report.Planned, report.Hold = p.Actions, p.Hold
+	if s.SoftwareInstalled && (s.SoftwareCurrent || s.HoldingFallback()) {
+		report.Catalog = catalogStateNames[s.CatalogState]
+	}
+	if len(p.Actions) == 0 && p.Hold == "" {
+		return Succeeded("This computer is up to date.")
+	}
+	p.Print()
+	NoteRemaining("Bring the computer up to date", RerunCommand())
+	return Unsuccessful("This computer has drifted. Nothing was changed, since this was a report-only run.")
+}
+
+// StatusCommand implements `2020runner status [-all-users] [-fresh]`, which only
+// reports. -all-users adds the catalog state DSA has for each user profile. The
+// detection comes from CachedPreflight unless -fresh is given.
+func StatusCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	allUsers := fs.Bool("all-users", false, "Also show the catalog state for every user profile (needs elevation)")
+	fresh := fs.Bool("fresh", false, "Detect everything again, rather than use the last detection if nothing it depends on changed")
+	fs.Parse(args)
+
+	var pf Preflight
+	if *fresh {
+		pf = RunPreflight(ctx)
+		InvalidateDetectionCache()
+	} else {
+		pf = CachedPreflight(ctx)
+	}
+	NoteSystemFacts().Print()
+	pf.Print()
+	if *allUsers {
+		users, err := GetUserCatalogs()
+		if err != nil {
+			return Failed("Unable to check the catalog state for each user.", err)
+		}
+		PrintUserCatalogs(users)
+		report.Users = users
+	}
+
+	s, err := pf.MachineState()
+	if err != nil {
+		return Failed("Unable to check the machine state.", err)
+	}
+	if state, err := LoadState(); err == nil && state.RebootRequired != "" && state.RebootSince != nil {
+		Say("The last run is waiting for a restart, since %s: %s", state.RebootSince.Format("Jan 2 3:04 PM"), state.RebootRequired)
+		if state.RebootAt != nil {
+			Say("It was set to restart the computer at %s.", state.RebootAt.Format("Jan 2 3:04 PM"))
+		}
+	}
+	p := BuildPlan(s)
+	p.Print()
+	if e, ok := FindExemption(); ok {
+		report.Exempt = e.String()
+		return Succeeded(fmt.Sprintf("This computer is exempt (%s), so runs leave it as it is.", e))
+	}
+	if len(p.Actions) == 0 && p.Hold == "" {
+		return Succeeded("This computer is up to date.")
+	}
+	NoteRemaining("Bring the computer up to date", RerunCommand())
+	return Unsuccessful("This computer needs attention. Run 2020runner without a command to fix it.")
+}
+
+// How long the license server gets to answer the connectivity check.
+const LICENSE_CHECK_TIMEOUT = 3 * time.Second
+
+// CheckLicenseServer tests that the license server's port takes connections, which is
+// as far as can be checked without speaking the license manager's own protocol. It
+// returns what it found for the status output.
+func CheckLicenseServer(ctx context.Context) (string, error) {
+	l := config.License
+	port := l.Port
+	if port == 0 {
+		port = LICENSE_PORT_DEFAULT
+	}
+	ctx, cancel := context.WithTimeout(ctx, LICENSE_CHECK_TIMEOUT)
+	defer cancel()
+
+	addr := net.JoinHostPort(l.Server, strconv.Itoa(int(port)))
+	start := time.Now()
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", Categorize(ERROR_NETWORK, errors.Wrapf(err, "License server %s isn't reachable", addr))
+	}
+	conn.Close()
+	return fmt.Sprintf("%s answered in %d ms", addr, time.Since(start).Milliseconds()), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+// The BITS job is found again by this name on later runs.
+const PRESTAGE_JOB = "2020runner-prestage"
+
+type prestageFile struct {
+	Src  string
+	Dst  string
+	Info os.FileInfo
+}
+
+// prestageFiles lists the installer files that aren't in the local cache yet.
+func prestageFiles() ([]prestageFile, error) {
+	var files []prestageFile
+	for _, installer := range []string{policy.SoftwareInstaller, policy.FallbackSoftwareInstaller} {
+		if !strings.HasPrefix(installer, `\\`) {
+			continue
+		}
+		src := filepath.Dir(installer)
+		dst, err := cacheDir(src)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			f := prestageFile{Src: path, Dst: filepath.Join(dst, rel), Info: info}
+			if !cacheUpToDate(f.Dst, info) {
+				files = append(files, f)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func psArray(items []string) string {
+	var quoted []string
+	for _, s := range items {
+		quoted = append(quoted, psQuote(s))
+	}
+	return "@(" + strings.Join(quoted, ", ") + ")"
+}
+
+// PrestageCommand implements `2020runner prestage`, meant to run from a scheduled task
+// ahead of the maintenance window. The first run hands the copy of the installers into
+// the local cache to BITS at low priority, so it only uses bandwidth nobody else wants
+// and survives reboots and dropped connections. Later runs check on it and finish it
+// off once it's done, after which the actual install needs no copying.
+func PrestageCommand(ctx context.Context, args []string) Result {
+	if !policy.CachesInstallers() {
+		return Unsuccessful("Pre-staging is only useful with CacheInstallers turned on.")
+	}
+	files, err := prestageFiles()
+	if err != nil {
+		return Failed("Unable to list the installer files.", err)
+	}
+
+	var srcs, dsts []string
+	for _, f := range files {
+		err = os.MkdirAll(filepath.Dir(f.Dst), 0755)
+		if err != nil {
+			return Failed("Unable to create the cache folder.", err)
+		}
+		srcs = append(srcs, f.Src)
+		dsts = append(dsts, f.Dst)
+	}
+
+	// BITS is kept to the transfer hours by suspending the job outside them.
+	window, err := transferWindow()
+	if err != nil {
+		return Failed("Unable to read the transfer hours.", err)
+	}
+	allowed := "$true"
+	if window != nil && !window.Open(time.Now()) {
+		allowed = "$false"
+	}
+
+	start := "'nothing'"
+	if allowed == "$false" {
+		start = "'closed'"
+	} else if len(files) > 0 {
+		start = fmt.Sprintf("Start-BitsTransfer -Source %s -Destination %s -Asynchronous -Priority Low -DisplayName $name | Out-Null; 'started'",
+			psArray(srcs), psArray(dsts))
+	}
+	script := fmt.Sprintf(`$name = %s
+$allowed = %s
+$job = Get-BitsTransfer -Name $name -ErrorAction SilentlyContinue | Select-Object -First 1
+if (-not $job) { %s }
+elseif ($job.JobState -eq 'Transferred') { Complete-BitsTransfer $job; 'done' }
+elseif (-not $allowed) { if ($job.JobState -ne 'Suspended') { Suspend-BitsTransfer $job | Out-Null }; 'closed' }
+elseif ($job.JobState -eq 'Error') { 'error ' + $job.ErrorDescription; Resume-BitsTransfer $job -Asynchronous | Out-Null }
+else {
+  if ($job.JobState -eq 'Suspended') { Resume-BitsTransfer $job -Asynchronous | Out-Null }
+  'transferring ' + $job.BytesTransferred + ' ' + $job.BytesTotal
+}`, psQuote(PRESTAGE_JOB), allowed, start)
+	out, err := runPowerShell(ctx, script)
+	if err != nil {
+		return Failed("Unable to talk to BITS.", err)
+	}
+
+	fields := strings.Fields(out)
+	status := ""
+	if len(fields) > 0 {
+		status = fields[0]
+	}
+	switch status {
+	case "nothing":
+		return Succeeded("The installers are already in the local cache.")
+	case "closed":
+		return Succeeded("Outside the transfer hours (" + policy.TransferHours + "). Copying waits until they start.")
+	case "started":
+		return Succeeded(fmt.Sprintf("Started copying %d installer files to the local cache in the background.", len(files)))
+	case "done":
+		// BITS doesn't carry the modification times over, and the cache goes by them.
+		for _, f := range files {
+			if fi, err := os.Stat(f.Dst); err == nil && fi.Size() == f.Info.Size() {
+				os.Chtimes(f.Dst, f.Info.ModTime(), f.Info.ModTime())
+			}
+		}
+		return Succeeded("The installers have been copied to the local cache.")
+	case "transferring":
+		var done, total uint64
+		fmt.Sscan(strings.Join(fields[1:], " "), &done, &total)
+		return Succeeded(fmt.Sprintf("Still copying the installers in the background: %d of %d MB.", done/1024/1024, total/1024/1024))
+	case "error":
+		return Unsuccessful("Copying the installers in the background ran into trouble, retrying: " + strings.TrimSpace(strings.TrimPrefix(out, "error")))
+	}
+	return Failed("BITS said something unexpected.", errors.Errorf("PowerShell output: %s", out))
+}
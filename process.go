@@ -0,0 +1,296 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "bytes"
+import "context"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+import "sync"
+import "syscall"
+import "time"
+import "unsafe"
+
+// How much of each command's output goes in the report. It's the end that's kept,
+// since that's where installers say what went wrong.
+const COMMAND_OUTPUT_MAX = 4096
+
+var commandsMu sync.Mutex
+
+// Variables passed through to child processes. Everything else the runner was started
+// with, like a PATH pointing at a share or a TEMP on a mapped drive, is left out.
+var CHILD_ENVIRONMENT = []string{
+	"ALLUSERSPROFILE", "APPDATA", "CommonProgramFiles", "CommonProgramFiles(x86)", "CommonProgramW6432",
+	"COMPUTERNAME", "ComSpec", "LOCALAPPDATA", "NUMBER_OF_PROCESSORS", "OS", "PATHEXT",
+	"PROCESSOR_ARCHITECTURE", "ProgramData", "ProgramFiles", "ProgramFiles(x86)", "ProgramW6432",
+	"PUBLIC", "SystemDrive", "SystemRoot", "TEMP", "TMP", "USERDOMAIN", "USERNAME", "USERPROFILE", "windir",
+}
+
+// Mirrors JOBOBJECT_BASIC_ACCOUNTING_INFORMATION, which x/sys/windows doesn't define.
+type jobAccountingInfo struct {
+	TotalUserTime             int64
+	TotalKernelTime           int64
+	ThisPeriodTotalUserTime   int64
+	ThisPeriodTotalKernelTime int64
+	TotalPageFaultCount       uint32
+	TotalProcesses            uint32
+	ActiveProcesses           uint32
+	TotalTerminatedProcesses  uint32
+}
+
+// ChildEnvironment is the environment child processes get unless they're given one:
+// CHILD_ENVIRONMENT from our own, and a PATH of just the Windows folders.
+func ChildEnvironment() []string {
+	var env []string
+	for _, name := range CHILD_ENVIRONMENT {
+		if v, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+v)
+		}
+	}
+	root := os.Getenv("SystemRoot")
+	env = append(env, "PATH="+strings.Join([]string{
+		filepath.Join(root, "System32"),
+		root,
+		filepath.Join(root, "System32", "Wbem"),
+		filepath.Join(root, "System32", "WindowsPowerShell", "v1.0"),
+	}, ";"))
+	return env
+}
+
+// ChildWorkDir is where child processes run unless told otherwise. Installers started
+// from the share would otherwise inherit it as their working directory.
+func ChildWorkDir() (string, error) {
+	dir := filepath.Join(os.Getenv("SystemRoot"), "Temp", "2020runner")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot create working folder for child processes")
+	}
+	return dir, nil
+}
+
+var loggedEnvMu sync.Mutex
+var loggedEnv string
+
+// logCommand prints exactly what's about to run. The environment is the same for
+// nearly everything, so it's only printed when it changes.
+func logCommand(cmd *exec.Cmd) {
+	line := windows.ComposeCommandLine(cmd.Args)
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.CmdLine != "" {
+		line = cmd.SysProcAttr.CmdLine
+	}
+	Say("Running %s (in %s)", line, cmd.Dir)
+
+	env := strings.Join(cmd.Env, "\n  ")
+	loggedEnvMu.Lock()
+	defer loggedEnvMu.Unlock()
+	if env != loggedEnv {
+		loggedEnv = env
+		Say("With environment:\n  %s", env)
+	}
+}
+
+// RunCommand runs cmd and returns its combined output once cmd and every process it
+// spawned have exited. dsa.exe and Setup.exe sometimes hand off to a child and return
+// straight away, so waiting on the parent alone would move on while the wizard is
+// still running. Cancelling ctx kills the whole process tree.
+//
+// Unless cmd says otherwise, it runs in ChildWorkDir with ChildEnvironment.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	return RunPromptedCommand(ctx, cmd, nil)
+}
+
+// RunPromptedCommand is RunCommand for a command that may ask for confirmation despite
+// being told not to. A dialog it keeps up is answered with the first of answers it
+// offers; any other is left for the user, and the run says which button to click.
+func RunPromptedCommand(ctx context.Context, cmd *exec.Cmd, answers []string) ([]byte, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Dir == "" {
+		cmd.Dir, err = ChildWorkDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cmd.Env == nil {
+		cmd.Env = ChildEnvironment()
+	}
+	logCommand(cmd)
+
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot create job object")
+	}
+	defer windows.CloseHandle(job)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// The command starts suspended and only runs once it's in the job, so nothing it
+	// spawns can get out of the job before then.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+	started := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := false
+	h, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, uint32(cmd.Process.Pid))
+	if err == nil {
+		tracked = windows.AssignProcessToJobObject(job, h) == nil
+		windows.CloseHandle(h)
+	}
+	err = resumeProcess(uint32(cmd.Process.Pid))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.Wrapf(err, "Cannot start %s", cmd.Path)
+	}
+
+	watchJob := job
+	if !tracked {
+		watchJob = 0
+	}
+	stop := make(chan struct{})
+	// The audit is waited for once stop is closed, so it's deferred first.
+	if auditUI {
+		audited := make(chan struct{})
+		defer func() { <-audited }()
+		go func() {
+			AuditWindows(windows.ComposeCommandLine(cmd.Args), watchJob, cmd.Process.Pid, stop)
+			close(audited)
+		}()
+	}
+	defer close(stop)
+	go WatchForPrompts(filepath.Base(cmd.Path), watchJob, cmd.Process.Pid, answers, stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if tracked {
+				windows.TerminateJobObject(job, 1)
+			}
+			cmd.Process.Kill()
+		case <-stop:
+		}
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		err = errors.Wrapf(ctx.Err(), "Stopped %s", cmd.Path)
+	} else if tracked {
+		if werr := waitForJob(ctx, job); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	logCommandEnd(cmd, started, out.Bytes(), err)
+	return out.Bytes(), err
+}
+
+// logCommandEnd adds cmd to the report, and shows how it ended under -v and its
+// output under -vv.
+func logCommandEnd(cmd *exec.Cmd, started time.Time, out []byte, err error) {
+	d := time.Since(started)
+	r := CommandRecord{Program: cmd.Path, Args: cmd.Args[1:], Dir: cmd.Dir, ExitCode: -1, Seconds: d.Seconds()}
+	if cmd.SysProcAttr != nil && cmd.SysProcAttr.CmdLine != "" {
+		if argv, derr := windows.DecomposeCommandLine(cmd.SysProcAttr.CmdLine); derr == nil && len(argv) > 0 {
+			r.Args = argv[1:]
+		}
+	}
+	if cmd.ProcessState != nil {
+		r.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Output = string(out)
+	if len(out) > COMMAND_OUTPUT_MAX {
+		r.Output, r.Truncated = string(out[len(out)-COMMAND_OUTPUT_MAX:]), true
+	}
+	commandsMu.Lock()
+	report.Commands = append(report.Commands, r)
+	commandsMu.Unlock()
+
+	took := d.Round(time.Second)
+	if err != nil {
+		Verbose("%s failed after %v: %v", filepath.Base(cmd.Path), took, err)
+	} else {
+		Verbose("%s finished after %v", filepath.Base(cmd.Path), took)
+	}
+	if len(out) > 0 {
+		Debug("Output of %s:\n%s", filepath.Base(cmd.Path), out)
+	}
+}
+
+// resumeProcess lets a process started with CREATE_SUSPENDED run. exec.Cmd closes the
+// handle to its first thread, so the thread is found again by its process.
+func resumeProcess(pid uint32) error {
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot list threads")
+	}
+	defer windows.CloseHandle(snap)
+	e := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	for err = windows.Thread32First(snap, &e); err == nil; err = windows.Thread32Next(snap, &e) {
+		if e.OwnerProcessID != pid {
+			continue
+		}
+		t, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, e.ThreadID)
+		if err != nil {
+			return errors.Wrap(err, "Cannot open the main thread")
+		}
+		_, err = windows.ResumeThread(t)
+		windows.CloseHandle(t)
+		return errors.Wrap(err, "Cannot resume the main thread")
+	}
+	return errors.Errorf("Process %d has no thread to resume", pid)
+}
+
+func waitForJob(ctx context.Context, job windows.Handle) error {
+	for {
+		var info jobAccountingInfo
+		err := windows.QueryInformationJobObject(job, windows.JobObjectBasicAccountingInformation,
+			uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info)), nil)
+		if err != nil {
+			return errors.Wrap(err, "Cannot query job object")
+		}
+		if info.ActiveProcesses == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			windows.TerminateJobObject(job, 1)
+			return errors.Wrapf(ctx.Err(), "%d spawned processes still running", info.ActiveProcesses)
+		case <-time.After(POLL_INTERVAL):
+		}
+	}
+}
+
+// WaitForKeyRemoval polls until the HKLM key at path no longer exists. Uninstallers
+// remove their own uninstall entry last, so this is the marker that they're done.
+func WaitForKeyRemoval(ctx context.Context, path string) error {
+	for {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+		if err == registry.ErrNotExist {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "Cannot open registry key %s", path)
+		}
+		k.Close()
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "Registry key %s still present", path)
+		case <-time.After(POLL_INTERVAL):
+		}
+	}
+}
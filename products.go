@@ -0,0 +1,67 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os/exec"
+import "regexp"
+import "strings"
+
+// Both the software's and the catalog's uninstall entries live under here.
+const UNINSTALL_ROOT = `SOFTWARE\WOW6432Node\Microsoft\Windows\CurrentVersion\Uninstall`
+
+// Where else a 64-bit build of the software would register itself.
+const UNINSTALL_ROOT_NATIVE = `SOFTWARE\Microsoft\Windows\CurrentVersion\Uninstall`
+
+var productCodePattern = regexp.MustCompile(`^\{[0-9A-Fa-f-]{36}\}$`)
+
+// An InstalledProduct is one uninstall entry for a version of the 2020 software.
+type InstalledProduct struct {
+	Key     string
+	Code    string
+	Name    string
+	Version string
+}
+
+// OtherVersions returns the versions in products other than the target, comma
+// separated, which keeps MachineState comparable.
+func OtherVersions(products []InstalledProduct) string {
+	var vs []string
+	for _, p := range products {
+		if p.Version != policy.SoftwareVersion {
+			vs = append(vs, p.Version)
+		}
+	}
+	return strings.Join(vs, ", ")
+}
+
+// RemoveOtherVersions uninstalls every version but the target. Only MSI products can be
+// removed like this; anything else is left for a person to deal with.
+func RemoveOtherVersions(ctx context.Context) error {
+	products, err := ListInstalledSoftware()
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		if p.Version == policy.SoftwareVersion {
+			continue
+		}
+		if CompareVersions(p.Version, policy.SoftwareVersion) > 0 && !allowDowngrade {
+			Warn("Leaving %s %s alone, since it's newer than %s.", p.Name, p.Version, policy.SoftwareVersion)
+			continue
+		}
+		if !productCodePattern.MatchString(p.Code) {
+			return errors.Errorf("Cannot remove %s %s, which isn't an MSI product", p.Name, p.Version)
+		}
+		Say("Removing %s %s...", p.Name, p.Version)
+		// The reboot, if any, is left to the usual pending reboot handling.
+		out, err := RunCommand(ctx, exec.Command("msiexec", "/x", p.Code, "/passive", "/norestart"))
+		if err != nil {
+			return errors.Wrapf(err, "Uninstall command output: %s", out)
+		}
+		err = WaitForKeyRemoval(ctx, p.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "path/filepath"
+
+type UserProfile struct {
+	SID  string
+	Path string
+}
+
+func (p UserProfile) Name() string {
+	return filepath.Base(p.Path)
+}
+
+func FindUserProfile(profiles []UserProfile, sid string) (UserProfile, bool) {
+	for _, p := range profiles {
+		if p.SID == sid {
+			return p, true
+		}
+	}
+	return UserProfile{}, false
+}
@@ -0,0 +1,83 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "os"
+import "path/filepath"
+import "unsafe"
+
+// The read-only progress window from the gui folder, looked for next to the runner.
+const PROGRESS_WINDOW_EXE = "2020runner-gui.exe"
+
+// progressWindowPath finds PROGRESS_WINDOW_EXE next to this program, or next to the
+// original when RelaunchLocally is running a copy.
+func progressWindowPath() string {
+	var dirs []string
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	dirs = append(dirs, filepath.Dir(os.Args[0]))
+	for _, d := range dirs {
+		p := filepath.Join(d, PROGRESS_WINDOW_EXE)
+		if exists(p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// ShowProgressWindow opens the progress window for the user logged on at the console,
+// when this run isn't in their session itself, e.g. because a deployment tool started
+// it as SYSTEM. It serves the pipe the window follows, unless that's already done. If
+// nobody is logged on, or the window isn't around, there's nothing to do.
+func ShowProgressWindow(servePipe bool) error {
+	var session uint32
+	err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session)
+	if err != nil {
+		return errors.Wrap(err, "Cannot find this program's session")
+	}
+	console := windows.WTSGetActiveConsoleSessionId()
+	if console == 0xFFFFFFFF || console == session {
+		return nil
+	}
+	exe := progressWindowPath()
+	if exe == "" {
+		return nil
+	}
+
+	var token windows.Token
+	err = windows.WTSQueryUserToken(console, &token)
+	if err == windows.ERROR_NO_TOKEN {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Cannot get the logged-on user's token")
+	}
+	defer token.Close()
+	var env *uint16
+	err = windows.CreateEnvironmentBlock(&env, token, false)
+	if err != nil {
+		return errors.Wrap(err, "Cannot make the logged-on user's environment")
+	}
+	defer windows.DestroyEnvironmentBlock(env)
+
+	if servePipe {
+		err = ServePipe()
+		if err != nil {
+			return err
+		}
+	}
+	si := windows.StartupInfo{Desktop: windows.StringToUTF16Ptr(`winsta0\default`)}
+	si.Cb = uint32(unsafe.Sizeof(si))
+	var pi windows.ProcessInformation
+	err = windows.CreateProcessAsUser(token, nil, windows.StringToUTF16Ptr(windows.EscapeArg(exe)), nil, nil, false,
+		windows.CREATE_UNICODE_ENVIRONMENT, env, windows.StringToUTF16Ptr(filepath.Dir(exe)), &si, &pi)
+	if err != nil {
+		return errors.Wrap(err, "Cannot start the progress window")
+	}
+	windows.CloseHandle(pi.Thread)
+	windows.CloseHandle(pi.Process)
+	Say("Showing the progress to the user logged on at the console.")
+	return nil
+}
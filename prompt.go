@@ -0,0 +1,162 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "fmt"
+import "strings"
+import "time"
+
+var (
+	procPostMessageW     = moduser32.NewProc("PostMessageW")
+	enumDialogsCallback  = windows.NewCallback(enumDialogsProc)
+	enumChildrenCallback = windows.NewCallback(enumChildrenProc)
+)
+
+// How often a running command's windows are looked over for prompts, and how long a
+// dialog has to stay up to count as one rather than a message that goes by itself.
+const PROMPT_POLL = time.Second
+const PROMPT_GRACE = 5 * time.Second
+
+// The window class of standard dialog boxes, which MessageBox and the confirmations of
+// the installers we run all use.
+const DIALOG_CLASS = "#32770"
+
+const BM_CLICK = 0x00F5
+
+var enumDialogs []windows.HWND
+var enumChildren []windows.HWND
+
+func enumDialogsProc(hwnd windows.HWND, lparam uintptr) uintptr {
+	var pid uint32
+	windows.GetWindowThreadProcessId(hwnd, &pid)
+	if enumPIDs[pid] && windows.IsWindowVisible(hwnd) && windowClass(hwnd) == DIALOG_CLASS {
+		enumDialogs = append(enumDialogs, hwnd)
+	}
+	return 1
+}
+
+func enumChildrenProc(hwnd windows.HWND, lparam uintptr) uintptr {
+	if windows.IsWindowVisible(hwnd) {
+		enumChildren = append(enumChildren, hwnd)
+	}
+	return 1
+}
+
+// A prompt is a dialog a command is waiting on someone to answer.
+type prompt struct {
+	Title   string
+	Text    []string
+	Buttons []promptButton
+}
+
+type promptButton struct {
+	Label string
+	hwnd  windows.HWND
+}
+
+// readPrompt reads the title, text and buttons of the dialog hwnd. Buttons are labelled
+// without their & accelerators, the way they read on screen.
+func readPrompt(hwnd windows.HWND) prompt {
+	enumMu.Lock()
+	enumChildren = nil
+	windows.EnumChildWindows(hwnd, enumChildrenCallback, nil)
+	children := enumChildren
+	enumMu.Unlock()
+
+	p := prompt{Title: windowText(hwnd)}
+	for _, c := range children {
+		text := strings.TrimSpace(windowText(c))
+		if text == "" {
+			continue
+		}
+		switch strings.ToLower(windowClass(c)) {
+		case "button":
+			p.Buttons = append(p.Buttons, promptButton{strings.ReplaceAll(text, "&", ""), c})
+		case "static":
+			p.Text = append(p.Text, text)
+		}
+	}
+	return p
+}
+
+// WatchForPrompts watches for dialogs belonging to pid or anything in job until stop is
+// closed. A dialog that stays up is answered with the first of answers it offers, if
+// any, and otherwise whoever is watching is told which button to click on which
+// dialog, so the run doesn't just sit there without saying why.
+func WatchForPrompts(program string, job windows.Handle, pid int, answers []string, stop chan struct{}) {
+	seen := map[windows.HWND]time.Time{}
+	handled := map[windows.HWND]bool{}
+	t := time.NewTicker(PROMPT_POLL)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		enumMu.Lock()
+		enumPIDs, enumDialogs = jobPIDs(job, pid), nil
+		windows.EnumWindows(enumDialogsCallback, nil)
+		dialogs := enumDialogs
+		enumMu.Unlock()
+
+		for _, hwnd := range dialogs {
+			if _, ok := seen[hwnd]; !ok {
+				seen[hwnd] = time.Now()
+			}
+			if !handled[hwnd] && time.Since(seen[hwnd]) >= PROMPT_GRACE {
+				handled[hwnd] = true
+				answerPrompt(program, readPrompt(hwnd), answers)
+			}
+		}
+	}
+}
+
+// answerPrompt clicks the first of answers p offers, or says which button to click. A
+// command that is answered for is meant to run unattended, so a message it shows with
+// only OK to click, which is usually its error, is logged as one and dismissed, letting
+// the command exit with the failure rather than wait for the step to time out.
+func answerPrompt(program string, p prompt, answers []string) {
+	if len(answers) > 0 && len(p.Buttons) == 1 && strings.EqualFold(p.Buttons[0].Label, "OK") {
+		Warn("%s showed %q: %s", program, p.Title, strings.Join(p.Text, " "))
+		Say("Dismissing it so %s can exit.", program)
+		procPostMessageW.Call(uintptr(p.Buttons[0].hwnd), BM_CLICK, 0, 0)
+		return
+	}
+	Warn("%s is asking %q: %s", program, p.Title, strings.Join(p.Text, " "))
+	var labels []string
+	for _, b := range p.Buttons {
+		labels = append(labels, b.Label)
+	}
+	for _, a := range answers {
+		for _, b := range p.Buttons {
+			if strings.EqualFold(b.Label, a) {
+				Say("Answering %s, as its silent switches should have.", b.Label)
+				// PostMessage rather than SendMessage, which would wait on a hung dialog.
+				procPostMessageW.Call(uintptr(b.hwnd), BM_CLICK, 0, 0)
+				return
+			}
+		}
+	}
+
+	click := "answer it"
+	if len(labels) > 0 {
+		click = "click " + strings.Join(labels, " or ")
+	}
+	m := fmt.Sprintf("%s is waiting on the %q dialog. To carry on, %s.", program, p.Title, click)
+	if !promptVisible() {
+		m += " It isn't on the console user's screen, so the run will wait until this step times out or is stopped."
+	}
+	fmt.Println(m)
+	Emit(Event{Type: EVENT_PROMPT, Message: m})
+}
+
+// promptVisible reports whether windows this run's commands open end up in front of
+// the user logged on at the console, which they don't when it runs as SYSTEM or in
+// another session.
+func promptVisible() bool {
+	var session uint32
+	err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session)
+	return err == nil && session == windows.WTSGetActiveConsoleSessionId()
+}
@@ -0,0 +1,240 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "flag"
+import "fmt"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+
+// Folders the 2020 suite leaves behind, relative to Program Files (x86).
+var PURGE_PROGRAM_FOLDERS = []string{"20-20 Technologies", "2020"}
+
+// Scheduled tasks for the runner itself live in this folder of the task library.
+const PURGE_TASK_FOLDER = `\2020runner\`
+
+type purgeStep struct {
+	Name string
+	Run  func(context.Context) error
+}
+
+var purgeSteps = []purgeStep{
+	{"Uninstall every version of the 2020 software", purgeSoftware},
+	{"Uninstall the catalogs", purgeCatalog},
+	{"Remove shortcuts", purgeShortcuts},
+	{"Remove leftover folders", purgeFolders},
+	{"Remove drives mapped to the 2020 shares", purgeMappedDrives},
+	{"Remove the runner's scheduled tasks", purgeScheduledTasks},
+	{"Remove the runner's state", purgeRunnerData},
+}
+
+// PurgeCommand implements `2020runner purge -yes`, which takes everything 2020 off a
+// machine that's being repurposed or returned. Each step is tried even if an earlier
+// one failed, so that as much as possible is gone by the end.
+func PurgeCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	yes := fs.Bool("yes", false, "Go ahead without asking")
+	fs.Parse(args)
+
+	if !*yes {
+		fmt.Println("purge will:")
+		for _, s := range purgeSteps {
+			fmt.Printf("  - %s\n", s.Name)
+		}
+		fmt.Println()
+		return Unsuccessful("Nothing removed. Run 2020runner purge -yes to go ahead.")
+	}
+
+	var failed []string
+	for i, s := range purgeSteps {
+		SayStep(i+1, len(purgeSteps), "%s...", s.Name)
+		done := TimePhase(s.Name)
+		err := s.Run(ctx)
+		done()
+		if err != nil {
+			Warn("%s failed: %v", s.Name, err)
+			failed = append(failed, s.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return Failed("Some of the purge didn't work.", errors.Errorf("Failed: %s", strings.Join(failed, ", ")))
+	}
+	return Succeeded("Everything 2020 has been removed. Restart the computer to finish.")
+}
+
+func purgeSoftware(ctx context.Context) error {
+	products, err := ListInstalledSoftware()
+	if err != nil {
+		return err
+	}
+	for _, p := range products {
+		if !productCodePattern.MatchString(p.Code) {
+			Warn("Skipping %s %s, which isn't an MSI product.", p.Name, p.Version)
+			continue
+		}
+		Say("Removing %s %s...", p.Name, p.Version)
+		out, err := RunCommand(ctx, exec.Command("msiexec", "/x", p.Code, "/passive", "/norestart"))
+		if err != nil {
+			return errors.Wrapf(err, "Uninstall command output: %s", out)
+		}
+	}
+	return nil
+}
+
+func purgeCatalog(ctx context.Context) error {
+	for _, l := range CATALOG_LINES {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, l.UninstallKey, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		k.Close()
+		Say("Removing the %s...", l.Name)
+		err = UninstallCatalogLine(ctx, l)
+		if err != nil {
+			return err
+		}
+	}
+	return CleanCatalog()
+}
+
+func purgeShortcuts(ctx context.Context) error {
+	programs, err := windows.KnownFolderPath(windows.FOLDERID_CommonPrograms, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot resolve the Start Menu folder")
+	}
+	desktop, err := windows.KnownFolderPath(windows.FOLDERID_PublicDesktop, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot resolve the public desktop folder")
+	}
+
+	for _, f := range PURGE_PROGRAM_FOLDERS {
+		err = os.RemoveAll(filepath.Join(programs, f))
+		if err != nil {
+			return errors.Wrap(err, "Cannot remove Start Menu folder")
+		}
+	}
+	links, _ := filepath.Glob(filepath.Join(desktop, "*2020*.lnk"))
+	for _, l := range links {
+		err = os.Remove(l)
+		if err != nil {
+			return errors.Wrap(err, "Cannot remove desktop shortcut")
+		}
+	}
+	return nil
+}
+
+func purgeFolders(ctx context.Context) error {
+	pf, err := windows.KnownFolderPath(windows.FOLDERID_ProgramFilesX86, 0)
+	if err != nil {
+		return errors.Wrap(err, "Cannot resolve the Program Files folder")
+	}
+	for _, f := range PURGE_PROGRAM_FOLDERS {
+		err = os.RemoveAll(filepath.Join(pf, f))
+		if err != nil {
+			return errors.Wrapf(FileAccessError(err, filepath.Join(pf, f)), "Cannot remove %s", f)
+		}
+	}
+	// The DSA folder went with the catalog; this is whatever else was around it.
+	root, err := DSARoot()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Dir(root))
+}
+
+// purgeMappedDrives removes every user's persistent drive mappings to the servers the
+// software and catalog come from. Drives already connected go away at logoff.
+func purgeMappedDrives(ctx context.Context) error {
+	var servers []string
+	for _, p := range []string{policy.SoftwareInstaller, policy.CatalogSetup} {
+		if s := shareServer(p); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil
+	}
+
+	profiles, err := ListUserProfiles()
+	if err != nil {
+		return err
+	}
+	for _, p := range profiles {
+		err = purgeUserDrives(ctx, p, servers)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func purgeUserDrives(ctx context.Context, p UserProfile, servers []string) error {
+	mount, unmount, err := MountUserHive(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	k, err := registry.OpenKey(registry.USERS, mount+`\Network`, registry.ENUMERATE_SUB_KEYS)
+	if err == registry.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "Cannot open mapped drives for %s", p.Name())
+	}
+	defer k.Close()
+	drives, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot list mapped drives for %s", p.Name())
+	}
+
+	for _, d := range drives {
+		dk, err := registry.OpenKey(k, d, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		remote, _, _ := dk.GetStringValue("RemotePath")
+		dk.Close()
+		for _, s := range servers {
+			if sameServer(shareServer(remote), s) {
+				Say("Removing drive %s: (%s) for %s", strings.ToUpper(d), remote, p.Name())
+				err = registry.DeleteKey(k, d)
+				if err != nil {
+					return errors.Wrapf(err, "Cannot remove drive %s for %s", d, p.Name())
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func purgeScheduledTasks(ctx context.Context) error {
+	script := fmt.Sprintf("Get-ScheduledTask -TaskPath '%s' -ErrorAction SilentlyContinue | Unregister-ScheduledTask -Confirm:$false", PURGE_TASK_FOLDER)
+	out, err := RunCommand(ctx, exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script))
+	if err != nil {
+		return errors.Wrapf(err, "Cannot remove scheduled tasks, output: %s", out)
+	}
+	return nil
+}
+
+func purgeRunnerData(ctx context.Context) error {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return err
+	}
+	// Nothing is recorded after this, so there's no last run to leave behind, and the
+	// log file has to be closed for its folder to go.
+	recordLastRun = false
+	CloseLog()
+	err = registry.DeleteKey(registry.LOCAL_MACHINE, HEALTH_KEY)
+	if err != nil && err != registry.ErrNotExist {
+		return errors.Wrap(KeyAccessError(err, registry.LOCAL_MACHINE, HEALTH_KEY), "Cannot remove the runner's registry key")
+	}
+	return FileAccessError(os.RemoveAll(dir), dir)
+}
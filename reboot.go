@@ -0,0 +1,277 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os"
+import "os/signal"
+import "time"
+
+// Set by -reboot-now and -reboot-at: when the run can't go on until the computer
+// restarts, restart it straight away, or at the next time of day like 22:00.
+var rebootNow bool
+var rebootAt string
+
+// Values for Policy.RebootCancel, what happens when the user calls off a restart the
+// runner scheduled: it's left for them to restart the computer themselves, it's put
+// off to the next RebootHours (or by REBOOT_POSTPONE) up to REBOOT_POSTPONE_MAX times,
+// or it's scheduled again straight away.
+const (
+	REBOOT_CANCEL_ALLOW    = "allow"
+	REBOOT_CANCEL_POSTPONE = "postpone"
+	REBOOT_CANCEL_DENY     = "deny"
+)
+
+var rebootCancels = map[string]bool{REBOOT_CANCEL_ALLOW: true, REBOOT_CANCEL_POSTPONE: true, REBOOT_CANCEL_DENY: true}
+
+const (
+	REBOOT_POSTPONE     = 4 * time.Hour
+	REBOOT_POSTPONE_MAX = 3
+)
+
+// How long past the restart the runner waits before taking it that the restart was
+// called off.
+const REBOOT_ABORT_SLACK = time.Minute
+
+func rebootWarning() time.Duration {
+	return time.Duration(policy.RebootWarningMinutes) * time.Minute
+}
+
+// rebootTime returns when the run is to restart the computer, counted from now: as
+// asked for by -reboot-now or -reboot-at, or else the next of the policy's RebootHours.
+// The restart comes after Windows has warned the user for rebootWarning.
+func rebootTime(now time.Time) (time.Time, bool, error) {
+	switch {
+	case rebootNow && rebootAt != "":
+		return time.Time{}, false, errors.New("Only one of -reboot-now and -reboot-at can be given")
+	case rebootNow:
+		return now.Add(rebootWarning()), true, nil
+	case rebootAt != "":
+		d, ok := parseTimeOfDay(rebootAt)
+		if !ok {
+			return time.Time{}, false, errors.Errorf("-reboot-at %s isn't a time of day like 22:00", rebootAt)
+		}
+		return nextTimeOfDay(now, d), true, nil
+	case policy.RebootHours != "":
+		w, err := ParseTransferWindow(policy.RebootHours)
+		if err != nil {
+			return time.Time{}, false, errors.Wrap(err, "Cannot use the RebootHours")
+		}
+		if w.Open(now) {
+			return now.Add(rebootWarning()), true, nil
+		}
+		return w.Opens(now).Add(rebootWarning()), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// postponedReboot is when a restart called off at now comes around again under
+// REBOOT_CANCEL_POSTPONE.
+func postponedReboot(now time.Time) time.Time {
+	if w, err := ParseTransferWindow(policy.RebootHours); err == nil {
+		return w.Opens(now).Add(rebootWarning())
+	}
+	return now.Add(REBOOT_POSTPONE)
+}
+
+// WaitingForReboot ends a run that can't go on until the computer restarts. It records
+// why in the runner state, for status and the next run, sets up the run to carry on
+// after the restart if the policy says so, and leaves Exit to restart the computer if
+// -reboot-now, -reboot-at or the policy's RebootHours have it do that.
+func WaitingForReboot(ctx context.Context, m string) Result {
+	now := time.Now()
+	at, ok, err := rebootTime(now)
+	if err != nil {
+		Warn("Not restarting the computer: %v", err)
+	}
+	state, err := LoadState()
+	if err == nil {
+		state.RebootRequired, state.RebootSince, state.RebootAt = m, &now, nil
+		if ok {
+			state.RebootAt, report.RebootAt = &at, &at
+		}
+		if policy.ContinuesAfterReboot() && !state.Continuation {
+			err = RegisterContinuation(ctx)
+			if err != nil {
+				Warn("Unable to have the run carry on after the restart: %v", err)
+			} else {
+				state.Continuation = true
+			}
+		}
+		err = SaveState(state)
+	}
+	if err != nil {
+		Warn("Unable to record that the computer needs a restart: %v", err)
+	}
+
+	next := RerunCommand()
+	if state.Continuation {
+		NoteDone("Set up the run to carry on by itself after the restart")
+		next = ""
+	}
+	if ok {
+		NoteRemaining("Let the computer restart at "+at.Format(time.Kitchen)+", or restart it sooner", next)
+	} else {
+		NoteRemaining("Restart the computer", next)
+	}
+	return RebootNeeded(m)
+}
+
+// ClearReboot forgets that the last run was waiting for a restart, and removes the
+// scheduled task that carried on after it, now that a run is looking again.
+func ClearReboot(ctx context.Context) {
+	state, err := LoadState()
+	if err != nil || (state.RebootRequired == "" && !state.Continuation) {
+		return
+	}
+	if state.Continuation {
+		err = RemoveContinuation(ctx)
+		if err != nil {
+			Warn("Unable to remove the task that carries on after a restart: %v", err)
+			return
+		}
+	}
+	state.RebootRequired, state.RebootSince, state.RebootAt, state.Continuation = "", nil, nil, false
+	err = SaveState(state)
+	if err != nil {
+		Warn("Unable to clear the pending restart: %v", err)
+	}
+}
+
+// AwaitReboot sees the restart rebootTime asks for through. Under -reboot-now it counts
+// down to it on the console and for anything following the events, has Windows warn
+// whoever is logged on for rebootWarning and then restarts the computer, unless the
+// user calls it off in the meantime, which is up to the policy's RebootCancel. Ctrl+C
+// calls it off for good. It runs once the run's report is out and the run lock is
+// released, so the wait holds nothing else up, and only returns if the restart doesn't
+// happen. A restart for later, under -reboot-at or RebootHours, is left to Windows, so
+// that a -watch or broker run isn't held up for hours; see scheduleReboot.
+func AwaitReboot(m string) {
+	at, ok, _ := rebootTime(time.Now())
+	if !ok {
+		return
+	}
+	if !rebootNow {
+		scheduleReboot(m, at)
+		return
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for postponed := 0; ; {
+		if !countDownTo(ctx, at.Add(-rebootWarning()), at, false) {
+			Warn("The restart was called off. Restart the computer yourself to finish the 2020 update.")
+			return
+		}
+		warning := time.Until(at)
+		if warning < 0 {
+			warning = 0
+		}
+		err := ScheduleRestart(m, warning)
+		if err != nil {
+			Warn("Unable to restart the computer: %v", err)
+			return
+		}
+		Say("Windows is warning whoever is logged on that the computer restarts at %s.", at.Format(time.Kitchen))
+		if !countDownTo(ctx, at.Add(REBOOT_ABORT_SLACK), at, policy.RebootCancel != REBOOT_CANCEL_DENY) {
+			AbortRestart()
+			Warn("The restart was called off. Restart the computer yourself to finish the 2020 update.")
+			return
+		}
+
+		// Still running, so someone called the restart off.
+		now := time.Now()
+		switch {
+		case policy.RebootCancel == REBOOT_CANCEL_ALLOW:
+			Warn("The restart was called off. Restart the computer yourself to finish the 2020 update.")
+			return
+		case policy.RebootCancel == REBOOT_CANCEL_POSTPONE && postponed < REBOOT_POSTPONE_MAX:
+			postponed++
+			at = postponedReboot(now)
+			Say("The restart was put off until %s.", at.Format("Jan 2 3:04 PM"))
+		default:
+			at = now.Add(rebootWarning())
+			Warn("The restart can't be called off on this computer. It restarts at %s.", at.Format(time.Kitchen))
+		}
+		noteRebootAt(at)
+	}
+}
+
+// scheduleReboot has Windows restart the computer at at, and returns straight away.
+// Windows warns whoever is logged on until then. If they call the restart off, the
+// next run finds the computer still waiting for it and schedules it again, which is as
+// far as RebootCancel goes without a run waiting on it.
+func scheduleReboot(m string, at time.Time) {
+	warning := time.Until(at)
+	if warning < 0 {
+		warning = 0
+	}
+	err := ScheduleRestart(m, warning)
+	if err != nil {
+		Warn("Unable to restart the computer: %v", err)
+		return
+	}
+	p := fmt.Sprintf("This computer restarts at %s to finish the 2020 update. Save your work before then.", at.Format("Jan 2 3:04 PM"))
+	Say("%s", p)
+	Emit(Event{Type: EVENT_REBOOT, Message: p, Cancel: policy.RebootCancel != REBOOT_CANCEL_DENY})
+}
+
+// countDownTo says how long there is until the restart at at, now and then up to
+// until, and reports whether it got there without Ctrl+C. During Windows' own warning
+// the events say whether the user can still call the restart off.
+func countDownTo(ctx context.Context, until, at time.Time, cancel bool) bool {
+	for left := time.Until(until); left > 0; left = time.Until(until) {
+		if time.Until(at) > 0 {
+			p := fmt.Sprintf("This computer restarts at %s, in %s, to finish the 2020 update. Save your work.",
+				at.Format(time.Kitchen), countdown(time.Until(at)))
+			fmt.Println(p)
+			Emit(Event{Type: EVENT_REBOOT, Message: p, Cancel: cancel})
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(countdownStep(left)):
+		}
+	}
+	return true
+}
+
+// noteRebootAt records a restart that was put off in the runner state, for status.
+func noteRebootAt(at time.Time) {
+	state, err := LoadState()
+	if err == nil {
+		state.RebootAt = &at
+		err = SaveState(state)
+	}
+	if err != nil {
+		Warn("Unable to record when the computer restarts: %v", err)
+	}
+}
+
+// countdown shows how long is left the way the countdown says it, like 2h05m or 45s.
+func countdown(left time.Duration) string {
+	switch {
+	case left >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(left.Hours()), int(left.Minutes())%60)
+	case left >= time.Minute:
+		return fmt.Sprintf("%dm", int(left.Round(time.Minute).Minutes()))
+	}
+	return fmt.Sprintf("%ds", int(left.Round(time.Second).Seconds()))
+}
+
+// countdownStep is how long until the countdown says how long is left again: less
+// often while the restart is far off, every few seconds at the end.
+func countdownStep(left time.Duration) time.Duration {
+	step := 10 * time.Second
+	switch {
+	case left > 2*time.Hour:
+		step = time.Hour
+	case left > 20*time.Minute:
+		step = 10 * time.Minute
+	case left > 2*time.Minute:
+		step = time.Minute
+	}
+	if left < step {
+		return left
+	}
+	return step
+}
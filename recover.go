@@ -0,0 +1,57 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "strings"
+import "unsafe"
+
+// rememberDrive records in the runner state that drive is mapped to remote, or that it
+// no longer is, so that a run that dies in between doesn't leave it behind for good.
+func rememberDrive(drive, remote string, mapped bool) {
+	state, err := LoadState()
+	if err != nil {
+		Warn("Unable to record the mapping of %s: %v", drive, err)
+		return
+	}
+	entry := drive + "=" + remote
+	var drives []string
+	for _, d := range state.MappedDrives {
+		if !strings.EqualFold(d, entry) {
+			drives = append(drives, d)
+		}
+	}
+	if mapped {
+		drives = append(drives, entry)
+	}
+	state.MappedDrives = drives
+	err = SaveState(state)
+	if err != nil {
+		Warn("Unable to record the mapping of %s: %v", drive, err)
+	}
+}
+
+// RecoverInterruptedRun cleans up after a run that stopped partway through. The other
+// half-way states it can leave are handled by the plan: a catalog removed but for its
+// state cookie is CATALOG_STATE_INCONSISTENT, software removed without the restart is
+// held with its own message, and an install that didn't finish is simply run again.
+func RecoverInterruptedRun() {
+	state, err := LoadState()
+	if err != nil || len(state.MappedDrives) == 0 {
+		return
+	}
+	for _, entry := range state.MappedDrives {
+		drive, remote, _ := strings.Cut(entry, "=")
+		Say("Removing drive %s (%s), left mapped by a run that didn't finish.", drive, remote)
+		// Only if it's still the share we mapped; the letter may have been reused.
+		current, ok := mappedRemote(drive)
+		if ok && strings.EqualFold(current, remote) {
+			procWNetCancelConnection2.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(drive))), 0, 1)
+		}
+	}
+	state.MappedDrives = nil
+	err = SaveState(state)
+	if err != nil {
+		Warn("Unable to clear the leftover drive mappings: %v", err)
+	}
+}
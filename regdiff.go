@@ -0,0 +1,155 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows/registry"
+import "fmt"
+import "sort"
+import "strings"
+
+// Subtrees of HKLM that -registry-diff always compares; RegistryDiff in the config adds
+// to them.
+var DEFAULT_REGISTRY_DIFF = []string{
+	`SOFTWARE\WOW6432Node\20-20 Technologies`,
+	CAP2020_SOFTWARE,
+	CAP2020_CATALOG,
+	RESIDENTIAL_CATALOG,
+}
+
+// Set by -registry-diff.
+var registryDiff bool
+
+// A registry snapshot flattened to key path -> value name -> type and data, so two of
+// them are easy to compare. Keys with no values still appear, with an empty map.
+type regFlat map[string]map[string]string
+
+func (f regFlat) add(path string, snap RegKeySnapshot) {
+	values := map[string]string{}
+	for _, v := range snap.Values {
+		data := v.Data
+		if v.Type == "MULTI_SZ" {
+			data = strings.Join(v.Strings, "|")
+		}
+		values[v.Name] = v.Type + " " + data
+	}
+	f[path] = values
+	for _, sub := range snap.Subkeys {
+		f.add(path+`\`+sub.Name, sub)
+	}
+}
+
+func registryDiffKeys() []string {
+	return append(append([]string{}, DEFAULT_REGISTRY_DIFF...), config.RegistryDiff...)
+}
+
+// SnapshotRegistry captures the subtrees -registry-diff compares. Those that don't
+// exist are simply left out.
+func SnapshotRegistry() regFlat {
+	f := regFlat{}
+	for _, path := range registryDiffKeys() {
+		snap, err := CaptureKey(registry.LOCAL_MACHINE, path, path)
+		if err == nil {
+			f.add(path, snap)
+		}
+	}
+	return f
+}
+
+// registryInputs condenses what detection reads from the registry into a string that
+// changes whenever any of it does: the values under the keys -registry-diff compares,
+// the programs registered for uninstall, when their entries were last written, and
+// the pending reboot flags.
+func registryInputs() string {
+	var b strings.Builder
+	f := SnapshotRegistry()
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		names := make([]string, 0, len(f[k]))
+		for n := range f[k] {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&b, "%s\n", k)
+		for _, n := range names {
+			fmt.Fprintf(&b, "%s=%s\n", n, f[k][n])
+		}
+	}
+	for _, root := range []string{UNINSTALL_ROOT, UNINSTALL_ROOT_NATIVE} {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, root, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			continue
+		}
+		names, _ := k.ReadSubKeyNames(-1)
+		k.Close()
+		sort.Strings(names)
+		for _, n := range names {
+			sk, err := registry.OpenKey(registry.LOCAL_MACHINE, root+`\`+n, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			if info, err := sk.Stat(); err == nil {
+				fmt.Fprintf(&b, "%s %d\n", n, info.ModTime().UnixNano())
+			}
+			sk.Close()
+		}
+	}
+	pending, why := IsRebootPending()
+	fmt.Fprintf(&b, "reboot %v %s\n", pending, why)
+	return b.String()
+}
+
+// DiffRegistry lists what changed from before to after, one line per key or value,
+// sorted by path.
+func DiffRegistry(before, after regFlat) []string {
+	var lines []string
+	for path, values := range after {
+		old, ok := before[path]
+		if !ok {
+			lines = append(lines, "+ "+path)
+		}
+		for name, v := range values {
+			if o, ok := old[name]; !ok {
+				lines = append(lines, fmt.Sprintf("+ %s\\%s = %s", path, name, v))
+			} else if o != v {
+				lines = append(lines, fmt.Sprintf("~ %s\\%s = %s (was %s)", path, name, v, o))
+			}
+		}
+		for name, o := range old {
+			if _, ok := values[name]; !ok {
+				lines = append(lines, fmt.Sprintf("- %s\\%s (was %s)", path, name, o))
+			}
+		}
+	}
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			lines = append(lines, "- "+path)
+		}
+	}
+	// Sort on the path rather than the marker, so changes to one key stay together.
+	sort.Slice(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+	return lines
+}
+
+// TrackRegistry snapshots the registry when -registry-diff is on and returns a function
+// that logs what changed since, for phase.
+func TrackRegistry(phase string) func() {
+	if !registryDiff {
+		return func() {}
+	}
+	before := SnapshotRegistry()
+	return func() {
+		lines := DiffRegistry(before, SnapshotRegistry())
+		if len(lines) == 0 {
+			Say("%s left the registry as it was.", phase)
+			return
+		}
+		Say("%s changed the registry:", phase)
+		for _, l := range lines {
+			Say("  %s", l)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "encoding/hex"
+import "strconv"
+
+// RegKeySnapshot is a registry subtree captured so it can be stored as XML and
+// written back later, possibly under a different root.
+type RegKeySnapshot struct {
+	Name    string           `xml:"Name,attr"`
+	Values  []RegValue       `xml:"Value"`
+	Subkeys []RegKeySnapshot `xml:"Key"`
+}
+
+// RegValue holds strings as-is, integers in decimal and binary data as hex. MULTI_SZ
+// values use Strings instead of Data.
+type RegValue struct {
+	Name    string   `xml:"Name,attr"`
+	Type    string   `xml:"Type,attr"`
+	Data    string   `xml:",chardata"`
+	Strings []string `xml:"String"`
+}
+
+var regTypeNames = map[uint32]string{
+	registry.SZ:        "SZ",
+	registry.EXPAND_SZ: "EXPAND_SZ",
+	registry.MULTI_SZ:  "MULTI_SZ",
+	registry.DWORD:     "DWORD",
+	registry.QWORD:     "QWORD",
+	registry.BINARY:    "BINARY",
+}
+
+// CaptureKey snapshots root\path and everything below it. Values of types we don't
+// know how to write back are skipped.
+func CaptureKey(root registry.Key, path string, name string) (RegKeySnapshot, error) {
+	snap := RegKeySnapshot{Name: name}
+
+	k, err := registry.OpenKey(root, path, registry.READ)
+	if err != nil {
+		return snap, errors.Wrapf(err, "Cannot open registry key %s", path)
+	}
+	defer k.Close()
+
+	names, err := k.ReadValueNames(-1)
+	if err != nil {
+		return snap, errors.Wrapf(err, "Cannot list values of %s", path)
+	}
+	for _, n := range names {
+		v, ok, err := readValue(k, n)
+		if err != nil {
+			return snap, errors.Wrapf(err, "Cannot read %s\\%s", path, n)
+		}
+		if ok {
+			snap.Values = append(snap.Values, v)
+		}
+	}
+
+	subkeys, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return snap, errors.Wrapf(err, "Cannot list subkeys of %s", path)
+	}
+	for _, sk := range subkeys {
+		sub, err := CaptureKey(root, path+`\`+sk, sk)
+		if err != nil {
+			return snap, err
+		}
+		snap.Subkeys = append(snap.Subkeys, sub)
+	}
+	return snap, nil
+}
+
+func readValue(k registry.Key, name string) (RegValue, bool, error) {
+	_, t, err := k.GetValue(name, nil)
+	if err != nil {
+		return RegValue{}, false, err
+	}
+	typ, ok := regTypeNames[t]
+	if !ok {
+		return RegValue{}, false, nil
+	}
+
+	v := RegValue{Name: name, Type: typ}
+	switch t {
+	case registry.SZ, registry.EXPAND_SZ:
+		v.Data, _, err = k.GetStringValue(name)
+	case registry.MULTI_SZ:
+		v.Strings, _, err = k.GetStringsValue(name)
+	case registry.DWORD, registry.QWORD:
+		var n uint64
+		n, _, err = k.GetIntegerValue(name)
+		v.Data = strconv.FormatUint(n, 10)
+	case registry.BINARY:
+		var b []byte
+		b, _, err = k.GetBinaryValue(name)
+		v.Data = hex.EncodeToString(b)
+	}
+	return v, true, err
+}
+
+// ApplySnapshot writes snap into root\path, creating keys as needed. Values and keys
+// that exist but aren't in the snapshot are left alone.
+func ApplySnapshot(root registry.Key, path string, snap RegKeySnapshot) error {
+	k, _, err := registry.CreateKey(root, path, registry.WRITE)
+	if err != nil {
+		return errors.Wrapf(KeyAccessError(err, root, path), "Cannot create registry key %s", path)
+	}
+	defer k.Close()
+
+	for _, v := range snap.Values {
+		err = writeValue(k, v)
+		if err != nil {
+			return errors.Wrapf(err, "Cannot write %s\\%s", path, v.Name)
+		}
+	}
+	for _, sub := range snap.Subkeys {
+		err = ApplySnapshot(root, path+`\`+sub.Name, sub)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeValue(k registry.Key, v RegValue) error {
+	switch v.Type {
+	case "SZ":
+		return k.SetStringValue(v.Name, v.Data)
+	case "EXPAND_SZ":
+		return k.SetExpandStringValue(v.Name, v.Data)
+	case "MULTI_SZ":
+		return k.SetStringsValue(v.Name, v.Strings)
+	case "DWORD":
+		n, err := strconv.ParseUint(v.Data, 10, 32)
+		if err != nil {
+			return err
+		}
+		return k.SetDWordValue(v.Name, uint32(n))
+	case "QWORD":
+		n, err := strconv.ParseUint(v.Data, 10, 64)
+		if err != nil {
+			return err
+		}
+		return k.SetQWordValue(v.Name, n)
+	case "BINARY":
+		b, err := hex.DecodeString(v.Data)
+		if err != nil {
+			return err
+		}
+		return k.SetBinaryValue(v.Name, b)
+	}
+	return errors.Errorf("Unknown value type %s", v.Type)
+}
@@ -0,0 +1,79 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "fmt"
+import "io"
+import "os"
+import "os/exec"
+import "os/signal"
+import "path/filepath"
+
+// onNetwork reports whether path is on a share or a mapped network drive.
+func onNetwork(path string) bool {
+	if shareServer(path) != "" {
+		return true
+	}
+	root := filepath.VolumeName(path) + `\`
+	return windows.GetDriveType(windows.StringToUTF16Ptr(root)) == windows.DRIVE_REMOTE
+}
+
+// RelaunchLocally makes sure the runner isn't running off the network. Windows pages
+// a program in from where it was started, so a blip on the share halfway through an
+// uninstall would take the process down with it. When started from the network, it
+// copies itself to the local working folder, runs the copy with the same arguments
+// and exits with its exit code; otherwise it returns straight away. The copy carries
+// on by itself if the original goes down after all.
+func RelaunchLocally() error {
+	exe, err := os.Executable()
+	if err != nil || !onNetwork(exe) {
+		return nil
+	}
+	dir, err := ChildWorkDir()
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(dir, fmt.Sprintf("2020runner-%d.exe", os.Getpid()))
+	err = copyExecutable(exe, local)
+	if err != nil {
+		return err
+	}
+
+	// Standard output is the copy's, which may be -output ndjson.
+	fmt.Fprintf(os.Stderr, "Running from a local copy of %s\n", exe)
+	// The copy shares the console and gets Ctrl+C itself; this process only waits.
+	signal.Ignore(os.Interrupt)
+	cmd := exec.Command(local, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	os.Remove(local)
+	if cmd.ProcessState == nil {
+		return errors.Wrap(err, "Cannot start the local copy")
+	}
+	os.Exit(cmd.ProcessState.ExitCode())
+	return nil
+}
+
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open the runner")
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create the local copy")
+	}
+	_, err = io.Copy(out, in)
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return errors.Wrap(err, "Cannot copy the runner")
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "encoding/json"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "text/tabwriter"
+import "time"
+
+const (
+	OUTCOME_SUCCESS      = "success"
+	OUTCOME_ERROR        = "error"
+	OUTCOME_UNSUCCESSFUL = "unsuccessful"
+	OUTCOME_BUSY         = "busy"
+	OUTCOME_FLAPPING     = "flapping"
+	OUTCOME_REBOOT       = "reboot"
+)
+
+type PhaseTiming struct {
+	Name     string    `json:"name"`
+	Started  time.Time `json:"started"`
+	Seconds  float64   `json:"seconds"`
+	duration time.Duration
+}
+
+// What was decided about software newer than the target, if there was any.
+const (
+	DOWNGRADE_ALLOWED  = "allowed"
+	DOWNGRADE_DECLINED = "declined"
+)
+
+const LAST_RUN_FILE = "last-run.json"
+
+// Report is the machine-readable record of a run, written with -report.
+type Report struct {
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Outcome  string    `json:"outcome"`
+	Message  string    `json:"message"`
+	Error    string    `json:"error,omitempty"`
+	// For errors, the category from Classify and what to try about it.
+	Category string   `json:"category,omitempty"`
+	Hint     string   `json:"hint,omitempty"`
+	Actions  []string `json:"actions,omitempty"`
+	// The software version found when the run started.
+	Installed string `json:"installed,omitempty"`
+	Downgrade string `json:"downgrade,omitempty"`
+	// Versions of the software installed besides the target.
+	OtherVersions string        `json:"otherVersions,omitempty"`
+	Phases        []PhaseTiming `json:"phases"`
+	// Every command run under -audit-ui, and the windows it showed.
+	UIAudit []UIAuditEntry `json:"uiAudit,omitempty"`
+	// Under -report-only or on an exempt computer, what a run would have done, or why
+	// it would have held off.
+	ReportOnly bool     `json:"reportOnly,omitempty"`
+	Planned    []string `json:"planned,omitempty"`
+	Hold       string   `json:"hold,omitempty"`
+	// The catalog state found when the run started, if the software was in place.
+	Catalog string `json:"catalog,omitempty"`
+	// Every external command the run started, in order.
+	Commands []CommandRecord `json:"commands,omitempty"`
+	// Under status -all-users, the catalog state for each user profile.
+	Users []UserCatalog `json:"users,omitempty"`
+	// The content version of each catalog granule selected when the run started, by
+	// MfgCode/PlatformType, "" where DSA doesn't say.
+	CatalogVersions map[string]string `json:"catalogVersions,omitempty"`
+	// Under catalog check, the granules selected on the share but not here, or at an
+	// older version.
+	CatalogBehind []string `json:"catalogBehind,omitempty"`
+	// The fixes the run held off because they keep coming undone, with how often they
+	// were made lately.
+	Flapping []string `json:"flapping,omitempty"`
+	// Why the computer is exempt and where that was said, if it is.
+	Exempt string `json:"exempt,omitempty"`
+	// When the run left the computer to restart, under -reboot-now or -reboot-at.
+	RebootAt *time.Time `json:"rebootAt,omitempty"`
+	// What the computer itself is, for lining failures up against Windows builds.
+	System *SystemFacts `json:"system,omitempty"`
+	// The end of the run's log, only in the copy sent to ReportURL, for the report
+	// server to show.
+	Log string `json:"log,omitempty"`
+}
+
+// SystemFacts are the Windows version and the rest of the computer a run was on.
+type SystemFacts struct {
+	OS         string    `json:"os,omitempty"`
+	Build      string    `json:"build,omitempty"`
+	Arch       string    `json:"arch,omitempty"`
+	FreeDiskMB uint64    `json:"freeDiskMB,omitempty"`
+	MemoryMB   uint64    `json:"memoryMB,omitempty"`
+	Domain     string    `json:"domain,omitempty"`
+	LastBoot   time.Time `json:"lastBoot,omitempty"`
+	DotNet     []string  `json:"dotNet,omitempty"`
+}
+
+// NoteSystemFacts puts the SystemFacts in the report, once per run.
+func NoteSystemFacts() *SystemFacts {
+	if report.System == nil {
+		report.System = CollectSystemFacts()
+	}
+	return report.System
+}
+
+// Print shows the facts the way status does the probes.
+func (f *SystemFacts) Print() {
+	if f == nil {
+		return
+	}
+	domain := f.Domain
+	if domain == "" {
+		domain = "none"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Windows	%s, build %s, %s\n", f.OS, f.Build, f.Arch)
+	fmt.Fprintf(w, "Memory	%d MB, %d MB free on the system drive\n", f.MemoryMB, f.FreeDiskMB)
+	fmt.Fprintf(w, "Domain	%s\n", domain)
+	fmt.Fprintf(w, "Last boot	%s\n", f.LastBoot.Format("2006-01-02 15:04"))
+	fmt.Fprintf(w, ".NET	%s\n", strings.Join(f.DotNet, ", "))
+	w.Flush()
+	fmt.Println()
+}
+
+var report = Report{Started: time.Now()}
+
+// Where to write the JSON report, if anywhere.
+var reportPath string
+
+// Set for runs that change the machine, as opposed to status and plan, so that only
+// those end up as the last run.
+var recordLastRun bool
+
+// Set for runs that publish whether the machine is compliant: the ones that record the
+// last run and -report-only, which changes nothing but checks the same.
+var sendReport bool
+
+// TimePhase starts timing a phase of the run. Call the returned function when the
+// phase is over:
+//
+//	defer TimePhase("Detection")()
+func TimePhase(name string) func() {
+	start := time.Now()
+	Emit(Event{Time: start, Type: EVENT_PHASE_START, Phase: name})
+	return func() {
+		d := time.Since(start)
+		Emit(Event{Type: EVENT_PHASE_END, Phase: name})
+		report.Phases = append(report.Phases, PhaseTiming{
+			Name:     name,
+			Started:  start,
+			Seconds:  d.Seconds(),
+			duration: d,
+		})
+	}
+}
+
+func PrintPhaseSummary() {
+	if len(report.Phases) == 0 {
+		return
+	}
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Phase\tDuration")
+	var total time.Duration
+	for _, p := range report.Phases {
+		fmt.Fprintf(w, "%s\t%s\n", p.Name, p.duration.Round(time.Second))
+		total += p.duration
+	}
+	fmt.Fprintf(w, "Total\t%s\n", total.Round(time.Second))
+	w.Flush()
+	fmt.Println()
+}
+
+// FinishReport records the outcome of the run, prints the timings and writes the JSON
+// report if one was asked for, to a file or ReportURL, and the HTML one.
+func FinishReport(outcome, message string, e error) {
+	report.Finished = time.Now()
+	report.Hostname, _ = os.Hostname()
+	NoteSystemFacts()
+	report.Outcome = outcome
+	report.Message = message
+	if e != nil {
+		report.Error = fmt.Sprintf("%v", e)
+	}
+	Emit(Event{Type: EVENT_DONE, Message: message, Outcome: outcome, Hint: report.Hint, Error: report.Error})
+	DisconnectShares()
+
+	PrintPhaseSummary()
+	PrintUIAudit()
+	if recordLastRun {
+		err := WriteLastRun()
+		if err != nil {
+			Warn("Unable to record the last run: %v", err)
+		}
+		err = AppendHistory()
+		if err != nil {
+			Warn("Unable to add the run to the history: %v", err)
+		}
+		if len(report.Actions) > 0 {
+			InvalidateDetectionCache()
+			err = StoreInventory()
+			if err != nil {
+				Warn("Unable to store the inventory: %v", err)
+			}
+		}
+	}
+	// Only these runs say whether the machine is compliant; a history or plan run that
+	// succeeded would make a broken machine look fine.
+	if recordLastRun || sendReport {
+		if config.FleetCSV != "" {
+			err := AppendFleetCSV()
+			if err != nil {
+				Warn("Unable to add the run to the fleet CSV: %v", err)
+			}
+		}
+		if config.ReportURL != "" {
+			err := SendReport()
+			if err != nil {
+				Warn("Unable to send the report: %v", err)
+			}
+		}
+	}
+	if reportHTMLPath != "" {
+		err := WriteHTMLReport(reportHTMLPath)
+		if err != nil {
+			Warn("Unable to write the HTML report: %v", err)
+		}
+	}
+	if reportPath == "" {
+		return
+	}
+	err := WriteReport(reportPath)
+	if err != nil {
+		Warn("Unable to write the report: %v", err)
+	}
+}
+
+// WriteLastRun keeps a copy of the report in the runner data folder, where the tray
+// agent reads the machine's status from.
+func WriteLastRun() error {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create runner data folder")
+	}
+	return WriteReport(filepath.Join(dir, LAST_RUN_FILE))
+}
+
+func WriteReport(path string) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode report")
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, path), "Cannot write report")
+	}
+	return nil
+}
+
+// SendReport posts the report, with the end of the run's log, to ReportURL, checking
+// the server's certificate with ReportCA and ReportPin if they're set, and with
+// ReportToken as its bearer token.
+func SendReport() error {
+	tc, err := TrustConfig(config.ReportCA, config.ReportPin)
+	if err != nil {
+		return err
+	}
+	token, err := Secret(config.ReportToken)
+	if err != nil {
+		return errors.Wrap(err, "Cannot read ReportToken")
+	}
+	r := report
+	r.Log = RunLogTail()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode report")
+	}
+	return PostJSON(context.Background(), NewHTTPClient(tc), config.ReportURL, token, b)
+}
+
+// A UIAuditEntry is one command run under -audit-ui, with the visible windows its
+// processes showed, if any.
+type UIAuditEntry struct {
+	Command string   `json:"command"`
+	Windows []string `json:"windows,omitempty"`
+}
+
+// A CommandRecord is one external command in the report.
+type CommandRecord struct {
+	Program  string   `json:"program"`
+	Args     []string `json:"args"`
+	Dir      string   `json:"dir"`
+	ExitCode int      `json:"exitCode"`
+	Seconds  float64  `json:"seconds"`
+	Error    string   `json:"error,omitempty"`
+	Output   string   `json:"output,omitempty"`
+	// Set when Output is only the last COMMAND_OUTPUT_MAX bytes.
+	Truncated bool `json:"truncated,omitempty"`
+}
@@ -0,0 +1,51 @@
+package main
+
+import "context"
+import "encoding/json"
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+func TestReportOnlySendsReport(t *testing.T) {
+	var got *Report
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		got = &Report{}
+		if err := json.NewDecoder(r.Body).Decode(got); err != nil {
+			t.Errorf("Cannot decode the report: %v", err)
+		}
+	}))
+	defer srv.Close()
+	useConfig(t, Config{ReportURL: srv.URL, ReportToken: "test-token"}, "TEST-PC")
+	oldReport, oldSend, oldRecord := report, sendReport, recordLastRun
+	t.Cleanup(func() { report, sendReport, recordLastRun = oldReport, oldSend, oldRecord })
+	report, sendReport, recordLastRun = Report{}, false, false
+
+	r := ReportOnly(context.Background())
+	FinishReport(r.Outcome, r.Message, r.Err)
+	if got == nil {
+		t.Fatalf("A report-only run (%s %q) sent no report", r.Outcome, r.Message)
+	}
+	if !got.ReportOnly || got.Outcome != r.Outcome {
+		t.Errorf("Sent a report with reportOnly %v and outcome %s, want true and %s", got.ReportOnly, got.Outcome, r.Outcome)
+	}
+	if auth != "Bearer test-token" {
+		t.Errorf("Sent the report with Authorization %q, want the ReportToken", auth)
+	}
+}
+
+func TestPlanSendsNoReport(t *testing.T) {
+	sent := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { sent = true }))
+	defer srv.Close()
+	useConfig(t, Config{ReportURL: srv.URL}, "TEST-PC")
+	oldReport, oldSend, oldRecord := report, sendReport, recordLastRun
+	t.Cleanup(func() { report, sendReport, recordLastRun = oldReport, oldSend, oldRecord })
+	report, sendReport, recordLastRun = Report{}, false, false
+
+	FinishReport(OUTCOME_SUCCESS, "Planned.", nil)
+	if sent {
+		t.Error("A run that neither records the last run nor reports only sent a report")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import "github.com/pkg/errors"
+import "bytes"
+import "html/template"
+import "os"
+import "sort"
+import "time"
+
+// Where to write the HTML report, if anywhere.
+var reportHTMLPath string
+
+// Colours for the outcome banner.
+var outcomeColours = map[string]string{
+	OUTCOME_SUCCESS:      "#2e7d32",
+	OUTCOME_ERROR:        "#c62828",
+	OUTCOME_UNSUCCESSFUL: "#ef6c00",
+	OUTCOME_BUSY:         "#1565c0",
+	OUTCOME_FLAPPING:     "#6a1b9a",
+	OUTCOME_REBOOT:       "#00838f",
+}
+
+// Styles for the headings and cells of the HTML report's tables.
+const (
+	REPORT_HTML_TH = "text-align:left;padding:4px 12px 4px 0;border-bottom:1px solid #bdbdbd"
+	REPORT_HTML_TD = "padding:4px 12px 4px 0;border-bottom:1px solid #eeeeee;vertical-align:top"
+)
+
+// The HTML report is one file with nothing to load and no scripts, and styled inline
+// on plain tables, since that's all mail clients reliably show.
+var reportHTML = template.Must(template.New("report").Funcs(template.FuncMap{
+	"colour":   func(o string) template.CSS { return template.CSS(outcomeColours[o]) },
+	"th":       func() template.CSS { return REPORT_HTML_TH },
+	"td":       func() template.CSS { return REPORT_HTML_TD },
+	"time":     func(t time.Time) string { return t.Format("2006-01-02 15:04:05 MST") },
+	"duration": func(s float64) string { return (time.Duration(s * float64(time.Second))).Round(time.Second).String() },
+	"sorted": func(m map[string]string) []string {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>2020runner on {{.Report.Hostname}}</title></head>
+<body style="margin:0;padding:16px;font-family:Segoe UI,Arial,sans-serif;font-size:14px;color:#212121;background:#ffffff">
+<table cellpadding="0" cellspacing="0" style="width:100%;border-collapse:collapse">
+<tr><td style="padding:12px;background:{{colour .Report.Outcome}};color:#ffffff;font-size:18px">
+<b>{{.Report.Hostname}}: {{.Report.Outcome}}</b><br>{{.Report.Message}}</td></tr>
+</table>
+
+<h3 style="margin:16px 0 4px">Run</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><td style="{{td}}">Started</td><td style="{{td}}">{{time .Report.Started}}</td></tr>
+<tr><td style="{{td}}">Finished</td><td style="{{td}}">{{time .Report.Finished}}</td></tr>
+{{if .Report.Exempt}}<tr><td style="{{td}}">Exempt</td><td style="{{td}}">{{.Report.Exempt}}</td></tr>{{end}}
+{{if .Report.Installed}}<tr><td style="{{td}}">Software found</td><td style="{{td}}">{{.Report.Installed}}</td></tr>{{end}}
+{{if .Report.OtherVersions}}<tr><td style="{{td}}">Other versions</td><td style="{{td}}">{{.Report.OtherVersions}}</td></tr>{{end}}
+{{if .Report.Catalog}}<tr><td style="{{td}}">Catalog</td><td style="{{td}}">{{.Report.Catalog}}</td></tr>{{end}}
+{{if .Report.Actions}}<tr><td style="{{td}}">Actions</td><td style="{{td}}">{{range .Report.Actions}}{{.}}<br>{{end}}</td></tr>{{end}}
+{{if .Report.Flapping}}<tr><td style="{{td}}">Keeps coming undone</td><td style="{{td}}">{{range .Report.Flapping}}{{.}}<br>{{end}}</td></tr>{{end}}
+{{with .Report.RebootAt}}<tr><td style="{{td}}">Restarts at</td><td style="{{td}}">{{time .}}</td></tr>{{end}}
+{{if .Report.Hold}}<tr><td style="{{td}}">On hold</td><td style="{{td}}">{{.Report.Hold}}</td></tr>{{end}}
+</table>
+
+{{with .Report.System}}
+<h3 style="margin:16px 0 4px">Computer</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><td style="{{td}}">Windows</td><td style="{{td}}">{{.OS}}, build {{.Build}}, {{.Arch}}</td></tr>
+<tr><td style="{{td}}">Memory</td><td style="{{td}}">{{.MemoryMB}} MB, {{.FreeDiskMB}} MB free on the system drive</td></tr>
+{{if .Domain}}<tr><td style="{{td}}">Domain</td><td style="{{td}}">{{.Domain}}</td></tr>{{end}}
+<tr><td style="{{td}}">Last boot</td><td style="{{td}}">{{time .LastBoot}}</td></tr>
+{{if .DotNet}}<tr><td style="{{td}}">.NET</td><td style="{{td}}">{{range .DotNet}}{{.}}<br>{{end}}</td></tr>{{end}}
+</table>
+{{end}}
+
+{{if .Report.Error}}
+<h3 style="margin:16px 0 4px">Error</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><td style="{{td}}">Category</td><td style="{{td}}">{{.Report.Category}}</td></tr>
+<tr><td style="{{td}}">What to try</td><td style="{{td}}">{{.Report.Hint}}</td></tr>
+<tr><td style="{{td}}">Detail</td><td style="{{td}};font-family:Consolas,monospace;white-space:pre-wrap">{{.Report.Error}}</td></tr>
+</table>
+{{end}}
+
+{{if or .Summary.Checked .Summary.Done .Summary.Remaining}}
+<h3 style="margin:16px 0 4px">Status</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+{{range .Summary.Checked}}<tr><td style="{{td}}">Checked</td><td style="{{td}}">{{.}}</td></tr>{{end}}
+{{range .Summary.Done}}<tr><td style="{{td}}">Done</td><td style="{{td}}">{{.}}</td></tr>{{end}}
+{{range .Summary.Remaining}}<tr><td style="{{td}}"><b>To do</b></td><td style="{{td}}"><b>{{.}}</b></td></tr>{{end}}
+</table>
+{{end}}
+
+{{if .Report.Phases}}
+<h3 style="margin:16px 0 4px">Timings</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Phase</th><th style="{{th}}">Started</th><th style="{{th}}">Duration</th></tr>
+{{range .Report.Phases}}<tr><td style="{{td}}">{{.Name}}</td><td style="{{td}}">{{time .Started}}</td><td style="{{td}}">{{duration .Seconds}}</td></tr>{{end}}
+</table>
+{{end}}
+
+{{if .Report.CatalogVersions}}
+<h3 style="margin:16px 0 4px">Catalog content</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Granule</th><th style="{{th}}">Version</th></tr>
+{{$v := .Report.CatalogVersions}}{{range sorted $v}}<tr><td style="{{td}}">{{.}}</td><td style="{{td}}">{{index $v .}}</td></tr>{{end}}
+</table>
+{{end}}
+{{if .Report.CatalogBehind}}<p style="margin:8px 0">Not picked up from the catalog share: {{range $i, $g := .Report.CatalogBehind}}{{if $i}}, {{end}}{{$g}}{{end}}</p>{{end}}
+
+{{if .Report.Commands}}
+<h3 style="margin:16px 0 4px">Commands</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Program</th><th style="{{th}}">Exit code</th><th style="{{th}}">Duration</th><th style="{{th}}">Error</th></tr>
+{{range .Report.Commands}}<tr><td style="{{td}};font-family:Consolas,monospace">{{.Program}}{{range .Args}} {{.}}{{end}}</td><td style="{{td}}">{{.ExitCode}}</td><td style="{{td}}">{{duration .Seconds}}</td><td style="{{td}}">{{.Error}}</td></tr>{{end}}
+</table>
+{{end}}
+
+{{range .Report.UIAudit}}{{if .Windows}}<p style="margin:8px 0">Not silent: <span style="font-family:Consolas,monospace">{{.Command}}</span>{{range .Windows}}<br>&nbsp;&nbsp;{{.}}{{end}}</p>{{end}}{{end}}
+</body></html>
+`))
+
+// WriteHTMLReport writes the report as a single HTML file, for attaching to a ticket
+// or pasting into a mail.
+func WriteHTMLReport(path string) error {
+	var b bytes.Buffer
+	err := reportHTML.Execute(&b, struct {
+		Report  Report
+		Summary RunSummary
+	}{report, summary})
+	if err != nil {
+		return errors.Wrap(err, "Cannot format the HTML report")
+	}
+	err = os.WriteFile(path, b.Bytes(), 0644)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, path), "Cannot write the HTML report")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "os"
+import "path/filepath"
+import "time"
+
+// The scheduled task that starts the run again once the computer has restarted, see
+// WaitingForReboot.
+const CONTINUATION_TASK = "2020runner continue"
+
+// The task runs its own copy of the runner from the runner data folder, since the one
+// running now may be on a share, or be RelaunchLocally's copy that goes away.
+const CONTINUATION_EXE = "2020runner-continue.exe"
+
+// How long after startup the continuation waits, for the network to come up first.
+const CONTINUATION_DELAY = "PT2M"
+
+const SE_SHUTDOWN_NAME = "SeShutdownPrivilege"
+
+// RegisterContinuation sets up a scheduled task that runs this program again as SYSTEM,
+// with the flags of this run, when the computer next starts. The run it starts removes
+// it through ClearReboot.
+func RegisterContinuation(ctx context.Context) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Cannot find the runner")
+	}
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return err
+	}
+	local := filepath.Join(dir, CONTINUATION_EXE)
+	if !sameFile(exe, local) {
+		err = copyExecutable(exe, local)
+		if err != nil {
+			return err
+		}
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		wd = dir
+	}
+
+	_, err = runPowerShell(ctx, fmt.Sprintf(
+		`$t = New-ScheduledTaskTrigger -AtStartup; $t.Delay = %s; `+
+			`Register-ScheduledTask -Force -TaskName %s -Trigger $t `+
+			`-Action (New-ScheduledTaskAction -Execute %s -Argument %s -WorkingDirectory %s) `+
+			`-Principal (New-ScheduledTaskPrincipal -UserId 'SYSTEM' -LogonType ServiceAccount -RunLevel Highest) | Out-Null`,
+		psQuote(CONTINUATION_DELAY), psQuote(CONTINUATION_TASK), psQuote(local),
+		psQuote(windows.ComposeCommandLine(append(rerunArgs(), "-nopause"))), psQuote(wd)))
+	if err != nil {
+		return errors.Wrap(err, "Cannot register the task that carries on after the restart")
+	}
+	Verbose("Registered the scheduled task %s to carry on after the restart.", CONTINUATION_TASK)
+	return nil
+}
+
+// RemoveContinuation removes the task RegisterContinuation set up, and its copy of the
+// runner unless that's what is running now.
+func RemoveContinuation(ctx context.Context) error {
+	_, err := runPowerShell(ctx, fmt.Sprintf(
+		`Unregister-ScheduledTask -TaskName %s -Confirm:$false -ErrorAction SilentlyContinue`, psQuote(CONTINUATION_TASK)))
+	if err != nil {
+		return errors.Wrap(err, "Cannot remove the task that carries on after the restart")
+	}
+	if dir, err := RunnerDataDir(); err == nil {
+		local := filepath.Join(dir, CONTINUATION_EXE)
+		if exe, err := os.Executable(); err != nil || !sameFile(exe, local) {
+			os.Remove(local)
+		}
+	}
+	return nil
+}
+
+var (
+	modadvapi32              = windows.NewLazySystemDLL("advapi32.dll")
+	procAbortSystemShutdownW = modadvapi32.NewProc("AbortSystemShutdownW")
+)
+
+// ScheduleRestart has Windows restart the computer after warning, showing whoever is
+// logged on its own notification with m until then. Programs that are still open are
+// closed, as the user has already been counted down to it. Until the restart, it can
+// be called off with AbortRestart, or shutdown /a, or from the progress window.
+func ScheduleRestart(m string, warning time.Duration) error {
+	err := enablePrivilege(SE_SHUTDOWN_NAME)
+	if err != nil {
+		return err
+	}
+	err = windows.InitiateSystemShutdownEx(nil, windows.StringToUTF16Ptr(m), uint32(warning.Seconds()), true, true,
+		windows.SHTDN_REASON_MAJOR_APPLICATION|windows.SHTDN_REASON_MINOR_INSTALLATION|windows.SHTDN_REASON_FLAG_PLANNED)
+	return errors.Wrap(err, "Cannot schedule the restart")
+}
+
+// AbortRestart calls off the restart ScheduleRestart set up.
+func AbortRestart() {
+	procAbortSystemShutdownW.Call(0)
+}
+
+// enablePrivilege enables the privilege called name for this process, which has to
+// hold it already.
+func enablePrivilege(name string) error {
+	var t windows.Token
+	err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ADJUST_PRIVILEGES|windows.TOKEN_QUERY, &t)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open this program's token")
+	}
+	defer t.Close()
+	var luid windows.LUID
+	err = windows.LookupPrivilegeValue(nil, windows.StringToUTF16Ptr(name), &luid)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot look up %s", name)
+	}
+	tp := windows.Tokenprivileges{PrivilegeCount: 1}
+	tp.Privileges[0] = windows.LUIDAndAttributes{Luid: luid, Attributes: windows.SE_PRIVILEGE_ENABLED}
+	return errors.Wrapf(windows.AdjustTokenPrivileges(t, false, &tp, 0, nil, nil), "Cannot enable %s", name)
+}
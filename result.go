@@ -0,0 +1,54 @@
+package main
+
+// A Result is how a run ended. The workflow and the commands return one instead of
+// exiting, so the same code can run under the console, the wizard or anything else
+// that drives it, and the caller decides what to do with the outcome.
+type Result struct {
+	Outcome string
+	Message string
+	Err     error
+	// Quiet results end without the summary or the pause, for commands whose console
+	// output is meant to be piped.
+	Quiet bool
+}
+
+func Succeeded(m string) Result {
+	return Result{Outcome: OUTCOME_SUCCESS, Message: m}
+}
+
+func Failed(m string, e error) Result {
+	return Result{Outcome: OUTCOME_ERROR, Message: m, Err: e}
+}
+
+func Unsuccessful(m string) Result {
+	return Result{Outcome: OUTCOME_UNSUCCESSFUL, Message: m}
+}
+
+// Busy is for runs that didn't start because another installer was running.
+func Busy(m string) Result {
+	return Result{Outcome: OUTCOME_BUSY, Message: m}
+}
+
+// Flapping is for runs that held off a fix that keeps coming undone, see CheckFlapping.
+func Flapping(m string) Result {
+	return Result{Outcome: OUTCOME_FLAPPING, Message: m}
+}
+
+// RebootNeeded is for runs that can't go on until the computer restarts, see
+// WaitingForReboot.
+func RebootNeeded(m string) Result {
+	return Result{Outcome: OUTCOME_REBOOT, Message: m}
+}
+
+var exitOutcomes = map[int]string{0: OUTCOME_SUCCESS, 1: OUTCOME_ERROR, 2: OUTCOME_UNSUCCESSFUL, 3: OUTCOME_BUSY, 4: OUTCOME_FLAPPING,
+	5: OUTCOME_REBOOT}
+
+// Code is the exit code for r.
+func (r Result) Code() int {
+	for code, outcome := range exitOutcomes {
+		if outcome == r.Outcome {
+			return code
+		}
+	}
+	return 1
+}
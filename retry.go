@@ -0,0 +1,99 @@
+package main
+
+import "context"
+import "strings"
+import "time"
+
+// StepRetry says how hard to try an action before giving up on it: Attempts runs of
+// the action itself, for failures that tend to clear up by themselves, and Checks of
+// whether it worked before it counts as not done, since some setups finish writing
+// their state a while after they exit. DelaySeconds goes in between either.
+//
+//	<Retries>
+//	  <Retry Action="InstallNetworkCatalog" Checks="3" DelaySeconds="10" />
+//	  <Retry Action="ConfigureLicense" Attempts="2" DelaySeconds="30" />
+//	</Retries>
+type StepRetry struct {
+	Action       string `xml:"Action,attr"`
+	Attempts     uint32 `xml:"Attempts,attr"`
+	Checks       uint32 `xml:"Checks,attr"`
+	DelaySeconds uint32 `xml:"DelaySeconds,attr"`
+}
+
+// DSA rewrites its state cookie a little while after the catalog setup exits, so a
+// single look straight away often still sees the old catalog.
+var DEFAULT_RETRIES = map[string]StepRetry{
+	ACTION_INSTALL_CATALOG: {Checks: 3, DelaySeconds: 10},
+}
+
+// RetryFor returns the retry settings for action: the defaults, with whatever the
+// config sets on top, and at least one attempt and one check.
+func RetryFor(action string) StepRetry {
+	r := DEFAULT_RETRIES[action]
+	for _, c := range config.Retries {
+		if !strings.EqualFold(c.Action, action) {
+			continue
+		}
+		if c.Attempts > 0 {
+			r.Attempts = c.Attempts
+		}
+		if c.Checks > 0 {
+			r.Checks = c.Checks
+		}
+		if c.DelaySeconds > 0 {
+			r.DelaySeconds = c.DelaySeconds
+		}
+	}
+	r.Action = action
+	if r.Attempts == 0 {
+		r.Attempts = 1
+	}
+	if r.Checks == 0 {
+		r.Checks = 1
+	}
+	return r
+}
+
+// wait sleeps for the delay, and reports false if ctx was done first.
+func (r StepRetry) wait(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(r.DelaySeconds) * time.Second):
+		return true
+	}
+}
+
+// runAction runs the action called name in its phase, as many times as its retry
+// settings allow while it fails.
+func runAction(ctx context.Context, name string, a planAction) error {
+	r := RetryFor(name)
+	for attempt := uint32(1); ; attempt++ {
+		err := RunPhase(ctx, a.Phase, a.Run)
+		if err == nil || attempt >= r.Attempts {
+			return err
+		}
+		Warn("%s failed, trying again in %d seconds (attempt %d of %d): %v", a.Title, r.DelaySeconds, attempt+1, r.Attempts, err)
+		if !r.wait(ctx) {
+			return err
+		}
+	}
+}
+
+// verifyAction runs the Verify of the action called name, as many times as its retry
+// settings allow until it passes.
+func verifyAction(ctx context.Context, name string, a planAction) bool {
+	r := RetryFor(name)
+	for check := uint32(1); ; check++ {
+		if a.Verify() {
+			return true
+		}
+		if check >= r.Checks {
+			return false
+		}
+		Verbose("%s hasn't taken effect yet; checking again in %d seconds.", a.Title, r.DelaySeconds)
+		if !r.wait(ctx) {
+			return false
+		}
+	}
+}
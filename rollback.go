@@ -0,0 +1,61 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os/exec"
+
+// InstallSoftwareWithRollback installs the target version. If that fails after we
+// removed the previous version ourselves, it falls back to the last known good
+// installer so the designer isn't left without 2020 until someone can look at it.
+// The installs can map drives, which records them in the runner state, so the state is
+// only read here, and changed with UpdateState.
+func InstallSoftwareWithRollback(ctx context.Context) error {
+	state, err := LoadState()
+	if err != nil {
+		return err
+	}
+
+	err = InstallSoftware(ctx)
+	if err == nil {
+		if state.UpgradeInProgress {
+			return UpdateState(func(s *RunnerState) { s.UpgradeInProgress = false })
+		}
+		return nil
+	}
+	if !state.UpgradeInProgress || policy.FallbackSoftwareInstaller == "" {
+		return err
+	}
+
+	Warn("Installing %s failed: %v", policy.SoftwareVersion, err)
+	Say("Reinstalling the last known good 2020 software instead...")
+	ferr := PrepareInstaller(ctx, policy.FallbackSoftwareInstaller, false)
+	if ferr != nil {
+		return errors.Wrapf(ferr, "Upgrade failed (%v) and the fallback installer can't be used", err)
+	}
+	installer, ferr := SoftwareInstallerPath(ctx, policy.FallbackSoftwareInstaller)
+	if ferr != nil {
+		return errors.Wrapf(ShareError(ctx, policy.FallbackSoftwareInstaller, ferr), "Upgrade failed (%v) and so did copying the fallback installer", err)
+	}
+	// The fallback is another build of the same setup, so it takes the same switches.
+	cmd, ferr := PhaseCommand(PHASE_SOFTWARE_INSTALL, map[string]string{"installer": installer}, exec.Command(installer))
+	if ferr != nil {
+		return errors.Wrapf(ferr, "Upgrade failed (%v) and the fallback install command is unusable", err)
+	}
+	out, ferr := RunCommand(ctx, cmd)
+	if ferr != nil {
+		return errors.Wrapf(ferr, "Upgrade failed (%v) and so did the fallback install, output: %s", err, out)
+	}
+
+	// Remember which target failed, so the next run doesn't remove the fallback
+	// again and go round in circles. A new target version clears this.
+	return UpdateState(func(s *RunnerState) {
+		s.UpgradeInProgress = false
+		s.FallbackFor = policy.SoftwareVersion
+	})
+}
+
+// HoldingFallback reports whether the installed, non-current software is a fallback we
+// put in place for the current target version.
+func (s MachineState) HoldingFallback() bool {
+	return s.SoftwareInstalled && !s.SoftwareCurrent && s.FallbackFor == policy.SoftwareVersion
+}
@@ -0,0 +1,44 @@
+package main
+
+import "hash/fnv"
+import "strings"
+
+// A Rollout stages a policy change, usually a new SoftwareVersion and
+// SoftwareInstaller, to a percentage of machines:
+//
+//	<Rollout Name="13.00.14000" Percent="10">
+//	  <SoftwareVersion>13.00.14000</SoftwareVersion>
+//	  <SoftwareInstaller>\\10.0.9.29\2020software-next\Setup.exe</SoftwareInstaller>
+//	</Rollout>
+//
+// Which machines are in the ring depends only on the hostname and Name, so raising
+// Percent from 10 to 50 keeps the first 10% and adds more. Everyone else holds back
+// on the top-level policy until Percent reaches 100 and the rollout is folded in.
+type Rollout struct {
+	Name    string `xml:"Name,attr"`
+	Percent uint32 `xml:"Percent,attr"`
+	Policy
+}
+
+// Bucket places host in 0-99 for this rollout.
+func (r Rollout) Bucket(host string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToUpper(r.Name + "/" + host)))
+	return h.Sum32() % 100
+}
+
+func (r Rollout) Includes(host string) bool {
+	return r.Bucket(host) < r.Percent
+}
+
+func (r Rollout) apply(p *Policy, host string) {
+	if r.Name == "" {
+		return
+	}
+	if r.Includes(host) {
+		Say("This computer is in the %d%% ring for %s", r.Percent, r.Name)
+		p.Merge(r.Policy)
+	} else {
+		Say("This computer is not yet in the rollout of %s (%d%%)", r.Name, r.Percent)
+	}
+}
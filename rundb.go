@@ -0,0 +1,249 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "os"
+import "path/filepath"
+import "strconv"
+import "time"
+
+// The run database, in the runner's data folder, has the history of runs, their
+// phase timings and inventory snapshots, for looking at how a machine has been doing
+// over time rather than just at its last run.
+const RUN_DB_FILE = "runs.db"
+
+// Times are kept as UTC RFC 3339 text, which sorts the same as the times do.
+const RUN_DB_TIME = time.RFC3339
+
+// The run database keeps this many inventory snapshots; older ones are dropped.
+const INVENTORY_MAX = 100
+
+// A RunDB is the open run database.
+type RunDB struct {
+	h uintptr
+}
+
+var runDBSchema = []string{
+	`CREATE TABLE IF NOT EXISTS runs (
+		id INTEGER PRIMARY KEY,
+		time TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		installed TEXT NOT NULL DEFAULT '',
+		target TEXT NOT NULL DEFAULT '',
+		catalog TEXT NOT NULL DEFAULT '',
+		actions TEXT NOT NULL DEFAULT '',
+		message TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '')`,
+	`CREATE INDEX IF NOT EXISTS runs_time ON runs (time)`,
+	`CREATE TABLE IF NOT EXISTS phases (
+		run INTEGER NOT NULL REFERENCES runs (id),
+		name TEXT NOT NULL,
+		seconds REAL NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS phases_run ON phases (run)`,
+	`CREATE TABLE IF NOT EXISTS inventory (
+		id INTEGER PRIMARY KEY,
+		time TEXT NOT NULL,
+		snapshot TEXT NOT NULL)`,
+}
+
+func runDBPath() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, RUN_DB_FILE), nil
+}
+
+// OpenRunDB opens the run database, creating it if need be. The first time, the runs
+// in the history.xml earlier versions kept are moved into it.
+func OpenRunDB() (*RunDB, error) {
+	path, err := runDBPath()
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, errors.Wrap(FileAccessError(err, path), "Cannot open the run database")
+	}
+	for _, s := range runDBSchema {
+		err = db.Exec(s)
+		if err != nil {
+			db.Close()
+			return nil, Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot set up the run database"))
+		}
+	}
+	err = importHistoryXML(db)
+	if err != nil {
+		Warn("Unable to move the old run history into the run database: %v", err)
+	}
+	return db, nil
+}
+
+// Tx runs fn in a transaction, which is rolled back if fn fails.
+func (db *RunDB) Tx(fn func() error) error {
+	err := db.Exec("BEGIN IMMEDIATE")
+	if err != nil {
+		return err
+	}
+	err = fn()
+	if err != nil {
+		db.Exec("ROLLBACK")
+		return err
+	}
+	return db.Exec("COMMIT")
+}
+
+// One returns the first column of the first row of query, "" if there are no rows.
+func (db *RunDB) One(query string, args ...string) (string, error) {
+	var v string
+	err := db.Query(query, args, func(cols []string) error {
+		if v == "" && len(cols) > 0 {
+			v = cols[0]
+		}
+		return nil
+	})
+	return v, err
+}
+
+// importHistoryXML moves the runs in history.xml, if it's still there, into an empty
+// run database, and renames it out of the way.
+func importHistoryXML(db *RunDB) error {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "history.xml")
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Cannot read the old run history")
+	}
+	n, err := db.One(`SELECT COUNT(*) FROM runs`)
+	if err != nil {
+		return err
+	}
+	if n == "0" {
+		var h History
+		err = xml.Unmarshal(b, &h)
+		if err != nil {
+			// As before, a damaged history is started afresh rather than holding up the run.
+			os.Rename(path, path+".damaged")
+			return errors.Wrap(err, "Cannot decode the old run history")
+		}
+		err = db.Tx(func() error {
+			for _, r := range h.Runs {
+				if err := insertRun(db, r); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(path, path+".imported")
+}
+
+func insertRun(db *RunDB, r HistoryEntry) error {
+	err := db.Exec(`INSERT INTO runs (time, outcome, installed, target, catalog, actions, message, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, r.Time.UTC().Format(RUN_DB_TIME), r.Outcome, r.Installed, r.Target,
+		r.Catalog, r.Actions, r.Message, r.Error)
+	if err != nil {
+		return errors.Wrap(err, "Cannot add the run to the run database")
+	}
+	id, err := db.One(`SELECT last_insert_rowid()`)
+	if err != nil {
+		return err
+	}
+	for _, p := range r.Phases {
+		err = db.Exec(`INSERT INTO phases (run, name, seconds) VALUES (?, ?, ?)`,
+			id, p.Name, strconv.FormatFloat(p.Seconds, 'f', -1, 64))
+		if err != nil {
+			return errors.Wrap(err, "Cannot add the run's timings to the run database")
+		}
+	}
+	return nil
+}
+
+// pruneRuns drops all but the last HISTORY_MAX runs, and their timings.
+func pruneRuns(db *RunDB) error {
+	err := db.Exec(`DELETE FROM runs WHERE id NOT IN (SELECT id FROM runs ORDER BY id DESC LIMIT ?)`,
+		strconv.Itoa(HISTORY_MAX))
+	if err == nil {
+		err = db.Exec(`DELETE FROM phases WHERE run NOT IN (SELECT id FROM runs)`)
+	}
+	return errors.Wrap(err, "Cannot trim the run database")
+}
+
+// loadRuns reads the runs in the run database, oldest first.
+func loadRuns(db *RunDB) ([]HistoryEntry, error) {
+	var runs []HistoryEntry
+	ids := map[string]int{}
+	err := db.Query(`SELECT id, time, outcome, installed, target, catalog, actions, message, error
+		FROM runs ORDER BY id`, nil, func(c []string) error {
+		t, err := time.Parse(RUN_DB_TIME, c[1])
+		if err != nil {
+			return Categorize(ERROR_CORRUPT_STATE, errors.Wrapf(err, "Cannot read the time of run %s", c[0]))
+		}
+		ids[c[0]] = len(runs)
+		runs = append(runs, HistoryEntry{Time: t, Outcome: c[2], Installed: c[3], Target: c[4],
+			Catalog: c[5], Actions: c[6], Message: c[7], Error: c[8]})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read the run history")
+	}
+	err = db.Query(`SELECT run, name, seconds FROM phases ORDER BY rowid`, nil, func(c []string) error {
+		i, ok := ids[c[0]]
+		if !ok {
+			return nil
+		}
+		s, err := strconv.ParseFloat(c[2], 64)
+		if err != nil {
+			return Categorize(ERROR_CORRUPT_STATE, errors.Wrapf(err, "Cannot read the timing of %s in run %s", c[1], c[0]))
+		}
+		runs[i].Phases = append(runs[i].Phases, HistoryPhase{Name: c[1], Seconds: s})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot read the run timings")
+	}
+	return runs, nil
+}
+
+// SaveInventorySnapshot stores snapshot, an inventory as JSON, in the run database.
+func SaveInventorySnapshot(collected time.Time, snapshot []byte) error {
+	db, err := OpenRunDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Tx(func() error {
+		err := db.Exec(`INSERT INTO inventory (time, snapshot) VALUES (?, ?)`,
+			collected.UTC().Format(RUN_DB_TIME), string(snapshot))
+		if err == nil {
+			err = db.Exec(`DELETE FROM inventory WHERE id NOT IN (SELECT id FROM inventory ORDER BY id DESC LIMIT ?)`,
+				strconv.Itoa(INVENTORY_MAX))
+		}
+		return errors.Wrap(err, "Cannot store the inventory")
+	})
+}
+
+// LoadInventorySnapshots returns the stored inventories collected since since, oldest
+// first, as JSON.
+func LoadInventorySnapshots(since time.Time) ([][]byte, error) {
+	db, err := OpenRunDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var snapshots [][]byte
+	err = db.Query(`SELECT snapshot FROM inventory WHERE time >= ? ORDER BY id`,
+		[]string{since.UTC().Format(RUN_DB_TIME)}, func(c []string) error {
+			snapshots = append(snapshots, []byte(c[0]))
+			return nil
+		})
+	return snapshots, errors.Wrap(err, "Cannot read the stored inventories")
+}
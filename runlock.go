@@ -0,0 +1,141 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+// Held by every run that changes the machine. Windows closes it with the process, so a
+// run that crashed never leaves it behind.
+const RUN_MUTEX = `Global\2020runner-run`
+
+const RUN_LOCK_FILE = "run.lock"
+
+// RunLock is what the lock file says about the run holding the lock, so that anyone
+// finding it can tell who it is and whether it's still around.
+type RunLock struct {
+	XMLName xml.Name  `xml:"RunLock"`
+	PID     uint32    `xml:"PID,attr"`
+	Started time.Time `xml:"Started,attr"`
+	Command string    `xml:"Command"`
+}
+
+var runMutex windows.Handle
+
+func runLockPath() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, RUN_LOCK_FILE), nil
+}
+
+func readRunLock(path string) (RunLock, error) {
+	var l RunLock
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return l, err
+	}
+	err = xml.Unmarshal(b, &l)
+	return l, err
+}
+
+// processStarted returns when process pid started, or false if there's no such process.
+func processStarted(pid uint32) (time.Time, bool) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer windows.CloseHandle(h)
+	var created, exited, kernel, user windows.Filetime
+	err = windows.GetProcessTimes(h, &created, &exited, &kernel, &user)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, created.Nanoseconds()), true
+}
+
+// alive reports whether the process that wrote l is still running. PIDs get reused, so
+// the process start time has to match as well.
+func (l RunLock) alive() bool {
+	started, ok := processStarted(l.PID)
+	if !ok {
+		return false
+	}
+	d := started.Sub(l.Started)
+	return d > -time.Second && d < time.Second
+}
+
+func (l RunLock) String() string {
+	return fmt.Sprintf("process %d, %s, started %s", l.PID, l.Command, l.Started.Local().Format("2006-01-02 15:04"))
+}
+
+// AcquireRunLock makes sure only one run at a time changes the machine. It holds
+// RUN_MUTEX for the rest of the process and writes the lock file. A lock file left by
+// a run that's gone is cleared with a warning. It returns false with the Result to end
+// on if another run has the lock.
+func AcquireRunLock() (Result, bool) {
+	path, err := runLockPath()
+	if err != nil {
+		return Failed("Unable to find the lock file.", err), false
+	}
+
+	m, err := windows.CreateMutex(nil, false, windows.StringToUTF16Ptr(RUN_MUTEX))
+	if err == windows.ERROR_ALREADY_EXISTS {
+		windows.CloseHandle(m)
+		holder := "another 2020runner"
+		if l, err := readRunLock(path); err == nil && l.alive() {
+			holder = l.String()
+		}
+		return Busy("Another run is already in progress (" + holder + ")."), false
+	} else if err != nil {
+		return Failed("Unable to take the run lock.", errors.Wrap(err, "Cannot create the run mutex")), false
+	}
+	runMutex = m
+
+	if l, err := readRunLock(path); err == nil {
+		if l.alive() {
+			// Nobody holds the mutex, so this is a runner from before it had one.
+			return Busy("Another run is already in progress (" + l.String() + ")."), false
+		}
+		Warn("Clearing the lock left by a run that didn't finish (%s).", l)
+	} else if !os.IsNotExist(err) {
+		Warn("Clearing an unreadable lock file: %v", err)
+	}
+
+	started, _ := processStarted(uint32(os.Getpid()))
+	b, err := xml.MarshalIndent(RunLock{
+		PID:     uint32(os.Getpid()),
+		Started: started,
+		Command: strings.Join(os.Args, " "),
+	}, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = os.WriteFile(path, b, 0644)
+	}
+	if err != nil {
+		return Failed("Unable to write the lock file.", errors.Wrap(FileAccessError(err, path), "Cannot write lock file")), false
+	}
+	return Result{}, true
+}
+
+// ReleaseRunLock removes the lock file if this run holds the lock. The mutex goes with
+// the process.
+func ReleaseRunLock() {
+	if runMutex == 0 {
+		return
+	}
+	path, err := runLockPath()
+	if err != nil {
+		return
+	}
+	if l, err := readRunLock(path); err == nil && l.PID == uint32(os.Getpid()) {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "github.com/pkg/errors"
+import "bufio"
+import "context"
+import "encoding/base64"
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+
+// Config values starting with this are DPAPI blobs made by protect-secret.
+const SECRET_PREFIX = "dpapi:"
+
+// Mixed into every blob, so that other programs' machine-scoped secrets can't be
+// passed off as ours and the other way round.
+var SECRET_ENTROPY = []byte("2020runner secret")
+
+// ProtectSecret encrypts s with DPAPI under the machine key. The result can be
+// decrypted by anything running on this machine, but not copied to another one.
+func ProtectSecret(s string) (string, error) {
+	b, err := protectData([]byte(s), SECRET_ENTROPY)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot protect the secret")
+	}
+	return SECRET_PREFIX + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Secret returns the plain text of a config value, decrypting it if it was protected.
+// Other values are passed through as they are.
+func Secret(value string) (string, error) {
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		return value, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[len(SECRET_PREFIX):]))
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot decode the protected value")
+	}
+	plain, err := unprotectData(b, SECRET_ENTROPY)
+	if err != nil {
+		return "", Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot decrypt the protected value, which only works on the machine that protected it"))
+	}
+	return string(plain), nil
+}
+
+// ProtectSecretCommand implements `2020runner protect-secret`, which reads a secret
+// from standard input, so it doesn't end up in the command history, and prints it
+// protected for this machine's config.
+func ProtectSecretCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("protect-secret", flag.ExitOnError)
+	fs.Parse(args)
+
+	fmt.Fprintln(os.Stderr, "Type the secret and press Enter:")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return Failed("Unable to read the secret.", err)
+	}
+	s, err := ProtectSecret(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return Failed("Unable to protect the secret.", err)
+	}
+	fmt.Println(s)
+	fmt.Println()
+	return Succeeded("Put the value above in this computer's config in place of the secret.")
+}
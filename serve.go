@@ -0,0 +1,404 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/base64"
+import "encoding/json"
+import "flag"
+import "io"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// `2020runner serve` is the other end of ReportURL, for one admin box to collect the
+// fleet's reports on: every run's report, and the end of its log, goes in a database
+// of its own in the runner data folder, and the dashboard, and the JSON API at /api/,
+// show how the fleet is doing from the latest report of each machine. Point ReportURL
+// at http://server:8020/reports, or https:// with -cert and -key, and ReportPin at the
+// key of that certificate. Reports are only taken with the server's token, from
+// -token-file, as their bearer token, which runs send from ReportToken. The dashboard
+// and the API have a token of their own, from -read-token-file, so that reading the
+// fleet's reports, logs and all, doesn't let anyone send them: tools send it as their
+// bearer token, and browsers ask for it as the password, with any user name.
+const (
+	SERVE_ADDR             = ":8020"
+	REPORTS_DB_FILE        = "reports.db"
+	REPORT_TOKEN_FILE      = "report-token.txt"
+	REPORT_READ_TOKEN_FILE = "report-read-token.txt"
+)
+
+// The random bytes in a token file is started with if it doesn't exist yet.
+const REPORT_TOKEN_BYTES = 32
+
+// Reports larger than this are turned away, which is well beyond what a run with a
+// full log sends.
+const SERVE_MAX_REPORT = 4 << 20
+
+// The server keeps this many reports for each machine, and shows this many failures
+// across the fleet on the dashboard.
+const (
+	SERVE_HISTORY_MAX     = 200
+	SERVE_RECENT_FAILURES = 25
+)
+
+var reportsDBSchema = []string{
+	`CREATE TABLE IF NOT EXISTS reports (
+		id INTEGER PRIMARY KEY,
+		hostname TEXT NOT NULL,
+		received TEXT NOT NULL,
+		finished TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		message TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		category TEXT NOT NULL DEFAULT '',
+		installed TEXT NOT NULL DEFAULT '',
+		catalog TEXT NOT NULL DEFAULT '',
+		exempt TEXT NOT NULL DEFAULT '',
+		report TEXT NOT NULL,
+		log TEXT NOT NULL DEFAULT '')`,
+	`CREATE INDEX IF NOT EXISTS reports_hostname ON reports (hostname, id)`,
+}
+
+// A ReportStore is the report server's database. The one SQLite connection is shared
+// by every request, one at a time.
+type ReportStore struct {
+	mu sync.Mutex
+	db *RunDB
+}
+
+// MachineSummary is the latest report of one machine. It's compliant if that run
+// succeeded and the machine isn't exempt.
+type MachineSummary struct {
+	Hostname  string    `json:"hostname"`
+	Finished  time.Time `json:"finished"`
+	Outcome   string    `json:"outcome"`
+	Message   string    `json:"message"`
+	Installed string    `json:"installed,omitempty"`
+	Catalog   string    `json:"catalog,omitempty"`
+	Exempt    string    `json:"exempt,omitempty"`
+	Compliant bool      `json:"compliant"`
+}
+
+// StoredReport is one report as the server keeps it, with the whole of it as the run
+// sent it in Report.
+type StoredReport struct {
+	ID        int64           `json:"id"`
+	Hostname  string          `json:"hostname"`
+	Finished  time.Time       `json:"finished"`
+	Outcome   string          `json:"outcome"`
+	Message   string          `json:"message"`
+	Error     string          `json:"error,omitempty"`
+	Category  string          `json:"category,omitempty"`
+	Installed string          `json:"installed,omitempty"`
+	Catalog   string          `json:"catalog,omitempty"`
+	Log       string          `json:"log,omitempty"`
+	Report    json.RawMessage `json:"report,omitempty"`
+}
+
+// OpenReportStore opens the report server's database at path, creating it if need be.
+func OpenReportStore(path string) (*ReportStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, errors.Wrap(FileAccessError(err, path), "Cannot open the report database")
+	}
+	for _, s := range reportsDBSchema {
+		err = db.Exec(s)
+		if err != nil {
+			db.Close()
+			return nil, Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot set up the report database"))
+		}
+	}
+	return &ReportStore{db: db}, nil
+}
+
+func (s *ReportStore) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db.Close()
+}
+
+// Add stores r, received now, and drops the machine's reports beyond SERVE_HISTORY_MAX.
+func (s *ReportStore) Add(r Report) error {
+	host := strings.ToUpper(r.Hostname)
+	log := r.Log
+	r.Log = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode the report")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.db.Tx(func() error {
+		err := s.db.Exec(`INSERT INTO reports (hostname, received, finished, outcome, message, error, category,
+			installed, catalog, exempt, report, log) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			host, time.Now().UTC().Format(RUN_DB_TIME), r.Finished.UTC().Format(RUN_DB_TIME), r.Outcome, r.Message,
+			r.Error, r.Category, r.Installed, r.Catalog, r.Exempt, string(b), log)
+		if err != nil {
+			return errors.Wrap(err, "Cannot store the report")
+		}
+		err = s.db.Exec(`DELETE FROM reports WHERE hostname = ? AND id NOT IN
+			(SELECT id FROM reports WHERE hostname = ? ORDER BY id DESC LIMIT ?)`, host, host, strconv.Itoa(SERVE_HISTORY_MAX))
+		return errors.Wrap(err, "Cannot trim the machine's reports")
+	})
+}
+
+// Machines returns the latest report of every machine, by name.
+func (s *ReportStore) Machines() ([]MachineSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var machines []MachineSummary
+	err := s.db.Query(`SELECT r.hostname, r.finished, r.outcome, r.message, r.installed, r.catalog, r.exempt
+		FROM reports r JOIN (SELECT MAX(id) AS id FROM reports GROUP BY hostname) l ON r.id = l.id
+		ORDER BY r.hostname`, nil, func(c []string) error {
+		t, err := time.Parse(RUN_DB_TIME, c[1])
+		if err != nil {
+			return Categorize(ERROR_CORRUPT_STATE, errors.Wrapf(err, "Cannot read the time of %s's report", c[0]))
+		}
+		machines = append(machines, MachineSummary{Hostname: c[0], Finished: t, Outcome: c[2], Message: c[3],
+			Installed: c[4], Catalog: c[5], Exempt: c[6], Compliant: c[2] == OUTCOME_SUCCESS && c[6] == ""})
+		return nil
+	})
+	return machines, errors.Wrap(err, "Cannot read the machines")
+}
+
+// Reports returns up to limit reports, newest first, where is a condition on them with
+// ? bound to args.
+func (s *ReportStore) Reports(where string, args []string, limit int) ([]StoredReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var reports []StoredReport
+	err := s.db.Query(`SELECT id, hostname, finished, outcome, message, error, category, installed, catalog, log, report
+		FROM reports WHERE `+where+` ORDER BY id DESC LIMIT ?`, append(args, strconv.Itoa(limit)), func(c []string) error {
+		id, _ := strconv.ParseInt(c[0], 10, 64)
+		t, err := time.Parse(RUN_DB_TIME, c[2])
+		if err != nil {
+			return Categorize(ERROR_CORRUPT_STATE, errors.Wrapf(err, "Cannot read the time of report %s", c[0]))
+		}
+		reports = append(reports, StoredReport{ID: id, Hostname: c[1], Finished: t, Outcome: c[3], Message: c[4],
+			Error: c[5], Category: c[6], Installed: c[7], Catalog: c[8], Log: c[9], Report: json.RawMessage(c[10])})
+		return nil
+	})
+	return reports, errors.Wrap(err, "Cannot read the reports")
+}
+
+// FleetSummary is what the dashboard shows at the top: how many machines there are in
+// each outcome, and the share of the ones that aren't exempt whose latest run succeeded.
+type FleetSummary struct {
+	Machines  int            `json:"machines"`
+	Exempt    int            `json:"exempt"`
+	Compliant int            `json:"compliant"`
+	Percent   float64        `json:"percent"`
+	Outcomes  map[string]int `json:"outcomes"`
+}
+
+func summarizeFleet(machines []MachineSummary) FleetSummary {
+	f := FleetSummary{Machines: len(machines), Outcomes: map[string]int{}}
+	for _, m := range machines {
+		f.Outcomes[m.Outcome]++
+		switch {
+		case m.Exempt != "":
+			f.Exempt++
+		case m.Compliant:
+			f.Compliant++
+		}
+	}
+	if n := f.Machines - f.Exempt; n > 0 {
+		f.Percent = 100 * float64(f.Compliant) / float64(n)
+	}
+	return f
+}
+
+// ServeCommand implements `2020runner serve [-addr host:port] [-db file] [-token-file
+// file] [-read-token-file file] [-cert file -key file]`, which runs the report server
+// until Ctrl+C.
+func ServeCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", SERVE_ADDR, "Address to take reports and serve the dashboard on")
+	dbPath := fs.String("db", "", "The report database, by default "+REPORTS_DB_FILE+" in the runner data folder")
+	tokenPath := fs.String("token-file", "", "The token runs have to send reports with, by default "+REPORT_TOKEN_FILE+
+		" in the runner data folder. A new one is made if the file doesn't exist.")
+	readTokenPath := fs.String("read-token-file", "", "The token the dashboard and the API are read with, by default "+
+		REPORT_READ_TOKEN_FILE+" in the runner data folder. A new one is made if the file doesn't exist.")
+	cert := fs.String("cert", "", "Serve HTTPS with this PEM certificate")
+	key := fs.String("key", "", "The PEM private key of -cert")
+	fs.Parse(args)
+	if (*cert == "") != (*key == "") {
+		return Failed("-cert and -key go together.", errors.New("Unsupported combination"))
+	}
+	if *dbPath == "" || *tokenPath == "" || *readTokenPath == "" {
+		dir, err := RunnerDataDir()
+		if err != nil {
+			return Failed("Unable to find the runner data folder.", err)
+		}
+		if *dbPath == "" {
+			*dbPath = filepath.Join(dir, REPORTS_DB_FILE)
+		}
+		if *tokenPath == "" {
+			*tokenPath = filepath.Join(dir, REPORT_TOKEN_FILE)
+		}
+		if *readTokenPath == "" {
+			*readTokenPath = filepath.Join(dir, REPORT_READ_TOKEN_FILE)
+		}
+	}
+	token, err := loadToken(*tokenPath, "Put it in the config's ReportToken, protected with protect-secret.")
+	if err != nil {
+		return Failed("Unable to read the report token.", err)
+	}
+	readToken, err := loadToken(*readTokenPath, "Give it to whoever reads the dashboard or the API.")
+	if err != nil {
+		return Failed("Unable to read the read token.", err)
+	}
+	if readToken == token {
+		return Failed("The report token and the read token have to differ.", errors.New("Unsupported combination"))
+	}
+
+	store, err := OpenReportStore(*dbPath)
+	if err != nil {
+		return Failed("Unable to open the report database.", err)
+	}
+	defer store.Close()
+	srv := &http.Server{Addr: *addr, Handler: reportServerMux(store, token, readToken), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	if *cert == "" {
+		Warn("Serving without TLS, so reports and the dashboard go over the network in the clear. Use -cert and -key for HTTPS.")
+		Say("Taking reports at http://%s/reports, with the dashboard at / and the JSON API at /api/.", *addr)
+		err = srv.ListenAndServe()
+	} else {
+		Say("Taking reports at https://%s/reports, with the dashboard at / and the JSON API at /api/.", *addr)
+		err = srv.ListenAndServeTLS(*cert, *key)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return Failed("The report server stopped.", errors.Wrapf(err, "Cannot serve on %s", *addr))
+	}
+	return Succeeded("Stopped taking reports.")
+}
+
+// loadToken reads one of the server's tokens from path, making a new one there if
+// there's no such file, and saying so with what to do with it.
+func loadToken(path, use string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(b))
+		if token == "" {
+			return "", errors.Errorf("%s is empty", path)
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", errors.Wrap(FileAccessError(err, path), "Cannot read the token")
+	}
+	raw := make([]byte, REPORT_TOKEN_BYTES)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot make a token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(token+"\n"), 0600)
+	}
+	if err != nil {
+		return "", errors.Wrap(FileAccessError(err, path), "Cannot write the token")
+	}
+	Say("Made a new token in %s. %s", path, use)
+	return token, nil
+}
+
+// reportAuthorized reports whether r carries token as its bearer token, or as the
+// password of its basic authentication, which is what a browser can send.
+func reportAuthorized(r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if ok {
+		given = strings.TrimSpace(given)
+	} else {
+		_, given, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// denyUnauthorized answers a request without the token it needed, asking the browser
+// for it if there is one.
+func denyUnauthorized(w http.ResponseWriter) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="2020runner"`)
+	w.Header().Add("WWW-Authenticate", `Basic realm="2020runner", charset="UTF-8"`)
+	http.Error(w, "The token is missing or wrong", http.StatusUnauthorized)
+}
+
+// withToken has h only answer requests that carry token.
+func withToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !reportAuthorized(r, token) {
+			denyUnauthorized(w)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func reportServerMux(store *ReportStore, token, readToken string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /reports", func(w http.ResponseWriter, r *http.Request) {
+		if !reportAuthorized(r, token) {
+			Verbose("Turned away a report from %s without the report token.", r.RemoteAddr)
+			denyUnauthorized(w)
+			return
+		}
+		var rep Report
+		err := json.NewDecoder(io.LimitReader(r.Body, SERVE_MAX_REPORT)).Decode(&rep)
+		if err != nil {
+			http.Error(w, "Cannot decode the report: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if rep.Hostname == "" || rep.Outcome == "" {
+			http.Error(w, "The report has no hostname or outcome", http.StatusBadRequest)
+			return
+		}
+		err = store.Add(rep)
+		if err != nil {
+			Warn("Unable to store the report from %s: %v", rep.Hostname, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		Verbose("Stored the %s report from %s.", rep.Outcome, rep.Hostname)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /{$}", withToken(readToken, func(w http.ResponseWriter, r *http.Request) {
+		machines, err := store.Machines()
+		var failures []StoredReport
+		if err == nil {
+			failures, err = store.Reports("outcome != ?", []string{OUTCOME_SUCCESS}, SERVE_RECENT_FAILURES)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		serveHTML(w, "dashboard", dashboardPage{summarizeFleet(machines), machines, failures})
+	}))
+	mux.HandleFunc("GET /machines/{host}", withToken(readToken, func(w http.ResponseWriter, r *http.Request) {
+		host := strings.ToUpper(r.PathValue("host"))
+		reports, err := store.Reports("hostname = ?", []string{host}, SERVE_HISTORY_MAX)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(reports) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		serveHTML(w, "machine", machinePage{host, reports})
+	}))
+	addReportAPI(mux, store, readToken)
+	return mux
+}
@@ -0,0 +1,51 @@
+package main
+
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+func TestReportServerNeedsToken(t *testing.T) {
+	const token, readToken = "report-token", "read-token"
+	// None of these get as far as the store, so there doesn't need to be one.
+	mux := reportServerMux(nil, token, readToken)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		bearer string
+		basic  string
+	}{
+		{name: "report without a token", method: http.MethodPost, path: "/reports"},
+		{name: "report with the read token", method: http.MethodPost, path: "/reports", bearer: readToken},
+		{name: "report with a wrong token", method: http.MethodPost, path: "/reports", bearer: "guess"},
+		{name: "dashboard without a token", method: http.MethodGet, path: "/"},
+		{name: "dashboard with the report token", method: http.MethodGet, path: "/", bearer: token},
+		{name: "dashboard with a wrong password", method: http.MethodGet, path: "/", basic: "guess"},
+		{name: "machine without a token", method: http.MethodGet, path: "/machines/LAB-PC01"},
+		{name: "machine with the report token", method: http.MethodGet, path: "/machines/LAB-PC01", basic: token},
+		{name: "API summary without a token", method: http.MethodGet, path: "/api/summary"},
+		{name: "API machines with the report token", method: http.MethodGet, path: "/api/machines", bearer: token},
+		{name: "API reports without a token", method: http.MethodGet, path: "/api/machines/LAB-PC01/reports"},
+		{name: "API noncompliant with a wrong token", method: http.MethodGet, path: "/api/noncompliant", bearer: "guess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"hostname": "LAB-PC01", "outcome": "success"}`))
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.basic != "" {
+				r.SetBasicAuth("admin", tt.basic)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s answered %d, want %d", tt.method, tt.path, w.Code, http.StatusUnauthorized)
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s %s answered without WWW-Authenticate", tt.method, tt.path)
+			}
+		})
+	}
+}
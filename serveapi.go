@@ -0,0 +1,150 @@
+package main
+
+import "encoding/json"
+import "net/http"
+import "strconv"
+import "strings"
+import "time"
+
+// The report server's JSON API, for monitoring and ticketing tools to read what the
+// dashboard shows. It's read-only, takes the read token the same way as the dashboard,
+// as a bearer token or the basic-auth password, and answers with application/json:
+//
+//	GET /api/summary
+//		The fleet's FleetSummary: {"machines": 120, "exempt": 2, "compliant": 113,
+//		"percent": 95.8, "outcomes": {"success": 115, "error": 5}}.
+//
+//	GET /api/machines[?outcome=error]
+//		The latest report of each machine as a list of MachineSummary, by name:
+//		[{"hostname": "LAB-PC01", "finished": "2026-10-12T02:14:03Z", "outcome":
+//		"success", "message": "...", "installed": "...", "catalog": "...",
+//		"exempt": "...", "compliant": true}]. Only those of the given outcome with
+//		?outcome.
+//
+//	GET /api/machines/{host}/reports[?limit=50][&log=1]
+//		The machine's reports, newest first, as a list of StoredReport: {"id", "hostname",
+//		"finished", "outcome", "message", "error", "category", "installed", "catalog",
+//		"report"}, where report is the whole report as the run sent it. The end of each
+//		run's log is in "log" with ?log=1. 404 if the server has no report from host.
+//
+//	GET /api/noncompliant[?stale=168h]
+//		The machines that aren't compliant: the ones not exempt whose latest run didn't
+//		succeed, or, with ?stale, whose latest report is older than that, as for
+//		/api/machines. A machine that has never reported isn't known to the server.
+//
+// Times are UTC in RFC 3339. Errors answer with {"error": "..."} and a 4xx or 5xx
+// status, 401 without the read token.
+
+// The number of reports /api/machines/{host}/reports returns without ?limit.
+const SERVE_API_REPORTS = 50
+
+func addReportAPI(mux *http.ServeMux, store *ReportStore, readToken string) {
+	handle := func(pattern string, h http.HandlerFunc) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+			if !reportAuthorized(r, readToken) {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="2020runner"`)
+				apiError(w, http.StatusUnauthorized, "The read token is missing or wrong")
+				return
+			}
+			h(w, r)
+		})
+	}
+	handle("GET /api/summary", func(w http.ResponseWriter, r *http.Request) {
+		machines, err := store.Machines()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, summarizeFleet(machines))
+	})
+	handle("GET /api/machines", func(w http.ResponseWriter, r *http.Request) {
+		machines, err := store.Machines()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		outcome := r.URL.Query().Get("outcome")
+		writeJSON(w, filterMachines(machines, func(m MachineSummary) bool {
+			return outcome == "" || strings.EqualFold(m.Outcome, outcome)
+		}))
+	})
+	handle("GET /api/machines/{host}/reports", func(w http.ResponseWriter, r *http.Request) {
+		limit := SERVE_API_REPORTS
+		if l := r.URL.Query().Get("limit"); l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				apiError(w, http.StatusBadRequest, "limit has to be a positive number")
+				return
+			}
+			limit = min(n, SERVE_HISTORY_MAX)
+		}
+		host := strings.ToUpper(r.PathValue("host"))
+		reports, err := store.Reports("hostname = ?", []string{host}, limit)
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if len(reports) == 0 {
+			apiError(w, http.StatusNotFound, "No reports from "+host)
+			return
+		}
+		if r.URL.Query().Get("log") != "1" {
+			for i := range reports {
+				reports[i].Log = ""
+			}
+		}
+		writeJSON(w, reports)
+	})
+	handle("GET /api/noncompliant", func(w http.ResponseWriter, r *http.Request) {
+		var stale time.Duration
+		if s := r.URL.Query().Get("stale"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				apiError(w, http.StatusBadRequest, "stale has to be a duration such as 168h")
+				return
+			}
+			stale = d
+		}
+		machines, err := store.Machines()
+		if err != nil {
+			apiError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, filterMachines(machines, func(m MachineSummary) bool {
+			if m.Exempt != "" {
+				return false
+			}
+			return !m.Compliant || stale > 0 && time.Since(m.Finished) > stale
+		}))
+	})
+}
+
+// filterMachines returns the machines keep is true for, as an empty list rather than
+// null if there are none.
+func filterMachines(machines []MachineSummary, keep func(MachineSummary) bool) []MachineSummary {
+	kept := []MachineSummary{}
+	for _, m := range machines {
+		if keep(m) {
+			kept = append(kept, m)
+		}
+	}
+	return kept
+}
+
+// writeJSON answers with v, encoded as JSON.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "Cannot encode the answer: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	b, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(b, '\n'))
+}
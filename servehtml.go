@@ -0,0 +1,85 @@
+package main
+
+import "bytes"
+import "html/template"
+import "net/http"
+import "strconv"
+import "time"
+
+// The report server's pages, styled the same way as the HTML report, plus a link from
+// each machine to its history with the logs its runs sent.
+var serveHTMLPages = template.Must(template.New("pages").Funcs(template.FuncMap{
+	"colour":  func(o string) template.CSS { return template.CSS(outcomeColours[o]) },
+	"th":      func() template.CSS { return REPORT_HTML_TH },
+	"td":      func() template.CSS { return REPORT_HTML_TD },
+	"time":    func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05 MST") },
+	"percent": func(p float64) string { return strconv.FormatFloat(p, 'f', 1, 64) + "%" },
+}).Parse(`
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title></head>
+<body style="margin:0;padding:16px;font-family:Segoe UI,Arial,sans-serif;font-size:14px;color:#212121;background:#ffffff">
+{{end}}
+
+{{define "dashboard"}}{{template "head" "2020runner fleet"}}
+<table cellpadding="0" cellspacing="0" style="width:100%;border-collapse:collapse">
+<tr><td style="padding:12px;background:#37474f;color:#ffffff;font-size:18px">
+<b>{{percent .Fleet.Percent}} compliant</b><br>{{.Fleet.Compliant}} of {{.Fleet.Machines}} machines up to date{{if .Fleet.Exempt}}, not counting {{.Fleet.Exempt}} exempt{{end}}</td></tr>
+</table>
+
+<h3 style="margin:16px 0 4px">Latest outcomes</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+{{range $o, $n := .Fleet.Outcomes}}<tr><td style="{{td}}"><span style="color:{{colour $o}}">&#9632;</span> {{$o}}</td><td style="{{td}}">{{$n}}</td></tr>{{end}}
+</table>
+
+{{if .Failures}}
+<h3 style="margin:16px 0 4px">Recent failures</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Finished</th><th style="{{th}}">Machine</th><th style="{{th}}">Outcome</th><th style="{{th}}">Message</th><th style="{{th}}">Category</th></tr>
+{{range .Failures}}<tr><td style="{{td}}">{{time .Finished}}</td><td style="{{td}}"><a href="/machines/{{.Hostname}}">{{.Hostname}}</a></td><td style="{{td}};color:{{colour .Outcome}}">{{.Outcome}}</td><td style="{{td}}">{{.Message}}</td><td style="{{td}}">{{.Category}}</td></tr>{{end}}
+</table>
+{{end}}
+
+<h3 style="margin:16px 0 4px">Machines</h3>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Machine</th><th style="{{th}}">Last run</th><th style="{{th}}">Outcome</th><th style="{{th}}">Software</th><th style="{{th}}">Catalog</th><th style="{{th}}">Message</th></tr>
+{{range .Machines}}<tr><td style="{{td}}"><a href="/machines/{{.Hostname}}">{{.Hostname}}</a></td><td style="{{td}}">{{time .Finished}}</td><td style="{{td}};color:{{colour .Outcome}}">{{if .Exempt}}exempt{{else}}{{.Outcome}}{{end}}</td><td style="{{td}}">{{.Installed}}</td><td style="{{td}}">{{.Catalog}}</td><td style="{{td}}">{{if .Exempt}}{{.Exempt}}{{else}}{{.Message}}{{end}}</td></tr>{{end}}
+</table>
+</body></html>
+{{end}}
+
+{{define "machine"}}{{template "head" .Hostname}}
+<p style="margin:0 0 8px"><a href="/">All machines</a></p>
+<h2 style="margin:0 0 8px">{{.Hostname}}</h2>
+<table cellpadding="0" cellspacing="0" style="border-collapse:collapse">
+<tr><th style="{{th}}">Finished</th><th style="{{th}}">Outcome</th><th style="{{th}}">Software</th><th style="{{th}}">Catalog</th><th style="{{th}}">Message</th></tr>
+{{range .Reports}}<tr><td style="{{td}}">{{time .Finished}}</td><td style="{{td}};color:{{colour .Outcome}}">{{.Outcome}}</td><td style="{{td}}">{{.Installed}}</td><td style="{{td}}">{{.Catalog}}</td>
+<td style="{{td}}">{{.Message}}{{if .Error}}<br><span style="font-family:Consolas,monospace;white-space:pre-wrap">{{.Error}}</span>{{end}}
+{{if .Log}}<details><summary>Log</summary><pre style="font-family:Consolas,monospace;font-size:12px;white-space:pre-wrap">{{.Log}}</pre></details>{{end}}</td></tr>
+{{end}}
+</table>
+</body></html>
+{{end}}
+`))
+
+type dashboardPage struct {
+	Fleet    FleetSummary
+	Machines []MachineSummary
+	Failures []StoredReport
+}
+
+type machinePage struct {
+	Hostname string
+	Reports  []StoredReport
+}
+
+// serveHTML answers with the page called name, formatted with data.
+func serveHTML(w http.ResponseWriter, name string, data interface{}) {
+	var b bytes.Buffer
+	err := serveHTMLPages.ExecuteTemplate(&b, name, data)
+	if err != nil {
+		http.Error(w, "Cannot format the page: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(b.Bytes())
+}
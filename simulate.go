@@ -0,0 +1,130 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "encoding/xml"
+import "flag"
+import "fmt"
+import "os"
+import "strings"
+
+// How many passes simulate goes through before it gives up on the plans settling down.
+const SIMULATE_MAX_PASSES = 10
+
+// SimulateCommand implements `2020runner simulate [-host name] state.xml`, which plans
+// for a machine described in a file rather than this one, and follows the plans from
+// pass to pass as if each action had worked, without running any of them. It's how
+// rules and policy changes get tried out, on any platform. The file is a saved plan,
+// whose State is used, or a State on its own:
+//
+//	<State>
+//	  <SoftwareInstalled>true</SoftwareInstalled>
+//	  <SoftwareCurrent>false</SoftwareCurrent>
+//	  <SoftwareVersion>12.00.11040</SoftwareVersion>
+//	  <CatalogState>1</CatalogState>
+//	  <SoftwareShare>true</SoftwareShare>
+//	  <CatalogShare>true</CatalogShare>
+//	</State>
+func SimulateCommand(ctx context.Context, args []string) Result {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	host := fs.String("host", "", "Apply the rules for this computer name instead of this computer's")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return Failed("Usage: 2020runner simulate [-host name] <state file>", errors.New("No state file given"))
+	}
+
+	s, err := loadSimulatedState(fs.Arg(0))
+	if err != nil {
+		return Failed("Unable to read the machine state.", err)
+	}
+	if *host != "" {
+		policy = ResolvePolicy(ctx, config, *host)
+		if policy.ShouldSkip() {
+			return Succeeded(*host + " is excluded from 2020 management. Nothing to do.")
+		}
+		if policy.Exempt != "" {
+			Say("%s is exempt (%s), so a run would only report what follows.", *host, policy.Exempt)
+		}
+	}
+
+	_, r := simulatePasses(s, *host)
+	return r
+}
+
+// simulatePasses plans for s, pass by pass, until the plans settle down or are held,
+// and returns the plans with the outcome.
+func simulatePasses(s MachineState, host string) ([]Plan, Result) {
+	var plans []Plan
+	for pass := 1; pass <= SIMULATE_MAX_PASSES; pass++ {
+		p := BuildPlan(s)
+		if host != "" {
+			p.Hostname = host
+		}
+		plans = append(plans, p)
+		Say("Pass %d:", pass)
+		p.Print()
+		if p.Hold != "" {
+			return plans, Unsuccessful(p.Hold)
+		}
+
+		next := s
+		for i, name := range p.Actions {
+			a := planActions[name]
+			SayStep(i+1, len(p.Actions), "Would %s", strings.ToLower(a.Title[:1])+a.Title[1:])
+			simulateAction(&next, name)
+		}
+		if next == s && pass == 1 {
+			return plans, Succeeded("The computer is up to date already.")
+		}
+		if next == s {
+			return plans, Succeeded("The computer would be up to date after the passes above. Nothing was changed.")
+		}
+		if p.has(ACTION_UNINSTALL_SOFTWARE) {
+			Say("The computer would be restarted before the next pass.")
+			next.RebootPending = false
+		}
+		s = next
+	}
+	return plans, Unsuccessful(fmt.Sprintf("The plans didn't settle down after %d passes.", SIMULATE_MAX_PASSES))
+}
+
+func loadSimulatedState(path string) (MachineState, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return MachineState{}, errors.Wrap(err, "Cannot read the state file")
+	}
+	var p Plan
+	if xml.Unmarshal(b, &p) == nil {
+		return p.State, nil
+	}
+	var s MachineState
+	err = xml.Unmarshal(b, &s)
+	if err != nil {
+		return MachineState{}, errors.Wrapf(err, "Cannot decode %s", path)
+	}
+	return s, nil
+}
+
+// simulateAction changes s the way action would if it worked.
+func simulateAction(s *MachineState, action string) {
+	switch action {
+	case ACTION_INSTALL_SOFTWARE:
+		s.SoftwareInstalled, s.SoftwareCurrent = true, true
+		s.SoftwareVersion = policy.SoftwareVersion
+		s.UpgradeInProgress = false
+	case ACTION_UNINSTALL_SOFTWARE:
+		s.SoftwareInstalled, s.SoftwareCurrent = false, false
+		s.SoftwareVersion = ""
+		s.UpgradeInProgress, s.RebootPending = true, true
+	case ACTION_REMOVE_OTHER_VERSIONS:
+		s.OtherVersions = ""
+	case ACTION_RESTORE_USER_DATA:
+		s.PendingRestore = ""
+	case ACTION_UNINSTALL_CATALOG, ACTION_REPAIR_CATALOG:
+		s.CatalogState = CATALOG_STATE_MISSNG
+	case ACTION_INSTALL_CATALOG:
+		s.CatalogState = CATALOG_STATE_NETWORK
+	case ACTION_SYNC_GRANULES:
+		s.GranulesToAdd, s.GranulesToRemove = "", ""
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import "context"
+import "path/filepath"
+import "reflect"
+import "strings"
+import "testing"
+
+// useConfig makes c the config and resolves the policy for host, putting both back
+// once the test is done.
+func useConfig(t testing.TB, c Config, host string) {
+	oldConfig, oldPolicy := config, policy
+	t.Cleanup(func() { config, policy = oldConfig, oldPolicy })
+	config = c
+	policy = ResolvePolicy(context.Background(), c, host)
+}
+
+func TestSimulatePasses(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name    string
+		state   string
+		rules   []Rule
+		passes  [][]string
+		outcome string
+	}{
+		{
+			name:    "up to date",
+			state:   "uptodate.xml",
+			passes:  [][]string{nil},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:    "fresh machine",
+			state:   "fresh.xml",
+			passes:  [][]string{{ACTION_INSTALL_SOFTWARE}, {ACTION_INSTALL_CATALOG}, nil},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:  "upgrade and move off the local catalog",
+			state: "upgrade-local-catalog.xml",
+			passes: [][]string{
+				{ACTION_UNINSTALL_SOFTWARE},
+				{ACTION_INSTALL_SOFTWARE},
+				{ACTION_VERIFY_MIGRATION, ACTION_UNINSTALL_CATALOG, ACTION_INSTALL_CATALOG},
+				nil,
+			},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:  "network-first migration",
+			state: "upgrade-local-catalog.xml",
+			rules: []Rule{{Hostname: "TEST-*", Policy: Policy{MigrationStrategy: MIGRATION_NETWORK_FIRST}}},
+			passes: [][]string{
+				{ACTION_UNINSTALL_SOFTWARE},
+				{ACTION_INSTALL_SOFTWARE},
+				{ACTION_VERIFY_MIGRATION, ACTION_STAGE_NETWORK_CATALOG, ACTION_UNINSTALL_CATALOG, ACTION_INSTALL_CATALOG},
+				nil,
+			},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:    "rule keeps the local catalog",
+			state:   "upgrade-local-catalog.xml",
+			rules:   []Rule{{Hostname: "TEST-*", Policy: Policy{KeepLocalCatalog: &yes}}},
+			passes:  [][]string{{ACTION_UNINSTALL_SOFTWARE}, {ACTION_INSTALL_SOFTWARE}, nil},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:  "rule for another machine",
+			state: "upgrade-local-catalog.xml",
+			rules: []Rule{{Hostname: "LAB-*", Policy: Policy{KeepLocalCatalog: &yes}}},
+			passes: [][]string{
+				{ACTION_UNINSTALL_SOFTWARE},
+				{ACTION_INSTALL_SOFTWARE},
+				{ACTION_VERIFY_MIGRATION, ACTION_UNINSTALL_CATALOG, ACTION_INSTALL_CATALOG},
+				nil,
+			},
+			outcome: OUTCOME_SUCCESS,
+		},
+		{
+			name:    "catalog share down",
+			state:   "catalog-share-down.xml",
+			passes:  [][]string{nil},
+			outcome: OUTCOME_UNSUCCESSFUL,
+		},
+		{
+			name:    "saved plan",
+			state:   "saved-plan.xml",
+			passes:  [][]string{{ACTION_INSTALL_CATALOG}, nil},
+			outcome: OUTCOME_SUCCESS,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t, Config{Rules: tt.rules}, "TEST-PC")
+			s, err := loadSimulatedState(filepath.Join("testdata", "simulate", tt.state))
+			if err != nil {
+				t.Fatal(err)
+			}
+			plans, r := simulatePasses(s, "")
+			var passes [][]string
+			for _, p := range plans {
+				passes = append(passes, p.Actions)
+			}
+			if !reflect.DeepEqual(passes, tt.passes) {
+				t.Errorf("passes = %q, want %q", passes, tt.passes)
+			}
+			if r.Outcome != tt.outcome {
+				t.Errorf("outcome = %s (%s), want %s", r.Outcome, r.Message, tt.outcome)
+			}
+		})
+	}
+}
+
+func TestSimulateCommandHost(t *testing.T) {
+	yes := true
+	useConfig(t, Config{Rules: []Rule{
+		{Hostname: "KIOSK-*", Policy: Policy{Skip: &yes}},
+		{Hostname: "DEMO-*", Policy: Policy{Exempt: "Trade show demo machines"}},
+	}}, "TEST-PC")
+	state := filepath.Join("testdata", "simulate", "fresh.xml")
+
+	r := SimulateCommand(context.Background(), []string{"-host", "KIOSK-07", state})
+	if r.Outcome != OUTCOME_SUCCESS || !strings.Contains(r.Message, "excluded") {
+		t.Errorf("KIOSK-07: %s %q, want it excluded", r.Outcome, r.Message)
+	}
+	r = SimulateCommand(context.Background(), []string{"-host", "DEMO-01", state})
+	if r.Outcome != OUTCOME_SUCCESS || policy.Exempt == "" {
+		t.Errorf("DEMO-01: %s %q with exemption %q, want it planned and exempt", r.Outcome, r.Message, policy.Exempt)
+	}
+	r = SimulateCommand(context.Background(), nil)
+	if r.Outcome != OUTCOME_ERROR {
+		t.Errorf("no state file: %s, want %s", r.Outcome, OUTCOME_ERROR)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "net"
+import "os/exec"
+import "strings"
+import "time"
+
+const DIAGNOSE_TIMEOUT = 5 * time.Second
+
+// UNC paths can't have colons in them, so IPv6 addresses are written as a name under
+// this domain instead: fd00::5 becomes fd00--5.ipv6-literal.net, with s for the % of a
+// zone index. Windows resolves these itself without asking DNS.
+const IPV6_LITERAL_SUFFIX = ".ipv6-literal.net"
+
+// shareServer returns the server part of a UNC path, or "". Long paths, like
+// \\?\UNC\server\share, count as well.
+func shareServer(unc string) string {
+	if len(unc) >= 8 && strings.EqualFold(unc[:8], `\\?\UNC\`) {
+		unc = `\\` + unc[8:]
+	}
+	if !strings.HasPrefix(unc, `\\`) || strings.HasPrefix(unc, `\\?\`) || strings.HasPrefix(unc, `\\.\`) {
+		return ""
+	}
+	return strings.SplitN(unc[2:], `\`, 2)[0]
+}
+
+// shareHost returns the address or host name to connect to for a UNC server name,
+// turning IPv6 literal names back into addresses.
+func shareHost(server string) string {
+	if strings.HasSuffix(strings.ToLower(server), IPV6_LITERAL_SUFFIX) {
+		s := strings.ReplaceAll(server[:len(server)-len(IPV6_LITERAL_SUFFIX)], "-", ":")
+		s = strings.Replace(s, "s", "%", 1)
+		if isAddress(s) {
+			server = s
+		}
+	}
+	if s := strings.TrimSuffix(strings.TrimPrefix(server, "["), "]"); isAddress(s) {
+		ip, zone, _ := strings.Cut(s, "%")
+		if zone != "" {
+			return net.ParseIP(ip).String() + "%" + zone
+		}
+		return net.ParseIP(ip).String()
+	}
+	return strings.TrimSuffix(server, ".")
+}
+
+// isAddress reports whether host is an IPv4 or IPv6 address rather than a name.
+func isAddress(host string) bool {
+	ip, _, _ := strings.Cut(host, "%")
+	return net.ParseIP(ip) != nil
+}
+
+// sameServer reports whether two UNC server names are the same machine as far as can
+// be told without asking DNS, e.g. fd00::5 and FD00--5.ipv6-literal.net.
+func sameServer(a, b string) bool {
+	return strings.EqualFold(shareHost(a), shareHost(b))
+}
+
+// NormalizeUNC rewrites a UNC path with a bare or bracketed IPv6 address for a server,
+// which Windows won't open, into the ipv6-literal.net form.
+func NormalizeUNC(path string) string {
+	server := shareServer(path)
+	if !strings.HasPrefix(path, `\\`+server) || !strings.Contains(server, ":") {
+		return path
+	}
+	host := shareHost(server)
+	if !isAddress(host) {
+		return path
+	}
+	name := strings.ReplaceAll(strings.Replace(host, "%", "s", 1), ":", "-") + IPV6_LITERAL_SUFFIX
+	return `\\` + name + path[2+len(server):]
+}
+
+// DiagnoseShare checks what it can about reaching the share at path: name resolution,
+// ping, SMB port 445, and the SMB dialect of any existing connection. err, if given,
+// is the failure being diagnosed. Each check has a short timeout, so this takes a few
+// seconds at worst.
+func DiagnoseShare(ctx context.Context, path string, err error) string {
+	server := shareServer(path)
+	if server == "" {
+		return ""
+	}
+	host := shareHost(server)
+	ctx, cancel := context.WithTimeout(ctx, DIAGNOSE_TIMEOUT)
+	defer cancel()
+
+	var notes []string
+	addr := host
+	if !isAddress(host) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			notes = append(notes, "DNS lookup of "+host+" failed: "+err.Error())
+		} else {
+			notes = append(notes, host+" resolves to "+strings.Join(addrs, ", "))
+			addr = addrs[0]
+		}
+	}
+
+	// The checks run quietly rather than through RunCommand: they only explain a
+	// failure, and the command lines would bury it.
+	out, perr := exec.CommandContext(ctx, "ping.exe", "-n", "1", "-w", "1000", addr).CombinedOutput()
+	if perr == nil && strings.Contains(string(out), "TTL=") {
+		notes = append(notes, "ping ok")
+	} else {
+		notes = append(notes, "no ping reply (may just be blocked)")
+	}
+
+	conn, derr := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(addr, "445"))
+	if derr != nil {
+		notes = append(notes, "port 445 not reachable: "+derr.Error())
+	} else {
+		conn.Close()
+		notes = append(notes, "port 445 open")
+	}
+
+	out, derr = exec.CommandContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command",
+		"Get-SmbConnection -ServerName "+psQuote(server)+" -ErrorAction SilentlyContinue | Select-Object -First 1 -ExpandProperty Dialect").Output()
+	if d := strings.TrimSpace(string(out)); derr == nil && d != "" {
+		notes = append(notes, "SMB "+d)
+	}
+
+	if kind := failureKind(err); kind != "" {
+		notes = append(notes, "the failure looks like "+kind)
+	}
+	return strings.Join(notes, "; ")
+}
+
+// ShareError adds DiagnoseShare's findings to err when path is on a share, and the
+// guidance for its kind of share failure. An installer that ran and failed has nothing
+// to do with the share, so exit codes are left alone.
+func ShareError(ctx context.Context, path string, err error) error {
+	var exit *exec.ExitError
+	if err == nil || shareServer(path) == "" || errors.As(err, &exit) {
+		return err
+	}
+	err = shareFailureError(err)
+	category := classify(err)
+	if category == ERROR_OTHER {
+		category = ERROR_NETWORK
+	}
+	// ctx may be what failed; the diagnostics get a moment of their own regardless.
+	return Categorize(category, errors.Wrapf(err, "Share diagnostics: %s", DiagnoseShare(context.Background(), path, err)))
+}
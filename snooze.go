@@ -0,0 +1,55 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "os"
+import "path/filepath"
+import "time"
+
+// A snooze can't be set further out than this, so a pending upgrade only ever waits a
+// day at a time.
+const SNOOZE_MAX = 24 * time.Hour
+
+// Snooze is written to the runner data folder by the tray agent when the user puts off
+// a pending remediation. It's a file of its own rather than part of RunnerState since
+// the user, not the runner, writes it.
+type Snooze struct {
+	XMLName xml.Name  `xml:"Snooze"`
+	Until   time.Time `xml:"Until,attr"`
+	User    string    `xml:"User,attr,omitempty"`
+}
+
+func snoozePath() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "snooze.xml"), nil
+}
+
+func LoadSnooze() (Snooze, error) {
+	var s Snooze
+	path, err := snoozePath()
+	if err != nil {
+		return s, err
+	}
+
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.Wrap(err, "Cannot read snooze")
+	}
+	err = xml.Unmarshal(b, &s)
+	if err != nil {
+		return s, errors.Wrap(err, "Cannot decode snooze")
+	}
+	return s, nil
+}
+
+// Active reports whether the snooze is still in effect. One set more than SNOOZE_MAX
+// ahead is ignored.
+func (s Snooze) Active() bool {
+	left := time.Until(s.Until)
+	return left > 0 && left <= SNOOZE_MAX
+}
@@ -0,0 +1,273 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "strings"
+
+// catalogRegistered reports whether the machine's catalog line has an uninstall entry.
+// Only local installs are known to need one, so a network deployment without one isn't
+// taken as inconsistent.
+func catalogRegistered() bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, policy.Catalog().UninstallKey, registry.QUERY_VALUE)
+	if err != nil {
+		return false
+	}
+	k.Close()
+	return true
+}
+
+// RepairCatalog clears out what's left of a catalog whose state cookie and uninstall
+// entry disagree: dsa.exe removes whatever it still knows about, then the DSA folder
+// goes.
+func RepairCatalog(ctx context.Context) error {
+	if catalogRegistered() {
+		err := UninstallCatalog(ctx)
+		if err != nil {
+			// Without a state cookie dsa.exe may well fail; the entry has to go.
+			Warn("The catalog uninstaller failed, removing its entry instead: %v", err)
+			err = registry.DeleteKey(registry.LOCAL_MACHINE, policy.Catalog().UninstallKey)
+			if err != nil && err != registry.ErrNotExist {
+				return errors.Wrap(KeyAccessError(err, registry.LOCAL_MACHINE, policy.Catalog().UninstallKey), "Cannot remove the catalog uninstall entry")
+			}
+		}
+	}
+	Say("Clearing out the DSA folder.")
+	return CleanCatalog()
+}
+
+func CleanCatalog() error {
+	root, err := DSARoot()
+	if err != nil {
+		return err
+	}
+	return FileAccessError(os.RemoveAll(root), root)
+}
+
+func UninstallAndCleanCatalog(ctx context.Context) error {
+	err := UninstallCatalog(ctx)
+	if err != nil {
+		return err
+	}
+	Say("Clearing out remaining files after uninstall.")
+	CleanCatalog()
+	return nil
+}
+
+// DSARemoveAllCommand turns the uninstall command registered for the catalog into the
+// dsa.exe path and arguments for a silent /removeall of the same rootpath. The rootpath
+// must be root, the DSA folder from DSARoot, so an odd registry value can't point the
+// removal somewhere else.
+func DSARemoveAllCommand(uninstall, root string) (string, []string, error) {
+	argv, err := windows.DecomposeCommandLine(uninstall)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Cannot parse uninstall command %s", uninstall)
+	}
+	if len(argv) == 0 || !strings.EqualFold(filepath.Base(argv[0]), "dsa.exe") {
+		return "", nil, errors.Errorf("Uninstall command %s does not run dsa.exe", uninstall)
+	}
+
+	removeall := false
+	rootpath := ""
+	for i := 1; i < len(argv); i++ {
+		switch strings.ToLower(argv[i]) {
+		case "/removeall":
+			removeall = true
+		case "/rootpath":
+			if i+1 < len(argv) {
+				i++
+				rootpath = argv[i]
+			}
+		}
+	}
+	if !removeall || rootpath == "" {
+		return "", nil, errors.Errorf("Uninstall command %s is not a /removeall with a /rootpath", uninstall)
+	}
+
+	if !strings.EqualFold(filepath.Clean(rootpath), filepath.Clean(root)) {
+		return "", nil, errors.Errorf("Uninstall command has an unexpected rootpath of %s", rootpath)
+	}
+
+	return argv[0], append([]string{"/removeall", "/rootpath", rootpath}, DSA_SILENT_SWITCHES...), nil
+}
+
+// catalogUninstallString returns the uninstall command registered for line l, and
+// which value it came from.
+func catalogUninstallString(l CatalogLine) (string, string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, l.UninstallKey, registry.READ)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Cannot open registry key for uninstall")
+	}
+	defer k.Close()
+
+	// Prefer the quiet variant when the catalog installer registered one.
+	name := "QuietUninstallString"
+	v, _, err := k.GetStringValue(name)
+	if err == registry.ErrNotExist {
+		name = "UninstallString"
+		v, _, err = k.GetStringValue(name)
+	}
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Cannot read value %s", name)
+	}
+	Verbose(`HKLM\%s %s = %s`, l.UninstallKey, name, v)
+	return name, v, nil
+}
+
+// DSAExecutable returns the dsa.exe that line l was installed with, going by its
+// uninstall command.
+func DSAExecutable(l CatalogLine) (string, error) {
+	name, v, err := catalogUninstallString(l)
+	if err != nil {
+		return "", err
+	}
+	root, err := DSARoot()
+	if err != nil {
+		return "", err
+	}
+	exe, _, err := DSARemoveAllCommand(v, root)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s had an unexpected value", name)
+	}
+	return exe, nil
+}
+
+func UninstallCatalog(ctx context.Context) error {
+	return UninstallCatalogLine(ctx, policy.Catalog())
+}
+
+// UninstallCatalogLine removes the catalogs of line l, whichever line the machine is
+// meant to have.
+func UninstallCatalogLine(ctx context.Context, l CatalogLine) error {
+	name, v, err := catalogUninstallString(l)
+	if err != nil {
+		return err
+	}
+
+	// Verify that the uninstall command looks like one we recognize.
+	root, err := DSARoot()
+	if err != nil {
+		return err
+	}
+	exe, args, err := DSARemoveAllCommand(v, root)
+	if err != nil {
+		return errors.Wrapf(err, "%s had an unexpected value", name)
+	}
+
+	cmd, err := PhaseCommand(PHASE_CATALOG_UNINSTALL, map[string]string{"uninstall": v}, exec.Command(exe, args...))
+	if err != nil {
+		return err
+	}
+	dsaLog := TailDSALogs(ctx)
+	before := stampDSAState()
+	out, err := RunPromptedCommand(ctx, cmd, DSA_PROMPT_ANSWERS)
+	if err != nil {
+		return dsaLog.Finish(errors.Wrapf(err, "Uninstall command output: %s", out))
+	}
+
+	// dsa.exe can still be finishing up in the background; it drops the uninstall
+	// entry once it's done, and updates its state cookie around the same time.
+	err = WaitForKeyRemoval(ctx, l.UninstallKey)
+	if err == nil && !WaitForDSAStateChange(ctx, before) {
+		Warn("DSA still hasn't updated %s after %v; carrying on regardless.", DSA_STATE_COOKIE, DSA_STATE_WAIT)
+	}
+	return dsaLog.Finish(err)
+}
+
+// GetSoftwareVersion returns the installed version of the 2020 software, or "" if it
+// isn't installed.
+func GetSoftwareVersion() (string, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, CAP2020_SOFTWARE, registry.READ)
+	if err == registry.ErrNotExist {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Cannot open registry key for software version")
+	}
+	defer k.Close()
+
+	v, _, err := k.GetStringValue("DisplayVersion")
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot read value DisplayVersion")
+	}
+	Verbose(`HKLM\%s DisplayVersion = %s`, CAP2020_SOFTWARE, v)
+	return v, nil
+}
+
+// "Is Installed", "Is Current", error
+func GetSoftwareStatus() (bool, bool, error) {
+	v, err := GetSoftwareVersion()
+	if err != nil {
+		return false, false, err
+	}
+	return v != "", (v == policy.SoftwareVersion), nil
+}
+
+// The catalog setup always runs from the share: DSA records where it was run from as
+// the network deployment's location.
+func InstallNetworkCatalog(ctx context.Context) error {
+	err := PrepareInstaller(ctx, policy.CatalogSetup, true)
+	if err != nil {
+		return err
+	}
+	cmd, err := PhaseCommand(PHASE_CATALOG_INSTALL, map[string]string{"installer": policy.CatalogSetup}, exec.Command(policy.CatalogSetup))
+	if err != nil {
+		return err
+	}
+	dsaLog := TailDSALogs(ctx)
+	out, err := RunCommand(ctx, cmd)
+	if err != nil {
+		return dsaLog.Finish(errors.Wrapf(ShareError(ctx, policy.CatalogSetup, err), "Setup command output: %s", out))
+	}
+	dsaLog.Stop()
+	return nil
+}
+
+func InstallSoftware(ctx context.Context) error {
+	err := PrepareInstaller(ctx, policy.SoftwareInstaller, false)
+	if err != nil {
+		return err
+	}
+	installer, err := SoftwareInstallerPath(ctx, policy.SoftwareInstaller)
+	if err != nil {
+		return ShareError(ctx, policy.SoftwareInstaller, err)
+	}
+	cmd, err := PhaseCommand(PHASE_SOFTWARE_INSTALL, map[string]string{"installer": installer}, exec.Command(installer))
+	if err != nil {
+		return err
+	}
+	out, err := RunCommand(ctx, cmd)
+	if err != nil {
+		return errors.Wrapf(ShareError(ctx, installer, err), "Install command output: %s", out)
+	}
+
+	return nil
+}
+
+// UninstallSoftware removes the 2020 software. The restart it needs is left to the plan,
+// which schedules it like any other, see WaitingForReboot, within RebootHours and with
+// a warning the user can act on, and only once the run has been recorded.
+func UninstallSoftware(ctx context.Context) error {
+	product := filepath.Base(CAP2020_SOFTWARE)
+	cmd, err := PhaseCommand(PHASE_SOFTWARE_UNINSTALL, map[string]string{"product": product},
+		exec.Command("msiexec", "/x", product, "/passive", "/norestart"))
+	if err != nil {
+		return err
+	}
+	out, err := RunCommand(ctx, cmd)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == int(windows.ERROR_SUCCESS_REBOOT_REQUIRED) {
+		Say("The uninstall needs a restart to finish.")
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Uninstall command output: %s", out)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+//go:build windows
+
+package main
+
+import "reflect"
+import "testing"
+
+func TestDSARemoveAllCommand(t *testing.T) {
+	const root = `C:\ProgramData\2020\DSA`
+	silent := func(args ...string) []string { return append(args, DSA_SILENT_SWITCHES...) }
+	tests := []struct {
+		name      string
+		uninstall string
+		exe       string
+		args      []string
+		wantErr   bool
+	}{
+		{
+			name:      "quoted paths",
+			uninstall: `"C:\Program Files (x86)\2020\DSA\dsa.exe" /removeall /rootpath "C:\ProgramData\2020\DSA"`,
+			exe:       `C:\Program Files (x86)\2020\DSA\dsa.exe`,
+			args:      silent("/removeall", "/rootpath", root),
+		},
+		{
+			name:      "unquoted paths",
+			uninstall: `C:\2020\DSA\dsa.exe /removeall /rootpath C:\ProgramData\2020\DSA`,
+			exe:       `C:\2020\DSA\dsa.exe`,
+			args:      silent("/removeall", "/rootpath", root),
+		},
+		{
+			name:      "mixed-case switches and rootpath",
+			uninstall: `"C:\2020\DSA\DSA.EXE" /RemoveAll /ROOTPATH c:\programdata\2020\dsa\`,
+			exe:       `C:\2020\DSA\DSA.EXE`,
+			args:      silent("/removeall", "/rootpath", `c:\programdata\2020\dsa\`),
+		},
+		{
+			name:      "other switches are dropped",
+			uninstall: `"C:\2020\DSA\dsa.exe" /rootpath "C:\ProgramData\2020\DSA" /removeall /interactive`,
+			exe:       `C:\2020\DSA\dsa.exe`,
+			args:      silent("/removeall", "/rootpath", root),
+		},
+		{
+			name:      "missing rootpath",
+			uninstall: `"C:\2020\DSA\dsa.exe" /removeall`,
+			wantErr:   true,
+		},
+		{
+			name:      "rootpath without a value",
+			uninstall: `"C:\2020\DSA\dsa.exe" /removeall /rootpath`,
+			wantErr:   true,
+		},
+		{
+			name:      "missing removeall",
+			uninstall: `"C:\2020\DSA\dsa.exe" /rootpath "C:\ProgramData\2020\DSA"`,
+			wantErr:   true,
+		},
+		{
+			name:      "unexpected rootpath",
+			uninstall: `"C:\2020\DSA\dsa.exe" /removeall /rootpath C:\Windows`,
+			wantErr:   true,
+		},
+		{
+			name:      "rootpath leaving the DSA folder",
+			uninstall: `"C:\2020\DSA\dsa.exe" /removeall /rootpath C:\ProgramData\2020\DSA\..\..\..\Windows`,
+			wantErr:   true,
+		},
+		{
+			name:      "not dsa.exe",
+			uninstall: `MsiExec.exe /X{5D4D912A-D5EE-4748-84B8-7C2C75EC4408} /removeall /rootpath C:\ProgramData\2020\DSA`,
+			wantErr:   true,
+		},
+		{
+			name:      "dsa.exe in a longer name",
+			uninstall: `"C:\Temp\dsa.exe.cmd" /removeall /rootpath C:\ProgramData\2020\DSA`,
+			wantErr:   true,
+		},
+		{
+			name:      "empty",
+			uninstall: ``,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exe, args, err := DSARemoveAllCommand(tt.uninstall, root)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("DSARemoveAllCommand(%q) = %q, %q, want an error", tt.uninstall, exe, args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DSARemoveAllCommand(%q): %v", tt.uninstall, err)
+			}
+			if exe != tt.exe || !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("DSARemoveAllCommand(%q) = %q, %q, want %q, %q", tt.uninstall, exe, args, tt.exe, tt.args)
+			}
+		})
+	}
+}
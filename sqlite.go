@@ -0,0 +1,133 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "unsafe"
+
+// The run database goes through the SQLite that comes with Windows 10 and later, so
+// there's nothing to install or build in for it.
+var (
+	modwinsqlite3         = windows.NewLazySystemDLL("winsqlite3.dll")
+	procSqliteOpen        = modwinsqlite3.NewProc("sqlite3_open_v2")
+	procSqliteClose       = modwinsqlite3.NewProc("sqlite3_close_v2")
+	procSqliteBusyTimeout = modwinsqlite3.NewProc("sqlite3_busy_timeout")
+	procSqliteErrmsg      = modwinsqlite3.NewProc("sqlite3_errmsg")
+	procSqlitePrepare     = modwinsqlite3.NewProc("sqlite3_prepare_v2")
+	procSqliteBindText    = modwinsqlite3.NewProc("sqlite3_bind_text")
+	procSqliteStep        = modwinsqlite3.NewProc("sqlite3_step")
+	procSqliteColumnCount = modwinsqlite3.NewProc("sqlite3_column_count")
+	procSqliteColumnText  = modwinsqlite3.NewProc("sqlite3_column_text")
+	procSqliteFinalize    = modwinsqlite3.NewProc("sqlite3_finalize")
+)
+
+const (
+	SQLITE_OK             = 0
+	SQLITE_ROW            = 100
+	SQLITE_DONE           = 101
+	SQLITE_OPEN_READWRITE = 0x2
+	SQLITE_OPEN_CREATE    = 0x4
+	// How long a statement waits for another process to finish with the database, in ms.
+	SQLITE_BUSY_TIMEOUT = 10000
+)
+
+// SQLITE_TRANSIENT has SQLite take its own copy of a bound value.
+const SQLITE_TRANSIENT = ^uintptr(0)
+
+// cString returns the NUL terminated string SQLite handed back at p.
+func cString(p uintptr) string {
+	if p == 0 {
+		return ""
+	}
+	return windows.BytePtrToString(*(**byte)(unsafe.Pointer(&p)))
+}
+
+func openSQLite(path string) (*RunDB, error) {
+	if err := modwinsqlite3.Load(); err != nil {
+		return nil, errors.Wrap(err, "Cannot load the SQLite that comes with Windows")
+	}
+	p, err := windows.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &RunDB{}
+	rc, _, _ := procSqliteOpen.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&db.h)),
+		SQLITE_OPEN_READWRITE|SQLITE_OPEN_CREATE, 0)
+	if rc != SQLITE_OK {
+		err := db.error(rc, "Cannot open "+path)
+		db.Close()
+		return nil, err
+	}
+	procSqliteBusyTimeout.Call(db.h, SQLITE_BUSY_TIMEOUT)
+	return db, nil
+}
+
+func (db *RunDB) Close() {
+	if db.h != 0 {
+		procSqliteClose.Call(db.h)
+		db.h = 0
+	}
+}
+
+func (db *RunDB) error(rc uintptr, what string) error {
+	msg := "out of memory"
+	if db.h != 0 {
+		p, _, _ := procSqliteErrmsg.Call(db.h)
+		msg = cString(p)
+	}
+	return errors.Errorf("%s: %s (SQLite error %d)", what, msg, rc)
+}
+
+// Exec runs a statement that doesn't return rows, with ? bound to args.
+func (db *RunDB) Exec(query string, args ...string) error {
+	return db.Query(query, args, nil)
+}
+
+// Query runs query with ? bound to args, and hands each row to row with every column
+// as text, NULL as "". SQLite converts bound text to the column's type, so numbers are
+// bound as text too.
+func (db *RunDB) Query(query string, args []string, row func([]string) error) error {
+	q, err := windows.BytePtrFromString(query)
+	if err != nil {
+		return err
+	}
+	var stmt uintptr
+	rc, _, _ := procSqlitePrepare.Call(db.h, uintptr(unsafe.Pointer(q)), ^uintptr(0), uintptr(unsafe.Pointer(&stmt)), 0)
+	if rc != SQLITE_OK {
+		return db.error(rc, "Cannot prepare a run database query")
+	}
+	defer procSqliteFinalize.Call(stmt)
+
+	for i, a := range args {
+		p, err := windows.BytePtrFromString(a)
+		if err != nil {
+			return err
+		}
+		rc, _, _ = procSqliteBindText.Call(stmt, uintptr(i+1), uintptr(unsafe.Pointer(p)), ^uintptr(0), SQLITE_TRANSIENT)
+		if rc != SQLITE_OK {
+			return db.error(rc, "Cannot bind a run database query")
+		}
+	}
+	for {
+		rc, _, _ = procSqliteStep.Call(stmt)
+		if rc == SQLITE_DONE {
+			return nil
+		}
+		if rc != SQLITE_ROW {
+			return db.error(rc, "Cannot run a run database query")
+		}
+		if row == nil {
+			continue
+		}
+		n, _, _ := procSqliteColumnCount.Call(stmt)
+		cols := make([]string, n)
+		for i := range cols {
+			p, _, _ := procSqliteColumnText.Call(stmt, uintptr(i))
+			cols[i] = cString(p)
+		}
+		if err := row(cols); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import "github.com/pkg/errors"
+import "encoding/xml"
+import "os"
+import "path/filepath"
+import "time"
+
+// RunnerState is what the runner needs to remember between runs, e.g. across the
+// reboot that separates uninstalling the old software from installing the new one.
+type RunnerState struct {
+	XMLName           xml.Name `xml:"RunnerState"`
+	PendingRestore    string   `xml:"PendingRestore,omitempty"`
+	UpgradeInProgress bool     `xml:"UpgradeInProgress,omitempty"`
+	FallbackFor       string   `xml:"FallbackFor,omitempty"`
+	// Drives MapDrive mapped that haven't been disconnected yet, as drive=remote.
+	MappedDrives []string `xml:"MappedDrive,omitempty"`
+	// Why the last run is waiting for a restart and since when, and when it's restarting
+	// the computer itself, if it is. Continuation is set while the scheduled task that
+	// carries on after the restart is registered.
+	RebootRequired string     `xml:"RebootRequired,omitempty"`
+	RebootSince    *time.Time `xml:"RebootSince,omitempty"`
+	RebootAt       *time.Time `xml:"RebootAt,omitempty"`
+	Continuation   bool       `xml:"Continuation,omitempty"`
+}
+
+func statePath() (string, error) {
+	dir, err := RunnerDataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "state.xml"), nil
+}
+
+func LoadState() (RunnerState, error) {
+	var s RunnerState
+	path, err := statePath()
+	if err != nil {
+		return s, err
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, errors.Wrap(err, "Cannot open runner state")
+	}
+	defer f.Close()
+
+	err = xml.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return s, Categorize(ERROR_CORRUPT_STATE, errors.Wrap(err, "Cannot decode runner state"))
+	}
+	DebugXML("Runner state", s)
+	return s, nil
+}
+
+func SaveState(s RunnerState) error {
+	path, err := statePath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, filepath.Dir(path)), "Cannot create runner data folder")
+	}
+
+	b, err := xml.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode runner state")
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		return errors.Wrap(FileAccessError(err, path), "Cannot write runner state")
+	}
+	return nil
+}
+
+// UpdateState loads the runner state, lets change change it and saves it again. Use it
+// rather than keeping a RunnerState across anything that can record its own, such as
+// mapping a drive, so that what was recorded in between isn't written over.
+func UpdateState(change func(*RunnerState)) error {
+	s, err := LoadState()
+	if err != nil {
+		return err
+	}
+	change(&s)
+	return SaveState(s)
+}
@@ -0,0 +1,217 @@
+//go:build !windows
+
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "os"
+import "os/exec"
+import "strings"
+import "syscall"
+import "time"
+
+// The runner only manages Windows machines, but builds and runs elsewhere so that the
+// config, rules and planning can be tested on CI and dev machines, with simulate in
+// place of a real run. These stand in for what windows.go and the Windows-only files
+// do: anything that only looks finds nothing there, and anything that would change
+// the machine fails with errNotSupported.
+
+var errNotSupported = errors.New("Only supported on Windows")
+
+// Set by -audit-ui and -registry-diff, which do nothing here.
+var auditUI bool
+var registryDiff bool
+
+// ProgramData returns the ProgramData variable if there is one, or the temp folder,
+// so that runs on a dev machine keep their files out of the way.
+func ProgramData() (string, error) {
+	if pd := os.Getenv("ProgramData"); pd != "" {
+		return pd, nil
+	}
+	return os.TempDir(), nil
+}
+
+// splitCommandLine splits line at spaces outside double quotes, which is as far as
+// config command lines need to go here.
+func splitCommandLine(line string) ([]string, error) {
+	var argv []string
+	var arg strings.Builder
+	quoted, started := false, false
+	for _, c := range line {
+		switch {
+		case c == '"':
+			quoted, started = !quoted, true
+		case (c == ' ' || c == '\t') && !quoted:
+			if started {
+				argv = append(argv, arg.String())
+				arg.Reset()
+				started = false
+			}
+		default:
+			arg.WriteRune(c)
+			started = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("Unterminated quote")
+	}
+	if started {
+		argv = append(argv, arg.String())
+	}
+	return argv, nil
+}
+
+func commandLine(argv []string, line string) *exec.Cmd {
+	return exec.Command(argv[0], argv[1:]...)
+}
+
+func classifyErrno(errno syscall.Errno) string { return "" }
+func failureKind(err error) string             { return "" }
+func shareFailureError(err error) error        { return err }
+func systemProxy() (string, string)            { return "", "" }
+func saveHealth(h Health) error                { return nil }
+func isElevated() bool                         { return os.Geteuid() == 0 }
+func IsRebootPending() (bool, string)          { return false, "" }
+func exemptionFlag() (string, bool)            { return "", false }
+func catalogRegistered() bool                  { return false }
+
+func FileAccessError(err error, path string) error { return err }
+
+// openExclusive only opens path for appending here; nothing else writes to it.
+func openExclusive(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+func diskFree(drive string) (uint64, error) {
+	return 0, errors.Wrapf(errNotSupported, "Cannot check the free space on %s", drive)
+}
+
+func GetComputerDN() (string, error) {
+	return "", errors.Wrap(errNotSupported, "Cannot get the computer's directory name")
+}
+
+func FileVersion(path string) (string, error) {
+	return "", errors.Wrapf(errNotSupported, "Cannot read the version of %s", path)
+}
+
+func protectData(b, entropy []byte) ([]byte, error)   { return nil, errNotSupported }
+func unprotectData(b, entropy []byte) ([]byte, error) { return nil, errNotSupported }
+
+// Nothing is installed and nobody has a profile.
+func ListInstalledSoftware() ([]InstalledProduct, error) { return nil, nil }
+func ListMSIProducts() ([]MSIProduct, error)             { return nil, nil }
+func ListUserProfiles() ([]UserProfile, error)           { return nil, nil }
+
+func GetSoftwareStatus() (bool, bool, error) {
+	return false, false, errors.Wrap(errNotSupported, "Cannot check the 2020 software")
+}
+
+func GetSoftwareVersion() (string, error) {
+	return "", errors.Wrap(errNotSupported, "Cannot check the 2020 software")
+}
+
+// Shares are opened as they are, with whatever the OS has mounted.
+func ConnectShare(path string) error                           { return nil }
+func DisconnectShares()                                        {}
+func ShareOrigin(ctx context.Context, path string) string      { return "" }
+func ValidateShareLayout(installer string, catalog bool) error { return nil }
+
+func PrepareInstaller(ctx context.Context, installer string, catalog bool) error {
+	return nil
+}
+
+func SoftwareInstallerPath(ctx context.Context, installer string) (string, error) {
+	return installer, nil
+}
+
+func ChildEnvironment() []string { return os.Environ() }
+
+// RunCommand runs cmd and returns its combined output, without the process tree
+// tracking the Windows one does.
+func RunCommand(ctx context.Context, cmd *exec.Cmd) ([]byte, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	Say("Running %s (in %s)", strings.Join(cmd.Args, " "), cmd.Dir)
+	return cmd.CombinedOutput()
+}
+
+func RunPromptedCommand(ctx context.Context, cmd *exec.Cmd, answers []string) ([]byte, error) {
+	return RunCommand(ctx, cmd)
+}
+
+func DSAExecutable(l CatalogLine) (string, error) {
+	return "", errors.Wrapf(errNotSupported, "Cannot find the %s's dsa.exe", l.Name)
+}
+
+func WaitForKeyRemoval(ctx context.Context, path string) error { return nil }
+func TrackRegistry(phase string) func()                        { return func() {} }
+func RecoverInterruptedRun()                                   {}
+func PrintUIAudit()                                            {}
+
+// Nothing else installs here and nobody uses the 2020 software, so nothing waits.
+func WaitForInstallers(ctx context.Context) (Result, bool) { return Result{}, true }
+func DeferIfInUse(p Plan) (Result, bool)                   { return Result{}, true }
+func AcquireRunLock() (Result, bool)                       { return Result{}, true }
+func ReleaseRunLock()                                      {}
+
+func InstallSoftware(ctx context.Context) error          { return errNotSupported }
+func UninstallSoftware(ctx context.Context) error        { return errNotSupported }
+func ConfigureLicense(ctx context.Context) error         { return errNotSupported }
+func InstallNetworkCatalog(ctx context.Context) error    { return errNotSupported }
+func RepairCatalog(ctx context.Context) error            { return errNotSupported }
+func UninstallAndCleanCatalog(ctx context.Context) error { return errNotSupported }
+func VerifyIntegration(ctx context.Context) error        { return errNotSupported }
+
+func CaptureUserSettings(ctx context.Context, p UserProfile, path string) error {
+	return errNotSupported
+}
+
+func ApplyUserSettings(ctx context.Context, p UserProfile, path string) error {
+	return errNotSupported
+}
+
+func RelaunchLocally() error                             { return nil }
+func ShowProgressWindow(servePipe bool) error            { return nil }
+func ServePipe() error                                   { return errNotSupported }
+func Watch(ctx context.Context, healthAddr string) error { return errNotSupported }
+
+func RunWizard(ctx context.Context) {
+	Warn("The wizard only works on Windows. Carrying on without it.")
+}
+
+func RunBroker(ctx context.Context) error { return errNotSupported }
+
+func ServiceCommand(ctx context.Context, args []string) Result {
+	return Failed("The service only works on Windows.", errNotSupported)
+}
+
+func CollectSystemFacts() *SystemFacts { return nil }
+
+func registryInputs() string { return "" }
+
+// Nobody else is logged on to check for.
+func CheckUserCatalogAccess() (string, error) { return "", nil }
+
+func RegisterContinuation(ctx context.Context) error        { return errNotSupported }
+func RemoveContinuation(ctx context.Context) error          { return errNotSupported }
+func ScheduleRestart(m string, warning time.Duration) error { return errNotSupported }
+func AbortRestart()                                         {}
+
+func StoreInventory() error { return errNotSupported }
+
+func openSQLite(path string) (*RunDB, error)              { return nil, errNotSupported }
+func (db *RunDB) Close()                                  {}
+func (db *RunDB) Exec(query string, args ...string) error { return errNotSupported }
+func (db *RunDB) Query(query string, args []string, row func([]string) error) error {
+	return errNotSupported
+}
+
+func InventoryCommand(ctx context.Context, args []string) Result {
+	return Failed("The inventory only works on Windows.", errNotSupported)
+}
+
+func PurgeCommand(ctx context.Context, args []string) Result {
+	return Failed("Purging only works on Windows.", errNotSupported)
+}
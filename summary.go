@@ -0,0 +1,130 @@
+package main
+
+import "flag"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+
+// RunSummary is what the end of a run tells the user: what was looked at, what got
+// done, what is left for them to do and the command to run once they have.
+type RunSummary struct {
+	Checked   []string
+	Done      []string
+	Remaining []string
+	Next      string
+}
+
+var summary RunSummary
+
+func NoteChecked(format string, a ...interface{}) {
+	summary.Checked = append(summary.Checked, fmt.Sprintf(format, a...))
+}
+
+func NoteDone(format string, a ...interface{}) {
+	summary.Done = append(summary.Done, fmt.Sprintf(format, a...))
+}
+
+// NoteRemaining adds a step the user has to take, and sets the command to run after it.
+func NoteRemaining(step, next string) {
+	summary.Remaining = append(summary.Remaining, step)
+	if next != "" {
+		summary.Next = next
+	}
+}
+
+// RerunCommand is the command line for another compliance run with the same flags as
+// this one, plus extra.
+func RerunCommand(extra ...string) string {
+	exe, _ := os.Executable()
+	args := append([]string{filepath.Base(exe)}, rerunArgs(extra...)...)
+	for i, a := range args {
+		if strings.ContainsAny(a, " \t") {
+			args[i] = `"` + a + `"`
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// rerunArgs is the flags of RerunCommand. The ones that only make sense for this run,
+// like when to restart the computer, are left out.
+func rerunArgs(extra ...string) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "nopause", "watch", "health-addr", "report-only", "reboot-now", "reboot-at":
+		default:
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return append(args, extra...)
+}
+
+// NoteState records what detection found about the machine.
+func NoteState(s MachineState) {
+	switch {
+	case !s.SoftwareInstalled:
+		NoteChecked("2020 software: not installed")
+	case s.SoftwareCurrent:
+		NoteChecked("2020 software: %s, up to date", s.SoftwareVersion)
+	default:
+		NoteChecked("2020 software: %s, target is %s", s.SoftwareVersion, policy.SoftwareVersion)
+	}
+	if s.OtherVersions != "" {
+		NoteChecked("Other 2020 versions: %s", s.OtherVersions)
+	}
+	if s.SoftwareInstalled && (s.SoftwareCurrent || s.HoldingFallback()) {
+		NoteChecked("Catalog: %s", catalogStateNames[s.CatalogState])
+		if s.GranulesToAdd != "" || s.GranulesToRemove != "" {
+			NoteChecked("Catalog selection differs from the master list (missing %q, retired %q)", s.GranulesToAdd, s.GranulesToRemove)
+		}
+	}
+	if s.RebootPending {
+		NoteChecked("A restart is pending")
+	}
+	if s.LowDisk {
+		NoteChecked("Free disk space is below %d MB", policy.MinFreeDiskMB)
+	}
+	if s.LicenseDown {
+		NoteChecked("The license server isn't answering")
+	}
+}
+
+// PrintSummary ends the run's console output with the outcome and the summary, and
+// puts the summary in the log file as well. The outcome itself is already there.
+func PrintSummary(outcome string, lines ...string) {
+	var out []string
+	section := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		out = append(out, title+":")
+		for _, i := range items {
+			out = append(out, "  - "+i)
+		}
+	}
+	section("Checked", summary.Checked)
+	section("Done", summary.Done)
+	section("Still to do", summary.Remaining)
+	if summary.Next != "" {
+		out = append(out, "Then run:", "  "+summary.Next)
+	}
+
+	fmt.Printf("%s: %s\n", outcome, lines[0])
+	for _, l := range lines[1:] {
+		fmt.Println(l)
+	}
+	if len(out) > 0 {
+		fmt.Println()
+	}
+	for _, l := range out {
+		fmt.Println(l)
+	}
+	fmt.Println()
+	if runLog != nil {
+		for _, l := range out {
+			runLog.write(Event{Time: time.Now(), Type: EVENT_MESSAGE, Message: l})
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import "github.com/pkg/errors"
+import "context"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+// TransferWindow is a daily span like 18:00-07:00 during which content may be copied
+// over the network, or the computer restarted. It can wrap past midnight.
+type TransferWindow struct {
+	Start, End time.Duration
+}
+
+func ParseTransferWindow(s string) (TransferWindow, error) {
+	var w TransferWindow
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return w, errors.Errorf("%s isn't a span of hours like 18:00-07:00", s)
+	}
+	for i, p := range parts {
+		d, ok := parseTimeOfDay(p)
+		if !ok {
+			return w, errors.Errorf("%s isn't a span of hours like 18:00-07:00", s)
+		}
+		if i == 0 {
+			w.Start = d
+		} else {
+			w.End = d
+		}
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses a time of day like 22:00 into how long after midnight it is.
+func parseTimeOfDay(s string) (time.Duration, bool) {
+	var h, m int
+	_, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &h, &m)
+	if err != nil || h < 0 || h > 24 || m < 0 || m > 59 {
+		return 0, false
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, true
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	y, mo, d := t.Date()
+	return t.Sub(time.Date(y, mo, d, 0, 0, 0, 0, t.Location()))
+}
+
+// Open reports whether t falls inside the window.
+func (w TransferWindow) Open(t time.Time) bool {
+	now := sinceMidnight(t)
+	if w.Start <= w.End {
+		return now >= w.Start && now < w.End
+	}
+	return now >= w.Start || now < w.End
+}
+
+// Opens returns when the window next opens after t.
+func (w TransferWindow) Opens(t time.Time) time.Time {
+	return nextTimeOfDay(t, w.Start)
+}
+
+// nextTimeOfDay returns the first time after t that is d after midnight.
+func nextTimeOfDay(t time.Time, d time.Duration) time.Time {
+	next := t.Add(d - sinceMidnight(t))
+	if !next.After(t) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// transferReader is what content copied over the network is read through. It keeps
+// to policy.TransferKBps, and waits out the hours outside policy.TransferHours, so a
+// rollout to many machines at once doesn't fill a branch office's link during the day.
+// Copies that have to wait are left to the run timeout like any other long step.
+type transferReader struct {
+	ctx    context.Context
+	r      io.Reader
+	window *TransferWindow
+	start  time.Time
+	read   int64
+}
+
+func NewTransferReader(ctx context.Context, r io.Reader) (io.Reader, error) {
+	w, err := transferWindow()
+	if err != nil {
+		return nil, err
+	}
+	return &transferReader{ctx: ctx, r: r, window: w, start: time.Now()}, nil
+}
+
+// transferWindow returns the policy's transfer hours, or nil if transfers can happen
+// at any time.
+func transferWindow() (*TransferWindow, error) {
+	if policy.TransferHours == "" {
+		return nil, nil
+	}
+	w, err := ParseTransferWindow(policy.TransferHours)
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (t *transferReader) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if t.window != nil && !t.window.Open(time.Now()) {
+		opens := t.window.Opens(time.Now())
+		Say("Waiting for the transfer hours (%s) to copy the rest, at %s.", policy.TransferHours, opens.Format(time.Kitchen))
+		select {
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		case <-time.After(time.Until(opens)):
+		}
+		// The rate is averaged from here on, not over the wait.
+		t.start, t.read = time.Now(), 0
+	}
+
+	if policy.TransferKBps > 0 {
+		// Small reads keep the rate even rather than bursting.
+		max := int(policy.TransferKBps) * 1024 / 4
+		if max > 0 && len(p) > max {
+			p = p[:max]
+		}
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+
+	if policy.TransferKBps > 0 {
+		due := time.Duration(float64(t.read) / (float64(policy.TransferKBps) * 1024) * float64(time.Second))
+		if ahead := due - time.Since(t.start); ahead > 0 {
+			select {
+			case <-t.ctx.Done():
+				return n, t.ctx.Err()
+			case <-time.After(ahead):
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,129 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "fmt"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+import "unsafe"
+
+var (
+	moduser32                 = windows.NewLazySystemDLL("user32.dll")
+	procInternalGetWindowText = moduser32.NewProc("InternalGetWindowText")
+	enumWindowsCallback       = windows.NewCallback(enumWindowsProc)
+)
+
+// How often the windows are looked over while a command runs under -audit-ui.
+const UI_AUDIT_POLL = 250 * time.Millisecond
+
+// Set by -audit-ui.
+var auditUI bool
+
+// The state of the EnumWindows pass in progress, which the callbacks can't be handed
+// in any useful way. Prompt watching uses enumPIDs too.
+var enumMu sync.Mutex
+var enumPIDs map[uint32]bool
+var enumFound map[string]bool
+
+var uiAuditMu sync.Mutex
+
+func enumWindowsProc(hwnd windows.HWND, lparam uintptr) uintptr {
+	var pid uint32
+	windows.GetWindowThreadProcessId(hwnd, &pid)
+	if !enumPIDs[pid] || !windows.IsWindowVisible(hwnd) {
+		return 1
+	}
+	enumFound[fmt.Sprintf("%q [%s]", windowText(hwnd), windowClass(hwnd))] = true
+	return 1
+}
+
+// windowText returns the title of hwnd, or the label of a control. InternalGetWindowText
+// doesn't send the window a message, so a hung installer can't hang us as well.
+func windowText(hwnd windows.HWND) string {
+	text := make([]uint16, 256)
+	procInternalGetWindowText.Call(uintptr(hwnd), uintptr(unsafe.Pointer(&text[0])), uintptr(len(text)))
+	return windows.UTF16ToString(text)
+}
+
+func windowClass(hwnd windows.HWND) string {
+	class := make([]uint16, 256)
+	windows.GetClassName(hwnd, &class[0], int32(len(class)))
+	return windows.UTF16ToString(class)
+}
+
+type jobProcessIDList struct {
+	Assigned uint32
+	InList   uint32
+	IDs      [256]uintptr
+}
+
+// jobPIDs returns the processes in job, or just pid if the job isn't usable.
+func jobPIDs(job windows.Handle, pid int) map[uint32]bool {
+	pids := map[uint32]bool{uint32(pid): true}
+	if job == 0 {
+		return pids
+	}
+	var list jobProcessIDList
+	err := windows.QueryInformationJobObject(job, windows.JobObjectBasicProcessIdList,
+		uintptr(unsafe.Pointer(&list)), uint32(unsafe.Sizeof(list)), nil)
+	if err != nil && err != windows.ERROR_MORE_DATA {
+		return pids
+	}
+	for _, p := range list.IDs[:list.InList] {
+		pids[uint32(p)] = true
+	}
+	return pids
+}
+
+// AuditWindows watches for visible windows belonging to pid or anything in job until
+// stop is closed, then adds what it saw to the report.
+func AuditWindows(line string, job windows.Handle, pid int, stop chan struct{}) {
+	seen := map[string]bool{}
+	t := time.NewTicker(UI_AUDIT_POLL)
+	defer t.Stop()
+	for done := false; !done; {
+		select {
+		case <-stop:
+			done = true
+		case <-t.C:
+		}
+		enumMu.Lock()
+		enumPIDs, enumFound = jobPIDs(job, pid), seen
+		windows.EnumWindows(enumWindowsCallback, nil)
+		enumMu.Unlock()
+	}
+
+	e := UIAuditEntry{Command: line}
+	for w := range seen {
+		e.Windows = append(e.Windows, w)
+	}
+	sort.Strings(e.Windows)
+	if len(e.Windows) > 0 {
+		Warn("Not silent, showed %s: %s", strings.Join(e.Windows, ", "), line)
+	}
+	uiAuditMu.Lock()
+	report.UIAudit = append(report.UIAudit, e)
+	uiAuditMu.Unlock()
+}
+
+// PrintUIAudit lists the commands that showed windows after an -audit-ui run.
+func PrintUIAudit() {
+	if !auditUI {
+		return
+	}
+	fmt.Println()
+	loud := 0
+	for _, e := range report.UIAudit {
+		if len(e.Windows) > 0 {
+			loud++
+			fmt.Printf("Not silent: %s\n", e.Command)
+			for _, w := range e.Windows {
+				fmt.Printf("  %s\n", w)
+			}
+		}
+	}
+	fmt.Printf("%d of %d commands showed windows.\n", loud, len(report.UIAudit))
+}
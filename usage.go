@@ -0,0 +1,130 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "fmt"
+import "os"
+import "path/filepath"
+import "strings"
+import "time"
+import "unsafe"
+
+// installFolders returns where the installed versions of the 2020 software are, from
+// their uninstall entries, or the usual Program Files folders if they don't say.
+func installFolders() []string {
+	var dirs []string
+	products, _ := ListInstalledSoftware()
+	for _, p := range products {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, p.Key, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		loc, _, _ := k.GetStringValue("InstallLocation")
+		k.Close()
+		if loc != "" {
+			dirs = append(dirs, strings.TrimRight(loc, `\`))
+		}
+	}
+	if len(dirs) == 0 {
+		pf, err := windows.KnownFolderPath(windows.FOLDERID_ProgramFilesX86, 0)
+		if err != nil {
+			return nil
+		}
+		for _, f := range PURGE_PROGRAM_FOLDERS {
+			dirs = append(dirs, filepath.Join(pf, f))
+		}
+	}
+	return dirs
+}
+
+func under(path string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(strings.ToLower(path), strings.ToLower(d)+`\`) {
+			return true
+		}
+	}
+	return false
+}
+
+// runningApps lists the processes running from the 2020 install folders.
+func runningApps(dirs []string) []string {
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil
+	}
+	defer windows.CloseHandle(snap)
+	var found []string
+	e := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(snap, &e); err == nil; err = windows.Process32Next(snap, &e) {
+		if path := processPath(e.ProcessID); path != "" && under(path, dirs) {
+			found = append(found, fmt.Sprintf("%s (process %d)", filepath.Base(path), e.ProcessID))
+		}
+	}
+	return found
+}
+
+// lastAppRun returns when a program from the install folders last started, going by
+// the prefetch files Windows updates on every launch, and which program it was.
+func lastAppRun(dirs []string) (time.Time, string) {
+	win, err := windows.KnownFolderPath(windows.FOLDERID_Windows, 0)
+	if err != nil {
+		return time.Time{}, ""
+	}
+	var last time.Time
+	var which string
+	for _, d := range dirs {
+		exes, _ := filepath.Glob(filepath.Join(d, "*.exe"))
+		more, _ := filepath.Glob(filepath.Join(d, "*", "*.exe"))
+		for _, exe := range append(exes, more...) {
+			name := strings.ToUpper(filepath.Base(exe))
+			pfs, _ := filepath.Glob(filepath.Join(win, "Prefetch", name+"-*.pf"))
+			for _, pf := range pfs {
+				fi, err := os.Stat(pf)
+				if err == nil && fi.ModTime().After(last) {
+					last, which = fi.ModTime(), filepath.Base(exe)
+				}
+			}
+		}
+	}
+	return last, which
+}
+
+// AppsInUse describes why the 2020 applications count as in use: running now, or
+// started within the policy's InUseMinutes. It returns "" if they're idle, or the
+// check is turned off.
+func AppsInUse() string {
+	if policy.InUseWindowMinutes() == 0 {
+		return ""
+	}
+	dirs := installFolders()
+	if running := runningApps(dirs); len(running) > 0 {
+		return "running " + strings.Join(running, ", ")
+	}
+	last, which := lastAppRun(dirs)
+	window := time.Duration(policy.InUseWindowMinutes()) * time.Minute
+	if !last.IsZero() && time.Since(last) < window {
+		return fmt.Sprintf("%s was started at %s", which, last.Format(time.Kitchen))
+	}
+	return ""
+}
+
+// DeferIfInUse holds off a plan that would disturb someone using the 2020
+// applications. It returns the Result to end the run with and false if so.
+func DeferIfInUse(p Plan) (Result, bool) {
+	disruptive := false
+	for _, name := range p.Actions {
+		disruptive = disruptive || planActions[name].Disruptive
+	}
+	if !disruptive {
+		return Result{}, true
+	}
+	use := AppsInUse()
+	if use == "" {
+		return Result{}, true
+	}
+	Say("The 2020 software is in use (%s).", use)
+	NoteRemaining("Wait until the 2020 software hasn't been used for "+fmt.Sprint(policy.InUseWindowMinutes())+" minutes", RerunCommand())
+	return Busy("The 2020 software is in use, so the update was put off. It will be tried again on the next run."), false
+}
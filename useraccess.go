@@ -0,0 +1,77 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "runtime"
+import "strings"
+
+// CheckUserCatalogAccess reads the catalog's index files the way the user logged on at
+// the console would, since the runner's own account, usually SYSTEM, or the Shares
+// credentials may get in where they can't. It impersonates them on a thread of its
+// own, so nothing else the run does is affected. It returns who it checked for, or ""
+// if nobody is logged on, or if the run is already theirs and ReadCatalogIndexFiles
+// checked as them.
+func CheckUserCatalogAccess() (string, error) {
+	var session uint32
+	err := windows.ProcessIdToSessionId(windows.GetCurrentProcessId(), &session)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot find this program's session")
+	}
+	console := windows.WTSGetActiveConsoleSessionId()
+	if console == 0xFFFFFFFF || console == session {
+		return "", nil
+	}
+	var token windows.Token
+	err = windows.WTSQueryUserToken(console, &token)
+	if err == windows.ERROR_NO_TOKEN {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Cannot get the logged-on user's token")
+	}
+	defer token.Close()
+	user := "the logged-on user"
+	if u, err := token.GetTokenUser(); err == nil {
+		user = accountName(u.User.Sid)
+	}
+
+	var imp windows.Token
+	err = windows.DuplicateTokenEx(token, windows.TOKEN_IMPERSONATE|windows.TOKEN_QUERY, nil,
+		windows.SecurityImpersonation, windows.TokenImpersonation, &imp)
+	if err != nil {
+		return user, errors.Wrapf(err, "Cannot impersonate %s", user)
+	}
+	defer imp.Close()
+
+	done := make(chan []string, 1)
+	go func() {
+		runtime.LockOSThread()
+		// A thread left impersonating isn't handed back to the scheduler.
+		err := windows.SetThreadToken(nil, imp)
+		if err != nil {
+			done <- []string{errors.Wrapf(err, "Cannot impersonate %s", user).Error()}
+			return
+		}
+		var problems []string
+		for _, path := range catalogIndexFiles() {
+			if err := readIndexFile(path); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+		if windows.RevertToSelf() == nil {
+			runtime.UnlockOSThread()
+		}
+		done <- problems
+	}()
+	problems := <-done
+	if len(problems) == 0 {
+		return user, nil
+	}
+	return user, &RunnerError{
+		Category: ERROR_ACCESS_DENIED,
+		Hint: "The runner's account can read the catalog share, but " + user + " can't. Check the share and NTFS permissions on " +
+			catalogShareRoot() + " for them, or for a group they're in.",
+		Err: errors.Errorf("%s can't read the catalog: %s", user, strings.Join(problems, "; ")),
+	}
+}
@@ -0,0 +1,121 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "encoding/xml"
+import "os"
+import "os/exec"
+import "path/filepath"
+
+// HKCU keys carried over an upgrade: units, toolbars, default catalogs and the like.
+var DEFAULT_USER_SETTINGS = []string{`Software\20-20 Technologies`}
+
+// UserSettings is the per-user file written next to the backed up files.
+type UserSettings struct {
+	XMLName xml.Name         `xml:"UserSettings"`
+	SID     string           `xml:"SID,attr"`
+	Keys    []RegKeySnapshot `xml:"Key"`
+}
+
+func userSettingsKeys() []string {
+	if len(config.UserSettings) == 0 {
+		return DEFAULT_USER_SETTINGS
+	}
+	return config.UserSettings
+}
+
+// MountUserHive makes the profile's registry available under HKEY_USERS and returns
+// the subkey it's at, plus a function to call once all keys below it are closed.
+// Logged on users already have their hive at HKU\<SID>; for everyone else we load
+// NTUSER.DAT ourselves.
+func MountUserHive(ctx context.Context, p UserProfile) (string, func(), error) {
+	k, err := registry.OpenKey(registry.USERS, p.SID, registry.QUERY_VALUE)
+	if err == nil {
+		k.Close()
+		return p.SID, func() {}, nil
+	}
+
+	mount := "2020runner-" + p.SID
+	out, err := RunCommand(ctx, exec.Command("reg.exe", "load", `HKU\`+mount, filepath.Join(p.Path, "NTUSER.DAT")))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "Cannot load registry hive for %s, output: %s", p.Name(), out)
+	}
+	// Unloading has to happen even when ctx has been cancelled.
+	unload := func() {
+		out, err := RunCommand(context.Background(), exec.Command("reg.exe", "unload", `HKU\`+mount))
+		if err != nil {
+			Warn("Cannot unload registry hive for %s: %v %s", p.Name(), err, out)
+		}
+	}
+	return mount, unload, nil
+}
+
+// CaptureUserSettings saves the profile's 2020 HKCU settings to path. Keys the user
+// doesn't have are skipped.
+func CaptureUserSettings(ctx context.Context, p UserProfile, path string) error {
+	mount, unmount, err := MountUserHive(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	settings := UserSettings{SID: p.SID}
+	for _, key := range userSettingsKeys() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		snap, err := CaptureKey(registry.USERS, mount+`\`+key, key)
+		if errors.Cause(err) == registry.ErrNotExist {
+			continue
+		} else if err != nil {
+			return err
+		}
+		settings.Keys = append(settings.Keys, snap)
+	}
+	if len(settings.Keys) == 0 {
+		return nil
+	}
+
+	Say("Saving 2020 settings for %s", p.Name())
+	b, err := xml.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Cannot encode user settings")
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create user settings folder")
+	}
+	return errors.Wrap(os.WriteFile(path, b, 0644), "Cannot write user settings")
+}
+
+// ApplyUserSettings writes settings saved by CaptureUserSettings back into the
+// profile's registry.
+func ApplyUserSettings(ctx context.Context, p UserProfile, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Cannot read user settings")
+	}
+	var settings UserSettings
+	err = xml.Unmarshal(b, &settings)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot decode user settings %s", path)
+	}
+
+	mount, unmount, err := MountUserHive(ctx, p)
+	if err != nil {
+		return err
+	}
+	defer unmount()
+
+	Say("Restoring 2020 settings for %s", p.Name())
+	for _, snap := range settings.Keys {
+		err = ApplySnapshot(registry.USERS, mount+`\`+snap.Name, snap)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
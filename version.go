@@ -0,0 +1,44 @@
+package main
+
+import "strconv"
+import "strings"
+
+// Set by -allow-downgrade. Without it, software newer than the target is left alone.
+var allowDowngrade bool
+
+// CompareVersions compares dotted version numbers like 13.00.13037 part by part, so
+// that 13.00.9 comes before 13.00.13037. It returns -1, 0 or 1. Parts that aren't
+// numbers are compared as text.
+func CompareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xerr == nil && yerr == nil && xn != yn:
+			if xn < yn {
+				return -1
+			}
+			return 1
+		case (xerr != nil || yerr != nil) && x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// IsDowngrade reports whether bringing the software in line would mean going back to
+// an older version, e.g. from a vendor beta.
+func (s MachineState) IsDowngrade() bool {
+	return s.SoftwareInstalled && !s.SoftwareCurrent && s.SoftwareVersion != "" && CompareVersions(s.SoftwareVersion, policy.SoftwareVersion) > 0
+}
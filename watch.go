@@ -0,0 +1,151 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "context"
+import "flag"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "time"
+
+// Installers touch the registry and the DSA folder many times over; wait for things to
+// settle before looking again.
+const WATCH_SETTLE = 30 * time.Second
+
+// Watch implements -watch: it runs the workflow once, then again whenever the 2020
+// uninstall entries or the DSA state cookie change, e.g. when somebody reinstalls a
+// local catalog by hand. Each check is a fresh run of this program, since a run ends
+// by exiting. Watch only returns when ctx is done. healthAddr is passed on to
+// StartHealth.
+func Watch(ctx context.Context, healthAddr string) error {
+	err := StartHealth(ctx, healthAddr)
+	if err != nil {
+		return err
+	}
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, UNINSTALL_ROOT, registry.NOTIFY)
+	if err != nil {
+		return errors.Wrap(err, "Cannot open the uninstall key to watch it")
+	}
+	defer k.Close()
+	regEvent, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return errors.Wrap(err, "Cannot create event")
+	}
+	defer windows.CloseHandle(regEvent)
+
+	for {
+		code := watchRun(ctx)
+		if ctx.Err() == nil {
+			Evaluated(code)
+		}
+		Say("Watching for changes to the 2020 software and catalog...")
+		err = waitForChange(ctx, k, regEvent)
+		if err != nil {
+			return err
+		}
+		Say("Something changed. Checking compliance again.")
+	}
+}
+
+// waitForChange waits for something to change, then for it to stop changing. It
+// starts watching afresh each time, so that what the last run did itself doesn't count.
+func waitForChange(ctx context.Context, k registry.Key, regEvent windows.Handle) error {
+	notifyReg := func() error {
+		return windows.RegNotifyChangeKeyValue(windows.Handle(k), true,
+			windows.REG_NOTIFY_CHANGE_NAME|windows.REG_NOTIFY_CHANGE_LAST_SET, regEvent, true)
+	}
+	// Drop any change the last run made while the previous watch was still armed.
+	windows.ResetEvent(regEvent)
+	err := notifyReg()
+	if err != nil {
+		return errors.Wrap(err, "Cannot watch the uninstall key")
+	}
+
+	// The DSA folder doesn't exist until a catalog has been set up, so fall back to
+	// watching the folders above it.
+	dir, err := DSARoot()
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	fileChange, err := windows.FindFirstChangeNotification(dir, true,
+		windows.FILE_NOTIFY_CHANGE_FILE_NAME|windows.FILE_NOTIFY_CHANGE_LAST_WRITE)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot watch %s", dir)
+	}
+	defer windows.FindCloseChangeNotification(fileChange)
+
+	changed := false
+	var quiet time.Time
+	for !changed || time.Now().Before(quiet) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		ev, err := windows.WaitForMultipleObjects([]windows.Handle{regEvent, fileChange}, false, 1000)
+		if err != nil {
+			return errors.Wrap(err, "Cannot wait for changes")
+		}
+		switch ev {
+		case windows.WAIT_OBJECT_0:
+			notifyReg()
+		case windows.WAIT_OBJECT_0 + 1:
+			windows.FindNextChangeNotification(fileChange)
+		default:
+			continue
+		}
+		changed = true
+		quiet = time.Now().Add(WATCH_SETTLE)
+	}
+	return nil
+}
+
+// forwardedFlags returns the flags this program was started with, other than the ones
+// named, for starting it again.
+func forwardedFlags(except ...string) []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		for _, e := range except {
+			if f.Name == e {
+				return
+			}
+		}
+		args = append(args, "-"+f.Name+"="+f.Value.String())
+	})
+	return args
+}
+
+// watchRun runs this program again with the same flags, minus -watch, waits for it to
+// finish and returns its exit code.
+func watchRun(ctx context.Context) int {
+	exe, err := os.Executable()
+	if err != nil {
+		Warn("Unable to find this program to run it: %v", err)
+		return 1
+	}
+	args := append(forwardedFlags("watch", "nopause", "health-addr"), "-nopause")
+
+	cmd := exec.CommandContext(ctx, exe, args...)
+	cmd.Stdout = os.Stdout
+	if ndjsonOut != nil {
+		cmd.Stdout = ndjsonOut
+	}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil && ctx.Err() == nil {
+		Warn("Compliance check ended with %v", err)
+	}
+	if cmd.ProcessState == nil {
+		return 1
+	}
+	return cmd.ProcessState.ExitCode()
+}
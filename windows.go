@@ -0,0 +1,451 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "golang.org/x/sys/windows/registry"
+import "github.com/pkg/errors"
+import "fmt"
+import "io"
+import "os"
+import "os/exec"
+import "path/filepath"
+import "sort"
+import "strings"
+import "syscall"
+import "time"
+import "unsafe"
+
+// The Windows side of the few things the rest of the runner needs from the system;
+// stubs.go has what the other platforms make do with.
+
+// ProgramData returns the machine-wide ProgramData folder.
+func ProgramData() (string, error) {
+	pd, err := windows.KnownFolderPath(windows.FOLDERID_ProgramData, 0)
+	if err != nil {
+		return "", errors.Wrap(err, "Cannot resolve the ProgramData folder")
+	}
+	return pd, nil
+}
+
+// splitCommandLine splits line into arguments the way programs built with the Microsoft
+// C runtime do.
+func splitCommandLine(line string) ([]string, error) {
+	return windows.DecomposeCommandLine(line)
+}
+
+// commandLine makes a command that gets line exactly as written, rather than its
+// arguments quoted again.
+func commandLine(argv []string, line string) *exec.Cmd {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: line}
+	return cmd
+}
+
+// classifyErrno is the error category of a Windows error code, or "" if it doesn't
+// tell.
+func classifyErrno(errno syscall.Errno) string {
+	switch errno {
+	case windows.ERROR_ACCESS_DISABLED_BY_POLICY, windows.ERROR_ACCESS_DISABLED_NO_SAFER_UI_BY_POLICY:
+		return ERROR_POLICY_BLOCKED
+	case windows.ERROR_PRIVILEGE_NOT_HELD, windows.ERROR_ELEVATION_REQUIRED:
+		return ERROR_ACCESS_DENIED
+	case windows.ERROR_FILE_CORRUPT, windows.ERROR_DISK_CORRUPT, windows.ERROR_BADDB, windows.ERROR_BADKEY:
+		return ERROR_CORRUPT_STATE
+	}
+	if _, ok := authErrors[errno]; ok {
+		return ERROR_ACCESS_DENIED
+	}
+	if kind := failureKind(errno); kind != "" {
+		return ERROR_NETWORK
+	}
+	return ""
+}
+
+var (
+	modwinhttp                                = windows.NewLazySystemDLL("winhttp.dll")
+	procWinHttpGetDefaultProxyConfiguration   = modwinhttp.NewProc("WinHttpGetDefaultProxyConfiguration")
+	procWinHttpGetIEProxyConfigForCurrentUser = modwinhttp.NewProc("WinHttpGetIEProxyConfigForCurrentUser")
+	modkernel32                               = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalFree                            = modkernel32.NewProc("GlobalFree")
+)
+
+const WINHTTP_ACCESS_TYPE_NAMED_PROXY = 3
+
+type winhttpProxyInfo struct {
+	AccessType  uint32
+	Proxy       *uint16
+	ProxyBypass *uint16
+}
+
+type winhttpIEProxyConfig struct {
+	AutoDetect    int32
+	AutoConfigUrl *uint16
+	Proxy         *uint16
+	ProxyBypass   *uint16
+}
+
+func freeString(s *uint16) {
+	if s != nil {
+		procGlobalFree.Call(uintptr(unsafe.Pointer(s)))
+	}
+}
+
+// systemProxy returns the proxy list and bypass list Windows is set up with, in the
+// WinHTTP format: "host:port" or "http=host:port;https=host:port", and "<local>;*.x".
+// Automatic configuration scripts aren't evaluated.
+func systemProxy() (string, string) {
+	var info winhttpProxyInfo
+	r, _, _ := procWinHttpGetDefaultProxyConfiguration.Call(uintptr(unsafe.Pointer(&info)))
+	if r != 0 {
+		defer freeString(info.Proxy)
+		defer freeString(info.ProxyBypass)
+		if info.AccessType == WINHTTP_ACCESS_TYPE_NAMED_PROXY && info.Proxy != nil {
+			return windows.UTF16PtrToString(info.Proxy), windows.UTF16PtrToString(info.ProxyBypass)
+		}
+	}
+	var ie winhttpIEProxyConfig
+	r, _, _ = procWinHttpGetIEProxyConfigForCurrentUser.Call(uintptr(unsafe.Pointer(&ie)))
+	if r != 0 {
+		defer freeString(ie.AutoConfigUrl)
+		defer freeString(ie.Proxy)
+		defer freeString(ie.ProxyBypass)
+		if ie.Proxy != nil {
+			return windows.UTF16PtrToString(ie.Proxy), windows.UTF16PtrToString(ie.ProxyBypass)
+		}
+	}
+	return "", ""
+}
+
+// saveHealth writes h to HEALTH_KEY.
+func saveHealth(h Health) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, HEALTH_KEY, registry.SET_VALUE)
+	if err != nil {
+		return KeyAccessError(err, registry.LOCAL_MACHINE, HEALTH_KEY)
+	}
+	defer k.Close()
+	k.SetStringValue("Heartbeat", h.Heartbeat.Format(time.RFC3339))
+	k.SetDWordValue("PID", uint32(h.PID))
+	if !h.LastEvaluated.IsZero() {
+		k.SetStringValue("LastEvaluated", h.LastEvaluated.Format(time.RFC3339))
+		k.SetStringValue("LastOutcome", h.LastOutcome)
+	}
+	return nil
+}
+
+var (
+	modsecur32                 = windows.NewLazySystemDLL("secur32.dll")
+	procGetComputerObjectNameW = modsecur32.NewProc("GetComputerObjectNameW")
+)
+
+// GetComputerDN returns the distinguished name of this computer's AD account.
+func GetComputerDN() (string, error) {
+	n := uint32(512)
+	for {
+		buf := make([]uint16, n)
+		r, _, err := procGetComputerObjectNameW.Call(uintptr(windows.NameFullyQualifiedDN),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)))
+		if r != 0 {
+			return windows.UTF16ToString(buf), nil
+		}
+		if err != syscall.Errno(windows.ERROR_MORE_DATA) && err != syscall.Errno(windows.ERROR_INSUFFICIENT_BUFFER) {
+			return "", errors.Wrap(err, "Cannot get the computer's directory name")
+		}
+	}
+}
+
+// FileVersion returns the file version from the version resource of path, as a.b.c.d.
+func FileVersion(path string) (string, error) {
+	size, err := windows.GetFileVersionInfoSize(path, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot read the version of %s", path)
+	}
+	buf := make([]byte, size)
+	err = windows.GetFileVersionInfo(path, 0, size, unsafe.Pointer(&buf[0]))
+	if err != nil {
+		return "", errors.Wrapf(err, "Cannot read the version of %s", path)
+	}
+	var fixed *windows.VS_FIXEDFILEINFO
+	var n uint32
+	err = windows.VerQueryValue(unsafe.Pointer(&buf[0]), `\`, unsafe.Pointer(&fixed), &n)
+	if err != nil || n == 0 {
+		return "", errors.Errorf("%s has no file version", path)
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", fixed.FileVersionMS>>16, fixed.FileVersionMS&0xffff,
+		fixed.FileVersionLS>>16, fixed.FileVersionLS&0xffff), nil
+}
+
+// openExclusive opens path for appending, creating it if need be, with no sharing, so
+// that nobody else can have it open on the server, Excel included, until it's closed.
+// errFileBusy means someone has.
+func openExclusive(path string) (*os.File, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(p, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_ALWAYS, windows.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == windows.ERROR_SHARING_VIOLATION || err == windows.ERROR_LOCK_VIOLATION {
+		return nil, errFileBusy
+	} else if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	f := os.NewFile(uintptr(h), path)
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// isElevated reports whether the runner has an elevated token.
+func isElevated() bool {
+	return windows.GetCurrentProcessToken().IsElevated()
+}
+
+// diskFree returns how many bytes are free on drive for the runner's account.
+func diskFree(drive string) (uint64, error) {
+	var free uint64
+	err := windows.GetDiskFreeSpaceEx(windows.StringToUTF16Ptr(drive), &free, nil, nil)
+	return free, err
+}
+
+var rebootKeys = []string{
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\Component Based Servicing\RebootPending`,
+	`SOFTWARE\Microsoft\Windows\CurrentVersion\WindowsUpdate\Auto Update\RebootRequired`,
+}
+
+// IsRebootPending checks the usual places Windows and installers flag a pending
+// restart.
+func IsRebootPending() (bool, string) {
+	for _, path := range rebootKeys {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, path, registry.QUERY_VALUE)
+		if err == nil {
+			k.Close()
+			return true, path
+		}
+	}
+
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Control\Session Manager`, registry.QUERY_VALUE)
+	if err == nil {
+		defer k.Close()
+		renames, _, err := k.GetStringsValue("PendingFileRenameOperations")
+		if err == nil && len(renames) > 0 {
+			return true, "PendingFileRenameOperations"
+		}
+	}
+	return false, ""
+}
+
+// exemptionFlag reads the Exempt value under HEALTH_KEY: a reason, or any number but 0.
+func exemptionFlag() (string, bool) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, HEALTH_KEY, registry.QUERY_VALUE)
+	if err != nil {
+		return "", false
+	}
+	defer k.Close()
+	if s, _, err := k.GetStringValue("Exempt"); err == nil {
+		return strings.TrimSpace(s), s != "" && s != "0"
+	}
+	if n, _, err := k.GetIntegerValue("Exempt"); err == nil {
+		return "", n != 0
+	}
+	return "", false
+}
+
+// Windows errors that mean the server was reached but wouldn't let us in.
+var authErrors = map[syscall.Errno]string{
+	windows.ERROR_ACCESS_DENIED:                "access denied",
+	windows.ERROR_LOGON_FAILURE:                "logon failure",
+	windows.ERROR_ACCOUNT_RESTRICTION:          "account restriction",
+	windows.ERROR_SESSION_CREDENTIAL_CONFLICT:  "conflicting credentials already in use for this server",
+	windows.ERROR_NOT_AUTHENTICATED:            "not authenticated",
+	windows.ERROR_DOWNGRADE_DETECTED:           "security downgrade detected",
+	windows.ERROR_TRUSTED_RELATIONSHIP_FAILURE: "machine trust relationship failed",
+}
+
+// failureKind says whether err looks like the network or authentication.
+func failureKind(err error) string {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ""
+	}
+	if f, ok := ShareFailure(errno); ok {
+		return f.Kind
+	}
+	if why, ok := authErrors[errno]; ok {
+		return "authentication (" + why + ")"
+	}
+	switch errno {
+	case windows.ERROR_BAD_NETPATH, windows.ERROR_NETWORK_UNREACHABLE, windows.ERROR_HOST_UNREACHABLE,
+		windows.ERROR_NETNAME_DELETED, windows.ERROR_UNEXP_NET_ERR, windows.ERROR_SEM_TIMEOUT:
+		return "network (" + errno.Error() + ")"
+	case windows.ERROR_BAD_NET_NAME:
+		return "share name (the server doesn't have that share)"
+	}
+	return ""
+}
+
+func blob(b []byte) *windows.DataBlob {
+	if len(b) == 0 {
+		return &windows.DataBlob{}
+	}
+	return &windows.DataBlob{Size: uint32(len(b)), Data: &b[0]}
+}
+
+func blobBytes(d windows.DataBlob) []byte {
+	defer windows.LocalFree(windows.Handle(unsafe.Pointer(d.Data)))
+	return append([]byte{}, unsafe.Slice(d.Data, d.Size)...)
+}
+
+// protectData encrypts b with DPAPI under the machine key, mixing in entropy.
+func protectData(b, entropy []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptProtectData(blob(b), nil, blob(entropy), 0, nil,
+		windows.CRYPTPROTECT_LOCAL_MACHINE|windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return blobBytes(out), nil
+}
+
+// unprotectData decrypts what protectData made of b.
+func unprotectData(b, entropy []byte) ([]byte, error) {
+	var out windows.DataBlob
+	err := windows.CryptUnprotectData(blob(b), nil, blob(entropy), 0, nil, windows.CRYPTPROTECT_UI_FORBIDDEN, &out)
+	if err != nil {
+		return nil, err
+	}
+	return blobBytes(out), nil
+}
+
+// ListInstalledSoftware finds every installed version of the 2020 software: the
+// product under CAP2020_SOFTWARE, plus anything whose display name matches
+// policy.SoftwareName, which is how versions installed side by side show up.
+func ListInstalledSoftware() ([]InstalledProduct, error) {
+	var products []InstalledProduct
+	seen := map[string]bool{}
+	for _, root := range []string{UNINSTALL_ROOT, UNINSTALL_ROOT_NATIVE} {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, root, registry.ENUMERATE_SUB_KEYS)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot open %s", root)
+		}
+		names, err := k.ReadSubKeyNames(-1)
+		k.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "Cannot list %s", root)
+		}
+
+		for _, code := range names {
+			sub, err := registry.OpenKey(registry.LOCAL_MACHINE, root+`\`+code, registry.QUERY_VALUE)
+			if err != nil {
+				continue
+			}
+			name, _, _ := sub.GetStringValue("DisplayName")
+			version, _, _ := sub.GetStringValue("DisplayVersion")
+			sub.Close()
+			Verbose(`HKLM\%s\%s DisplayName = %s, DisplayVersion = %s`, root, code, name, version)
+
+			ours := strings.EqualFold(root+`\`+code, CAP2020_SOFTWARE)
+			if !ours && (policy.SoftwareName == "" || !matchPattern(policy.SoftwareName, name)) {
+				continue
+			}
+			if seen[strings.ToUpper(code)] {
+				continue
+			}
+			seen[strings.ToUpper(code)] = true
+			products = append(products, InstalledProduct{Key: root + `\` + code, Code: code, Name: name, Version: version})
+		}
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return CompareVersions(products[i].Version, products[j].Version) < 0
+	})
+	return products, nil
+}
+
+const PROFILE_LIST = `SOFTWARE\Microsoft\Windows NT\CurrentVersion\ProfileList`
+
+// ListUserProfiles returns the local and domain user profiles on the machine, leaving
+// out the built-in service accounts.
+func ListUserProfiles() ([]UserProfile, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, PROFILE_LIST, registry.ENUMERATE_SUB_KEYS)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot open profile list")
+	}
+	defer k.Close()
+
+	sids, err := k.ReadSubKeyNames(-1)
+	if err != nil {
+		return nil, errors.Wrap(err, "Cannot enumerate profile list")
+	}
+
+	var profiles []UserProfile
+	for _, sid := range sids {
+		// Real user accounts are S-1-5-21-*; SYSTEM, LocalService etc. are not.
+		if !strings.HasPrefix(sid, "S-1-5-21-") {
+			continue
+		}
+		pk, err := registry.OpenKey(k, sid, registry.QUERY_VALUE)
+		if err != nil {
+			continue
+		}
+		path, _, err := pk.GetStringValue("ProfileImagePath")
+		pk.Close()
+		if err != nil {
+			continue
+		}
+		path, err = registry.ExpandString(path)
+		if err != nil {
+			continue
+		}
+		profiles = append(profiles, UserProfile{SID: sid, Path: path})
+	}
+	return profiles, nil
+}
+
+var (
+	modmsi                 = windows.NewLazySystemDLL("msi.dll")
+	procMsiEnumProductsW   = modmsi.NewProc("MsiEnumProductsW")
+	procMsiGetProductInfoW = modmsi.NewProc("MsiGetProductInfoW")
+)
+
+func msiProductInfo(code, property string) string {
+	n := uint32(256)
+	for {
+		buf := make([]uint16, n)
+		r, _, _ := procMsiGetProductInfoW.Call(uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(code))),
+			uintptr(unsafe.Pointer(windows.StringToUTF16Ptr(property))),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&n)))
+		if syscall.Errno(r) == windows.ERROR_MORE_DATA {
+			n++
+			continue
+		}
+		if r != 0 {
+			return ""
+		}
+		return windows.UTF16ToString(buf)
+	}
+}
+
+// ListMSIProducts returns the 2020 software products registered with Windows
+// Installer: our product code, and anything named like policy.SoftwareName.
+func ListMSIProducts() ([]MSIProduct, error) {
+	ours := filepath.Base(CAP2020_SOFTWARE)
+	var products []MSIProduct
+	for i := 0; ; i++ {
+		buf := make([]uint16, 39)
+		r, _, _ := procMsiEnumProductsW.Call(uintptr(i), uintptr(unsafe.Pointer(&buf[0])))
+		if syscall.Errno(r) == windows.ERROR_NO_MORE_ITEMS {
+			return products, nil
+		}
+		if r != 0 {
+			return nil, errors.Wrap(syscall.Errno(r), "Cannot list Windows Installer products")
+		}
+		code := windows.UTF16ToString(buf)
+		name := msiProductInfo(code, "ProductName")
+		if !strings.EqualFold(code, ours) && (policy.SoftwareName == "" || !matchPattern(policy.SoftwareName, name)) {
+			continue
+		}
+		products = append(products, MSIProduct{Code: code, Name: name, Version: msiProductInfo(code, "VersionString")})
+	}
+}
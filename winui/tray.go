@@ -0,0 +1,121 @@
+//go:build windows
+
+package winui
+
+import "github.com/lxn/win"
+import "syscall"
+import "time"
+import "unsafe"
+
+// The tray icon's notifications come back to its window as this message.
+const WM_TRAY = win.WM_APP + 2
+
+// A MenuItem with no Text is a separator.
+type MenuItem struct {
+	Text     string
+	Disabled bool
+	OnClick  func()
+}
+
+type TrayIcon struct {
+	w   *Window
+	nid win.NOTIFYICONDATA
+
+	// Menu is called for the items to show each time the icon is right-clicked.
+	Menu func() []MenuItem
+	// OnDoubleClick is called when the icon is double-clicked.
+	OnDoubleClick func()
+}
+
+// AddTrayIcon puts an icon for w in the notification area. w itself usually stays
+// hidden.
+func (w *Window) AddTrayIcon(tip string) *TrayIcon {
+	t := &TrayIcon{w: w}
+	t.nid.CbSize = uint32(unsafe.Sizeof(t.nid))
+	t.nid.HWnd = w.hwnd
+	t.nid.UID = 1
+	t.nid.UFlags = win.NIF_MESSAGE | win.NIF_ICON | win.NIF_TIP
+	t.nid.UCallbackMessage = WM_TRAY
+	t.nid.HIcon = win.LoadIcon(0, win.MAKEINTRESOURCE(win.IDI_APPLICATION))
+	t.setTip(tip)
+	win.Shell_NotifyIcon(win.NIM_ADD, &t.nid)
+
+	w.Handle(WM_TRAY, func(wParam, lParam uintptr) {
+		switch uint32(lParam) {
+		case win.WM_RBUTTONUP, win.WM_CONTEXTMENU:
+			t.showMenu()
+		case win.WM_LBUTTONDBLCLK:
+			if t.OnDoubleClick != nil {
+				t.OnDoubleClick()
+			}
+		}
+	})
+	return t
+}
+
+func (t *TrayIcon) setTip(tip string) {
+	u, _ := syscall.UTF16FromString(tip)
+	if len(u) > len(t.nid.SzTip) {
+		u = append(u[:len(t.nid.SzTip)-1], 0)
+	}
+	t.nid.SzTip = [len(t.nid.SzTip)]uint16{}
+	copy(t.nid.SzTip[:], u)
+}
+
+// SetTip changes the text shown when hovering over the icon. It's cut short at 127
+// characters, which is all the notification area allows.
+func (t *TrayIcon) SetTip(tip string) {
+	t.setTip(tip)
+	win.Shell_NotifyIcon(win.NIM_MODIFY, &t.nid)
+}
+
+func (t *TrayIcon) Remove() {
+	win.Shell_NotifyIcon(win.NIM_DELETE, &t.nid)
+}
+
+func (t *TrayIcon) showMenu() {
+	if t.Menu == nil {
+		return
+	}
+	items := t.Menu()
+	m := win.CreatePopupMenu()
+	defer win.DestroyMenu(m)
+	for i, item := range items {
+		mii := win.MENUITEMINFO{FMask: win.MIIM_ID | win.MIIM_FTYPE | win.MIIM_STATE, WID: uint32(i + 1)}
+		mii.CbSize = uint32(unsafe.Sizeof(mii))
+		if item.Text == "" {
+			mii.FType = win.MFT_SEPARATOR
+		} else {
+			mii.FMask |= win.MIIM_STRING
+			mii.DwTypeData = syscall.StringToUTF16Ptr(item.Text)
+		}
+		if item.Disabled {
+			mii.FState = win.MFS_DISABLED
+		}
+		win.InsertMenuItem(m, uint32(i), true, &mii)
+	}
+
+	// Without this the menu doesn't go away when the user clicks somewhere else.
+	win.SetForegroundWindow(t.w.hwnd)
+	var pt win.POINT
+	win.GetCursorPos(&pt)
+	id := win.TrackPopupMenu(m, win.TPM_RETURNCMD|win.TPM_RIGHTBUTTON, pt.X, pt.Y, 0, t.w.hwnd, nil)
+	if id > 0 && int(id) <= len(items) && items[id-1].OnClick != nil {
+		items[id-1].OnClick()
+	}
+}
+
+// Every calls f on the window's thread every d until the window is destroyed.
+func (w *Window) Every(d time.Duration, f func()) {
+	w.nextID++
+	id := uintptr(w.nextID)
+	win.SetTimer(w.hwnd, id, uint32(d/time.Millisecond), 0)
+	prev := w.messages[win.WM_TIMER]
+	w.messages[win.WM_TIMER] = func(wParam, lParam uintptr) {
+		if wParam == id {
+			f()
+		} else if prev != nil {
+			prev(wParam, lParam)
+		}
+	}
+}
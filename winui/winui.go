@@ -0,0 +1,278 @@
+//go:build windows
+
+// Package winui is the little bit of Win32 UI the runner's front-ends need: a fixed
+// layout window with labels, a progress bar, a log box, buttons and checkboxes, and a
+// way to update it from other goroutines. It sits straight on lxn/win so the tools stay
+// small and don't drag in a whole GUI framework.
+package winui
+
+import "github.com/lxn/win"
+import "runtime"
+import "sync"
+import "syscall"
+import "unsafe"
+
+const CLASS_NAME = "2020runnerWindow"
+
+// Posted to a window to run whatever Invoke queued up.
+const WM_INVOKE = win.WM_APP + 1
+
+type Window struct {
+	hwnd     win.HWND
+	font     uintptr
+	nextID   uint16
+	commands map[uint16]func()
+	messages map[uint32]func(wParam, lParam uintptr)
+
+	mu    sync.Mutex
+	queue []func()
+
+	// OnClose is called when the user closes the window. Return false to keep it open.
+	OnClose func() bool
+}
+
+type Control struct {
+	hwnd win.HWND
+}
+
+var windowsMu sync.Mutex
+var windows = map[win.HWND]*Window{}
+var registerOnce sync.Once
+
+func register() {
+	icc := win.INITCOMMONCONTROLSEX{DwICC: win.ICC_PROGRESS_CLASS | win.ICC_LISTVIEW_CLASSES}
+	icc.DwSize = uint32(unsafe.Sizeof(icc))
+	win.InitCommonControlsEx(&icc)
+
+	wc := win.WNDCLASSEX{
+		LpfnWndProc:   syscall.NewCallback(wndProc),
+		HInstance:     win.GetModuleHandle(nil),
+		HIcon:         win.LoadIcon(0, win.MAKEINTRESOURCE(win.IDI_APPLICATION)),
+		HCursor:       win.LoadCursor(0, win.MAKEINTRESOURCE(win.IDC_ARROW)),
+		HbrBackground: win.COLOR_BTNFACE + 1,
+		LpszClassName: syscall.StringToUTF16Ptr(CLASS_NAME),
+	}
+	wc.CbSize = uint32(unsafe.Sizeof(wc))
+	win.RegisterClassEx(&wc)
+}
+
+// NewWindow creates a hidden top-level window with a client area of about width by
+// height. Windows belong to the thread that makes them, so this locks the calling
+// goroutine to its thread; call Run from the same goroutine.
+func NewWindow(title string, width, height int32) *Window {
+	runtime.LockOSThread()
+	registerOnce.Do(register)
+
+	w := &Window{
+		font:     uintptr(win.GetStockObject(win.DEFAULT_GUI_FONT)),
+		commands: map[uint16]func(){},
+		messages: map[uint32]func(wParam, lParam uintptr){},
+	}
+	// Leave room for the caption and borders.
+	w.hwnd = win.CreateWindowEx(win.WS_EX_CONTROLPARENT, syscall.StringToUTF16Ptr(CLASS_NAME), syscall.StringToUTF16Ptr(title),
+		win.WS_CAPTION|win.WS_SYSMENU|win.WS_MINIMIZEBOX, win.CW_USEDEFAULT, win.CW_USEDEFAULT, width+16, height+39,
+		0, 0, win.GetModuleHandle(nil), nil)
+
+	windowsMu.Lock()
+	windows[w.hwnd] = w
+	windowsMu.Unlock()
+	return w
+}
+
+func wndProc(hwnd win.HWND, msg uint32, wParam, lParam uintptr) uintptr {
+	windowsMu.Lock()
+	w := windows[hwnd]
+	windowsMu.Unlock()
+	if w == nil {
+		return win.DefWindowProc(hwnd, msg, wParam, lParam)
+	}
+
+	switch msg {
+	case win.WM_COMMAND:
+		if f, ok := w.commands[win.LOWORD(uint32(wParam))]; ok {
+			f()
+			return 0
+		}
+	case WM_INVOKE:
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, f := range queue {
+			f()
+		}
+		return 0
+	case win.WM_CLOSE:
+		if w.OnClose != nil && !w.OnClose() {
+			return 0
+		}
+	case win.WM_DESTROY:
+		// Run ends once the last window is gone.
+		windowsMu.Lock()
+		delete(windows, hwnd)
+		last := len(windows) == 0
+		windowsMu.Unlock()
+		if last {
+			win.PostQuitMessage(0)
+		}
+		return 0
+	}
+	if f, ok := w.messages[msg]; ok {
+		f(wParam, lParam)
+		return 0
+	}
+	return win.DefWindowProc(hwnd, msg, wParam, lParam)
+}
+
+func (w *Window) HWND() win.HWND {
+	return w.hwnd
+}
+
+// Handle calls f for msg, for window messages nothing else here deals with.
+func (w *Window) Handle(msg uint32, f func(wParam, lParam uintptr)) {
+	w.messages[msg] = f
+}
+
+func (w *Window) child(class, text string, style, exStyle uint32, x, y, width, height int32) (*Control, uint16) {
+	w.nextID++
+	h := win.CreateWindowEx(exStyle, syscall.StringToUTF16Ptr(class), syscall.StringToUTF16Ptr(text),
+		win.WS_CHILD|win.WS_VISIBLE|style, x, y, width, height,
+		w.hwnd, win.HMENU(w.nextID), win.GetModuleHandle(nil), nil)
+	win.SendMessage(h, win.WM_SETFONT, w.font, 1)
+	return &Control{hwnd: h}, w.nextID
+}
+
+func (w *Window) AddLabel(text string, x, y, width, height int32) *Control {
+	c, _ := w.child("STATIC", text, win.SS_LEFT, 0, x, y, width, height)
+	return c
+}
+
+func (w *Window) AddProgress(x, y, width, height int32) *Control {
+	c, _ := w.child("msctls_progress32", "", 0, 0, x, y, width, height)
+	return c
+}
+
+// AddLog adds a read-only, scrolling text box that Append adds lines to.
+func (w *Window) AddLog(x, y, width, height int32) *Control {
+	c, _ := w.child("EDIT", "", win.ES_MULTILINE|win.ES_READONLY|win.ES_AUTOVSCROLL|win.WS_VSCROLL, win.WS_EX_CLIENTEDGE,
+		x, y, width, height)
+	return c
+}
+
+func (w *Window) AddButton(text string, x, y, width, height int32, onClick func()) *Control {
+	c, id := w.child("BUTTON", text, win.BS_PUSHBUTTON|win.WS_TABSTOP, 0, x, y, width, height)
+	if onClick != nil {
+		w.commands[id] = onClick
+	}
+	return c
+}
+
+func (w *Window) AddCheckbox(text string, x, y, width, height int32) *Control {
+	c, _ := w.child("BUTTON", text, win.BS_AUTOCHECKBOX|win.WS_TABSTOP, 0, x, y, width, height)
+	return c
+}
+
+func (w *Window) SetTitle(title string) {
+	(&Control{hwnd: w.hwnd}).SetText(title)
+}
+
+func (w *Window) Show() {
+	win.ShowWindow(w.hwnd, win.SW_SHOWNORMAL)
+	win.UpdateWindow(w.hwnd)
+}
+
+func (w *Window) Hide() {
+	win.ShowWindow(w.hwnd, win.SW_HIDE)
+}
+
+// Close asks the window to close, the same as the user clicking the X. It's safe to
+// call from any goroutine.
+func (w *Window) Close() {
+	win.PostMessage(w.hwnd, win.WM_CLOSE, 0, 0)
+}
+
+// Destroy closes the window without asking OnClose.
+func (w *Window) Destroy() {
+	w.Invoke(func() { win.DestroyWindow(w.hwnd) })
+}
+
+// Invoke runs f on the window's thread. Controls can only be touched from there, so
+// anything updating the window from another goroutine goes through this.
+func (w *Window) Invoke(f func()) {
+	w.mu.Lock()
+	w.queue = append(w.queue, f)
+	w.mu.Unlock()
+	win.PostMessage(w.hwnd, WM_INVOKE, 0, 0)
+}
+
+// Run pumps messages for every window on the thread until they've all been
+// destroyed.
+func (w *Window) Run() {
+	var msg win.MSG
+	for win.GetMessage(&msg, 0, 0, 0) > 0 {
+		// Let Tab and Enter move between and press controls.
+		root := win.GetAncestor(msg.HWnd, win.GA_ROOT)
+		windowsMu.Lock()
+		_, ours := windows[root]
+		windowsMu.Unlock()
+		if ours && win.IsDialogMessage(root, &msg) {
+			continue
+		}
+		win.TranslateMessage(&msg)
+		win.DispatchMessage(&msg)
+	}
+}
+
+// MessageBox shows a modal message box over w, which may be nil, and returns the
+// button that was pressed (win.IDOK and friends).
+func MessageBox(w *Window, title, text string, flags uint32) int32 {
+	var owner win.HWND
+	if w != nil {
+		owner = w.hwnd
+	}
+	return win.MessageBox(owner, syscall.StringToUTF16Ptr(text), syscall.StringToUTF16Ptr(title), flags)
+}
+
+func (c *Control) SetText(text string) {
+	win.SendMessage(c.hwnd, win.WM_SETTEXT, 0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(text))))
+}
+
+// Append adds a line to the end of a log box.
+func (c *Control) Append(line string) {
+	n := win.SendMessage(c.hwnd, win.WM_GETTEXTLENGTH, 0, 0)
+	win.SendMessage(c.hwnd, win.EM_SETSEL, n, n)
+	if n > 0 {
+		line = "\r\n" + line
+	}
+	win.SendMessage(c.hwnd, win.EM_REPLACESEL, 0, uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(line))))
+}
+
+// SetProgress moves a progress bar to pos out of max.
+func (c *Control) SetProgress(pos, max int) {
+	win.SendMessage(c.hwnd, win.PBM_SETRANGE32, 0, uintptr(max))
+	win.SendMessage(c.hwnd, win.PBM_SETPOS, uintptr(pos), 0)
+}
+
+func (c *Control) Checked() bool {
+	return win.SendMessage(c.hwnd, win.BM_GETCHECK, 0, 0) == win.BST_CHECKED
+}
+
+func (c *Control) SetChecked(checked bool) {
+	state := uintptr(win.BST_UNCHECKED)
+	if checked {
+		state = win.BST_CHECKED
+	}
+	win.SendMessage(c.hwnd, win.BM_SETCHECK, state, 0)
+}
+
+func (c *Control) Enable(enabled bool) {
+	win.EnableWindow(c.hwnd, enabled)
+}
+
+func (c *Control) Show(visible bool) {
+	if visible {
+		win.ShowWindow(c.hwnd, win.SW_SHOW)
+	} else {
+		win.ShowWindow(c.hwnd, win.SW_HIDE)
+	}
+}
@@ -0,0 +1,176 @@
+//go:build windows
+
+package main
+
+import "github.com/ispaceenvironments/2020runner/winui"
+import "github.com/lxn/win"
+import "context"
+import "fmt"
+import "os"
+import "strings"
+import "time"
+
+const WIZARD_TITLE = "2020 Software Update"
+
+type wizard struct {
+	*winui.Window
+	results  *winui.Control
+	actions  []*winui.Control
+	hold     *winui.Control
+	status   *winui.Control
+	progress *winui.Control
+	log      *winui.Control
+	run      *winui.Control
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	plan   Plan
+
+	// Only touched on the window's thread.
+	started  bool
+	finished bool
+	closing  bool
+	code     int
+	step     int
+	steps    int
+}
+
+// RunWizard is the -gui front-end for techs who'd rather click: it shows what detection
+// found, lets them untick any of the proposed actions, and follows the run in a window
+// instead of the console. It doesn't return.
+func RunWizard(ctx context.Context) {
+	w := &wizard{Window: winui.NewWindow(WIZARD_TITLE, 520, 460)}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+
+	w.AddLabel("Detection", 12, 12, 496, 16)
+	w.results = w.AddLabel("Checking this computer...", 24, 32, 484, 110)
+	w.AddLabel("Proposed actions", 12, 150, 496, 16)
+	w.hold = w.AddLabel("", 12, 304, 496, 32)
+	w.status = w.AddLabel("", 12, 340, 496, 16)
+	w.progress = w.AddProgress(12, 360, 496, 16)
+	w.log = w.AddLog(12, 382, 496, 44)
+	w.run = w.AddButton("Run", 340, 432, 80, 24, w.start)
+	w.run.Enable(false)
+	w.AddButton("Close", 428, 432, 80, 24, func() { w.Close() })
+	w.OnClose = w.onClose
+
+	// The console would only repeat what the window shows.
+	win.ShowWindow(win.GetConsoleWindow(), win.SW_HIDE)
+
+	AddEventSink(func(e Event) { w.Invoke(func() { w.show(e) }) })
+	exit = func(code int, pause time.Duration) {
+		w.Invoke(func() { w.finish(code) })
+		select {}
+	}
+
+	w.Show()
+	go w.detect()
+	w.Run()
+}
+
+func (w *wizard) detect() {
+	done := TimePhase("Detection")
+	pf := RunPreflight(w.ctx)
+	s, err := pf.MachineState()
+	done()
+
+	w.Invoke(func() {
+		var lines []string
+		for _, r := range pf.Results {
+			mark := "OK"
+			if !r.OK {
+				mark = "FAIL"
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s (%s)", r.Name, r.Detail, mark))
+		}
+		w.results.SetText(strings.Join(lines, "\r\n"))
+	})
+	if err != nil {
+		Exit(Failed("Unable to check the machine state.", err))
+		return
+	}
+
+	p := BuildPlan(s)
+	w.Invoke(func() {
+		w.plan = p
+		for i, name := range p.Actions {
+			c := w.AddCheckbox(planActions[name].Title, 24, 170+int32(i)*22, 484, 20)
+			c.SetChecked(true)
+			w.actions = append(w.actions, c)
+		}
+		if len(p.Actions) == 0 {
+			w.AddLabel("Nothing to do.", 24, 170, 484, 16)
+		}
+		if p.Hold != "" {
+			w.hold.SetText("On hold: " + p.Hold)
+		}
+		w.run.Enable(true)
+	})
+}
+
+// start applies the plan with whichever actions are still ticked.
+func (w *wizard) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.run.Enable(false)
+
+	p := w.plan
+	p.Actions = nil
+	for i, c := range w.actions {
+		c.Enable(false)
+		if c.Checked() {
+			p.Actions = append(p.Actions, w.plan.Actions[i])
+		}
+	}
+	go func() { Exit(ApplyPlan(w.ctx, p)) }()
+}
+
+func (w *wizard) show(e Event) {
+	switch e.Type {
+	case EVENT_MESSAGE, EVENT_WARNING, EVENT_PROMPT, EVENT_REBOOT:
+		w.log.Append(e.Message)
+		if e.Steps > 0 {
+			w.step, w.steps = e.Step, e.Steps
+			w.progress.SetProgress(e.Step-1, e.Steps)
+		}
+	case EVENT_PHASE_START:
+		if a, ok := planActions[e.Phase]; ok {
+			w.status.SetText(fmt.Sprintf("Step %d of %d: %s...", w.step, w.steps, a.Title))
+		}
+	case EVENT_DONE:
+		w.progress.SetProgress(1, 1)
+		w.status.SetText(e.Message)
+		if e.Hint != "" {
+			w.log.Append(e.Hint)
+		}
+	}
+}
+
+func (w *wizard) finish(code int) {
+	w.finished = true
+	w.code = code
+	w.run.Enable(false)
+	if w.closing {
+		os.Exit(code)
+	}
+}
+
+func (w *wizard) onClose() bool {
+	switch {
+	case w.finished:
+		os.Exit(w.code)
+	case w.started:
+		if winui.MessageBox(w.Window, WIZARD_TITLE, "Stop the run? Whatever is installing now will be cancelled.",
+			win.MB_YESNO|win.MB_ICONQUESTION) != win.IDYES {
+			return false
+		}
+		w.closing = true
+		w.cancel()
+	default:
+		w.closing = true
+		go Exit(Unsuccessful("Closed without running the plan."))
+	}
+	return false
+}
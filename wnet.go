@@ -0,0 +1,62 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+import "github.com/pkg/errors"
+import "syscall"
+
+// A ShareFailureKind is what a failure to connect to or open a share comes down to,
+// the category it goes in and what to do about it.
+type ShareFailureKind struct {
+	Kind     string
+	Category string
+	Hint     string
+}
+
+// The failures connecting to the 2020 shares that there's something specific to do
+// about. Anything else gets the usual hints of its category.
+var shareFailureKinds = map[syscall.Errno]ShareFailureKind{
+	windows.ERROR_LOGON_FAILURE: {
+		"wrong credentials", ERROR_ACCESS_DENIED,
+		"The server turned down the user name or password. Check the Shares User in the config, and protect the current password again with 2020runner protect-secret.",
+	},
+	windows.ERROR_NO_LOGON_SERVERS: {
+		"no logon servers", ERROR_NETWORK,
+		"No domain controller answered to check the credentials with. Check that the computer is on the office network or VPN, and that it uses the domain's DNS servers.",
+	},
+	windows.ERROR_BAD_NETPATH: {
+		"path not found", ERROR_NETWORK,
+		"The file server couldn't be found. Check the server name in the config, and that the computer is on the office network or VPN.",
+	},
+	windows.ERROR_BAD_NET_NAME: {
+		"share not found", ERROR_NETWORK,
+		"The file server is up but has no share by that name. Check the share name in the config.",
+	},
+	windows.ERROR_SESSION_CREDENTIAL_CONFLICT: {
+		"conflicting connection", ERROR_ACCESS_DENIED,
+		"This computer is already connected to the file server under another user name, and Windows allows only one. The runner couldn't disconnect the other connection; find it with net use, remove it and run again.",
+	},
+}
+
+// ShareFailure returns the kind of share failure err is, if it's one of
+// shareFailureKinds.
+func ShareFailure(err error) (ShareFailureKind, bool) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return ShareFailureKind{}, false
+	}
+	f, ok := shareFailureKinds[errno]
+	return f, ok
+}
+
+// shareFailureError puts err in the category of its share failure kind, with the
+// guidance for it, if it's one of shareFailureKinds.
+func shareFailureError(err error) error {
+	f, ok := ShareFailure(err)
+	if !ok {
+		return err
+	}
+	Verbose("The share failure is %s (%v).", f.Kind, err)
+	return &RunnerError{Category: f.Category, Hint: f.Hint, Err: err}
+}